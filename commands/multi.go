@@ -3,6 +3,8 @@ package commands
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -13,6 +15,7 @@ import (
 	"github.com/codegangsta/cli"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/helpers"
@@ -33,6 +36,8 @@ type RunCommand struct {
 	User             string `short:"u" long:"user" description:"Use specific user to execute shell scripts"`
 	Syslog           bool   `long:"syslog" description:"Log to syslog"`
 
+	MetricsServerAddress string `long:"metrics-server" description:"Address (<host>:<port>) on which the Prometheus metrics are served at /metrics, they aren't served by default"`
+
 	sentryLogHook sentry.LogHook
 
 	// abortBuilds is used to abort running builds
@@ -244,12 +249,67 @@ func (mr *RunCommand) Start(s service.Service) error {
 		return err
 	}
 
+	if mr.MetricsServerAddress != "" {
+		err = mr.serveMetrics()
+		if err != nil {
+			return err
+		}
+	}
+
+	go mr.collectGarbage()
+
 	// Start should not block. Do the actual work async.
 	go mr.Run()
 
 	return nil
 }
 
+// collectGarbage deletes the resources leaked by the builds of the runners,
+// eg. since the runner crashed during a build, with the executors supporting it
+func (mr *RunCommand) collectGarbage() {
+	config := mr.config
+	for _, runner := range config.Runners {
+		collector, ok := common.GetExecutor(runner.Executor).(common.ExecutorGarbageCollector)
+		if !ok {
+			continue
+		}
+
+		err := collector.CollectGarbage(runner)
+		if err != nil {
+			mr.log().WithField("runner", runner.ShortDescription()).
+				Warningln("Failed to collect the garbage of the executor", runner.Executor, err)
+		}
+	}
+}
+
+// serveMetrics registers the metrics of the executors which collect them, and
+// serves them with the metrics of the process on the metrics server address
+func (mr *RunCommand) serveMetrics() error {
+	for _, name := range common.GetExecutors() {
+		if collector, ok := common.GetExecutor(name).(prometheus.Collector); ok {
+			err := prometheus.Register(collector)
+			if err != nil {
+				return fmt.Errorf("registering the metrics of the %s executor: %s", name, err.Error())
+			}
+		}
+	}
+
+	listener, err := net.Listen("tcp", mr.MetricsServerAddress)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler())
+	go func() {
+		err := http.Serve(listener, mux)
+		mr.log().WithError(err).Errorln("Metrics server stopped")
+	}()
+
+	mr.log().Println("Serving the metrics on", listener.Addr().String())
+	return nil
+}
+
 func (mr *RunCommand) updateWorkers(currentWorkers, workerIndex *int, startWorker chan int, stopWorker chan bool) os.Signal {
 	buildLimit := mr.config.Concurrent
 
@@ -89,16 +89,314 @@ type VirtualBoxConfig struct {
 
 type KubernetesConfig struct {
 	Host          string `toml:"host" json:"host" long:"host" env:"KUBERNETES_HOST" description:"Optional Kubernetes master host URL (auto-discovery attempted if not specified)"`
-	CertFile      string `toml:"cert_file" json:"cert_file" long:"cert-file" env:"KUBERNETES_CERT_FILE" description:"Optional Kubernetes master auth certificate"`
-	KeyFile       string `toml:"key_file" json:"key_file" long:"key-file" env:"KUBERNETES_KEY_FILE" description:"Optional Kubernetes master auth private key"`
-	CAFile        string `toml:"ca_file" json:"ca_file" long:"ca-file" env:"KUBERNETES_CA_FILE" description:"Optional Kubernetes master auth ca certificate"`
+	CertFile      string `toml:"cert_file" json:"cert_file" long:"cert-file" env:"KUBERNETES_CERT_FILE" description:"Optional Kubernetes master auth certificate, a file or PEM encoded"`
+	KeyFile       string `toml:"key_file" json:"key_file" long:"key-file" env:"KUBERNETES_KEY_FILE" description:"Optional Kubernetes master auth private key, a file or PEM encoded"`
+	CAFile        string `toml:"ca_file" json:"ca_file" long:"ca-file" env:"KUBERNETES_CA_FILE" description:"Optional Kubernetes master auth ca certificate, a file or PEM encoded"`
+	Insecure      bool   `toml:"insecure,omitzero" json:"insecure" long:"insecure" env:"KUBERNETES_INSECURE" description:"Don't verify the TLS certificate of the Kubernetes master, which makes the connection insecure"`
+	KubeConfig    string `toml:"kube_config,omitempty" json:"kube_config" long:"kube-config" env:"KUBERNETES_KUBE_CONFIG" description:"Optional kubeconfig file to connect to the cluster with, instead of the default ones"`
+	Context       string `toml:"context,omitempty" json:"context" long:"context" env:"KUBERNETES_CONTEXT" description:"Optional context of the kubeconfig to connect to the cluster with, instead of the current one"`
 	Image         string `toml:"image" json:"image" long:"image" env:"KUBERNETES_IMAGE" description:"Default docker image to use for builds when none is specified"`
+	HelperImage   string `toml:"helper_image,omitempty" json:"helper_image" long:"helper-image" env:"KUBERNETES_HELPER_IMAGE" description:"Docker image used to clone the repository and handle caches and artifacts"`
 	Namespace     string `toml:"namespace" json:"namespace" long:"namespace" env:"KUBERNETES_NAMESPACE" description:"Namespace to run Kubernetes jobs in"`
 	Privileged    bool   `toml:"privileged" json:"privileged" long:"privileged" env:"KUBERNETES_PRIVILEGED" description:"Run all containers with the privileged flag enabled"`
 	CPUs          string `toml:"cpus" json:"cpus" long:"cpus" env:"KUBERNETES_CPUS" description:"The CPU allocation given to build containers"`
 	Memory        string `toml:"memory" json:"memory" long:"memory" env:"KUBERNETES_MEMORY" description:"The amount of memory allocated to build containers"`
 	ServiceCPUs   string `toml:"service_cpus" json:"service_cpus" long:"service-cpus" env:"KUBERNETES_SERVICE_CPUS" description:"The CPU allocation given to build service containers"`
 	ServiceMemory string `toml:"service_memory" json:"service_memory" long:"service-memory" env:"KUBERNETES_SERVICE_MEMORY" description:"The amount of memory allocated to build service containers"`
+	HelperCPUs    string `toml:"helper_cpus,omitempty" json:"helper_cpus" long:"helper-cpus" env:"KUBERNETES_HELPER_CPUS" description:"The CPU allocation given to the helper container"`
+	HelperMemory  string `toml:"helper_memory,omitempty" json:"helper_memory" long:"helper-memory" env:"KUBERNETES_HELPER_MEMORY" description:"The amount of memory allocated to the helper container"`
+
+	CPURequest           string `toml:"cpu_request,omitempty" json:"cpu_request" long:"cpu-request" env:"KUBERNETES_CPU_REQUEST" description:"The CPU allocation requested for build containers, defaults to the CPU allocation"`
+	MemoryRequest        string `toml:"memory_request,omitempty" json:"memory_request" long:"memory-request" env:"KUBERNETES_MEMORY_REQUEST" description:"The amount of memory requested for build containers, defaults to the memory allocation"`
+	ServiceCPURequest    string `toml:"service_cpu_request,omitempty" json:"service_cpu_request" long:"service-cpu-request" env:"KUBERNETES_SERVICE_CPU_REQUEST" description:"The CPU allocation requested for build service containers, defaults to the service CPU allocation"`
+	ServiceMemoryRequest string `toml:"service_memory_request,omitempty" json:"service_memory_request" long:"service-memory-request" env:"KUBERNETES_SERVICE_MEMORY_REQUEST" description:"The amount of memory requested for build service containers, defaults to the service memory allocation"`
+
+	EphemeralStorage               string `toml:"ephemeral_storage,omitempty" json:"ephemeral_storage" long:"ephemeral-storage" env:"KUBERNETES_EPHEMERAL_STORAGE" description:"The amount of local ephemeral storage the build containers may use"`
+	EphemeralStorageRequest        string `toml:"ephemeral_storage_request,omitempty" json:"ephemeral_storage_request" long:"ephemeral-storage-request" env:"KUBERNETES_EPHEMERAL_STORAGE_REQUEST" description:"The amount of local ephemeral storage requested for build containers, defaults to the ephemeral storage limit"`
+	ServiceEphemeralStorage        string `toml:"service_ephemeral_storage,omitempty" json:"service_ephemeral_storage" long:"service-ephemeral-storage" env:"KUBERNETES_SERVICE_EPHEMERAL_STORAGE" description:"The amount of local ephemeral storage the build service containers may use"`
+	ServiceEphemeralStorageRequest string `toml:"service_ephemeral_storage_request,omitempty" json:"service_ephemeral_storage_request" long:"service-ephemeral-storage-request" env:"KUBERNETES_SERVICE_EPHEMERAL_STORAGE_REQUEST" description:"The amount of local ephemeral storage requested for build service containers, defaults to the service ephemeral storage limit"`
+
+	ExtendedResources map[string]string `toml:"extended_resources,omitempty" json:"extended_resources" description:"Extended resources allocated to the build container, eg. nvidia.com/gpu = \"1\""`
+
+	CreateNamespace        bool              `toml:"create_namespace,omitzero" json:"create_namespace" long:"create-namespace" env:"KUBERNETES_CREATE_NAMESPACE" description:"Create the namespace of the build pods if it doesn't exist"`
+	NamespaceLabels        map[string]string `toml:"namespace_labels,omitempty" json:"namespace_labels" description:"Labels of the namespace created by the runner"`
+	DeleteCreatedNamespace bool              `toml:"delete_created_namespace,omitzero" json:"delete_created_namespace" long:"delete-created-namespace" env:"KUBERNETES_DELETE_CREATED_NAMESPACE" description:"Delete the namespace after the build, if it was created by the build"`
+	NamespacePerBuild      bool              `toml:"namespace_per_build,omitzero" json:"namespace_per_build" long:"namespace-per-build" env:"KUBERNETES_NAMESPACE_PER_BUILD" description:"Run each build in its own namespace, which is created before and deleted after the build"`
+
+	RequestTimeout int `toml:"request_timeout,omitzero" json:"request_timeout" long:"request-timeout" env:"KUBERNETES_REQUEST_TIMEOUT" description:"Timeout, in seconds, of the requests to the Kubernetes API, defaults to 30 seconds"`
+
+	QPS   float32 `toml:"qps,omitzero" json:"qps" long:"qps" env:"KUBERNETES_QPS" description:"Maximum number of requests per second to the Kubernetes API, defaults to 5"`
+	Burst int     `toml:"burst,omitzero" json:"burst" long:"burst" env:"KUBERNETES_BURST" description:"Maximum burst of requests to the Kubernetes API above the QPS, defaults to 10"`
+
+	Hosts []string `toml:"hosts,omitempty" json:"hosts" long:"hosts" env:"KUBERNETES_HOSTS" description:"Optional additional Kubernetes master host URLs, the requests are spread across all hosts"`
+
+	ReferenceNodeCPUs   string `toml:"reference_node_cpus,omitempty" json:"reference_node_cpus" long:"reference-node-cpus" env:"KUBERNETES_REFERENCE_NODE_CPUS" description:"Allocatable CPUs of the reference node, used to resolve CPU allocations given as percentages"`
+	ReferenceNodeMemory string `toml:"reference_node_memory,omitempty" json:"reference_node_memory" long:"reference-node-memory" env:"KUBERNETES_REFERENCE_NODE_MEMORY" description:"Allocatable memory of the reference node, used to resolve memory allocations given as percentages"`
+
+	PodSecurityStandard string `toml:"pod_security_standard,omitempty" json:"pod_security_standard" long:"pod-security-standard" env:"KUBERNETES_POD_SECURITY_STANDARD" description:"Pod security standard enforced on the namespace (baseline or restricted), the build pods comply with it"`
+
+	CapAdd              []string `toml:"cap_add,omitempty" json:"cap_add" long:"cap-add" env:"KUBERNETES_CAP_ADD" description:"Linux capabilities added to the build containers"`
+	CapDrop             []string `toml:"cap_drop,omitempty" json:"cap_drop" long:"cap-drop" env:"KUBERNETES_CAP_DROP" description:"Linux capabilities dropped from the build containers, ALL drops all of them"`
+	AllowedCapabilities []string `toml:"allowed_capabilities,omitempty" json:"allowed_capabilities" long:"allowed-capabilities" env:"KUBERNETES_ALLOWED_CAPABILITIES" description:"Whitelist of capabilities which can be requested with the KUBERNETES_CAP_ADD variable"`
+
+	PodSecurityContext KubernetesPodSecurityContext `toml:"pod_security_context,omitempty" json:"pod_security_context" description:"Security context of the build pods"`
+
+	WorkspaceMountPath string `toml:"workspace_mount_path,omitempty" json:"workspace_mount_path" long:"workspace-mount-path" env:"KUBERNETES_WORKSPACE_MOUNT_PATH" description:"Path where the volume of the repository is mounted in the containers, it must contain the build directory. Defaults to the parent directory of the build directory"`
+
+	ExecWorkingDir string   `toml:"exec_working_dir,omitempty" json:"exec_working_dir" long:"exec-working-dir" env:"KUBERNETES_EXEC_WORKING_DIR" description:"Working directory of the build scripts, defaults to the build directory"`
+	ShellFlags     []string `toml:"shell_flags,omitempty" json:"shell_flags" long:"shell-flags" env:"KUBERNETES_SHELL_FLAGS" description:"Shell options set before the build scripts are executed, eg. -x or -o pipefail"`
+	Shell          string   `toml:"shell,omitempty" json:"shell" long:"shell" env:"KUBERNETES_SHELL" description:"Shell running the build scripts, bash or sh, overrides the shell of the runner. bash falls back to sh if the image doesn't have bash"`
+
+	ScriptsConfigMap bool `toml:"scripts_config_map,omitzero" json:"scripts_config_map" long:"scripts-config-map" env:"KUBERNETES_SCRIPTS_CONFIG_MAP" description:"Store the build scripts in a ConfigMap mounted in the build pod, instead of passing them with the standard input"`
+
+	JobTokenPath string `toml:"job_token_path,omitempty" json:"job_token_path" long:"job-token-path" env:"KUBERNETES_JOB_TOKEN_PATH" description:"Path in the build container where the job token is mounted as files, instead of being passed as variables"`
+
+	DownwardAPIPath string `toml:"downward_api_path,omitempty" json:"downward_api_path" long:"downward-api-path" env:"KUBERNETES_DOWNWARD_API_PATH" description:"Path in the build container where the labels and annotations of the build pod are mounted"`
+
+	HTTPProxy    string `toml:"http_proxy,omitempty" json:"http_proxy" long:"http-proxy" env:"KUBERNETES_HTTP_PROXY" description:"HTTP_PROXY of the containers of the build pods"`
+	HTTPSProxy   string `toml:"https_proxy,omitempty" json:"https_proxy" long:"https-proxy" env:"KUBERNETES_HTTPS_PROXY" description:"HTTPS_PROXY of the containers of the build pods"`
+	NoProxy      string `toml:"no_proxy,omitempty" json:"no_proxy" long:"no-proxy" env:"KUBERNETES_NO_PROXY" description:"NO_PROXY of the containers of the build pods"`
+	InheritProxy bool   `toml:"inherit_proxy,omitzero" json:"inherit_proxy" long:"inherit-proxy" env:"KUBERNETES_INHERIT_PROXY" description:"Pass the proxy variables of the runner to the containers of the build pods, unless they're configured"`
+
+	ResourceVariables bool `toml:"resource_variables,omitzero" json:"resource_variables" long:"resource-variables" env:"KUBERNETES_RESOURCE_VARIABLES" description:"Set the CPU and memory limits and requests of the build container as KUBERNETES_CPU_LIMIT and similar variables"`
+
+	FailOnServiceStartFailure *bool `toml:"fail_on_service_start_failure,omitempty" json:"fail_on_service_start_failure" description:"Fail the build when a service container fails to start, enabled by default"`
+
+	PodNamePrefix string `toml:"pod_name_prefix,omitempty" json:"pod_name_prefix" long:"pod-name-prefix" env:"KUBERNETES_POD_NAME_PREFIX" description:"Prefix of the names of the build pods and their objects, followed by the unique name of the project"`
+
+	PodLabels map[string]string `toml:"pod_labels,omitempty" json:"pod_labels" description:"Additional labels of the build pods, the values can contain build variables"`
+
+	PreventAutoscalerEviction bool `toml:"prevent_autoscaler_eviction,omitzero" json:"prevent_autoscaler_eviction" long:"prevent-autoscaler-eviction" env:"KUBERNETES_PREVENT_AUTOSCALER_EVICTION" description:"Annotate the build pods so the cluster autoscalers don't evict them when scaling down their node"`
+
+	EmitEvents bool `toml:"emit_events,omitzero" json:"emit_events" long:"emit-events" env:"KUBERNETES_EMIT_EVENTS" description:"Create Kubernetes events about the build pods when the builds start, succeed or fail"`
+
+	RestartPolicy string `toml:"restart_policy,omitempty" json:"restart_policy" long:"restart-policy" env:"KUBERNETES_RESTART_POLICY" description:"Restart policy of the build pods: Never (default), OnFailure or Always"`
+
+	HostNetwork      bool `toml:"host_network,omitzero" json:"host_network" long:"host-network" env:"KUBERNETES_HOST_NETWORK" description:"Run the build pods in the network namespace of their node, requires allow_host_network"`
+	AllowHostNetwork bool `toml:"allow_host_network,omitzero" json:"allow_host_network" long:"allow-host-network" env:"KUBERNETES_ALLOW_HOST_NETWORK" description:"Allow the build pods to use the network namespace of their node, with host_network or the KUBERNETES_HOST_NETWORK variable"`
+
+	RunAsJob bool `toml:"run_as_job,omitzero" json:"run_as_job" long:"run-as-job" env:"KUBERNETES_RUN_AS_JOB" description:"Run the build pods as batch/v1 Jobs, so they are owned and recorded by the cluster"`
+
+	PodOwner *KubernetesOwnerReference `toml:"pod_owner,omitempty" json:"pod_owner" description:"Object owning the build pods, which are deleted by the cluster when it's deleted"`
+
+	DNSPolicy string `toml:"dns_policy,omitempty" json:"dns_policy" long:"dns-policy" env:"KUBERNETES_DNS_POLICY" description:"DNS policy of the build pods: ClusterFirst, ClusterFirstWithHostNet, Default or None, defaults to the one of Kubernetes"`
+
+	DNSConfig KubernetesDNSConfig `toml:"dns_config,omitempty" json:"dns_config" description:"DNS config of the build pods, merged with the one generated by the DNS policy"`
+
+	HostAliases []KubernetesHostAlias `toml:"host_aliases,omitempty" json:"host_aliases" description:"Additional entries of /etc/hosts in the containers of the build pods"`
+
+	PullPolicy string `toml:"pull_policy,omitempty" json:"pull_policy" long:"pull-policy" env:"KUBERNETES_PULL_POLICY" description:"Policy for pulling the images of the build pods: Always, IfNotPresent or Never, defaults to the one of Kubernetes"`
+
+	ExistingPodPolicy string `toml:"existing_pod_policy,omitempty" json:"existing_pod_policy" long:"existing-pod-policy" env:"KUBERNETES_EXISTING_POD_POLICY" description:"What to do when a pod of the build already exists, eg. after a restart of the runner: adopt (default) or fail"`
+
+	CreatePodOnPrepare bool `toml:"create_pod_on_prepare,omitzero" json:"create_pod_on_prepare" long:"create-pod-on-prepare" env:"KUBERNETES_CREATE_POD_ON_PREPARE" description:"Create the build pod while preparing the build, instead of before its first command"`
+
+	PodDeletionTimeout int `toml:"pod_deletion_timeout,omitzero" json:"pod_deletion_timeout" long:"pod-deletion-timeout" env:"KUBERNETES_POD_DELETION_TIMEOUT" description:"How long, in seconds, to wait for the build pod to be deleted during cleanup (0 to not wait)"`
+
+	OrphanedPodsTimeout int `toml:"orphaned_pods_timeout,omitzero" json:"orphaned_pods_timeout" long:"orphaned-pods-timeout" env:"KUBERNETES_ORPHANED_PODS_TIMEOUT" description:"Age, in seconds, after which the pods of the runner are deleted as orphaned when the runner starts, 0 doesn't delete them"`
+
+	KeepFailedPods int `toml:"keep_failed_pods,omitzero" json:"keep_failed_pods" long:"keep-failed-pods" env:"KUBERNETES_KEEP_FAILED_PODS" description:"How long, in seconds, to keep the pods of failed builds for debugging before they are deleted, 0 deletes them during the cleanup"`
+
+	PollInterval int `toml:"poll_interval,omitzero" json:"poll_interval" long:"poll-interval" env:"KUBERNETES_POLL_INTERVAL" description:"How often, in seconds, the build pod is checked while it's started if it can't be watched, defaults to 3"`
+	PollTimeout  int `toml:"poll_timeout,omitzero" json:"poll_timeout" long:"poll-timeout" env:"KUBERNETES_POLL_TIMEOUT" description:"How long, in seconds, to wait for the build pod to be running, defaults to 180"`
+
+	ExecTimeout    int `toml:"exec_timeout,omitzero" json:"exec_timeout" long:"exec-timeout" env:"KUBERNETES_EXEC_TIMEOUT" description:"How long, in seconds, each command of the build may run in the build pod, 0 doesn't limit it"`
+	ExecKeepalive  int `toml:"exec_keepalive,omitzero" json:"exec_keepalive" long:"exec-keepalive" env:"KUBERNETES_EXEC_KEEPALIVE" description:"How often, in seconds, TCP keepalives are sent on the connections of the commands, so the L4 load balancers and NAT gateways don't close them while the build is quiet, HTTP proxies aren't covered, 0 uses the system default"`
+	ExecReconnects int `toml:"exec_reconnects,omitzero" json:"exec_reconnects" long:"exec-reconnects" env:"KUBERNETES_EXEC_RECONNECTS" description:"How many times the output of a command is re-attached if its connection drops, the commands then run in the background of the containers"`
+
+	StderrPrefix string `toml:"stderr_prefix,omitempty" json:"stderr_prefix" long:"stderr-prefix" env:"KUBERNETES_STDERR_PREFIX" description:"Prefix of the lines of the build trace written to stderr by the build, they aren't tagged by default"`
+
+	WaitForServicesTimeout int `toml:"wait_for_services_timeout,omitzero" json:"wait_for_services_timeout" long:"wait-for-services-timeout" env:"KUBERNETES_WAIT_FOR_SERVICES_TIMEOUT" description:"How long, in seconds, to wait for the ports of the services to accept connections before the build starts, 0 doesn't wait"`
+
+	DumpLogsOnFailure bool `toml:"dump_logs_on_failure,omitzero" json:"dump_logs_on_failure" long:"dump-logs-on-failure" env:"KUBERNETES_DUMP_LOGS_ON_FAILURE" description:"Append the recent logs of the build and service containers to the build trace when a command of the build fails"`
+
+	CheckResourceQuota bool `toml:"check_resource_quota,omitzero" json:"check_resource_quota" long:"check-resource-quota" env:"KUBERNETES_CHECK_RESOURCE_QUOTA" description:"Check the resources of the build pod against the resource quotas of the namespace, and fail the build early if they may not fit"`
+
+	ActiveDeadlineSeconds int `toml:"active_deadline_seconds,omitzero" json:"active_deadline_seconds" long:"active-deadline-seconds" env:"KUBERNETES_ACTIVE_DEADLINE_SECONDS" description:"How long, in seconds, the build pod may run before Kubernetes kills it, defaults to the timeout of the build"`
+
+	TerminationGracePeriodSeconds *int64 `toml:"termination_grace_period_seconds,omitempty" json:"termination_grace_period_seconds" description:"How long, in seconds, the containers of the build pod are given to stop when it's deleted, 0 kills them immediately"`
+
+	ServiceAccount   string   `toml:"service_account,omitempty" json:"service_account" long:"service-account" env:"KUBERNETES_SERVICE_ACCOUNT" description:"Service account used by the build pods"`
+	ImagePullSecrets []string `toml:"image_pull_secrets,omitempty" json:"image_pull_secrets" long:"image-pull-secrets" env:"KUBERNETES_IMAGE_PULL_SECRETS" description:"Secrets used to pull the images of the build pods, instead of the ones of the service account"`
+
+	AutomountServiceAccountToken *bool `toml:"automount_service_account_token,omitempty" json:"automount_service_account_token" description:"Whether the token of the service account is mounted in the containers of the build pods, defaults to the setting of the service account"`
+
+	AllowedImagePullSecrets []string `toml:"allowed_image_pull_secrets,omitempty" json:"allowed_image_pull_secrets" long:"allowed-image-pull-secrets" env:"KUBERNETES_ALLOWED_IMAGE_PULL_SECRETS" description:"Whitelist of image pull secrets which can be requested by the services of the builds"`
+
+	EnvFrom        []KubernetesEnvFrom `toml:"env_from,omitempty" json:"env_from" description:"Secrets and config maps whose keys are set as environment variables of the build container"`
+	AllowedEnvFrom []string            `toml:"allowed_env_from,omitempty" json:"allowed_env_from" long:"allowed-env-from" env:"KUBERNETES_ALLOWED_ENV_FROM" description:"Whitelist of secret/NAME and config_map/NAME which can be requested with the KUBERNETES_ENV_FROM variable"`
+
+	NodeSelector         map[string]string `toml:"node_selector,omitempty" json:"node_selector" description:"Node labels the build pods are scheduled on"`
+	AllowedNodeSelectors []string          `toml:"allowed_node_selectors,omitempty" json:"allowed_node_selectors" long:"allowed-node-selectors" env:"KUBERNETES_ALLOWED_NODE_SELECTORS" description:"Whitelist of key=value node labels which can be requested with the KUBERNETES_NODE_SELECTOR variable"`
+
+	NodePools map[string]map[string]string `toml:"node_pools,omitempty" json:"node_pools" description:"Named sets of node labels which can be requested with the KUBERNETES_NODE_POOL variable"`
+
+	SpreadBuilds bool `toml:"spread_builds,omitzero" json:"spread_builds" long:"spread-builds" env:"KUBERNETES_SPREAD_BUILDS" description:"Prefer to schedule the build pods on nodes without other build pods"`
+
+	Affinity *KubernetesAffinity `toml:"affinity,omitempty" json:"affinity" description:"Affinity rules of the build pods"`
+
+	Tolerations []KubernetesToleration `toml:"tolerations,omitempty" json:"tolerations" description:"Tolerations of the build pods, so they can be scheduled on tainted nodes"`
+
+	Volumes KubernetesVolumes `toml:"volumes,omitempty" json:"volumes" description:"Additional volumes mounted in the build and service containers"`
+
+	Sidecars []KubernetesSidecar `toml:"sidecars,omitempty" json:"sidecars" description:"Additional containers added to every build pod"`
+
+	InitContainers []KubernetesInitContainer `toml:"init_containers,omitempty" json:"init_containers" description:"Containers run to completion in every build pod before the build starts"`
+
+	ShareProcessNamespace *bool `toml:"share_process_namespace,omitempty" json:"share_process_namespace" description:"Whether the containers of the build pods share a process namespace, so they can see and signal each other's processes"`
+
+	PodSpec  string `toml:"pod_spec,omitempty" json:"pod_spec" long:"pod-spec" env:"KUBERNETES_POD_SPEC" description:"Base spec of the build pods as YAML, the containers and volumes of the build are merged into it"`
+	PodPatch string `toml:"pod_patch,omitempty" json:"pod_patch" long:"pod-patch" env:"KUBERNETES_POD_PATCH" description:"Strategic merge patch of the metadata and spec of the build pods as YAML, applied to the generated pods"`
+
+	PrintPodYAML bool   `toml:"print_pod_yaml,omitzero" json:"print_pod_yaml" long:"print-pod-yaml" env:"KUBERNETES_PRINT_POD_YAML" description:"Print the definition of the build pod to the build trace"`
+	PodYAMLFile  string `toml:"pod_yaml_file,omitempty" json:"pod_yaml_file" long:"pod-yaml-file" env:"KUBERNETES_POD_YAML_FILE" description:"Write the definition of the build pod to this file, relative to the project directory"`
+
+	PriorityClassName string `toml:"priority_class_name,omitempty" json:"priority_class_name" long:"priority-class-name" env:"KUBERNETES_PRIORITY_CLASS_NAME" description:"Priority class of the build pods, which can be overridden with the KUBERNETES_PRIORITY_CLASS variable"`
+
+	AllowedHelperImages    []string `toml:"allowed_helper_images,omitempty" json:"allowed_helper_images" long:"allowed-helper-images" env:"KUBERNETES_ALLOWED_HELPER_IMAGES" description:"Whitelist of helper images which can be requested with the KUBERNETES_HELPER_IMAGE variable"`
+	AllowedPriorityClasses []string `toml:"allowed_priority_classes,omitempty" json:"allowed_priority_classes" long:"allowed-priority-classes" env:"KUBERNETES_ALLOWED_PRIORITY_CLASSES" description:"Whitelist of priority classes which can be requested with the KUBERNETES_PRIORITY_CLASS variable"`
+}
+
+type KubernetesSidecar struct {
+	Name         string                  `toml:"name" json:"name" description:"Name of the sidecar container"`
+	Image        string                  `toml:"image" json:"image" description:"Docker image of the sidecar container"`
+	Command      []string                `toml:"command,omitempty" json:"command" description:"Command to run in the sidecar container"`
+	Environment  []string                `toml:"environment,omitempty" json:"environment" description:"Environment variables of the sidecar container"`
+	VolumeMounts []KubernetesVolumeMount `toml:"volume_mounts,omitempty" json:"volume_mounts" description:"Pod volumes mounted in the sidecar container"`
+	CPUs         string                  `toml:"cpus,omitempty" json:"cpus" description:"The CPU allocation given to the sidecar container"`
+	Memory       string                  `toml:"memory,omitempty" json:"memory" description:"The amount of memory allocated to the sidecar container"`
+	WaitForReady bool                    `toml:"wait_for_ready,omitzero" json:"wait_for_ready" description:"Wait for the sidecar container to be ready before the build starts"`
+}
+
+type KubernetesInitContainer struct {
+	Name         string                  `toml:"name" json:"name" description:"Name of the init container"`
+	Image        string                  `toml:"image" json:"image" description:"Docker image of the init container"`
+	Command      []string                `toml:"command,omitempty" json:"command" description:"Command to run in the init container"`
+	VolumeMounts []KubernetesVolumeMount `toml:"volume_mounts,omitempty" json:"volume_mounts" description:"Pod volumes mounted in the init container"`
+	CPUs         string                  `toml:"cpus,omitempty" json:"cpus" description:"The CPU allocation given to the init container"`
+	Memory       string                  `toml:"memory,omitempty" json:"memory" description:"The amount of memory allocated to the init container"`
+}
+
+type KubernetesEnvFrom struct {
+	Secret    string `toml:"secret,omitempty" json:"secret" description:"Secret whose keys are set as environment variables"`
+	ConfigMap string `toml:"config_map,omitempty" json:"config_map" description:"Config map whose keys are set as environment variables"`
+	Prefix    string `toml:"prefix,omitempty" json:"prefix" description:"Prefix of the names of the environment variables"`
+	Optional  bool   `toml:"optional,omitzero" json:"optional" description:"Start the build even if the secret or config map doesn't exist"`
+}
+
+type KubernetesHostAlias struct {
+	IP        string   `toml:"ip" json:"ip" description:"IP address the hostnames resolve to"`
+	Hostnames []string `toml:"hostnames" json:"hostnames" description:"Hostnames resolving to the IP address"`
+}
+
+type KubernetesOwnerReference struct {
+	APIVersion string `toml:"api_version,omitempty" json:"api_version" description:"API version of the owner, defaults to v1"`
+	Kind       string `toml:"kind" json:"kind" description:"Kind of the owner, eg. ConfigMap or Pod"`
+	Name       string `toml:"name" json:"name" description:"Name of the owner"`
+	UID        string `toml:"uid" json:"uid" description:"UID of the owner"`
+}
+
+type KubernetesDNSConfig struct {
+	Nameservers []string                    `toml:"nameservers,omitempty" json:"nameservers" description:"IP addresses of the DNS servers, at most 3"`
+	Searches    []string                    `toml:"searches,omitempty" json:"searches" description:"Search domains for host-name lookup, at most 6"`
+	Options     []KubernetesDNSConfigOption `toml:"options,omitempty" json:"options" description:"Resolver options, eg. ndots"`
+}
+
+type KubernetesDNSConfigOption struct {
+	Name  string  `toml:"name" json:"name" description:"Name of the resolver option"`
+	Value *string `toml:"value,omitempty" json:"value" description:"Value of the resolver option"`
+}
+
+type KubernetesPodSecurityContext struct {
+	RunAsUser    *int64 `toml:"run_as_user,omitempty" json:"run_as_user" description:"User ID the processes of the containers run as"`
+	RunAsGroup   *int64 `toml:"run_as_group,omitempty" json:"run_as_group" description:"Primary group ID the processes of the containers run as"`
+	RunAsNonRoot *bool  `toml:"run_as_non_root,omitempty" json:"run_as_non_root" description:"Refuse to start the containers if they run as root"`
+	FSGroup      *int64 `toml:"fs_group,omitempty" json:"fs_group" description:"Group ID owning the volumes of the pod, so they're writable by the containers"`
+}
+
+type KubernetesToleration struct {
+	Key               string `toml:"key,omitempty" json:"key" description:"Taint key the toleration applies to, all keys if empty and the operator is Exists"`
+	Operator          string `toml:"operator,omitempty" json:"operator" description:"Equal (default) to match the value of the taint, or Exists to match any value"`
+	Value             string `toml:"value,omitempty" json:"value" description:"Taint value the toleration matches with the Equal operator"`
+	Effect            string `toml:"effect,omitempty" json:"effect" description:"Taint effect the toleration matches: NoSchedule, PreferNoSchedule or NoExecute, all effects if empty"`
+	TolerationSeconds *int64 `toml:"toleration_seconds,omitempty" json:"toleration_seconds" description:"How long the pod stays bound to a node tainted with the NoExecute effect"`
+}
+
+type KubernetesAffinity struct {
+	NodeAffinity    *KubernetesNodeAffinity `toml:"node_affinity,omitempty" json:"node_affinity" description:"Rules which nodes the build pods are scheduled on"`
+	PodAffinity     *KubernetesPodAffinity  `toml:"pod_affinity,omitempty" json:"pod_affinity" description:"Rules which pods the build pods are co-located with"`
+	PodAntiAffinity *KubernetesPodAffinity  `toml:"pod_anti_affinity,omitempty" json:"pod_anti_affinity" description:"Rules which pods the build pods are not co-located with"`
+}
+
+type KubernetesNodeAffinity struct {
+	RequiredDuringSchedulingIgnoredDuringExecution  []KubernetesNodeSelectorTerm        `toml:"required_during_scheduling_ignored_during_execution,omitempty" json:"required_during_scheduling_ignored_during_execution" description:"Node selector terms, one of which the node needs to match"`
+	PreferredDuringSchedulingIgnoredDuringExecution []KubernetesPreferredSchedulingTerm `toml:"preferred_during_scheduling_ignored_during_execution,omitempty" json:"preferred_during_scheduling_ignored_during_execution" description:"Weighted node selector terms, the nodes matching most of them are preferred"`
+}
+
+type KubernetesNodeSelectorTerm struct {
+	MatchExpressions []KubernetesSelectorRequirement `toml:"match_expressions,omitempty" json:"match_expressions" description:"Requirements on the node labels, all of which need to match"`
+}
+
+type KubernetesPreferredSchedulingTerm struct {
+	Weight     int32                      `toml:"weight" json:"weight" description:"Weight of the term, in the range 1-100"`
+	Preference KubernetesNodeSelectorTerm `toml:"preference" json:"preference" description:"Node selector term"`
+}
+
+type KubernetesPodAffinity struct {
+	RequiredDuringSchedulingIgnoredDuringExecution  []KubernetesPodAffinityTerm         `toml:"required_during_scheduling_ignored_during_execution,omitempty" json:"required_during_scheduling_ignored_during_execution" description:"Pod affinity terms, all of which need to match"`
+	PreferredDuringSchedulingIgnoredDuringExecution []KubernetesWeightedPodAffinityTerm `toml:"preferred_during_scheduling_ignored_during_execution,omitempty" json:"preferred_during_scheduling_ignored_during_execution" description:"Weighted pod affinity terms, the nodes matching most of them are preferred"`
+}
+
+type KubernetesPodAffinityTerm struct {
+	MatchLabels      map[string]string               `toml:"match_labels,omitempty" json:"match_labels" description:"Labels of the selected pods"`
+	MatchExpressions []KubernetesSelectorRequirement `toml:"match_expressions,omitempty" json:"match_expressions" description:"Requirements on the labels of the selected pods"`
+	Namespaces       []string                        `toml:"namespaces,omitempty" json:"namespaces" description:"Namespaces of the selected pods, defaults to the namespace of the build pod"`
+	TopologyKey      string                          `toml:"topology_key" json:"topology_key" description:"Node label defining the topology domain, eg. kubernetes.io/hostname"`
+}
+
+type KubernetesWeightedPodAffinityTerm struct {
+	Weight          int32                     `toml:"weight" json:"weight" description:"Weight of the term, in the range 1-100"`
+	PodAffinityTerm KubernetesPodAffinityTerm `toml:"pod_affinity_term" json:"pod_affinity_term" description:"Pod affinity term"`
+}
+
+type KubernetesSelectorRequirement struct {
+	Key      string   `toml:"key" json:"key" description:"Label key the requirement applies to"`
+	Operator string   `toml:"operator" json:"operator" description:"In, NotIn, Exists or DoesNotExist, and for nodes Gt or Lt"`
+	Values   []string `toml:"values,omitempty" json:"values" description:"Label values of the In and NotIn operators, or the number of the Gt and Lt operators"`
+}
+
+type KubernetesVolumes struct {
+	HostPaths []KubernetesHostPath `toml:"host_path,omitempty" json:"host_path" description:"Directories of the node mounted in the build containers"`
+	PVCs      []KubernetesPVC      `toml:"pvc,omitempty" json:"pvc" description:"Persistent volume claims mounted in the build containers"`
+	Secrets   []KubernetesSecret   `toml:"secret,omitempty" json:"secret" description:"Secrets mounted read-only in the build container"`
+}
+
+type KubernetesHostPath struct {
+	Name      string `toml:"name" json:"name" description:"Name of the volume"`
+	HostPath  string `toml:"host_path" json:"host_path" description:"Path of the directory on the node"`
+	MountPath string `toml:"mount_path" json:"mount_path" description:"Path where the volume is mounted in the containers"`
+	ReadOnly  bool   `toml:"read_only,omitzero" json:"read_only" description:"Mount the volume read-only"`
+}
+
+type KubernetesPVC struct {
+	Name      string `toml:"name" json:"name" description:"Name of the volume"`
+	ClaimName string `toml:"claim_name,omitempty" json:"claim_name" description:"Name of the persistent volume claim, defaults to the name of the volume"`
+	MountPath string `toml:"mount_path" json:"mount_path" description:"Path where the volume is mounted in the containers"`
+	ReadOnly  bool   `toml:"read_only,omitzero" json:"read_only" description:"Mount the volume read-only"`
+}
+
+type KubernetesSecret struct {
+	Name       string            `toml:"name" json:"name" description:"Name of the volume"`
+	SecretName string            `toml:"secret_name,omitempty" json:"secret_name" description:"Name of the secret, defaults to the name of the volume"`
+	MountPath  string            `toml:"mount_path" json:"mount_path" description:"Path where the volume is mounted in the build container"`
+	Items      map[string]string `toml:"items,omitempty" json:"items" description:"Keys of the secret mounted as files at the given relative paths, all keys if empty"`
+	FileMode   string            `toml:"file_mode,omitempty" json:"file_mode" description:"Octal mode of the files, eg. 0400"`
+}
+
+type KubernetesVolumeMount struct {
+	Name      string `toml:"name" json:"name" description:"Name of the pod volume"`
+	MountPath string `toml:"mount_path" json:"mount_path" description:"Path where the volume is mounted in the container"`
+	ReadOnly  bool   `toml:"read_only,omitzero" json:"read_only" description:"Mount the volume read-only"`
 }
 
 type RunnerCredentials struct {
@@ -169,6 +467,27 @@ func (c *RunnerCredentials) Log() *log.Entry {
 	return log.WithFields(log.Fields{})
 }
 
+func (c *KubernetesConfig) GetFailOnServiceStartFailure() bool {
+	if c.FailOnServiceStartFailure == nil {
+		return true
+	}
+	return *c.FailOnServiceStartFailure
+}
+
+func (c *KubernetesConfig) GetPollInterval() time.Duration {
+	if c.PollInterval <= 0 {
+		return DefaultKubernetesPollInterval * time.Second
+	}
+	return time.Duration(c.PollInterval) * time.Second
+}
+
+func (c *KubernetesConfig) GetPollTimeout() time.Duration {
+	if c.PollTimeout <= 0 {
+		return DefaultKubernetesPollTimeout * time.Second
+	}
+	return time.Duration(c.PollTimeout) * time.Second
+}
+
 func (c *RunnerConfig) String() string {
 	return fmt.Sprintf("%v url=%v token=%v executor=%v", c.Name, c.URL, c.Token, c.Executor)
 }
@@ -12,6 +12,8 @@ const ReloadConfigInterval = 3
 const HealthyChecks = 3
 const HealthCheckInterval = 3600
 const DefaultWaitForServicesTimeout = 30
+const DefaultKubernetesPollInterval = 3
+const DefaultKubernetesPollTimeout = 180
 const ShutdownTimeout = 30
 const DefaultOutputLimit = 4096 // 4MB in kilobytes
 const ForceTraceSentInterval = 30 * time.Second
@@ -28,6 +28,13 @@ type ExecutorProvider interface {
 	GetFeatures(features *FeaturesInfo)
 }
 
+// ExecutorGarbageCollector is implemented by the executor providers which
+// delete the resources leaked by the builds of a runner, eg. since the runner
+// crashed during a build. It's called when the runner starts
+type ExecutorGarbageCollector interface {
+	CollectGarbage(config *RunnerConfig) error
+}
+
 type BuildError struct {
 	Inner error
 }
@@ -0,0 +1,236 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+// convertAffinity converts the configured affinity rules to the spec.affinity
+// of the pod. The affinity of api.PodSpec is stored in an annotation in old
+// clusters, the newer ones only support spec.affinity, therefore it's passed
+// as unstructured data to encodePod
+func convertAffinity(config *common.KubernetesAffinity) (map[string]interface{}, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	var affinity api.Affinity
+	var err error
+
+	if config.NodeAffinity != nil {
+		if affinity.NodeAffinity, err = convertNodeAffinity(config.NodeAffinity); err != nil {
+			return nil, fmt.Errorf("node affinity: %s", err.Error())
+		}
+	}
+
+	if config.PodAffinity != nil {
+		required, preferred, err := convertPodAffinity(config.PodAffinity)
+		if err != nil {
+			return nil, fmt.Errorf("pod affinity: %s", err.Error())
+		}
+		affinity.PodAffinity = &api.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  required,
+			PreferredDuringSchedulingIgnoredDuringExecution: preferred,
+		}
+	}
+
+	if config.PodAntiAffinity != nil {
+		required, preferred, err := convertPodAffinity(config.PodAntiAffinity)
+		if err != nil {
+			return nil, fmt.Errorf("pod anti-affinity: %s", err.Error())
+		}
+		affinity.PodAntiAffinity = &api.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  required,
+			PreferredDuringSchedulingIgnoredDuringExecution: preferred,
+		}
+	}
+
+	data, err := json.Marshal(affinity)
+	if err != nil {
+		return nil, err
+	}
+
+	var unstructured map[string]interface{}
+	if err = json.Unmarshal(data, &unstructured); err != nil {
+		return nil, err
+	}
+	return unstructured, nil
+}
+
+// withBuildPodAntiAffinity returns a copy of config which prefers to schedule
+// the pod on a node without other build pods
+func withBuildPodAntiAffinity(config *common.KubernetesAffinity) *common.KubernetesAffinity {
+	affinity := common.KubernetesAffinity{}
+	if config != nil {
+		affinity = *config
+	}
+
+	antiAffinity := common.KubernetesPodAffinity{}
+	if affinity.PodAntiAffinity != nil {
+		antiAffinity = *affinity.PodAntiAffinity
+	}
+
+	// the terms are copied, not to modify the configuration
+	antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(
+		append([]common.KubernetesWeightedPodAffinityTerm{}, antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution...),
+		common.KubernetesWeightedPodAffinityTerm{
+			Weight: 100,
+			PodAffinityTerm: common.KubernetesPodAffinityTerm{
+				MatchLabels: map[string]string{buildPodLabel: "true"},
+				TopologyKey: "kubernetes.io/hostname",
+			},
+		})
+
+	affinity.PodAntiAffinity = &antiAffinity
+	return &affinity
+}
+
+func convertNodeAffinity(config *common.KubernetesNodeAffinity) (*api.NodeAffinity, error) {
+	affinity := &api.NodeAffinity{}
+
+	if len(config.RequiredDuringSchedulingIgnoredDuringExecution) > 0 {
+		affinity.RequiredDuringSchedulingIgnoredDuringExecution = &api.NodeSelector{}
+	}
+	for i, term := range config.RequiredDuringSchedulingIgnoredDuringExecution {
+		converted, err := convertNodeSelectorTerm(term)
+		if err != nil {
+			return nil, fmt.Errorf("required term %d: %s", i, err.Error())
+		}
+		affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = append(
+			affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms, converted)
+	}
+
+	for i, term := range config.PreferredDuringSchedulingIgnoredDuringExecution {
+		if err := checkWeight(term.Weight); err != nil {
+			return nil, fmt.Errorf("preferred term %d: %s", i, err.Error())
+		}
+		converted, err := convertNodeSelectorTerm(term.Preference)
+		if err != nil {
+			return nil, fmt.Errorf("preferred term %d: %s", i, err.Error())
+		}
+		affinity.PreferredDuringSchedulingIgnoredDuringExecution = append(
+			affinity.PreferredDuringSchedulingIgnoredDuringExecution,
+			api.PreferredSchedulingTerm{Weight: term.Weight, Preference: converted})
+	}
+	return affinity, nil
+}
+
+func convertNodeSelectorTerm(config common.KubernetesNodeSelectorTerm) (api.NodeSelectorTerm, error) {
+	var term api.NodeSelectorTerm
+	if len(config.MatchExpressions) == 0 {
+		return term, fmt.Errorf("no match expressions specified")
+	}
+
+	for _, requirement := range config.MatchExpressions {
+		if requirement.Key == "" {
+			return term, fmt.Errorf("no key specified")
+		}
+
+		operator := api.NodeSelectorOperator(requirement.Operator)
+		switch operator {
+		case api.NodeSelectorOpIn, api.NodeSelectorOpNotIn:
+			if len(requirement.Values) == 0 {
+				return term, fmt.Errorf("the %s operator of %s requires values", operator, requirement.Key)
+			}
+		case api.NodeSelectorOpExists, api.NodeSelectorOpDoesNotExist:
+			if len(requirement.Values) > 0 {
+				return term, fmt.Errorf("the %s operator of %s doesn't allow values", operator, requirement.Key)
+			}
+		case api.NodeSelectorOpGt, api.NodeSelectorOpLt:
+			if len(requirement.Values) != 1 {
+				return term, fmt.Errorf("the %s operator of %s requires a single value", operator, requirement.Key)
+			}
+			if _, err := strconv.ParseInt(requirement.Values[0], 10, 64); err != nil {
+				return term, fmt.Errorf("the %s operator of %s requires an integer value", operator, requirement.Key)
+			}
+		default:
+			return term, fmt.Errorf("unsupported operator %q of %s", requirement.Operator, requirement.Key)
+		}
+
+		term.MatchExpressions = append(term.MatchExpressions, api.NodeSelectorRequirement{
+			Key:      requirement.Key,
+			Operator: operator,
+			Values:   requirement.Values,
+		})
+	}
+	return term, nil
+}
+
+func convertPodAffinity(config *common.KubernetesPodAffinity) ([]api.PodAffinityTerm, []api.WeightedPodAffinityTerm, error) {
+	var required []api.PodAffinityTerm
+	for i, term := range config.RequiredDuringSchedulingIgnoredDuringExecution {
+		converted, err := convertPodAffinityTerm(term)
+		if err != nil {
+			return nil, nil, fmt.Errorf("required term %d: %s", i, err.Error())
+		}
+		required = append(required, converted)
+	}
+
+	var preferred []api.WeightedPodAffinityTerm
+	for i, term := range config.PreferredDuringSchedulingIgnoredDuringExecution {
+		if err := checkWeight(term.Weight); err != nil {
+			return nil, nil, fmt.Errorf("preferred term %d: %s", i, err.Error())
+		}
+		converted, err := convertPodAffinityTerm(term.PodAffinityTerm)
+		if err != nil {
+			return nil, nil, fmt.Errorf("preferred term %d: %s", i, err.Error())
+		}
+		preferred = append(preferred, api.WeightedPodAffinityTerm{Weight: int(term.Weight), PodAffinityTerm: converted})
+	}
+	return required, preferred, nil
+}
+
+func convertPodAffinityTerm(config common.KubernetesPodAffinityTerm) (api.PodAffinityTerm, error) {
+	var term api.PodAffinityTerm
+	if config.TopologyKey == "" {
+		return term, fmt.Errorf("no topology key specified")
+	}
+	if len(config.MatchLabels) == 0 && len(config.MatchExpressions) == 0 {
+		return term, fmt.Errorf("no match labels or expressions specified")
+	}
+
+	selector := &unversioned.LabelSelector{MatchLabels: config.MatchLabels}
+	for _, requirement := range config.MatchExpressions {
+		if requirement.Key == "" {
+			return term, fmt.Errorf("no key specified")
+		}
+
+		operator := unversioned.LabelSelectorOperator(requirement.Operator)
+		switch operator {
+		case unversioned.LabelSelectorOpIn, unversioned.LabelSelectorOpNotIn:
+			if len(requirement.Values) == 0 {
+				return term, fmt.Errorf("the %s operator of %s requires values", operator, requirement.Key)
+			}
+		case unversioned.LabelSelectorOpExists, unversioned.LabelSelectorOpDoesNotExist:
+			if len(requirement.Values) > 0 {
+				return term, fmt.Errorf("the %s operator of %s doesn't allow values", operator, requirement.Key)
+			}
+		default:
+			return term, fmt.Errorf("unsupported operator %q of %s", requirement.Operator, requirement.Key)
+		}
+
+		selector.MatchExpressions = append(selector.MatchExpressions, unversioned.LabelSelectorRequirement{
+			Key:      requirement.Key,
+			Operator: operator,
+			Values:   requirement.Values,
+		})
+	}
+
+	term.LabelSelector = selector
+	term.Namespaces = config.Namespaces
+	term.TopologyKey = config.TopologyKey
+	return term, nil
+}
+
+func checkWeight(weight int32) error {
+	if weight < 1 || weight > 100 {
+		return fmt.Errorf("weight %d is not in the range 1-100", weight)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/kubernetes/pkg/api/testapi"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+func TestBuildPodAffinity(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Affinity: &common.KubernetesAffinity{
+			NodeAffinity: &common.KubernetesNodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []common.KubernetesNodeSelectorTerm{
+					{
+						MatchExpressions: []common.KubernetesSelectorRequirement{
+							{Key: "node-role.kubernetes.io/control-plane", Operator: "DoesNotExist"},
+							{Key: "cpus", Operator: "Gt", Values: []string{"4"}},
+						},
+					},
+				},
+				PreferredDuringSchedulingIgnoredDuringExecution: []common.KubernetesPreferredSchedulingTerm{
+					{
+						Weight: 50,
+						Preference: common.KubernetesNodeSelectorTerm{
+							MatchExpressions: []common.KubernetesSelectorRequirement{
+								{Key: "disk", Operator: "In", Values: []string{"ssd"}},
+							},
+						},
+					},
+				},
+			},
+			PodAffinity: &common.KubernetesPodAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []common.KubernetesWeightedPodAffinityTerm{
+					{
+						Weight: 10,
+						PodAffinityTerm: common.KubernetesPodAffinityTerm{
+							MatchLabels: map[string]string{"app": "cache"},
+							Namespaces:  []string{"cache"},
+							TopologyKey: "kubernetes.io/hostname",
+						},
+					},
+				},
+			},
+			PodAntiAffinity: &common.KubernetesPodAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []common.KubernetesPodAffinityTerm{
+					{
+						MatchExpressions: []common.KubernetesSelectorRequirement{
+							{Key: "app", Operator: "In", Values: []string{"database"}},
+						},
+						TopologyKey: "kubernetes.io/hostname",
+					},
+				},
+			},
+		},
+	}, &kubernetesOptions{Image: "test-image"})
+
+	var err error
+	ex.affinity, err = convertAffinity(ex.Config.Kubernetes.Affinity)
+	require.NoError(t, err)
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	c := client.NewOrDie(&restclient.Config{ContentConfig: restclient.ContentConfig{GroupVersion: &unversioned.GroupVersion{Version: testapi.Default.GroupVersion().Version}}})
+	data, err := encodePod(c, pod, ex.buildPodSpecExtra(pod))
+	require.NoError(t, err)
+
+	var encoded struct {
+		Spec struct {
+			Affinity json.RawMessage `json:"affinity"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	var expected, actual interface{}
+	require.NoError(t, json.Unmarshal(encoded.Spec.Affinity, &actual))
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"nodeAffinity": {
+			"requiredDuringSchedulingIgnoredDuringExecution": {
+				"nodeSelectorTerms": [{
+					"matchExpressions": [
+						{"key": "node-role.kubernetes.io/control-plane", "operator": "DoesNotExist"},
+						{"key": "cpus", "operator": "Gt", "values": ["4"]}
+					]
+				}]
+			},
+			"preferredDuringSchedulingIgnoredDuringExecution": [{
+				"weight": 50,
+				"preference": {
+					"matchExpressions": [{"key": "disk", "operator": "In", "values": ["ssd"]}]
+				}
+			}]
+		},
+		"podAffinity": {
+			"preferredDuringSchedulingIgnoredDuringExecution": [{
+				"weight": 10,
+				"podAffinityTerm": {
+					"labelSelector": {"matchLabels": {"app": "cache"}},
+					"namespaces": ["cache"],
+					"topologyKey": "kubernetes.io/hostname"
+				}
+			}]
+		},
+		"podAntiAffinity": {
+			"requiredDuringSchedulingIgnoredDuringExecution": [{
+				"labelSelector": {
+					"matchExpressions": [{"key": "app", "operator": "In", "values": ["database"]}]
+				},
+				"namespaces": null,
+				"topologyKey": "kubernetes.io/hostname"
+			}]
+		}
+	}`), &expected))
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("unexpected affinity: %s", encoded.Spec.Affinity)
+	}
+
+	ex.affinity = nil
+	_, found := ex.buildPodSpecExtra(pod)["affinity"]
+	assert.False(t, found)
+}
+
+func TestSpreadBuilds(t *testing.T) {
+	antiAffinity := &common.KubernetesPodAffinity{
+		PreferredDuringSchedulingIgnoredDuringExecution: []common.KubernetesWeightedPodAffinityTerm{
+			{
+				Weight: 10,
+				PodAffinityTerm: common.KubernetesPodAffinityTerm{
+					MatchLabels: map[string]string{"app": "database"},
+					TopologyKey: "kubernetes.io/hostname",
+				},
+			},
+		},
+	}
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		SpreadBuilds: true,
+		Affinity:     &common.KubernetesAffinity{PodAntiAffinity: antiAffinity},
+	}, &kubernetesOptions{Image: "test-image"})
+
+	affinity, err := ex.getAffinity()
+	require.NoError(t, err)
+
+	data, err := json.Marshal(affinity["podAntiAffinity"])
+	require.NoError(t, err)
+	var encoded struct {
+		Preferred []struct {
+			Weight          int `json:"weight"`
+			PodAffinityTerm struct {
+				LabelSelector struct {
+					MatchLabels map[string]string `json:"matchLabels"`
+				} `json:"labelSelector"`
+				TopologyKey string `json:"topologyKey"`
+			} `json:"podAffinityTerm"`
+		} `json:"preferredDuringSchedulingIgnoredDuringExecution"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	require.Equal(t, 2, len(encoded.Preferred))
+	assert.Equal(t, map[string]string{"app": "database"}, encoded.Preferred[0].PodAffinityTerm.LabelSelector.MatchLabels)
+	assert.Equal(t, 100, encoded.Preferred[1].Weight)
+	assert.Equal(t, map[string]string{"gitlab-runner/build": "true"}, encoded.Preferred[1].PodAffinityTerm.LabelSelector.MatchLabels)
+	assert.Equal(t, "kubernetes.io/hostname", encoded.Preferred[1].PodAffinityTerm.TopologyKey)
+
+	// the configuration isn't modified
+	assert.Equal(t, 1, len(antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution))
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, "true", pod.Labels["gitlab-runner/build"])
+
+	ex.Config.Kubernetes.SpreadBuilds = false
+	ex.Config.Kubernetes.Affinity = nil
+	affinity, err = ex.getAffinity()
+	require.NoError(t, err)
+	assert.Nil(t, affinity)
+}
+
+func TestConvertAffinityInvalid(t *testing.T) {
+	nodeAffinity := func(requirements ...common.KubernetesSelectorRequirement) *common.KubernetesAffinity {
+		return &common.KubernetesAffinity{
+			NodeAffinity: &common.KubernetesNodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []common.KubernetesNodeSelectorTerm{
+					{MatchExpressions: requirements},
+				},
+			},
+		}
+	}
+	podAffinity := func(term common.KubernetesPodAffinityTerm) *common.KubernetesAffinity {
+		return &common.KubernetesAffinity{
+			PodAffinity: &common.KubernetesPodAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []common.KubernetesPodAffinityTerm{term},
+			},
+		}
+	}
+
+	tests := map[string]*common.KubernetesAffinity{
+		"no expressions":    nodeAffinity(),
+		"no key":            nodeAffinity(common.KubernetesSelectorRequirement{Operator: "Exists"}),
+		"unknown operator":  nodeAffinity(common.KubernetesSelectorRequirement{Key: "disk", Operator: "Equals", Values: []string{"ssd"}}),
+		"In without values": nodeAffinity(common.KubernetesSelectorRequirement{Key: "disk", Operator: "In"}),
+		"Exists with value": nodeAffinity(common.KubernetesSelectorRequirement{Key: "disk", Operator: "Exists", Values: []string{"ssd"}}),
+		"Gt not a number":   nodeAffinity(common.KubernetesSelectorRequirement{Key: "cpus", Operator: "Gt", Values: []string{"four"}}),
+		"weight": {
+			NodeAffinity: &common.KubernetesNodeAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []common.KubernetesPreferredSchedulingTerm{
+					{
+						Weight: 0,
+						Preference: common.KubernetesNodeSelectorTerm{
+							MatchExpressions: []common.KubernetesSelectorRequirement{{Key: "disk", Operator: "Exists"}},
+						},
+					},
+				},
+			},
+		},
+		"no topology key": podAffinity(common.KubernetesPodAffinityTerm{MatchLabels: map[string]string{"app": "cache"}}),
+		"no selector":     podAffinity(common.KubernetesPodAffinityTerm{TopologyKey: "kubernetes.io/hostname"}),
+		"Gt on pod labels": podAffinity(common.KubernetesPodAffinityTerm{
+			MatchExpressions: []common.KubernetesSelectorRequirement{{Key: "replicas", Operator: "Gt", Values: []string{"1"}}},
+			TopologyKey:      "kubernetes.io/hostname",
+		}),
+	}
+
+	for name, affinity := range tests {
+		_, err := convertAffinity(affinity)
+		assert.Error(t, err, name)
+	}
+
+	affinity, err := convertAffinity(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, affinity)
+}
@@ -0,0 +1,156 @@
+package kubernetes
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const allCapabilities = api.Capability("ALL")
+
+var capabilityRegexp = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// baselineCapabilities are the capabilities which can be added by the
+// containers of a namespace enforcing the baseline pod security standard
+var baselineCapabilities = []api.Capability{
+	"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "MKNOD",
+	"NET_BIND_SERVICE", "SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYS_CHROOT",
+}
+
+// restrictedCapabilities are the capabilities which can be added by the
+// containers of a namespace enforcing the restricted pod security standard
+var restrictedCapabilities = []api.Capability{"NET_BIND_SERVICE"}
+
+// parseCapabilities parses a list of capabilities separated by commas or
+// spaces. The names are case-insensitive and can have the CAP_ prefix
+func parseCapabilities(names []string) ([]api.Capability, error) {
+	var capabilities []api.Capability
+	for _, name := range names {
+		for _, field := range strings.FieldsFunc(name, isCapabilitySeparator) {
+			capability := strings.TrimPrefix(strings.ToUpper(field), "CAP_")
+			if !capabilityRegexp.MatchString(capability) {
+				return nil, fmt.Errorf("invalid capability %q", field)
+			}
+			capabilities = appendCapability(capabilities, api.Capability(capability))
+		}
+	}
+	return capabilities, nil
+}
+
+func isCapabilitySeparator(r rune) bool {
+	return r == ',' || r == ' ' || r == '\t' || r == '\n'
+}
+
+func appendCapability(capabilities []api.Capability, capability api.Capability) []api.Capability {
+	if hasCapability(capabilities, capability) {
+		return capabilities
+	}
+	return append(capabilities, capability)
+}
+
+func hasCapability(capabilities []api.Capability, capability api.Capability) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// getCapabilities returns the capabilities added to and dropped from the
+// containers of the build pod. The configured ones are replaced by the ones
+// requested with the KUBERNETES_CAP_ADD variable, which need to be configured
+// or allowed, and the ones requested with the KUBERNETES_CAP_DROP variable
+// are dropped in addition to the configured ones
+func (s *executor) getCapabilities() (*api.Capabilities, error) {
+	add, err := parseCapabilities(s.Config.Kubernetes.CapAdd)
+	if err != nil {
+		return nil, err
+	}
+
+	drop, err := parseCapabilities(s.Config.Kubernetes.CapDrop)
+	if err != nil {
+		return nil, err
+	}
+
+	variables := s.Build.GetAllVariables()
+	if value := variables.Get("KUBERNETES_CAP_ADD"); value != "" {
+		requested, err := parseCapabilities([]string{value})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, capability := range requested {
+			if !hasCapability(add, capability) && !s.isAllowedCapability(capability) {
+				return nil, fmt.Errorf("capability %q is not present on list of allowed capabilities: %s",
+					capability, strings.Join(s.Config.Kubernetes.AllowedCapabilities, ", "))
+			}
+		}
+		add = requested
+	}
+
+	requested, err := parseCapabilities([]string{variables.Get("KUBERNETES_CAP_DROP")})
+	if err != nil {
+		return nil, err
+	}
+	for _, capability := range requested {
+		drop = appendCapability(drop, capability)
+	}
+
+	for _, capability := range add {
+		if capability == allCapabilities {
+			return nil, fmt.Errorf("adding all capabilities is not supported, use privileged instead")
+		}
+		if hasCapability(drop, capability) {
+			return nil, fmt.Errorf("capability %q is both added and dropped", capability)
+		}
+	}
+
+	if len(add) == 0 && len(drop) == 0 {
+		return nil, nil
+	}
+	return &api.Capabilities{Add: add, Drop: drop}, nil
+}
+
+func (s *executor) isAllowedCapability(capability api.Capability) bool {
+	for _, allowed := range s.Config.Kubernetes.AllowedCapabilities {
+		allowed = strings.TrimPrefix(strings.ToUpper(allowed), "CAP_")
+		if ok, _ := filepath.Match(allowed, string(capability)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCapabilities verifies that the added capabilities are allowed by the
+// pod security standard enforced on the namespace
+func (s *executor) checkCapabilities(capabilities *api.Capabilities) error {
+	if capabilities == nil {
+		return nil
+	}
+
+	var allowed []api.Capability
+	switch s.Config.Kubernetes.PodSecurityStandard {
+	case podSecurityStandardBaseline:
+		allowed = baselineCapabilities
+	case podSecurityStandardRestricted:
+		allowed = restrictedCapabilities
+		if len(capabilities.Drop) > 0 && !hasCapability(capabilities.Drop, allCapabilities) {
+			return fmt.Errorf("the %s pod security standard requires dropping all capabilities",
+				s.Config.Kubernetes.PodSecurityStandard)
+		}
+	default:
+		return nil
+	}
+
+	for _, capability := range capabilities.Add {
+		if !hasCapability(allowed, capability) {
+			return fmt.Errorf("capability %q is not allowed by the %s pod security standard",
+				capability, s.Config.Kubernetes.PodSecurityStandard)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/kubernetes/pkg/api"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	tests := []struct {
+		Names    []string
+		Expected []api.Capability
+		Error    bool
+	}{
+		{Names: nil, Expected: nil},
+		{Names: []string{""}, Expected: nil},
+		{Names: []string{"SYS_PTRACE"}, Expected: []api.Capability{"SYS_PTRACE"}},
+		{Names: []string{"cap_sys_ptrace, NET_ADMIN"}, Expected: []api.Capability{"SYS_PTRACE", "NET_ADMIN"}},
+		{Names: []string{"all", "NET_RAW NET_RAW"}, Expected: []api.Capability{"ALL", "NET_RAW"}},
+		{Names: []string{"SYS-PTRACE"}, Error: true},
+		{Names: []string{"1CAP"}, Error: true},
+	}
+
+	for _, test := range tests {
+		capabilities, err := parseCapabilities(test.Names)
+		if test.Error {
+			assert.Error(t, err, "names: %v", test.Names)
+			continue
+		}
+		require.NoError(t, err, "names: %v", test.Names)
+		assert.Equal(t, test.Expected, capabilities, "names: %v", test.Names)
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	tests := []struct {
+		Add          string
+		Drop         string
+		ExpectedAdd  []api.Capability
+		ExpectedDrop []api.Capability
+		Error        bool
+	}{
+		{
+			ExpectedAdd:  []api.Capability{"NET_BIND_SERVICE"},
+			ExpectedDrop: []api.Capability{"ALL"},
+		},
+		{
+			Add:          "SYS_PTRACE",
+			ExpectedAdd:  []api.Capability{"SYS_PTRACE"},
+			ExpectedDrop: []api.Capability{"ALL"},
+		},
+		{
+			Add:          "net_bind_service,SYS_PTRACE",
+			Drop:         "NET_RAW",
+			ExpectedAdd:  []api.Capability{"NET_BIND_SERVICE", "SYS_PTRACE"},
+			ExpectedDrop: []api.Capability{"ALL", "NET_RAW"},
+		},
+		{Add: "SYS_ADMIN", Error: true},
+		{Add: "ALL", Error: true},
+		{Add: "SYS_PTRACE", Drop: "SYS_PTRACE", Error: true},
+		{Drop: "NET-RAW", Error: true},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			CapAdd:              []string{"NET_BIND_SERVICE"},
+			CapDrop:             []string{"ALL"},
+			AllowedCapabilities: []string{"sys_ptrace", "NET_*"},
+		}, &kubernetesOptions{Image: "test-image"})
+		ex.Build.Variables = common.BuildVariables{
+			{Key: "KUBERNETES_CAP_ADD", Value: test.Add},
+			{Key: "KUBERNETES_CAP_DROP", Value: test.Drop},
+		}
+
+		capabilities, err := ex.getCapabilities()
+		if test.Error {
+			assert.Error(t, err, "add: %s, drop: %s", test.Add, test.Drop)
+			continue
+		}
+		require.NoError(t, err, "add: %s, drop: %s", test.Add, test.Drop)
+		require.NotNil(t, capabilities)
+		assert.Equal(t, test.ExpectedAdd, capabilities.Add, "add: %s, drop: %s", test.Add, test.Drop)
+		assert.Equal(t, test.ExpectedDrop, capabilities.Drop, "add: %s, drop: %s", test.Add, test.Drop)
+	}
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	capabilities, err := ex.getCapabilities()
+	require.NoError(t, err)
+	assert.Nil(t, capabilities)
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	tests := []struct {
+		Standard     string
+		Capabilities *api.Capabilities
+		Error        bool
+	}{
+		{Standard: "restricted", Capabilities: nil},
+		{Standard: "", Capabilities: &api.Capabilities{Add: []api.Capability{"SYS_ADMIN"}}},
+		{Standard: "baseline", Capabilities: &api.Capabilities{Add: []api.Capability{"CHOWN", "KILL"}}},
+		{Standard: "baseline", Capabilities: &api.Capabilities{Add: []api.Capability{"SYS_PTRACE"}}, Error: true},
+		{Standard: "restricted", Capabilities: &api.Capabilities{Add: []api.Capability{"NET_BIND_SERVICE"}}},
+		{Standard: "restricted", Capabilities: &api.Capabilities{Drop: []api.Capability{"ALL"}}},
+		{Standard: "restricted", Capabilities: &api.Capabilities{Drop: []api.Capability{"NET_RAW"}}, Error: true},
+		{Standard: "restricted", Capabilities: &api.Capabilities{Add: []api.Capability{"CHOWN"}}, Error: true},
+	}
+
+	for i, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			PodSecurityStandard: test.Standard,
+		}, &kubernetesOptions{Image: "test-image"})
+
+		err := ex.checkCapabilities(test.Capabilities)
+		if test.Error {
+			assert.Error(t, err, "test %d", i)
+		} else {
+			assert.NoError(t, err, "test %d", i)
+		}
+	}
+}
+
+func TestBuildPodCapabilities(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		CapAdd:              []string{"SYS_PTRACE"},
+		CapDrop:             []string{"ALL"},
+		PodSecurityStandard: "restricted",
+	}, &kubernetesOptions{
+		Image:    "test-image",
+		Services: []kubernetesService{{Name: "test-service"}},
+	})
+	ex.helperImage = defaultHelperImage
+
+	var err error
+	ex.capabilities, err = ex.getCapabilities()
+	require.NoError(t, err)
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	require.Equal(t, 3, len(pod.Spec.Containers))
+	for _, container := range pod.Spec.Containers {
+		require.NotNil(t, container.SecurityContext.Capabilities, container.Name)
+		assert.Equal(t, []api.Capability{"SYS_PTRACE"}, container.SecurityContext.Capabilities.Add, container.Name)
+		assert.Equal(t, []api.Capability{"ALL"}, container.SecurityContext.Capabilities.Drop, container.Name)
+	}
+
+	// the restricted standard only drops all capabilities if none are dropped
+	ex.capabilities = &api.Capabilities{Add: []api.Capability{"NET_BIND_SERVICE"}}
+	pod, err = ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, []api.Capability{"NET_BIND_SERVICE"}, pod.Spec.Containers[0].SecurityContext.Capabilities.Add)
+	assert.Equal(t, []api.Capability{"ALL"}, pod.Spec.Containers[0].SecurityContext.Capabilities.Drop)
+	assert.Nil(t, ex.capabilities.Drop)
+}
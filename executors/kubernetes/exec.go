@@ -19,9 +19,14 @@ This file was modified by James Munnelly (https://gitlab.com/u/munnerz)
 package kubernetes
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"k8s.io/kubernetes/pkg/api"
@@ -29,6 +34,8 @@ import (
 	client "k8s.io/kubernetes/pkg/client/unversioned"
 	"k8s.io/kubernetes/pkg/client/unversioned/remotecommand"
 	remotecommandserver "k8s.io/kubernetes/pkg/kubelet/server/remotecommand"
+	"k8s.io/kubernetes/pkg/util/httpstream"
+	"k8s.io/kubernetes/pkg/util/httpstream/spdy"
 )
 
 // RemoteExecutor defines the interface accepted by the Exec command - provided for test stubbing
@@ -37,16 +44,105 @@ type RemoteExecutor interface {
 }
 
 // DefaultRemoteExecutor is the standard implementation of remote command execution
-type DefaultRemoteExecutor struct{}
+type DefaultRemoteExecutor struct {
+	// KeepAlive is how often TCP keepalives are sent on the connection, so
+	// the L4 load balancers and NAT gateways don't close it while the command
+	// is quiet, the HTTP proxies don't forward them. 0 uses the system default
+	KeepAlive time.Duration
+
+	// Cancel closes the connection of the command once it's closed, so the
+	// stream returns, eg. once the command timed out or the build was aborted
+	Cancel <-chan struct{}
+}
+
+func (e *DefaultRemoteExecutor) Execute(method string, url *url.URL, config *restclient.Config, stdin io.Reader, stdout, stderr io.Writer, tty bool) error {
+	roundTripper, err := newKeepAliveRoundTripper(config, e.KeepAlive)
+	if err != nil {
+		return err
+	}
+
+	upgrader := &cancelableUpgrader{SpdyRoundTripper: roundTripper}
+	wrapper, err := restclient.HTTPWrappersForConfig(config, upgrader)
+	if err != nil {
+		return err
+	}
 
-func (*DefaultRemoteExecutor) Execute(method string, url *url.URL, config *restclient.Config, stdin io.Reader, stdout, stderr io.Writer, tty bool) error {
-	exec, err := remotecommand.NewExecutor(config, method, url)
+	exec, err := remotecommand.NewStreamExecutor(upgrader, func(http.RoundTripper) http.RoundTripper {
+		return wrapper
+	}, method, url)
 	if err != nil {
 		return err
 	}
+
+	if e.Cancel != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-e.Cancel:
+				upgrader.cancel()
+			case <-done:
+			}
+		}()
+	}
+
 	return exec.Stream(remotecommandserver.SupportedStreamingProtocols, stdin, stdout, stderr, tty)
 }
 
+// newKeepAliveRoundTripper returns the round tripper upgrading the
+// connections to SPDY, which sends TCP keepalives every keepAlive if it's set
+func newKeepAliveRoundTripper(config *restclient.Config, keepAlive time.Duration) (*spdy.SpdyRoundTripper, error) {
+	tlsConfig, err := restclient.TLSConfigFor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	upgrader := spdy.NewSpdyRoundTripper(tlsConfig)
+	if keepAlive > 0 {
+		upgrader.Dialer = &net.Dialer{KeepAlive: keepAlive}
+	}
+	return upgrader, nil
+}
+
+// errExecCanceled is returned by the execs whose stream was canceled before
+// the connection was upgraded
+var errExecCanceled = errors.New("the stream of the command was canceled")
+
+// cancelableUpgrader closes the connection it upgraded once it's canceled,
+// which resets the streams of the command so they return
+type cancelableUpgrader struct {
+	*spdy.SpdyRoundTripper
+
+	mu       sync.Mutex
+	conn     httpstream.Connection
+	canceled bool
+}
+
+func (u *cancelableUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := u.SpdyRoundTripper.NewConnection(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.canceled {
+		conn.Close()
+		return nil, errExecCanceled
+	}
+	u.conn = conn
+	return conn, nil
+}
+
+func (u *cancelableUpgrader) cancel() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.canceled = true
+	if u.conn != nil {
+		u.conn.Close()
+	}
+}
+
 // ExecOptions declare the arguments accepted by the Exec command
 type ExecOptions struct {
 	Namespace     string
@@ -22,8 +22,11 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/api/testapi"
@@ -31,18 +34,29 @@ import (
 	"k8s.io/kubernetes/pkg/client/restclient"
 	client "k8s.io/kubernetes/pkg/client/unversioned"
 	"k8s.io/kubernetes/pkg/client/unversioned/fake"
+	remotecommandserver "k8s.io/kubernetes/pkg/kubelet/server/remotecommand"
 	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/types"
 )
 
 type fakeRemoteExecutor struct {
 	method  string
 	url     *url.URL
 	execErr error
+	block   chan struct{}
+	cancel  <-chan struct{}
 }
 
 func (f *fakeRemoteExecutor) Execute(method string, url *url.URL, config *restclient.Config, stdin io.Reader, stdout, stderr io.Writer, tty bool) error {
 	f.method = method
 	f.url = url
+	if f.block != nil {
+		select {
+		case <-f.block:
+		case <-f.cancel:
+			return errExecCanceled
+		}
+	}
 	return f.execErr
 }
 
@@ -145,6 +159,100 @@ func TestExec(t *testing.T) {
 	}
 }
 
+func TestDefaultRemoteExecutorKeepAlive(t *testing.T) {
+	upgrader, err := newKeepAliveRoundTripper(&restclient.Config{Host: "https://kubernetes.example.com"}, 30*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if upgrader.Dialer == nil || upgrader.Dialer.KeepAlive != 30*time.Second {
+		t.Errorf("expected the connections to be kept alive every 30s, got %#v", upgrader.Dialer)
+	}
+
+	_, err = newKeepAliveRoundTripper(&restclient.Config{
+		Host:            "https://kubernetes.example.com",
+		TLSClientConfig: restclient.TLSClientConfig{CAFile: "/missing/ca.crt"},
+	}, 30*time.Second)
+	if err == nil {
+		t.Errorf("expected the missing CA to fail")
+	}
+
+	// the server doesn't upgrade the connection, the request is sent as usual
+	requested := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case requested <- req.Method == "POST" && req.URL.Path == "/api/v1/namespaces/test/pods/foo/exec":
+		default:
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/api/v1/namespaces/test/pods/foo/exec")
+	remote := &DefaultRemoteExecutor{KeepAlive: 30 * time.Second}
+	err = remote.Execute("POST", u, &restclient.Config{Host: server.URL}, nil, ioutil.Discard, ioutil.Discard, false)
+	if err == nil || !strings.Contains(err.Error(), "unable to upgrade connection") {
+		t.Errorf("expected the connection not to be upgraded, got %v", err)
+	}
+	select {
+	case ok := <-requested:
+		if !ok {
+			t.Errorf("expected the exec to be requested")
+		}
+	default:
+		t.Errorf("expected the exec to be requested")
+	}
+}
+
+// blockingContainerExecutor runs the commands until they're released
+type blockingContainerExecutor struct {
+	release chan struct{}
+}
+
+func (e *blockingContainerExecutor) ExecInContainer(name string, uid types.UID, container string, cmd []string, in io.Reader, out, err io.WriteCloser, tty bool) error {
+	out.Write([]byte("started\n"))
+	<-e.release
+	return nil
+}
+
+func TestDefaultRemoteExecutorCancel(t *testing.T) {
+	container := &blockingContainerExecutor{release: make(chan struct{})}
+	defer close(container.release)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		remotecommandserver.ServeExec(w, req, container, "foo", "", "bar", time.Minute, time.Minute, remotecommandserver.SupportedStreamingProtocols)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/api/v1/namespaces/test/pods/foo/exec?command=sleep&output=1")
+	cancel := make(chan struct{})
+	remote := &DefaultRemoteExecutor{Cancel: cancel}
+	out := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- remote.Execute("POST", u, &restclient.Config{Host: server.URL}, nil, testWriter{call: func(b []byte) (int, error) {
+			out <- string(b)
+			return len(b), nil
+		}}, nil, false)
+	}()
+
+	select {
+	case output := <-out:
+		if output != "started\n" {
+			t.Errorf("unexpected output %q", output)
+		}
+	case err := <-done:
+		t.Fatalf("expected the command to start, got %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the command to start")
+	}
+
+	close(cancel)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Errorf("expected the stream to be closed once canceled")
+	}
+}
+
 func execPod() *api.Pod {
 	return &api.Pod{
 		ObjectMeta: api.ObjectMeta{Name: "foo", Namespace: "test", ResourceVersion: "10"},
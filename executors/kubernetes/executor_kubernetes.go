@@ -1,12 +1,30 @@
 package kubernetes
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/api"
+	kubeerrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/resource"
 	client "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/types"
+	"k8s.io/kubernetes/pkg/util/intstr"
+	"k8s.io/kubernetes/pkg/util/validation"
 
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/executors"
@@ -25,207 +43,2899 @@ var (
 	}
 )
 
+const defaultHelperImage = "munnerz/gitlab-runner-helper"
+
+// scriptsMountPath is where the scripts ConfigMap is mounted in the build and
+// helper containers
+const scriptsMountPath = "/gitlab-runner/scripts"
+
+// jobTokenVariables are the variables holding the job token, which are
+// stored in the job token Secret
+var jobTokenVariables = []string{"CI_JOB_TOKEN", "CI_BUILD_TOKEN"}
+
+// scriptTypes are the scripts which can be stored in the scripts ConfigMap
+var scriptTypes = []common.ShellScriptType{
+	common.ShellPrepareScript,
+	common.ShellBuildScript,
+	common.ShellAfterScript,
+	common.ShellArchiveCache,
+	common.ShellUploadArtifacts,
+}
+
+var shellFlagRegexp = regexp.MustCompile(`^[-+]([a-zA-Z]+|o [a-z]+)$`)
+
+const (
+	existingPodPolicyAdopt = "adopt"
+	existingPodPolicyFail  = "fail"
+)
+
+const (
+	podSecurityStandardBaseline   = "baseline"
+	podSecurityStandardRestricted = "restricted"
+)
+
+// dnsPolicyClusterFirstWithHostNet and dnsPolicyNone are not modeled by
+// api.DNSPolicy, the latter requires the DNS config of the pod
+const (
+	dnsPolicyClusterFirstWithHostNet = api.DNSPolicy("ClusterFirstWithHostNet")
+	dnsPolicyNone                    = api.DNSPolicy("None")
+)
+
+// maxDNSNameservers and maxDNSSearches are the limits of the DNS config
+// enforced by Kubernetes
+const (
+	maxDNSNameservers = 3
+	maxDNSSearches    = 6
+)
+
+// taintEffectNoExecute evicts the pods which don't tolerate the taint, it's
+// not modeled by api.TaintEffect
+const taintEffectNoExecute = "NoExecute"
+
+// kubernetesOptions are the options of the build. The image is defined either
+// by its name, or with the extended syntax: {"name": "ruby:2.3",
+// "entrypoint": ["/usr/bin/tini", "--"]}
 type kubernetesOptions struct {
-	Image    string   `json:"image"`
-	Services []string `json:"services"`
+	Image      string              `json:"image"`
+	Entrypoint []string            `json:"-"`
+	Services   []kubernetesService `json:"services"`
+}
+
+func (o *kubernetesOptions) UnmarshalJSON(data []byte) error {
+	type options kubernetesOptions
+	var decoded struct {
+		*options
+		Image json.RawMessage `json:"image"`
+	}
+	decoded.options = (*options)(o)
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	if len(decoded.Image) == 0 || string(decoded.Image) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(decoded.Image, &o.Image); err == nil {
+		return nil
+	}
+
+	var image struct {
+		Name       string   `json:"name"`
+		Entrypoint []string `json:"entrypoint"`
+	}
+	if err := json.Unmarshal(decoded.Image, &image); err != nil {
+		return err
+	}
+	o.Image, o.Entrypoint = image.Name, image.Entrypoint
+	return nil
+}
+
+// kubernetesService is a service defined either by its image name, or with
+// the extended syntax: {"name": "postgres:9.5", "alias": "db",
+// "entrypoint": ["docker-entrypoint.sh"], "command": ["postgres"],
+// "ports": [5432], "pull_secrets": ["registry"], "readiness_probe":
+// {"exec": {"command": ["pg_isready"]}}}
+type kubernetesService struct {
+	Name           string           `json:"name"`
+	Alias          string           `json:"alias"`
+	Entrypoint     []string         `json:"entrypoint"`
+	Command        []string         `json:"command"`
+	Ports          []int32          `json:"ports"`
+	PullSecrets    []string         `json:"pull_secrets"`
+	ReadinessProbe *kubernetesProbe `json:"readiness_probe"`
+	LivenessProbe  *kubernetesProbe `json:"liveness_probe"`
+}
+
+// aliases returns the hostnames of the service: its alias if set, otherwise
+// the names the Docker executor links the service with
+func (s *kubernetesService) aliases(variables common.BuildVariables) []string {
+	if s.Alias != "" {
+		return []string{variables.ExpandValue(s.Alias)}
+	}
+
+	image := variables.ExpandValue(s.Name)
+	if index := strings.Index(image, "@"); index >= 0 {
+		image = image[:index]
+	}
+	if index := strings.LastIndex(image, ":"); index > strings.LastIndex(image, "/") {
+		image = image[:index]
+	}
+
+	// the link name with "__" isn't a valid hostname, see splitServiceAndVersion
+	// of the Docker executor
+	return []string{strings.Replace(image, "/", "-", -1)}
+}
+
+func (s *kubernetesService) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*s = kubernetesService{Name: name}
+		return nil
+	}
+
+	type service kubernetesService
+	return json.Unmarshal(data, (*service)(s))
+}
+
+type executor struct {
+	executors.AbstractExecutor
+
+	kubeClient *client.Client
+	prepod     *api.Pod
+	pod        *api.Pod
+	options    *kubernetesOptions
+
+	buildLimits     api.ResourceList
+	serviceLimits   api.ResourceList
+	helperLimits    api.ResourceList
+	buildRequests   api.ResourceList
+	serviceRequests api.ResourceList
+	helperRequests  api.ResourceList
+
+	helperImage   string
+	priorityClass string
+	nodeSelector  map[string]string
+	hostNetwork   bool
+	affinity      map[string]interface{}
+	capabilities  *api.Capabilities
+
+	initContainers  []interface{}
+	podSpecTemplate map[string]interface{}
+	podPatch        map[string]interface{}
+	envFrom         []interface{}
+
+	podYAML        string
+	podYAMLWritten bool
+	servicesWaited bool
+	sidecarsWaited bool
+	podCreated     time.Time
+	execCount      int
+
+	scriptsConfigMap *api.ConfigMap
+	job              string
+	namespaceCreated bool
+	keepFailedPod    bool
+	jobTokenSecret   *api.Secret
+
+	dockerAuthSecret      *api.Secret
+	serviceAccountSecrets []string
+}
+
+func (s *executor) Prepare(globalConfig *common.Config, config *common.RunnerConfig, build *common.Build) error {
+	if config.Kubernetes != nil && config.Kubernetes.Shell != "" {
+		if err := checkShell(config.Kubernetes.Shell); err != nil {
+			return err
+		}
+
+		// the shell of the executor overrides the one of the runner
+		runnerConfig := *config
+		runnerConfig.Shell = config.Kubernetes.Shell
+		config = &runnerConfig
+	}
+
+	err := s.AbstractExecutor.Prepare(globalConfig, config, build)
+	if err != nil {
+		return err
+	}
+
+	if s.Shell().Shell == "sh" {
+		// bash is only detected if it's requested, sh runs the scripts as is
+		s.BuildShell.DockerCommand = []string{"sh"}
+	}
+
+	err = build.Options.Decode(&s.options)
+	if err != nil {
+		return err
+	}
+
+	s.kubeClient, err = getKubeClient(config.Token, config.Kubernetes)
+	if err != nil {
+		return fmt.Errorf("error connecting to Kubernetes: %s", err.Error())
+	}
+
+	if s.serviceLimits, err = s.limits(s.Config.Kubernetes.ServiceCPUs, s.Config.Kubernetes.ServiceMemory, s.Config.Kubernetes.ServiceEphemeralStorage); err != nil {
+		return err
+	}
+
+	if s.buildLimits, err = s.limits(s.Config.Kubernetes.CPUs, s.Config.Kubernetes.Memory, s.Config.Kubernetes.EphemeralStorage); err != nil {
+		return err
+	}
+
+	// the requests of the extended resources default to their limits
+	extended, err := extendedResources(s.Config.Kubernetes.ExtendedResources)
+	if err != nil {
+		return err
+	}
+	for name, quantity := range extended {
+		s.buildLimits[name] = quantity
+	}
+
+	if s.serviceRequests, err = s.requests(s.Config.Kubernetes.ServiceCPURequest, s.Config.Kubernetes.ServiceMemoryRequest, s.Config.Kubernetes.ServiceEphemeralStorageRequest, s.serviceLimits); err != nil {
+		return err
+	}
+
+	if s.buildRequests, err = s.requests(s.Config.Kubernetes.CPURequest, s.Config.Kubernetes.MemoryRequest, s.Config.Kubernetes.EphemeralStorageRequest, s.buildLimits); err != nil {
+		return err
+	}
+
+	if s.helperLimits, err = s.limits(s.Config.Kubernetes.HelperCPUs, s.Config.Kubernetes.HelperMemory, ""); err != nil {
+		return err
+	}
+
+	if s.helperRequests, err = s.requests("", "", "", s.helperLimits); err != nil {
+		return err
+	}
+
+	if err = s.checkDefaults(); err != nil {
+		return err
+	}
+
+	if err = s.setupNamespace(); err != nil {
+		return err
+	}
+
+	s.collectOrphanedPods()
+
+	if err = s.checkResourceQuota(); err != nil {
+		return err
+	}
+
+	if err = s.checkPodSecurityStandard(); err != nil {
+		return err
+	}
+
+	if err = s.checkPodSecurityContext(); err != nil {
+		return err
+	}
+
+	if s.helperImage, err = s.getHelperImage(); err != nil {
+		return err
+	}
+
+	if s.priorityClass, err = s.getPriorityClass(); err != nil {
+		return err
+	}
+
+	if s.nodeSelector, err = s.getNodeSelector(); err != nil {
+		return err
+	}
+
+	if s.hostNetwork, err = s.getHostNetwork(); err != nil {
+		return err
+	}
+
+	if s.capabilities, err = s.getCapabilities(); err != nil {
+		return err
+	}
+
+	if err = s.checkCapabilities(s.capabilities); err != nil {
+		return err
+	}
+
+	if err = s.checkServicePorts(); err != nil {
+		return err
+	}
+
+	if err = s.checkServiceAliases(); err != nil {
+		return err
+	}
+
+	if err = s.checkDNSConfig(); err != nil {
+		return err
+	}
+
+	if err = s.checkHostAliases(); err != nil {
+		return err
+	}
+
+	if err = s.checkImagePullSecrets(); err != nil {
+		return err
+	}
+
+	if err = s.checkServiceAccount(); err != nil {
+		return err
+	}
+
+	if err = s.checkTolerations(); err != nil {
+		return err
+	}
+
+	if err = s.checkPodLabels(); err != nil {
+		return err
+	}
+
+	if err = s.checkVolumes(); err != nil {
+		return err
+	}
+
+	if err = s.checkPersistentVolumeClaims(); err != nil {
+		return err
+	}
+
+	if s.affinity, err = s.getAffinity(); err != nil {
+		return fmt.Errorf("invalid affinity: %s", err.Error())
+	}
+
+	if s.initContainers, err = s.buildInitContainers(); err != nil {
+		return err
+	}
+
+	if s.envFrom, err = s.getEnvFrom(); err != nil {
+		return err
+	}
+
+	if s.Config.Kubernetes.PodSpec != "" {
+		if s.podSpecTemplate, err = parsePodSpec(s.Config.Kubernetes.PodSpec); err != nil {
+			return fmt.Errorf("invalid pod spec: %s", err.Error())
+		}
+	}
+
+	if s.Config.Kubernetes.PodPatch != "" {
+		if s.podPatch, err = parsePodPatch(s.Config.Kubernetes.PodPatch); err != nil {
+			return fmt.Errorf("invalid pod patch: %s", err.Error())
+		}
+	}
+
+	if err = s.checkShellFlags(); err != nil {
+		return err
+	}
+
+	s.Println("Using Kubernetes executor with image", s.options.Image, "...")
+
+	// the pod is scheduled and its images are pulled while the build is set
+	// up, and the preparation is retried if the pod can't be created
+	if s.Config.Kubernetes.CreatePodOnPrepare {
+		if err = s.setupBuildPod(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *executor) Run(cmd common.ExecutorCommand) error {
+	s.Debugln("Starting Kubernetes command...")
+
+	if s.pod == nil {
+		err := s.setupBuildPod()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	containerName := "build"
+	if cmd.Predefined {
+		containerName = "pre"
+	}
+
+	var command []string
+	var script string
+	if s.BuildShell.PassFile {
+		var err error
+		if command, err = s.passFileCommand(cmd.Script); err != nil {
+			return err
+		}
+	} else {
+		command, script = s.execCommand(s.containerScript(cmd), cmd.Predefined)
+	}
+
+	writesPodYAML := !s.BuildShell.PassFile && s.writesPodYAML(cmd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := s.runInContainer(ctx, containerName, command, script)
+	select {
+	case err := <-errc:
+		if err == nil && writesPodYAML {
+			s.podYAMLWritten = true
+		}
+		if err != nil && s.Config.Kubernetes.DumpLogsOnFailure {
+			s.dumpLogs()
+		}
+		if err != nil && strings.Contains(err.Error(), "executing in Docker Container") {
+			return &common.BuildError{Inner: err}
+		}
+		return err
+	case <-cmd.Abort:
+		cancel()
+		s.abortPod(errc)
+		return fmt.Errorf("build aborted")
+	}
+}
+
+// dumpLogs appends the last lines of the logs of the build and service
+// containers to the build trace, to diagnose why a command failed
+func (s *executor) dumpLogs() {
+	for _, container := range s.pod.Spec.Containers {
+		if container.Name != "build" && !strings.HasPrefix(container.Name, "svc-") {
+			continue
+		}
+
+		logs, err := getContainerLogs(s.kubeClient, s.pod, container.Name, dumpLogsTailLines)
+		if err != nil {
+			s.Warningln(fmt.Sprintf("Error getting the logs of container %s: %s", container.Name, err.Error()))
+			continue
+		}
+
+		s.Println(fmt.Sprintf("Logs of container %s (%s):", container.Name, container.Image))
+		if len(logs) > 0 && logs[len(logs)-1] != '\n' {
+			logs = append(logs, '\n')
+		}
+		s.BuildTrace.Write(logs)
+	}
+}
+
+// abortPod deletes the build pod immediately, which ends the command running
+// in it, and waits up to podAbortTimeout for runInContainer to return, so its
+// resources are freed before the cleanup
+func (s *executor) abortPod(errc <-chan error) {
+	immediately := int64(0)
+	err := deletePod(s.kubeClient, s.pod, &immediately)
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		s.Warningln(fmt.Sprintf("Error deleting the aborted pod: %s", err.Error()))
+	}
+
+	select {
+	case <-errc:
+	case <-time.After(podAbortTimeout):
+		s.Warningln("The command of the aborted pod didn't end in time")
+	}
+}
+
+func (s *executor) Finish(err error) {
+	if err != nil && s.pod != nil && s.Config.Kubernetes != nil && s.Config.Kubernetes.KeepFailedPods > 0 && s.job == "" {
+		s.keepFailedPod = true
+		s.Println(fmt.Sprintf("Keeping pod %s/%s of the failed build for %d seconds",
+			s.pod.Namespace, s.pod.Name, s.Config.Kubernetes.KeepFailedPods))
+	}
+
+	if err != nil {
+		s.recordEvent(api.EventTypeWarning, "BuildFailed",
+			fmt.Sprintf("Build %d of project %d failed: %s", s.Build.ID, s.Build.ProjectID, err.Error()))
+	} else {
+		s.recordEvent(api.EventTypeNormal, "BuildSucceeded",
+			fmt.Sprintf("Build %d of project %d succeeded", s.Build.ID, s.Build.ProjectID))
+	}
+
+	s.AbstractExecutor.Finish(err)
+}
+
+// recordEvent creates an event about the build pod, if enabled. Failing to
+// create an event doesn't fail the build
+func (s *executor) recordEvent(eventType, reason, message string) {
+	if s.pod == nil || s.Config.Kubernetes == nil || !s.Config.Kubernetes.EmitEvents {
+		return
+	}
+
+	err := createPodEvent(s.kubeClient, s.pod, eventType, reason, message)
+	if err != nil {
+		s.Warningln(fmt.Sprintf("Error creating %s event: %s", reason, err.Error()))
+	}
+}
+
+// terminationGracePeriod returns the configured grace period of the build
+// pod, nil for the default one of Kubernetes
+func (s *executor) terminationGracePeriod() *int64 {
+	if s.Config.Kubernetes == nil {
+		return nil
+	}
+	return s.Config.Kubernetes.TerminationGracePeriodSeconds
+}
+
+// restartPolicy returns the configured restart policy of the build pod,
+// which defaults to Never
+func (s *executor) restartPolicy() api.RestartPolicy {
+	if s.Config.Kubernetes.RestartPolicy == "" {
+		return api.RestartPolicyNever
+	}
+	return api.RestartPolicy(s.Config.Kubernetes.RestartPolicy)
+}
+
+func (s *executor) Cleanup() {
+	if s.keepFailedPod {
+		until := time.Now().Add(time.Duration(s.Config.Kubernetes.KeepFailedPods) * time.Second)
+		if err := keepPod(s.kubeClient, s.pod, until); err != nil {
+			s.Errorln(fmt.Sprintf("Error keeping pod of the failed build: %s", err.Error()))
+			s.keepFailedPod = false
+		}
+	}
+	if s.job != "" && !s.keepFailedPod {
+		// the job is also deleted if its pod wasn't created
+		err := deleteJob(s.kubeClient, s.Config.Kubernetes.Namespace, s.job)
+		if err != nil && !kubeerrors.IsNotFound(err) {
+			s.Errorln(fmt.Sprintf("Error cleaning up job: %s", err.Error()))
+		} else if err == nil {
+			s.waitForPodDeletion()
+		}
+	} else if s.pod != nil && !s.keepFailedPod {
+		err := deletePod(s.kubeClient, s.pod, s.terminationGracePeriod())
+		// the pod of an aborted build is already deleted
+		if err != nil && !kubeerrors.IsNotFound(err) {
+			s.Errorln(fmt.Sprintf("Error cleaning up pod: %s", err.Error()))
+		} else if err == nil {
+			s.waitForPodDeletion()
+		}
+	}
+	if s.keepFailedPod {
+		// the kept pod can still be exec'd, its resources are deleted with it
+		s.keepPodResources()
+	} else {
+		s.deletePodResources()
+	}
+	if s.namespaceCreated && (s.Config.Kubernetes.DeleteCreatedNamespace || s.Config.Kubernetes.NamespacePerBuild) {
+		s.cleanupNamespace()
+	}
+	if s.kubeClient != nil && s.Config.Kubernetes != nil && s.Config.Kubernetes.KeepFailedPods > 0 {
+		s.reapKeptPods()
+	}
+	// the client is cached and shared with other builds, see kubeClientCache
+	s.AbstractExecutor.Cleanup()
+}
+
+// deletePodResources deletes the scripts ConfigMap and the secrets created
+// for the build pod
+func (s *executor) deletePodResources() {
+	if s.scriptsConfigMap != nil {
+		err := s.kubeClient.ConfigMaps(s.scriptsConfigMap.Namespace).Delete(s.scriptsConfigMap.Name)
+		if err != nil {
+			s.Errorln(fmt.Sprintf("Error cleaning up scripts config map: %s", err.Error()))
+		}
+	}
+	if s.jobTokenSecret != nil {
+		err := s.kubeClient.Secrets(s.jobTokenSecret.Namespace).Delete(s.jobTokenSecret.Name)
+		if err != nil {
+			s.Errorln(fmt.Sprintf("Error cleaning up job token secret: %s", err.Error()))
+		}
+	}
+	if s.dockerAuthSecret != nil {
+		err := s.kubeClient.Secrets(s.dockerAuthSecret.Namespace).Delete(s.dockerAuthSecret.Name)
+		if err != nil {
+			s.Errorln(fmt.Sprintf("Error cleaning up registry secret: %s", err.Error()))
+		}
+	}
+}
+
+// keepPodResources makes the kept pod of the failed build the owner of its
+// scripts ConfigMap and secrets, so they're deleted once the pod is reaped
+func (s *executor) keepPodResources() {
+	if s.scriptsConfigMap != nil {
+		if err := ownByPod(s.kubeClient, "configmaps", s.scriptsConfigMap.Name, s.pod); err != nil {
+			s.Errorln(fmt.Sprintf("Error keeping scripts config map: %s", err.Error()))
+		}
+	}
+	for _, secret := range []*api.Secret{s.jobTokenSecret, s.dockerAuthSecret} {
+		if secret == nil {
+			continue
+		}
+		if err := ownByPod(s.kubeClient, "secrets", secret.Name, s.pod); err != nil {
+			s.Errorln(fmt.Sprintf("Error keeping secret %s: %s", secret.Name, err.Error()))
+		}
+	}
+}
+
+// cleanupNamespace deletes the namespace created for the build, or keeps it
+// with the kept pod of the failed build until the pod expires, since the pod
+// would be deleted with it
+func (s *executor) cleanupNamespace() {
+	namespace := s.Config.Kubernetes.Namespace
+	if s.keepFailedPod {
+		until := time.Now().Add(time.Duration(s.Config.Kubernetes.KeepFailedPods) * time.Second)
+		if err := keepNamespace(s.kubeClient, namespace, until); err != nil {
+			s.Errorln(fmt.Sprintf("Error keeping namespace: %s", err.Error()))
+		}
+		return
+	}
+
+	err := s.kubeClient.Namespaces().Delete(namespace)
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		s.Errorln(fmt.Sprintf("Error cleaning up namespace: %s", err.Error()))
+	}
+}
+
+// waitForPodDeletion waits for the pod of the build to be deleted, if a pod
+// deletion timeout is configured
+func (s *executor) waitForPodDeletion() {
+	if s.pod == nil || s.Config.Kubernetes == nil || s.Config.Kubernetes.PodDeletionTimeout <= 0 {
+		return
+	}
+
+	timeout := time.Duration(s.Config.Kubernetes.PodDeletionTimeout) * time.Second
+	if err := waitForPodDeletion(s.kubeClient, s.pod, timeout); err != nil {
+		s.Errorln(fmt.Sprintf("Error waiting for pod deletion: %s", err.Error()))
+	}
+}
+
+// reapKeptPods deletes the expired pods of failed builds, and the kept
+// namespaces created for them, at most every keptPodsReapInterval per
+// namespace, since the namespaces are shared by the builds of the runner
+func (s *executor) reapKeptPods() {
+	now := time.Now()
+
+	if reapDue(s.Config.Kubernetes.Host+"/"+s.Config.Kubernetes.Namespace, now) {
+		if err := reapKeptPods(s.kubeClient, s.Config.Kubernetes.Namespace, now); err != nil {
+			s.Warningln(fmt.Sprintf("Error deleting the kept pods of failed builds: %s", err.Error()))
+		}
+	}
+
+	// the namespaces of the builds aren't shared, so the kept ones are
+	// looked for in the whole cluster
+	if !s.Config.Kubernetes.DeleteCreatedNamespace && !s.Config.Kubernetes.NamespacePerBuild {
+		return
+	}
+	if reapDue(s.Config.Kubernetes.Host+"/", now) {
+		if err := reapKeptNamespaces(s.kubeClient, now); err != nil {
+			s.Warningln(fmt.Sprintf("Error deleting the kept namespaces of failed builds: %s", err.Error()))
+		}
+	}
+}
+
+// workspaceMountPath returns where the repo volume is mounted in the
+// containers, by default the parent directory of the build directory so the
+// other projects of the build directory can be cloned next to it. The build
+// directory is mounted itself if it's in the root directory
+func (s *executor) workspaceMountPath() string {
+	if mountPath := s.Config.Kubernetes.WorkspaceMountPath; mountPath != "" {
+		return path.Clean(mountPath)
+	}
+
+	buildDir := path.Clean(s.Build.BuildDir)
+	if dir := path.Dir(buildDir); dir != "/" && dir != "." {
+		return dir
+	}
+	return buildDir
+}
+
+// buildContainer returns a container running command, which replaces the
+// ENTRYPOINT of the image, with args, which replace its CMD
+func (s *executor) buildContainer(name, image string, limits, requests api.ResourceList, command, args []string) api.Container {
+	privileged := false
+	if s.Config.Kubernetes != nil {
+		privileged = s.Config.Kubernetes.Privileged
+	}
+
+	return api.Container{
+		Name:            name,
+		Image:           image,
+		ImagePullPolicy: api.PullPolicy(s.Config.Kubernetes.PullPolicy),
+		Command:         command,
+		Args:            args,
+		Env:             append(buildVariables(s.containerVariables()), podInfoVariables()...),
+		Resources: api.ResourceRequirements{
+			Limits:   limits,
+			Requests: requests,
+		},
+		VolumeMounts: append([]api.VolumeMount{
+			api.VolumeMount{
+				Name:      "repo",
+				MountPath: s.workspaceMountPath(),
+			},
+		}, s.buildVolumeMounts()...),
+		SecurityContext: &api.SecurityContext{
+			Privileged:   &privileged,
+			Capabilities: s.buildCapabilities(),
+		},
+		Stdin: true,
+	}
+}
+
+// buildCapabilities returns a copy of the capabilities of the containers, so
+// that they can be modified per container
+func (s *executor) buildCapabilities() *api.Capabilities {
+	if s.capabilities == nil {
+		return nil
+	}
+
+	return &api.Capabilities{
+		Add:  append([]api.Capability(nil), s.capabilities.Add...),
+		Drop: append([]api.Capability(nil), s.capabilities.Drop...),
+	}
+}
+
+// limits returns the resource limits for cpu, memory and ephemeral storage,
+// percentages of cpu and memory are resolved against the size of the
+// reference node
+func (s *executor) limits(cpu, memory, ephemeralStorage string) (api.ResourceList, error) {
+	cpu, err := resolvePercentage(cpu, s.Config.Kubernetes.ReferenceNodeCPUs, resource.DecimalSI)
+	if err != nil {
+		return nil, err
+	}
+
+	memory, err = resolvePercentage(memory, s.Config.Kubernetes.ReferenceNodeMemory, resource.BinarySI)
+	if err != nil {
+		return nil, err
+	}
+
+	return limits(cpu, memory, ephemeralStorage)
+}
+
+// requests returns the resource requests for cpu, memory and ephemeral
+// storage, which are parsed like the limits. The resources without a request
+// default to their limit, so that the containers are guaranteed the resources
+// they are allowed to use
+func (s *executor) requests(cpu, memory, ephemeralStorage string, limits api.ResourceList) (api.ResourceList, error) {
+	requests, err := s.limits(cpu, memory, ephemeralStorage)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, limit := range limits {
+		request, ok := requests[name]
+		if !ok {
+			requests[name] = limit
+			continue
+		}
+		if request.Cmp(limit) > 0 {
+			return nil, fmt.Errorf("%s request %s is greater than its limit %s", name, request.String(), limit.String())
+		}
+	}
+	return requests, nil
+}
+
+// podResources returns the sums of the requests and limits of the build,
+// helper and service containers of the build pod
+func (s *executor) podResources() (requests, limits api.ResourceList) {
+	add := func(sum, resources api.ResourceList) {
+		for name, quantity := range resources {
+			if total, ok := sum[name]; ok {
+				total.Add(quantity)
+				sum[name] = total
+			} else {
+				sum[name] = *quantity.Copy()
+			}
+		}
+	}
+
+	requests, limits = api.ResourceList{}, api.ResourceList{}
+	add(requests, s.buildRequests)
+	add(requests, s.helperRequests)
+	add(limits, s.buildLimits)
+	add(limits, s.helperLimits)
+	for range s.options.Services {
+		add(requests, s.serviceRequests)
+		add(limits, s.serviceLimits)
+	}
+	return requests, limits
+}
+
+// checkResourceQuota verifies, if it's enabled, that the resource quotas of
+// the namespace whose scopes match the build pod can accommodate it, so the
+// build fails early instead of when the pod is created. The usage of the
+// quotas may be stale, so the pod may still fit. The quotas aren't checked if
+// they can't be listed, eg. because the runner isn't allowed to
+func (s *executor) checkResourceQuota() error {
+	if !s.Config.Kubernetes.CheckResourceQuota {
+		return nil
+	}
+
+	namespace := s.Config.Kubernetes.Namespace
+	quotas, err := s.kubeClient.ResourceQuotas(namespace).List(api.ListOptions{})
+	if err != nil {
+		s.Debugln("Not checking the resource quotas:", err.Error())
+		return nil
+	}
+
+	requests, limits := s.podResources()
+	needed := api.ResourceList{api.ResourcePods: resource.MustParse("1")}
+	for name, quantity := range requests {
+		needed[name] = quantity
+		needed["requests."+name] = quantity
+	}
+	for name, quantity := range limits {
+		needed["limits."+name] = quantity
+	}
+
+	for _, quota := range quotas.Items {
+		if !quotaScopesMatch(quota.Spec.Scopes, s.activeDeadline() != nil, isBestEffort(requests, limits)) {
+			continue
+		}
+
+		for name, hard := range quota.Status.Hard {
+			quantity, ok := needed[name]
+			if !ok {
+				continue
+			}
+
+			used, ok := quota.Status.Used[name]
+			if !ok {
+				s.Warningln(fmt.Sprintf("Not checking %s against the resource quota %s of namespace %s, its usage isn't known",
+					name, quota.Name, namespace))
+				continue
+			}
+
+			available := *hard.Copy()
+			available.Sub(used)
+			if quantity.Cmp(available) > 0 {
+				return fmt.Errorf("the build pod may not fit in the resource quota %s of namespace %s, it needs %s of %s, "+
+					"but only %s of %s seemed to be left", quota.Name, namespace, quantity.String(), name, available.String(), hard.String())
+			}
+		}
+	}
+	return nil
+}
+
+// quotaScopesMatch returns true if a quota with scopes tracks the pod, which
+// is terminating if it has an active deadline, and best effort if none of its
+// containers has CPU or memory requests or limits
+func quotaScopesMatch(scopes []api.ResourceQuotaScope, terminating, bestEffort bool) bool {
+	for _, scope := range scopes {
+		switch scope {
+		case api.ResourceQuotaScopeTerminating:
+			if !terminating {
+				return false
+			}
+		case api.ResourceQuotaScopeNotTerminating:
+			if terminating {
+				return false
+			}
+		case api.ResourceQuotaScopeBestEffort:
+			if !bestEffort {
+				return false
+			}
+		case api.ResourceQuotaScopeNotBestEffort:
+			if bestEffort {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isBestEffort returns true if the pod with requests and limits is in the
+// BestEffort QoS class
+func isBestEffort(requests, limits api.ResourceList) bool {
+	for _, resources := range []api.ResourceList{requests, limits} {
+		for _, name := range []api.ResourceName{api.ResourceCPU, api.ResourceMemory} {
+			if quantity, ok := resources[name]; ok && !quantity.IsZero() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// containerVariables returns the variables passed to the containers, after
+// the proxy variables, see proxyVariables. If the job token is stored in a
+// Secret, the variables holding it are replaced by ones holding the path of
+// the respective file
+func (s *executor) containerVariables() common.BuildVariables {
+	variables := s.Build.GetAllVariables().PublicOrInternal()
+	if s.jobTokenSecret == nil {
+		return append(s.proxyVariables(variables), variables...)
+	}
+
+	var filtered common.BuildVariables
+	for _, variable := range variables {
+		if _, ok := s.jobTokenSecret.Data[variable.Key]; !ok {
+			filtered = append(filtered, variable)
+		}
+	}
+
+	for _, key := range jobTokenVariables {
+		if _, ok := s.jobTokenSecret.Data[key]; ok {
+			filtered = append(filtered, common.BuildVariable{
+				Key:   key + "_FILE",
+				Value: path.Join(s.Config.Kubernetes.JobTokenPath, key),
+			})
+		}
+	}
+	return append(s.proxyVariables(filtered), filtered...)
+}
+
+// proxyVariables returns the configured proxy variables, or the ones of the
+// runner if they're inherited, in upper and lower case since the tools use
+// either of them. The proxy variables of the build override them, so the ones
+// set in variables are skipped
+func (s *executor) proxyVariables(variables common.BuildVariables) common.BuildVariables {
+	proxies := []struct {
+		name, value string
+	}{
+		{"HTTP_PROXY", s.Config.Kubernetes.HTTPProxy},
+		{"HTTPS_PROXY", s.Config.Kubernetes.HTTPSProxy},
+		{"NO_PROXY", s.Config.Kubernetes.NoProxy},
+	}
+
+	set := make(map[string]bool)
+	for _, variable := range variables {
+		set[variable.Key] = true
+	}
+
+	var proxyVariables common.BuildVariables
+	for _, proxy := range proxies {
+		lower := strings.ToLower(proxy.name)
+		value := proxy.value
+		if value == "" && s.Config.Kubernetes.InheritProxy {
+			if value = os.Getenv(proxy.name); value == "" {
+				value = os.Getenv(lower)
+			}
+		}
+		if value == "" {
+			continue
+		}
+
+		for _, name := range []string{proxy.name, lower} {
+			if !set[name] {
+				proxyVariables = append(proxyVariables, common.BuildVariable{Key: name, Value: value})
+			}
+		}
+	}
+	return proxyVariables
+}
+
+func sidecarName(i int, sidecar common.KubernetesSidecar) string {
+	if sidecar.Name == "" {
+		return fmt.Sprintf("sidecar-%d", i)
+	}
+	return sidecar.Name
+}
+
+func (s *executor) buildSidecars() ([]api.Container, error) {
+	sidecars := make([]api.Container, len(s.Config.Kubernetes.Sidecars))
+	for i, sidecar := range s.Config.Kubernetes.Sidecars {
+		if sidecar.Image == "" {
+			return nil, fmt.Errorf("no image specified for sidecar %d", i)
+		}
+
+		name := sidecarName(i, sidecar)
+
+		limits, err := s.limits(sidecar.CPUs, sidecar.Memory, "")
+		if err != nil {
+			return nil, err
+		}
+
+		requests, err := s.requests("", "", "", limits)
+		if err != nil {
+			return nil, err
+		}
+
+		var env []api.EnvVar
+		for _, text := range sidecar.Environment {
+			variable, err := common.ParseVariable(text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid environment variable %q for sidecar %s: %s", text, name, err.Error())
+			}
+			env = append(env, api.EnvVar{Name: variable.Key, Value: variable.Value})
+		}
+
+		var mounts []api.VolumeMount
+		for _, mount := range sidecar.VolumeMounts {
+			mounts = append(mounts, api.VolumeMount{
+				Name:      mount.Name,
+				MountPath: mount.MountPath,
+				ReadOnly:  mount.ReadOnly,
+			})
+		}
+
+		sidecars[i] = api.Container{
+			Name:            name,
+			Image:           sidecar.Image,
+			ImagePullPolicy: api.PullPolicy(s.Config.Kubernetes.PullPolicy),
+			Command:         sidecar.Command,
+			Env:             env,
+			Resources: api.ResourceRequirements{
+				Limits:   limits,
+				Requests: requests,
+			},
+			VolumeMounts: mounts,
+		}
+	}
+	return sidecars, nil
+}
+
+// buildInitContainers returns the init containers of the build pod, which
+// run to completion before its containers start. The init containers of
+// api.PodSpec are stored in an annotation in old clusters, the newer ones only
+// support spec.initContainers, therefore they're passed as unstructured data
+// to encodePod
+func (s *executor) buildInitContainers() ([]interface{}, error) {
+	if len(s.Config.Kubernetes.InitContainers) == 0 {
+		return nil, nil
+	}
+
+	restricted := s.Config.Kubernetes.PodSecurityStandard == podSecurityStandardRestricted
+	containers := make([]api.Container, len(s.Config.Kubernetes.InitContainers))
+	for i, initContainer := range s.Config.Kubernetes.InitContainers {
+		if initContainer.Image == "" {
+			return nil, fmt.Errorf("no image specified for init container %d", i)
+		}
+
+		name := initContainer.Name
+		if name == "" {
+			name = fmt.Sprintf("init-%d", i)
+		}
+
+		limits, err := s.limits(initContainer.CPUs, initContainer.Memory, "")
+		if err != nil {
+			return nil, err
+		}
+
+		requests, err := s.requests("", "", "", limits)
+		if err != nil {
+			return nil, err
+		}
+
+		var mounts []api.VolumeMount
+		for _, mount := range initContainer.VolumeMounts {
+			mounts = append(mounts, api.VolumeMount{
+				Name:      mount.Name,
+				MountPath: mount.MountPath,
+				ReadOnly:  mount.ReadOnly,
+			})
+		}
+
+		containers[i] = api.Container{
+			Name:            name,
+			Image:           initContainer.Image,
+			ImagePullPolicy: api.PullPolicy(s.Config.Kubernetes.PullPolicy),
+			Command:         initContainer.Command,
+			Resources: api.ResourceRequirements{
+				Limits:   limits,
+				Requests: requests,
+			},
+			VolumeMounts: mounts,
+		}
+		if restricted {
+			containers[i].SecurityContext = &api.SecurityContext{
+				Capabilities: &api.Capabilities{Drop: []api.Capability{allCapabilities}},
+			}
+		}
+	}
+
+	data, err := json.Marshal(containers)
+	if err != nil {
+		return nil, err
+	}
+
+	var unstructured []interface{}
+	if err = json.Unmarshal(data, &unstructured); err != nil {
+		return nil, err
+	}
+
+	if restricted {
+		for _, container := range unstructured {
+			securityContext := container.(map[string]interface{})["securityContext"].(map[string]interface{})
+			securityContext["allowPrivilegeEscalation"] = false
+		}
+	}
+	return unstructured, nil
+}
+
+func (s *executor) buildPod() (*api.Pod, error) {
+	services := make([]api.Container, len(s.options.Services))
+	for i, service := range s.options.Services {
+		resolvedImage := s.Build.GetAllVariables().ExpandValue(service.Name)
+		services[i] = s.buildContainer(fmt.Sprintf("svc-%d", i), resolvedImage, s.serviceLimits, s.serviceRequests, service.Entrypoint, service.Command)
+		for _, port := range service.Ports {
+			services[i].Ports = append(services[i].Ports, api.ContainerPort{
+				ContainerPort: port,
+			})
+		}
+
+		var err error
+		if services[i].ReadinessProbe, err = s.serviceReadinessProbe(service); err != nil {
+			return nil, fmt.Errorf("readiness probe of service %s: %s", service.Name, err.Error())
+		}
+		if services[i].LivenessProbe, err = convertProbe(service.LivenessProbe, true); err != nil {
+			return nil, fmt.Errorf("liveness probe of service %s: %s", service.Name, err.Error())
+		}
+	}
+
+	sidecars, err := s.buildSidecars()
+	if err != nil {
+		return nil, err
+	}
+
+	// the shell is passed as the arguments of the entrypoint of the build
+	// image, if it's set
+	shellCommand := s.shellCommand()
+	buildCommand, buildArgs := shellCommand, []string(nil)
+	if len(s.options.Entrypoint) > 0 {
+		buildCommand, buildArgs = s.options.Entrypoint, shellCommand
+	}
+
+	containers := []api.Container{
+		s.buildContainer("build", s.Build.GetAllVariables().ExpandValue(s.options.Image), s.buildLimits, s.buildRequests, buildCommand, buildArgs),
+		s.buildContainer("pre", s.helperImage, s.helperLimits, s.helperRequests, shellCommand, nil),
+	}
+	containers = append(containers, services...)
+	containers = append(containers, sidecars...)
+
+	// the pull secrets of the service account are used
+	// by Kubernetes unless they are explicitly set
+	var imagePullSecrets []api.LocalObjectReference
+	for _, secret := range s.imagePullSecrets() {
+		imagePullSecrets = append(imagePullSecrets, api.LocalObjectReference{Name: secret})
+	}
+	if s.dockerAuthSecret != nil {
+		for _, secret := range s.serviceAccountSecrets {
+			imagePullSecrets = append(imagePullSecrets, api.LocalObjectReference{Name: secret})
+		}
+		imagePullSecrets = append(imagePullSecrets, api.LocalObjectReference{Name: s.dockerAuthSecret.Name})
+	}
+
+	volumes := []api.Volume{
+		api.Volume{
+			Name: "repo",
+			VolumeSource: api.VolumeSource{
+				EmptyDir: &api.EmptyDirVolumeSource{},
+			},
+		},
+	}
+	volumes = append(volumes, s.buildVolumes()...)
+	containers[0].VolumeMounts = append(containers[0].VolumeMounts, s.buildSecretVolumeMounts()...)
+
+	if s.jobTokenSecret != nil {
+		volumes = append(volumes, api.Volume{
+			Name: "job-token",
+			VolumeSource: api.VolumeSource{
+				Secret: &api.SecretVolumeSource{SecretName: s.jobTokenSecret.Name},
+			},
+		})
+		containers[0].VolumeMounts = append(containers[0].VolumeMounts, api.VolumeMount{
+			Name:      "job-token",
+			MountPath: s.Config.Kubernetes.JobTokenPath,
+			ReadOnly:  true,
+		})
+	}
+
+	if s.scriptsConfigMap != nil {
+		volumes = append(volumes, api.Volume{
+			Name: "scripts",
+			VolumeSource: api.VolumeSource{
+				ConfigMap: &api.ConfigMapVolumeSource{
+					LocalObjectReference: api.LocalObjectReference{Name: s.scriptsConfigMap.Name},
+				},
+			},
+		})
+		for i := range containers[:2] {
+			containers[i].VolumeMounts = append(containers[i].VolumeMounts, api.VolumeMount{
+				Name:      "scripts",
+				MountPath: scriptsMountPath,
+				ReadOnly:  true,
+			})
+		}
+	}
+
+	if s.Config.Kubernetes.ResourceVariables {
+		containers[0].Env = append(containers[0].Env, resourceVariables()...)
+	}
+
+	if s.Config.Kubernetes.DownwardAPIPath != "" {
+		volumes = append(volumes, api.Volume{
+			Name: "podinfo",
+			VolumeSource: api.VolumeSource{
+				DownwardAPI: &api.DownwardAPIVolumeSource{
+					Items: []api.DownwardAPIVolumeFile{
+						{
+							Path:     "labels",
+							FieldRef: &api.ObjectFieldSelector{APIVersion: "v1", FieldPath: "metadata.labels"},
+						},
+						{
+							Path:     "annotations",
+							FieldRef: &api.ObjectFieldSelector{APIVersion: "v1", FieldPath: "metadata.annotations"},
+						},
+					},
+				},
+			},
+		})
+		containers[0].VolumeMounts = append(containers[0].VolumeMounts, api.VolumeMount{
+			Name:      "podinfo",
+			MountPath: s.Config.Kubernetes.DownwardAPIPath,
+			ReadOnly:  true,
+		})
+	}
+
+	labels := s.podLabels()
+	for key, value := range s.buildLabels() {
+		labels[key] = value
+	}
+	labels[buildPodLabel] = "true"
+
+	pod := &api.Pod{
+		ObjectMeta: api.ObjectMeta{
+			GenerateName:    s.objectNamePrefix(""),
+			Namespace:       s.Config.Kubernetes.Namespace,
+			Labels:          labels,
+			Annotations:     s.buildAnnotations(),
+			OwnerReferences: s.buildOwnerReferences(),
+		},
+		Spec: api.PodSpec{
+			ServiceAccountName: s.Config.Kubernetes.ServiceAccount,
+			SecurityContext:    s.buildPodSecurityContext(),
+			DNSPolicy:          api.DNSPolicy(s.Config.Kubernetes.DNSPolicy),
+			ImagePullSecrets:   imagePullSecrets,
+			NodeSelector:       s.nodeSelector,
+			Volumes:            volumes,
+			RestartPolicy:      s.restartPolicy(),
+			Containers:         containers,
+
+			TerminationGracePeriodSeconds: s.terminationGracePeriod(),
+			ActiveDeadlineSeconds:         s.activeDeadline(),
+		},
+	}
+	s.applyPodSecurityStandard(pod)
+
+	return pod, nil
+}
+
+// buildOwnerReferences returns the reference to the configured owner of the
+// build pod, so it's deleted by the garbage collector with its owner
+func (s *executor) buildOwnerReferences() []api.OwnerReference {
+	owner := s.Config.Kubernetes.PodOwner
+	if owner == nil {
+		return nil
+	}
+
+	apiVersion := owner.APIVersion
+	if apiVersion == "" {
+		apiVersion = "v1"
+	}
+	return []api.OwnerReference{{
+		APIVersion: apiVersion,
+		Kind:       owner.Kind,
+		Name:       owner.Name,
+		UID:        types.UID(owner.UID),
+	}}
+}
+
+// autoscalerEvictionAnnotations prevent the cluster autoscalers from evicting
+// the build pods when they scale down their node
+var autoscalerEvictionAnnotations = map[string]string{
+	"cluster-autoscaler.kubernetes.io/safe-to-evict": "false",
+	"karpenter.sh/do-not-disrupt":                    "true",
+}
+
+// buildPodLabel marks all build pods, eg. to spread them across the nodes
+const buildPodLabel = "gitlab-runner/build"
+
+// buildLabels returns the labels of the build pod, which identify the build,
+// its project and the runner. The IDs are only unique per GitLab instance, the
+// runner tells apart the builds of the runners sharing a namespace
+func (s *executor) buildLabels() map[string]string {
+	labels := map[string]string{
+		"gitlab-runner/build-id":   strconv.Itoa(s.Build.ID),
+		"gitlab-runner/project-id": strconv.Itoa(s.Build.ProjectID),
+	}
+	if runner := s.Build.Runner.ShortDescription(); runner != "" {
+		labels[runnerLabel] = runner
+	}
+	return labels
+}
+
+// podLabels returns the configured labels of the build pod, with the build
+// variables expanded in their values
+func (s *executor) podLabels() map[string]string {
+	variables := s.Build.GetAllVariables()
+	labels := make(map[string]string, len(s.Config.Kubernetes.PodLabels))
+	for key, value := range s.Config.Kubernetes.PodLabels {
+		labels[key] = variables.ExpandValue(value)
+	}
+	return labels
+}
+
+// checkPodLabels verifies the syntax of the configured labels, once the
+// variables are expanded, and that they don't replace the ones of the runner
+func (s *executor) checkPodLabels() error {
+	for key, value := range s.podLabels() {
+		if strings.HasPrefix(key, "gitlab-runner/") {
+			return fmt.Errorf("pod label %s uses the reserved gitlab-runner/ prefix", key)
+		}
+		if msgs := validation.IsQualifiedName(key); len(msgs) > 0 {
+			return fmt.Errorf("invalid pod label key %q: %s", key, strings.Join(msgs, ", "))
+		}
+		if msgs := validation.IsValidLabelValue(value); len(msgs) > 0 {
+			return fmt.Errorf("invalid value %q of pod label %s: %s", value, key, strings.Join(msgs, ", "))
+		}
+	}
+	return nil
+}
+
+// buildAnnotations returns the annotations of the build pod
+func (s *executor) buildAnnotations() map[string]string {
+	if !s.Config.Kubernetes.PreventAutoscalerEviction {
+		return nil
+	}
+
+	annotations := make(map[string]string)
+	for key, value := range autoscalerEvictionAnnotations {
+		annotations[key] = value
+	}
+	return annotations
+}
+
+// buildPodSecurityContext returns the configured security context of the
+// build pod. The group of the processes isn't modeled by api.PodSecurityContext
+// and is set by buildPodSpecExtra
+func (s *executor) buildPodSecurityContext() *api.PodSecurityContext {
+	config := s.Config.Kubernetes.PodSecurityContext
+	if config.RunAsUser == nil && config.RunAsNonRoot == nil && config.FSGroup == nil && !s.hostNetwork {
+		return nil
+	}
+
+	// the host network of api.PodSpec is encoded as spec.hostNetwork
+	return &api.PodSecurityContext{
+		HostNetwork:  s.hostNetwork,
+		RunAsUser:    config.RunAsUser,
+		RunAsNonRoot: config.RunAsNonRoot,
+		FSGroup:      config.FSGroup,
+	}
+}
+
+// applyPodSecurityStandard sets the defaults required by the restricted pod
+// security standard on the fields which weren't explicitly set. The fields
+// which aren't modeled by api.PodSpec are set by buildPodSpecExtra
+func (s *executor) applyPodSecurityStandard(pod *api.Pod) {
+	if s.Config.Kubernetes.PodSecurityStandard != podSecurityStandardRestricted {
+		return
+	}
+
+	if pod.Spec.SecurityContext == nil {
+		pod.Spec.SecurityContext = &api.PodSecurityContext{}
+	}
+	if pod.Spec.SecurityContext.RunAsNonRoot == nil {
+		runAsNonRoot := true
+		pod.Spec.SecurityContext.RunAsNonRoot = &runAsNonRoot
+	}
+
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		if container.SecurityContext == nil {
+			container.SecurityContext = &api.SecurityContext{}
+		}
+		if container.SecurityContext.Capabilities == nil {
+			container.SecurityContext.Capabilities = &api.Capabilities{}
+		}
+		if len(container.SecurityContext.Capabilities.Drop) == 0 {
+			container.SecurityContext.Capabilities.Drop = []api.Capability{allCapabilities}
+		}
+	}
+}
+
+// getAffinity returns the configured affinity rules, together with the
+// preferred anti-affinity to the other build pods if spread_builds is set
+func (s *executor) getAffinity() (map[string]interface{}, error) {
+	affinity := s.Config.Kubernetes.Affinity
+	if s.Config.Kubernetes.SpreadBuilds {
+		affinity = withBuildPodAntiAffinity(affinity)
+	}
+	return convertAffinity(affinity)
+}
+
+// buildTolerations returns the configured tolerations as spec.tolerations
+// entries
+func (s *executor) buildTolerations() []interface{} {
+	var tolerations []interface{}
+	for _, toleration := range s.Config.Kubernetes.Tolerations {
+		entry := make(map[string]interface{})
+		if toleration.Key != "" {
+			entry["key"] = toleration.Key
+		}
+		if toleration.Operator != "" {
+			entry["operator"] = toleration.Operator
+		}
+		if toleration.Value != "" {
+			entry["value"] = toleration.Value
+		}
+		if toleration.Effect != "" {
+			entry["effect"] = toleration.Effect
+		}
+		if toleration.TolerationSeconds != nil {
+			entry["tolerationSeconds"] = *toleration.TolerationSeconds
+		}
+		tolerations = append(tolerations, entry)
+	}
+	return tolerations
+}
+
+// checkTolerations verifies the configured tolerations, as the API server
+// would reject the pod otherwise
+func (s *executor) checkTolerations() error {
+	for i, toleration := range s.Config.Kubernetes.Tolerations {
+		switch api.TolerationOperator(toleration.Operator) {
+		case "", api.TolerationOpEqual:
+			if toleration.Key == "" {
+				return fmt.Errorf("toleration %d: the key is required with the %s operator", i, api.TolerationOpEqual)
+			}
+		case api.TolerationOpExists:
+			if toleration.Value != "" {
+				return fmt.Errorf("toleration %d: the value must be empty with the %s operator", i, api.TolerationOpExists)
+			}
+		default:
+			return fmt.Errorf("toleration %d: unsupported operator %q, expected %q or %q",
+				i, toleration.Operator, api.TolerationOpEqual, api.TolerationOpExists)
+		}
+
+		switch toleration.Effect {
+		case "", string(api.TaintEffectNoSchedule), string(api.TaintEffectPreferNoSchedule), taintEffectNoExecute:
+		default:
+			return fmt.Errorf("toleration %d: unsupported effect %q, expected %q, %q or %q", i, toleration.Effect,
+				api.TaintEffectNoSchedule, api.TaintEffectPreferNoSchedule, taintEffectNoExecute)
+		}
+
+		if toleration.TolerationSeconds != nil && toleration.Effect != taintEffectNoExecute {
+			return fmt.Errorf("toleration %d: toleration_seconds requires the %s effect", i, taintEffectNoExecute)
+		}
+	}
+	return nil
+}
+
+// buildPodSpecExtra returns the PodSpec fields which are not modeled by
+// api.PodSpec, see encodePod
+func (s *executor) buildPodSpecExtra(pod *api.Pod) map[string]interface{} {
+	extra := make(map[string]interface{})
+	if s.priorityClass != "" {
+		extra["priorityClassName"] = s.priorityClass
+	}
+
+	var volumes []interface{}
+	if s.jobTokenSecret != nil {
+		// the mode of the files isn't modeled by api.SecretVolumeSource
+		volumes = append(volumes, map[string]interface{}{
+			"name": "job-token",
+			"secret": map[string]interface{}{
+				"defaultMode": 0400,
+			},
+		})
+	}
+	volumes = append(volumes, s.buildVolumesExtra()...)
+	if len(volumes) > 0 {
+		extra["volumes"] = volumes
+	}
+
+	// the tolerations of api.PodSpec are stored in an annotation
+	// in old clusters, the newer ones only support spec.tolerations
+	if tolerations := s.buildTolerations(); len(tolerations) > 0 {
+		extra["tolerations"] = tolerations
+	}
+
+	if s.affinity != nil {
+		extra["affinity"] = s.affinity
+	}
+
+	if len(s.initContainers) > 0 {
+		extra["initContainers"] = s.initContainers
+	}
+
+	if dnsConfig := s.buildDNSConfig(); len(dnsConfig) > 0 {
+		extra["dnsConfig"] = dnsConfig
+	}
+
+	if automount := s.Config.Kubernetes.AutomountServiceAccountToken; automount != nil {
+		extra["automountServiceAccountToken"] = *automount
+	}
+
+	if share := s.Config.Kubernetes.ShareProcessNamespace; share != nil {
+		extra["shareProcessNamespace"] = *share
+	}
+
+	// the host aliases are only supported by api.PodSpec of newer clusters
+	if hostAliases := s.buildHostAliases(); len(hostAliases) > 0 {
+		extra["hostAliases"] = hostAliases
+	}
+
+	var containers []interface{}
+	securityContext := make(map[string]interface{})
+	if runAsGroup := s.Config.Kubernetes.PodSecurityContext.RunAsGroup; runAsGroup != nil {
+		securityContext["runAsGroup"] = *runAsGroup
+	}
+
+	if s.Config.Kubernetes.PodSecurityStandard == podSecurityStandardRestricted {
+		securityContext["seccompProfile"] = map[string]interface{}{
+			"type": "RuntimeDefault",
+		}
+
+		for _, container := range pod.Spec.Containers {
+			containers = append(containers, map[string]interface{}{
+				"name": container.Name,
+				"securityContext": map[string]interface{}{
+					"allowPrivilegeEscalation": false,
+				},
+			})
+		}
+	}
+
+	// the envFrom of the containers is only supported by api.Container of
+	// newer clusters
+	if len(s.envFrom) > 0 {
+		containers = mergeNamedList(containers, []interface{}{
+			map[string]interface{}{
+				"name":    "build",
+				"envFrom": s.envFrom,
+			},
+		})
+	}
+
+	if len(containers) > 0 {
+		extra["containers"] = containers
+	}
+
+	if len(securityContext) > 0 {
+		extra["securityContext"] = securityContext
+	}
+
+	return extra
+}
+
+// buildDNSConfig returns the configured dnsConfig of the pod, which is not
+// modeled by api.PodSpec
+func (s *executor) buildDNSConfig() map[string]interface{} {
+	config := s.Config.Kubernetes.DNSConfig
+	dnsConfig := make(map[string]interface{})
+
+	if len(config.Nameservers) > 0 {
+		dnsConfig["nameservers"] = config.Nameservers
+	}
+	if len(config.Searches) > 0 {
+		dnsConfig["searches"] = config.Searches
+	}
+
+	var options []interface{}
+	for _, option := range config.Options {
+		converted := map[string]interface{}{"name": option.Name}
+		if option.Value != nil {
+			converted["value"] = *option.Value
+		}
+		options = append(options, converted)
+	}
+	if len(options) > 0 {
+		dnsConfig["options"] = options
+	}
+	return dnsConfig
+}
+
+// checkDNSConfig verifies the configured DNS config, and that it defines the
+// nameservers if the DNS policy is None
+func (s *executor) checkDNSConfig() error {
+	config := s.Config.Kubernetes.DNSConfig
+	if api.DNSPolicy(s.Config.Kubernetes.DNSPolicy) == dnsPolicyNone && len(config.Nameservers) == 0 {
+		return fmt.Errorf("the %s DNS policy requires at least one nameserver in the DNS config", dnsPolicyNone)
+	}
+
+	if len(config.Nameservers) > maxDNSNameservers {
+		return fmt.Errorf("the DNS config has %d nameservers, at most %d are supported", len(config.Nameservers), maxDNSNameservers)
+	}
+	for _, nameserver := range config.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			return fmt.Errorf("invalid nameserver %q of the DNS config, expected an IP address", nameserver)
+		}
+	}
+
+	if len(config.Searches) > maxDNSSearches {
+		return fmt.Errorf("the DNS config has %d search domains, at most %d are supported", len(config.Searches), maxDNSSearches)
+	}
+	for _, search := range config.Searches {
+		if msgs := validation.IsDNS1123Subdomain(strings.TrimSuffix(search, ".")); len(msgs) > 0 {
+			return fmt.Errorf("invalid search domain %q of the DNS config: %s", search, strings.Join(msgs, ", "))
+		}
+	}
+
+	for _, option := range config.Options {
+		if option.Name == "" {
+			return fmt.Errorf("no name specified for an option of the DNS config")
+		}
+	}
+	return nil
+}
+
+// collectOrphanedPods deletes the orphaned pods of the runner, if they
+// weren't collected when the runner started, eg. since the API server was
+// unavailable
+func (s *executor) collectOrphanedPods() {
+	deleted, err := collectOrphanedPods(s.kubeClient, s.Config.Kubernetes, s.Build.Runner.ShortDescription())
+	if err != nil {
+		s.Warningln(fmt.Sprintf("Error deleting the orphaned pods of the runner: %s", err.Error()))
+	}
+	if deleted > 0 {
+		s.Println(fmt.Sprintf("Deleted %d orphaned pods of the runner", deleted))
+	}
+}
+
+// buildNamespace returns the namespace of the build if every build runs in
+// its own namespace. The name is derived from the project and the build, and
+// shortened to the 63 characters of a DNS label
+func (s *executor) buildNamespace() string {
+	// the ID of the build is kept, so the namespace of a previous build
+	// which is still terminating isn't reused
+	suffix := fmt.Sprintf("-%d", s.Build.ID)
+	return sanitizeName(s.Build.ProjectUniqueName(), validation.DNS1123LabelMaxLength-len(suffix)) + suffix
+}
+
+// objectNamePrefix returns the GenerateName of the objects of the build of
+// kind, eg. "scripts". The names are derived from the unique name of the
+// project, which can contain invalid characters, eg. of the runner token.
+// The configured prefix is kept as is, only the project name is truncated
+func (s *executor) objectNamePrefix(kind string) string {
+	name, maxLength := s.Build.ProjectUniqueName(), generatedNameMaxLength
+	if kind != "" {
+		name += "-" + kind
+		maxLength--
+	}
+
+	prefix := s.Config.Kubernetes.PodNamePrefix
+	if prefix != "" {
+		prefix += "-"
+	}
+	name = prefix + sanitizeName(name, maxLength-len(prefix))
+
+	if kind != "" {
+		name += "-"
+	}
+	return name
+}
+
+// setupNamespace creates the namespace of the build pod with the configured
+// labels, if it's enabled and the namespace doesn't exist. A namespace
+// created concurrently, eg. by another build, is used as is, except the
+// namespace of the build which is always deleted during the cleanup
+func (s *executor) setupNamespace() error {
+	if !s.Config.Kubernetes.CreateNamespace && !s.Config.Kubernetes.NamespacePerBuild {
+		return nil
+	}
+
+	for key, value := range s.Config.Kubernetes.NamespaceLabels {
+		if msgs := validation.IsQualifiedName(key); len(msgs) > 0 {
+			return fmt.Errorf("invalid namespace label key %q: %s", key, strings.Join(msgs, ", "))
+		}
+		if msgs := validation.IsValidLabelValue(value); len(msgs) > 0 {
+			return fmt.Errorf("invalid value %q of namespace label %s: %s", value, key, strings.Join(msgs, ", "))
+		}
+	}
+
+	name := s.Config.Kubernetes.Namespace
+	_, err := s.kubeClient.Namespaces().Get(name)
+	if err == nil {
+		s.namespaceCreated = s.Config.Kubernetes.NamespacePerBuild
+		return nil
+	}
+	if !kubeerrors.IsNotFound(err) {
+		return fmt.Errorf("error checking namespace %s: %s", name, err.Error())
+	}
+
+	_, err = s.kubeClient.Namespaces().Create(&api.Namespace{
+		ObjectMeta: api.ObjectMeta{
+			Name:   name,
+			Labels: s.Config.Kubernetes.NamespaceLabels,
+		},
+	})
+	if kubeerrors.IsAlreadyExists(err) {
+		s.namespaceCreated = s.Config.Kubernetes.NamespacePerBuild
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error creating namespace %s: %s", name, err.Error())
+	}
+
+	s.namespaceCreated = true
+	s.Println("Created namespace", name)
+	s.waitForDefaultServiceAccount()
+	return nil
+}
+
+// waitForDefaultServiceAccount waits up to serviceAccountTimeout for the
+// default service account of the created namespace, which is created
+// asynchronously by Kubernetes
+func (s *executor) waitForDefaultServiceAccount() {
+	if s.Config.Kubernetes.ServiceAccount != "" {
+		return
+	}
+
+	deadline := time.Now().Add(serviceAccountTimeout)
+	for {
+		_, err := s.kubeClient.ServiceAccounts(s.Config.Kubernetes.Namespace).Get("default")
+		if !kubeerrors.IsNotFound(err) {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.Warningln("The default service account of namespace", s.Config.Kubernetes.Namespace, "doesn't exist yet")
+			return
+		}
+		time.Sleep(serviceAccountCheckInterval)
+	}
+}
+
+// setupScriptsConfigMap creates a ConfigMap with the scripts of the build,
+// which is mounted in the build and helper containers. The scripts are then
+// executed from it instead of being passed with the standard input
+func (s *executor) setupScriptsConfigMap() error {
+	data := make(map[string]string)
+	for _, scriptType := range scriptTypes {
+		script, err := common.GenerateShellScript(scriptType, *s.Shell())
+		if err != nil {
+			return err
+		}
+		if script == "" {
+			continue
+		}
+
+		name := string(scriptType)
+		if s.BuildShell.Extension != "" {
+			name += "." + s.BuildShell.Extension
+		}
+		data[name] = script
+	}
+
+	configMap, err := s.kubeClient.ConfigMaps(s.Config.Kubernetes.Namespace).Create(&api.ConfigMap{
+		ObjectMeta: api.ObjectMeta{
+			GenerateName: s.objectNamePrefix("scripts"),
+			Namespace:    s.Config.Kubernetes.Namespace,
+			Labels:       s.buildLabels(),
+		},
+		Data: data,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating scripts config map: %s", err.Error())
+	}
+
+	s.scriptsConfigMap = configMap
+	return nil
+}
+
+// setupJobTokenSecret creates a Secret with the job token, which is mounted
+// in the build container
+func (s *executor) setupJobTokenSecret() error {
+	data := make(map[string][]byte)
+	variables := s.Build.GetAllVariables()
+	for _, key := range jobTokenVariables {
+		if value := variables.Get(key); value != "" {
+			data[key] = []byte(value)
+		}
+	}
+
+	secret, err := s.kubeClient.Secrets(s.Config.Kubernetes.Namespace).Create(&api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			GenerateName: s.objectNamePrefix("token"),
+			Namespace:    s.Config.Kubernetes.Namespace,
+			Labels:       s.buildLabels(),
+		},
+		Type: api.SecretTypeOpaque,
+		Data: data,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating job token secret: %s", err.Error())
+	}
+
+	s.jobTokenSecret = secret
+	return nil
+}
+
+// setupDockerAuthSecret stores the registry credentials of the
+// DOCKER_AUTH_CONFIG variable, and the ones of the GitLab registry given by
+// the CI_REGISTRY variables, in a Secret. It's used to pull the images of the
+// build pod and deleted after the build
+func (s *executor) setupDockerAuthSecret() error {
+	variables := s.Build.GetAllVariables()
+	auth := variables.Get("DOCKER_AUTH_CONFIG")
+	registry := variables.Get("CI_REGISTRY")
+	user := variables.Get("CI_REGISTRY_USER")
+	password := variables.Get("CI_REGISTRY_PASSWORD")
+	if auth == "" && (registry == "" || user == "" || password == "") {
+		return nil
+	}
+
+	data, err := dockerConfigJSON(auth, registry, user, password)
+	if err != nil {
+		return fmt.Errorf("invalid DOCKER_AUTH_CONFIG: %s", err.Error())
+	}
+
+	// the pull secrets of the service account aren't used by Kubernetes
+	// anymore once the pod has its own, so they are set explicitly
+	if len(s.imagePullSecrets()) == 0 {
+		s.serviceAccountSecrets = s.serviceAccountPullSecrets()
+	}
+
+	secret, err := s.kubeClient.Secrets(s.Config.Kubernetes.Namespace).Create(&api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			GenerateName: s.objectNamePrefix("registry"),
+			Namespace:    s.Config.Kubernetes.Namespace,
+			Labels:       s.buildLabels(),
+		},
+		Type: api.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{api.DockerConfigJsonKey: data},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating registry secret: %s", err.Error())
+	}
+
+	s.dockerAuthSecret = secret
+	return nil
+}
+
+// serviceAccountPullSecrets returns the image pull secrets of the service
+// account of the build pods. If they can't be read, eg. because the runner
+// isn't allowed to, none are returned
+func (s *executor) serviceAccountPullSecrets() []string {
+	name := s.Config.Kubernetes.ServiceAccount
+	if name == "" {
+		name = "default"
+	}
+
+	account, err := s.kubeClient.ServiceAccounts(s.Config.Kubernetes.Namespace).Get(name)
+	if err != nil {
+		return nil
+	}
+
+	var secrets []string
+	for _, secret := range account.ImagePullSecrets {
+		secrets = append(secrets, secret.Name)
+	}
+	return secrets
+}
+
+// shellCommand returns the command of the build and helper containers, which
+// waits for the scripts. The shells which require a script file may not have
+// a Docker command, they are then started without arguments
+func (s *executor) shellCommand() []string {
+	if len(s.BuildShell.DockerCommand) == 0 && s.BuildShell.PassFile {
+		return []string{s.BuildShell.Command}
+	}
+	return s.BuildShell.DockerCommand
+}
+
+// scriptFile returns the path of script in the scripts ConfigMap, or an empty
+// string if it's not stored there
+func (s *executor) scriptFile(script string) string {
+	if s.scriptsConfigMap == nil {
+		return ""
+	}
+
+	for name, content := range s.scriptsConfigMap.Data {
+		if content == script {
+			return path.Join(scriptsMountPath, name)
+		}
+	}
+	return ""
+}
+
+// findExistingPod returns a pod of the build which is still pending or
+// running, eg. created before the runner was restarted
+func (s *executor) findExistingPod() (*api.Pod, error) {
+	pods, err := s.kubeClient.Pods(s.Config.Kubernetes.Namespace).List(api.ListOptions{
+		LabelSelector: labels.SelectorFromSet(s.buildLabels()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error looking for existing pods: %s", err.Error())
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		switch pod.Status.Phase {
+		case api.PodPending, api.PodRunning:
+			return pod, nil
+		}
+	}
+	return nil, nil
+}
+
+// adoptPod uses an existing pod for the build, together with the ConfigMap
+// and Secret it mounts, so they are deleted during the cleanup
+func (s *executor) adoptPod(pod *api.Pod) error {
+	for _, volume := range pod.Spec.Volumes {
+		switch {
+		case volume.Name == "scripts" && volume.ConfigMap != nil:
+			configMap, err := s.kubeClient.ConfigMaps(pod.Namespace).Get(volume.ConfigMap.Name)
+			if err != nil {
+				return fmt.Errorf("error getting scripts config map: %s", err.Error())
+			}
+			s.scriptsConfigMap = configMap
+		case volume.Name == "job-token" && volume.Secret != nil:
+			s.jobTokenSecret = &api.Secret{
+				ObjectMeta: api.ObjectMeta{
+					Name:      volume.Secret.SecretName,
+					Namespace: pod.Namespace,
+				},
+			}
+		}
+	}
+
+	if s.Config.Kubernetes.PrintPodYAML || s.Config.Kubernetes.PodYAMLFile != "" {
+		data, err := runtime.Encode(s.kubeClient.RESTClient.Codec(), pod)
+		if err != nil {
+			return err
+		}
+
+		if s.podYAML, err = podYAML(data); err != nil {
+			return err
+		}
+	}
+
+	// the registry secret is created for the build, unlike the other pull secrets
+	for _, secret := range pod.Spec.ImagePullSecrets {
+		if strings.HasPrefix(secret.Name, s.objectNamePrefix("registry")) {
+			s.dockerAuthSecret = &api.Secret{
+				ObjectMeta: api.ObjectMeta{
+					Name:      secret.Name,
+					Namespace: pod.Namespace,
+				},
+			}
+		}
+	}
+
+	// the Job of the pod is deleted with it
+	if s.Config.Kubernetes.RunAsJob {
+		s.job = pod.Labels[jobNameLabel]
+	}
+
+	s.pod = pod
+	s.Println("Using existing pod", pod.Namespace+"/"+pod.Name, "of the build")
+	return nil
+}
+
+func (s *executor) setupBuildPod() error {
+	existing, err := s.findExistingPod()
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		if s.Config.Kubernetes.ExistingPodPolicy == existingPodPolicyFail {
+			return fmt.Errorf("pod %s/%s of the build already exists, delete it to retry the build",
+				existing.Namespace, existing.Name)
+		}
+		return s.adoptPod(existing)
+	}
+
+	// the shells which require a script file run the scripts of the ConfigMap
+	if s.Config.Kubernetes.ScriptsConfigMap || s.BuildShell.PassFile {
+		if err := s.setupScriptsConfigMap(); err != nil {
+			return err
+		}
+	}
+
+	if s.Config.Kubernetes.JobTokenPath != "" {
+		if err := s.setupJobTokenSecret(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.setupDockerAuthSecret(); err != nil {
+		return err
+	}
+
+	pod, err := s.buildPod()
+	if err != nil {
+		return err
+	}
+
+	extra, err := podSpecWithTemplate(s.kubeClient, pod, s.podSpecTemplate, s.buildPodSpecExtra(pod))
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	var created *api.Pod
+	if s.Config.Kubernetes.RunAsJob {
+		created, err = s.createJob(pod, extra)
+	} else {
+		created, err = s.createPod(pod, extra)
+	}
+	if err != nil {
+		podFailures.WithLabelValues(podFailureCreate).Inc()
+		return err
+	}
+	podCreationDuration.Observe(time.Since(started).Seconds())
+
+	s.pod = created
+	s.podCreated = time.Now()
+	s.recordEvent(api.EventTypeNormal, "BuildStarted",
+		fmt.Sprintf("Build %d of project %d started", s.Build.ID, s.Build.ProjectID))
+
+	if s.Config.Kubernetes.PrintPodYAML || s.Config.Kubernetes.PodYAMLFile != "" {
+		pod.Name = created.Name
+		data, err := encodePatchedPod(s.kubeClient, pod, extra, s.podPatch)
+		if err != nil {
+			return err
+		}
+
+		if s.podYAML, err = podYAML(data); err != nil {
+			return err
+		}
+	}
+
+	if s.Config.Kubernetes.PrintPodYAML {
+		s.Println("Created pod", created.Namespace+"/"+created.Name, "with definition:")
+		fmt.Fprint(s.BuildTrace, s.podYAML)
+	}
+
+	return nil
+}
+
+// createPod creates the build pod, retrying podCreationRetries times with
+// an increasing interval if the API server fails temporarily. If the pod was
+// created by a request which failed, eg. because its response timed out, the
+// pod is used instead of creating another one
+func (s *executor) createPod(pod *api.Pod, extra map[string]interface{}) (*api.Pod, error) {
+	interval := podCreationRetryInterval
+	for retry := 1; ; retry++ {
+		created, err := createPod(s.kubeClient, pod, extra, s.podPatch)
+		if err == nil || retry > podCreationRetries || !isRetryableError(err) {
+			return created, err
+		}
+
+		s.Warningln(fmt.Sprintf("Error creating the pod, retrying in %s (%d/%d): %s",
+			interval, retry, podCreationRetries, err.Error()))
+		time.Sleep(interval)
+		interval *= 2
+
+		existing, findErr := s.findExistingPod()
+		if findErr == nil && existing != nil {
+			return existing, nil
+		}
+	}
+}
+
+// createJob creates a Job running the build pod and waits for the job
+// controller to create the pod
+func (s *executor) createJob(pod *api.Pod, extra map[string]interface{}) (*api.Pod, error) {
+	job, err := createJob(s.kubeClient, pod, extra, s.podPatch)
+	if err != nil {
+		return nil, err
+	}
+
+	s.job = job
+	s.Println("Created job", pod.Namespace+"/"+job)
+	return waitForJobPod(s.kubeClient, pod.Namespace, job, s.Config.Kubernetes.GetPollTimeout())
+}
+
+// podYAMLScript returns a shell script which writes the pod definition
+// to the configured file in the project directory, the script fails if the
+// file can't be written
+func (s *executor) podYAMLScript() string {
+	file := shellQuote(path.Join(s.Build.FullProjectDir(), s.Config.Kubernetes.PodYAMLFile))
+	return fmt.Sprintf("cat > %s <<'GITLAB_RUNNER_POD_YAML' || "+
+		"{ printf 'ERROR: Failed to write the pod YAML to %%s\\n' %s >&2; exit 1; }\n%sGITLAB_RUNNER_POD_YAML\n",
+		file, file, s.podYAML)
+}
+
+// writesPodYAML returns true if the script of cmd writes the pod YAML file.
+// The project directory is cloned during the predefined stage, so the file is
+// written by the first build script, or by the following ones until it was
+func (s *executor) writesPodYAML(cmd common.ExecutorCommand) bool {
+	return !cmd.Predefined && !s.podYAMLWritten && s.Config.Kubernetes.PodYAMLFile != ""
+}
+
+// containerScript returns the script passed to the container with the
+// standard input to execute cmd
+func (s *executor) containerScript(cmd common.ExecutorCommand) string {
+	script := cmd.Script
+	if file := s.scriptFile(script); file != "" {
+		script = ". " + shellQuote(file) + "\n"
+	}
+
+	if s.writesPodYAML(cmd) {
+		script = s.podYAMLScript() + script
+	}
+
+	return script
+}
+
+// execCommand returns the command executed in the containers and its
+// standard input for script. The command changes to the build directory,
+// which doesn't exist before the repository is cloned, or to the configured
+// exec working directory for the scripts of the build, which must exist. The
+// configured shell flags are set before script is run
+func (s *executor) execCommand(script string, predefined bool) ([]string, string) {
+	cd := "cd " + shellQuote(s.Build.FullProjectDir()) + " 2>/dev/null"
+	if s.Config.Kubernetes.ExecWorkingDir != "" && !predefined {
+		workingDir := shellQuote(s.Build.GetAllVariables().ExpandValue(s.Config.Kubernetes.ExecWorkingDir))
+		cd = "cd " + workingDir + " || { printf 'ERROR: Failed to change to the exec working directory %s\\n' " +
+			workingDir + " >&2; exit 1; }"
+	}
+
+	command := []string{"sh", "-c", cd + "; exec \"$0\" \"$@\""}
+	command = append(command, s.BuildShell.DockerCommand...)
+
+	return command, s.shellFlagsScript() + script
+}
+
+// shellFlagsScript returns the script setting the configured shell flags. The
+// flags which the shell doesn't support, eg. `-o pipefail` in dash, are
+// skipped with a warning instead of making the shell exit
+func (s *executor) shellFlagsScript() string {
+	var script string
+	for _, flag := range s.Config.Kubernetes.ShellFlags {
+		script += "if (set " + flag + ") 2>/dev/null; then set " + flag + "; " +
+			"else echo 'WARNING: The shell doesn'\\''t support `set " + flag + "`, skipping it' >&2; fi\n"
+	}
+	return script
+}
+
+// passFileCommand returns the command running script from the scripts
+// ConfigMap, for the shells which require a script file
+func (s *executor) passFileCommand(script string) ([]string, error) {
+	file := s.scriptFile(script)
+	if file == "" {
+		return nil, fmt.Errorf("the script isn't stored in the scripts config map of the pod")
+	}
+	return append(append([]string{s.BuildShell.Command}, s.BuildShell.Arguments...), file), nil
+}
+
+func (s *executor) runInContainer(ctx context.Context, name string, command []string, script string) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+
+		status, err := waitForPodRunning(ctx, s.kubeClient, s.pod, s.BuildTrace, podWaitOptions{
+			failOnServices: s.Config.Kubernetes.GetFailOnServiceStartFailure(),
+			pollInterval:   s.Config.Kubernetes.GetPollInterval(),
+			timeout:        s.Config.Kubernetes.GetPollTimeout(),
+		})
+
+		if err != nil {
+			errc <- s.checkPodFailure(name, err)
+			return
+		}
+
+		if status != api.PodRunning {
+			errc <- fmt.Errorf("pod failed to enter running state: %s", status)
+			return
+		}
+
+		// the pods which were adopted weren't created by this build
+		if !s.podCreated.IsZero() {
+			podRunningDuration.Observe(time.Since(s.podCreated).Seconds())
+			s.podCreated = time.Time{}
+		}
+
+		if !s.sidecarsWaited {
+			s.sidecarsWaited = true
+			if err = s.waitForSidecars(ctx); err != nil {
+				errc <- err
+				return
+			}
+		}
+
+		if name == "build" && !s.servicesWaited {
+			s.servicesWaited = true
+			s.waitForServices(ctx)
+		}
+
+		config, err := getKubeClientConfig(s.Config.Kubernetes)
+
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		var stderr io.Writer = s.BuildTrace
+		if prefix := s.Config.Kubernetes.StderrPrefix; prefix != "" {
+			stderr = newLinePrefixWriter(s.BuildTrace, prefix)
+		}
+
+		exec := ExecOptions{
+			PodName:       s.pod.Name,
+			Namespace:     s.pod.Namespace,
+			ContainerName: name,
+			Command:       command,
+			In:            strings.NewReader(script),
+			Out:           s.BuildTrace,
+			Err:           stderr,
+			Stdin:         true,
+			Config:        config,
+			Client:        s.kubeClient,
+		}
+
+		var file string
+		reconnects := s.Config.Kubernetes.ExecReconnects
+		if reconnects > 0 {
+			s.execCount++
+			file = s.execFile(s.execCount)
+		}
+
+		run := func(ctx context.Context) error {
+			exec := exec
+			exec.Executor = &DefaultRemoteExecutor{
+				KeepAlive: time.Duration(s.Config.Kubernetes.ExecKeepalive) * time.Second,
+				Cancel:    ctx.Done(),
+			}
+			if reconnects == 0 {
+				return exec.Run()
+			}
+
+			detached := &reconnectingExec{
+				exec:       exec,
+				file:       file,
+				reconnects: reconnects,
+				stop:       ctx.Done(),
+				warn:       s.Warningln,
+			}
+			return detached.Run()
+		}
+
+		timeout := time.Duration(s.Config.Kubernetes.ExecTimeout) * time.Second
+		started := time.Now()
+		err = runWithTimeout(ctx, name, run, timeout)
+		execDuration.WithLabelValues(name).Observe(time.Since(started).Seconds())
+		errc <- s.checkPodFailure(name, err)
+	}()
+
+	return errc
+}
+
+// execFile returns the path of the files of the n-th command run in the
+// background, they're stored in the repo volume shared by the containers
+func (s *executor) execFile(n int) string {
+	return path.Join(s.workspaceMountPath(), ".gitlab-runner", fmt.Sprintf("exec-%d", n))
+}
+
+// runWithTimeout runs the command of container, it's canceled once timeout
+// is exceeded or ctx is canceled, eg. since the build was aborted. The
+// stream of the command is closed and waited for before it returns, so the
+// command doesn't write to the trace of the next one. A timeout of 0 doesn't
+// limit the command
+func runWithTimeout(ctx context.Context, container string, run func(ctx context.Context) error, timeout time.Duration) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- run(runCtx)
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var err error
+	select {
+	case err = <-done:
+		return err
+	case <-expired:
+		err = fmt.Errorf("command in container %s timed out after %s", container, timeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cancel()
+	<-done
+	return err
+}
+
+// serviceReadinessProbe returns the readiness probe of service, if it's
+// defined, otherwise the probe checking that its first port accepts
+// connections, if the services are waited for
+func (s *executor) serviceReadinessProbe(service kubernetesService) (*api.Probe, error) {
+	if service.ReadinessProbe != nil {
+		return convertProbe(service.ReadinessProbe, false)
+	}
+	if s.Config.Kubernetes.WaitForServicesTimeout <= 0 || len(service.Ports) == 0 {
+		return nil, nil
+	}
+
+	return &api.Probe{
+		Handler: api.Handler{
+			TCPSocket: &api.TCPSocketAction{Port: intstr.FromInt(int(service.Ports[0]))},
+		},
+		TimeoutSeconds:   1,
+		PeriodSeconds:    1,
+		SuccessThreshold: 1,
+		FailureThreshold: 3,
+	}, nil
+}
+
+// servicesWaitTimeout returns how long to wait for the services to be ready,
+// the configured timeout, or the timeout of the build pod to start if only
+// some services define a readiness probe. 0 means they aren't waited for
+func (s *executor) servicesWaitTimeout() time.Duration {
+	if timeout := s.Config.Kubernetes.WaitForServicesTimeout; timeout > 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	for _, service := range s.options.Services {
+		if service.ReadinessProbe != nil {
+			return s.Config.Kubernetes.GetPollTimeout()
+		}
+	}
+	return 0
+}
+
+// waitForSidecars waits up to the poll timeout for the sidecars configured
+// with wait_for_ready to be ready, before the first command of the build runs,
+// eg. until a secrets agent fetched the secrets
+func (s *executor) waitForSidecars(ctx context.Context) error {
+	names := make(map[string]bool)
+	for i, sidecar := range s.Config.Kubernetes.Sidecars {
+		if sidecar.WaitForReady {
+			names[sidecarName(i, sidecar)] = true
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	s.Println("Waiting for sidecars to be ready...")
+	timeout := s.Config.Kubernetes.GetPollTimeout()
+	deadline := time.Now().Add(timeout)
+	for {
+		pod, err := getPod(s.kubeClient, s.pod.Namespace, s.pod.Name)
+		if err == nil {
+			notReady := notReadyContainers(pod, func(name string) bool { return names[name] })
+			if len(notReady) == 0 {
+				return nil
+			}
+
+			if time.Now().After(deadline) {
+				return fmt.Errorf("sidecar containers %s are not ready after %s", strings.Join(notReady, ", "), timeout)
+			}
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("error checking if the sidecars are ready: %s", err.Error())
+		}
+
+		select {
+		case <-time.After(servicesCheckInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
-type executor struct {
-	executors.AbstractExecutor
+// waitForServices waits up to the configured timeout for the service
+// containers to be ready, ie. their readiness probe passes. The build is
+// started anyway, with a warning about the services which are not ready, like
+// with the Docker executor
+func (s *executor) waitForServices(ctx context.Context) {
+	timeout := s.servicesWaitTimeout()
+	if timeout <= 0 || len(s.options.Services) == 0 {
+		return
+	}
 
-	kubeClient *client.Client
-	prepod     *api.Pod
-	pod        *api.Pod
-	options    *kubernetesOptions
+	s.Println("Waiting for services to be up and running...")
+	deadline := time.Now().Add(timeout)
+	for {
+		pod, err := getPod(s.kubeClient, s.pod.Namespace, s.pod.Name)
+		if err == nil {
+			notReady := notReadyServices(pod)
+			if len(notReady) == 0 {
+				return
+			}
 
-	buildLimits   api.ResourceList
-	serviceLimits api.ResourceList
+			if time.Now().After(deadline) {
+				for _, service := range notReady {
+					s.Warningln(fmt.Sprintf("Service %s probably didn't start properly, "+
+						"it's not ready after %s", service, timeout))
+				}
+				return
+			}
+		} else if time.Now().After(deadline) {
+			s.Warningln(fmt.Sprintf("Error checking if the services are ready: %s", err.Error()))
+			return
+		}
+
+		select {
+		case <-time.After(servicesCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-func (s *executor) Prepare(globalConfig *common.Config, config *common.RunnerConfig, build *common.Build) error {
-	err := s.AbstractExecutor.Prepare(globalConfig, config, build)
-	if err != nil {
-		return err
+// activeDeadline returns how long the build pod may run, the configured
+// deadline or the timeout of the build
+func (s *executor) activeDeadline() *int64 {
+	deadline := int64(s.Config.Kubernetes.ActiveDeadlineSeconds)
+	if deadline <= 0 {
+		deadline = int64(s.Build.Timeout)
 	}
+	if deadline <= 0 {
+		deadline = common.DefaultTimeout
+	}
+	return &deadline
+}
 
-	if s.BuildShell.PassFile {
-		return fmt.Errorf("kubernetes doesn't support shells that require script file")
+// checkPodFailure returns a build error instead of err if the build pod
+// was killed by Kubernetes since it exceeded its active deadline or its
+// ephemeral storage limit, or if the container was killed since it ran out of
+// memory
+func (s *executor) checkPodFailure(container string, err error) error {
+	if err == nil {
+		return nil
 	}
 
-	err = build.Options.Decode(&s.options)
-	if err != nil {
+	pod, getErr := getPod(s.kubeClient, s.pod.Namespace, s.pod.Name)
+	if getErr != nil {
 		return err
 	}
+	if deadlineErr := deadlineExceeded(pod); deadlineErr != nil {
+		return &common.BuildError{Inner: deadlineErr}
+	}
+	if storageErr := ephemeralStorageExceeded(pod); storageErr != nil {
+		return &common.BuildError{Inner: storageErr}
+	}
+	if oomErr := oomKilled(pod, container); oomErr != nil {
+		podFailures.WithLabelValues(podFailureOOMKilled).Inc()
+		return &common.BuildError{Inner: oomErr}
+	}
+	return err
+}
 
-	s.kubeClient, err = getKubeClient(config.Kubernetes)
-	if err != nil {
-		return fmt.Errorf("error connecting to Kubernetes: %s", err.Error())
+// checkServiceAccount verifies that the configured service account exists, a
+// build pod using a missing one is rejected by Kubernetes
+func (s *executor) checkServiceAccount() error {
+	serviceAccount := s.Config.Kubernetes.ServiceAccount
+	if serviceAccount == "" {
+		return nil
 	}
 
-	if s.serviceLimits, err = limits(s.Config.Kubernetes.ServiceCPUs, s.Config.Kubernetes.ServiceMemory); err != nil {
-		return err
+	_, err := s.kubeClient.ServiceAccounts(s.Config.Kubernetes.Namespace).Get(serviceAccount)
+	if kubeerrors.IsNotFound(err) {
+		return fmt.Errorf("service account %q doesn't exist in namespace %s", serviceAccount, s.Config.Kubernetes.Namespace)
 	}
+	// other errors, eg. if the runner isn't allowed to get the service
+	// accounts, don't prevent the build
+	return nil
+}
 
-	if s.buildLimits, err = limits(s.Config.Kubernetes.CPUs, s.Config.Kubernetes.Memory); err != nil {
-		return err
+// checkPodSecurityStandard verifies that the configuration can be honored
+// by the pod security standard enforced on the namespace
+func (s *executor) checkPodSecurityStandard() error {
+	switch s.Config.Kubernetes.PodSecurityStandard {
+	case "":
+		return nil
+	case podSecurityStandardBaseline, podSecurityStandardRestricted:
+	default:
+		return fmt.Errorf("unsupported pod security standard %q, expected %q or %q",
+			s.Config.Kubernetes.PodSecurityStandard, podSecurityStandardBaseline, podSecurityStandardRestricted)
 	}
 
-	if err = s.checkDefaults(); err != nil {
-		return err
+	if s.Config.Kubernetes.Privileged {
+		return fmt.Errorf("privileged containers are not allowed by the %s pod security standard",
+			s.Config.Kubernetes.PodSecurityStandard)
 	}
 
-	s.Println("Using Kubernetes executor with image", s.options.Image, "...")
+	if s.Config.Kubernetes.PodSecurityStandard == podSecurityStandardRestricted {
+		config := s.Config.Kubernetes.PodSecurityContext
+		if config.RunAsNonRoot != nil && !*config.RunAsNonRoot {
+			return fmt.Errorf("containers running as root are not allowed by the %s pod security standard",
+				s.Config.Kubernetes.PodSecurityStandard)
+		}
+		if config.RunAsUser != nil && *config.RunAsUser == 0 {
+			return fmt.Errorf("the root user is not allowed by the %s pod security standard",
+				s.Config.Kubernetes.PodSecurityStandard)
+		}
+	}
+	return nil
+}
+
+// checkPodSecurityContext verifies the user and group IDs of the configured
+// pod security context
+func (s *executor) checkPodSecurityContext() error {
+	config := s.Config.Kubernetes.PodSecurityContext
+	for name, id := range map[string]*int64{
+		"run_as_user":  config.RunAsUser,
+		"run_as_group": config.RunAsGroup,
+		"fs_group":     config.FSGroup,
+	} {
+		if id != nil && *id < 0 {
+			return fmt.Errorf("invalid %s %d of the pod security context, expected a non-negative ID", name, *id)
+		}
+	}
 
+	if config.RunAsNonRoot != nil && *config.RunAsNonRoot && config.RunAsUser != nil && *config.RunAsUser == 0 {
+		return fmt.Errorf("the pod security context runs as user 0 but requires a non-root user")
+	}
 	return nil
 }
 
-func (s *executor) Run(cmd common.ExecutorCommand) error {
-	s.Debugln("Starting Kubernetes command...")
+// getHelperImage returns the image of the helper container. The build can
+// override it with the KUBERNETES_HELPER_IMAGE variable, if the requested
+// image is allowed by the configuration
+func (s *executor) getHelperImage() (string, error) {
+	helperImage := s.Config.Kubernetes.HelperImage
+	if helperImage == "" {
+		helperImage = defaultHelperImage
+	}
 
-	if s.pod == nil {
-		err := s.setupBuildPod()
+	requested := s.Build.GetAllVariables().Get("KUBERNETES_HELPER_IMAGE")
+	if requested == "" || requested == helperImage {
+		return helperImage, nil
+	}
 
-		if err != nil {
-			return err
+	for _, allowed := range s.Config.Kubernetes.AllowedHelperImages {
+		if ok, _ := filepath.Match(allowed, requested); ok {
+			return requested, nil
 		}
 	}
 
-	containerName := "build"
+	return "", fmt.Errorf("helper image %q is not present on list of allowed helper images: %s",
+		requested, strings.Join(s.Config.Kubernetes.AllowedHelperImages, ", "))
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	select {
-	case err := <-s.runInContainer(ctx, containerName, cmd.Script):
-		if err != nil && strings.Contains(err.Error(), "executing in Docker Container") {
-			return &common.BuildError{Inner: err}
+// imagePullSecrets returns the secrets used to pull the images of the pod, the
+// configured ones followed by the ones requested by the services. The secrets
+// apply to all containers, Kubernetes uses the ones matching the registry of
+// the respective image
+func (s *executor) imagePullSecrets() []string {
+	var secrets []string
+	seen := make(map[string]bool)
+	add := func(secret string) {
+		if !seen[secret] {
+			seen[secret] = true
+			secrets = append(secrets, secret)
+		}
+	}
+
+	for _, secret := range s.Config.Kubernetes.ImagePullSecrets {
+		add(secret)
+	}
+	for _, service := range s.options.Services {
+		for _, secret := range service.PullSecrets {
+			add(secret)
 		}
-		return err
-	case <-cmd.Abort:
-		cancel()
-		return fmt.Errorf("build aborted")
 	}
+	return secrets
 }
 
-func (s *executor) Cleanup() {
-	if s.pod != nil {
-		err := s.kubeClient.Pods(s.pod.Namespace).Delete(s.pod.Name, nil)
-		if err != nil {
-			s.Errorln(fmt.Sprintf("Error cleaning up pod: %s", err.Error()))
+// checkImagePullSecrets verifies that the services only request the allowed
+// pull secrets, and that all pull secrets exist, so the build fails early
+// instead of waiting for the images which can't be pulled
+func (s *executor) checkImagePullSecrets() error {
+	for _, service := range s.options.Services {
+		for _, secret := range service.PullSecrets {
+			if !s.isAllowedImagePullSecret(secret) {
+				return fmt.Errorf("image pull secret %q of service %s is not present on list of allowed image pull secrets: %s",
+					secret, service.Name, strings.Join(s.Config.Kubernetes.AllowedImagePullSecrets, ", "))
+			}
 		}
 	}
-	closeKubeClient(s.kubeClient)
-	s.AbstractExecutor.Cleanup()
+
+	for _, secret := range s.imagePullSecrets() {
+		_, err := s.kubeClient.Secrets(s.Config.Kubernetes.Namespace).Get(secret)
+		if kubeerrors.IsNotFound(err) {
+			return fmt.Errorf("image pull secret %q doesn't exist in namespace %s", secret, s.Config.Kubernetes.Namespace)
+		}
+		// other errors, eg. if the runner isn't allowed to get the secrets,
+		// don't prevent the build, Kubernetes reports the missing secrets
+	}
+	return nil
 }
 
-func (s *executor) buildContainer(name, image string, limits api.ResourceList, command ...string) api.Container {
-	path := strings.Split(s.Build.BuildDir, "/")
-	path = path[:len(path)-1]
+// getEnvFrom returns the envFrom of the build container: the configured
+// secrets and config maps, and the ones requested by the build with the
+// KUBERNETES_ENV_FROM variable, as a comma separated list of secret/NAME and
+// config_map/NAME, if they're allowed by the configuration. The secrets and
+// config maps which aren't optional must exist, so the build fails early
+// instead of waiting for the build container which can't be started
+func (s *executor) getEnvFrom() ([]interface{}, error) {
+	refs := append([]common.KubernetesEnvFrom{}, s.Config.Kubernetes.EnvFrom...)
+	for _, requested := range strings.Split(s.Build.GetAllVariables().Get("KUBERNETES_ENV_FROM"), ",") {
+		requested = strings.TrimSpace(requested)
+		if requested == "" {
+			continue
+		}
+		if !s.isAllowedEnvFrom(requested) {
+			return nil, fmt.Errorf("env from %q is not present on list of allowed env from: %s",
+				requested, strings.Join(s.Config.Kubernetes.AllowedEnvFrom, ", "))
+		}
 
-	privileged := false
-	if s.Config.Kubernetes != nil {
-		privileged = s.Config.Kubernetes.Privileged
+		switch kind, name := path.Split(requested); kind {
+		case "secret/":
+			refs = append(refs, common.KubernetesEnvFrom{Secret: name})
+		case "config_map/":
+			refs = append(refs, common.KubernetesEnvFrom{ConfigMap: name})
+		default:
+			return nil, fmt.Errorf("invalid env from %q, expected secret/NAME or config_map/NAME", requested)
+		}
 	}
 
-	return api.Container{
-		Name:    name,
-		Image:   image,
-		Command: command,
-		Env:     buildVariables(s.Build.GetAllVariables().PublicOrInternal()),
-		Resources: api.ResourceRequirements{
-			Limits: limits,
-		},
-		VolumeMounts: []api.VolumeMount{
-			api.VolumeMount{
-				Name:      "repo",
-				MountPath: strings.Join(path, "/"),
-			},
-		},
-		SecurityContext: &api.SecurityContext{
-			Privileged: &privileged,
-		},
-		Stdin: true,
+	var envFrom []interface{}
+	for _, ref := range refs {
+		if (ref.Secret == "") == (ref.ConfigMap == "") {
+			return nil, fmt.Errorf("env from needs either a secret or a config map")
+		}
+		if ref.Prefix != "" && !validation.IsCIdentifier(ref.Prefix) {
+			return nil, fmt.Errorf("invalid env from prefix %q, it must be a valid variable name", ref.Prefix)
+		}
+
+		source := map[string]interface{}{}
+		if ref.Prefix != "" {
+			source["prefix"] = ref.Prefix
+		}
+
+		var err error
+		namespace := s.Config.Kubernetes.Namespace
+		if ref.Secret != "" {
+			source["secretRef"] = map[string]interface{}{"name": ref.Secret, "optional": ref.Optional}
+			if !ref.Optional {
+				_, err = s.kubeClient.Secrets(namespace).Get(ref.Secret)
+			}
+		} else {
+			source["configMapRef"] = map[string]interface{}{"name": ref.ConfigMap, "optional": ref.Optional}
+			if !ref.Optional {
+				_, err = s.kubeClient.ConfigMaps(namespace).Get(ref.ConfigMap)
+			}
+		}
+		if kubeerrors.IsNotFound(err) {
+			return nil, fmt.Errorf("env from %s%s doesn't exist in namespace %s", ref.Secret, ref.ConfigMap, namespace)
+		}
+		// other errors, eg. if the runner isn't allowed to get the secrets,
+		// don't prevent the build, Kubernetes reports the missing references
+
+		envFrom = append(envFrom, source)
 	}
+	return envFrom, nil
 }
 
-func (s *executor) setupBuildPod() error {
-	services := make([]api.Container, len(s.options.Services))
-	for i, image := range s.options.Services {
-		resolvedImage := s.Build.GetAllVariables().ExpandValue(image)
-		services[i] = s.buildContainer(fmt.Sprintf("svc-%d", i), resolvedImage, s.serviceLimits)
+func (s *executor) isAllowedEnvFrom(ref string) bool {
+	for _, allowed := range s.Config.Kubernetes.AllowedEnvFrom {
+		if ok, _ := filepath.Match(allowed, ref); ok {
+			return true
+		}
 	}
+	return false
+}
 
-	buildImage := s.Build.GetAllVariables().ExpandValue(s.options.Image)
-	pod, err := s.kubeClient.Pods(s.Config.Kubernetes.Namespace).Create(&api.Pod{
-		ObjectMeta: api.ObjectMeta{
-			GenerateName: s.Build.ProjectUniqueName(),
-			Namespace:    s.Config.Kubernetes.Namespace,
-		},
-		Spec: api.PodSpec{
-			Volumes: []api.Volume{
-				api.Volume{
-					Name: "repo",
-					VolumeSource: api.VolumeSource{
-						EmptyDir: &api.EmptyDirVolumeSource{},
-					},
-				},
-			},
-			RestartPolicy: api.RestartPolicyNever,
-			Containers: append([]api.Container{
-				s.buildContainer("build", buildImage, s.buildLimits, s.BuildShell.DockerCommand...),
-			}, services...),
-		},
-	})
+func (s *executor) isAllowedImagePullSecret(secret string) bool {
+	for _, allowed := range s.Config.Kubernetes.AllowedImagePullSecrets {
+		if ok, _ := filepath.Match(allowed, secret); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getPriorityClass returns the priority class of the build pod: the
+// configured one, or the one requested by the build with the
+// KUBERNETES_PRIORITY_CLASS variable, if it's allowed by the configuration
+func (s *executor) getPriorityClass() (string, error) {
+	priorityClass := s.Config.Kubernetes.PriorityClassName
+	if requested := s.Build.GetAllVariables().Get("KUBERNETES_PRIORITY_CLASS"); requested != "" && requested != priorityClass {
+		if !s.isAllowedPriorityClass(requested) {
+			return "", fmt.Errorf("priority class %q is not present on list of allowed priority classes: %s",
+				requested, strings.Join(s.Config.Kubernetes.AllowedPriorityClasses, ", "))
+		}
+		priorityClass = requested
+	}
+
+	if priorityClass == "" {
+		return "", nil
+	}
+	if msgs := validation.IsDNS1123Subdomain(priorityClass); len(msgs) > 0 {
+		return "", fmt.Errorf("invalid priority class %q: %s", priorityClass, strings.Join(msgs, ", "))
+	}
+	return priorityClass, nil
+}
+
+func (s *executor) isAllowedPriorityClass(priorityClass string) bool {
+	for _, allowed := range s.Config.Kubernetes.AllowedPriorityClasses {
+		if ok, _ := filepath.Match(allowed, priorityClass); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getNodeSelector returns the node selector of the build pod: the configured
+// one, updated with the node labels of the node pool requested with the
+// KUBERNETES_NODE_POOL variable and with the labels requested with the
+// KUBERNETES_NODE_SELECTOR variable. Only the node pools defined in the
+// configuration and the allowed labels can be requested
+func (s *executor) getNodeSelector() (map[string]string, error) {
+	nodeSelector := make(map[string]string)
+	for key, value := range s.Config.Kubernetes.NodeSelector {
+		nodeSelector[key] = value
+	}
 
+	if nodePool := s.Build.GetAllVariables().Get("KUBERNETES_NODE_POOL"); nodePool != "" {
+		labels, ok := s.Config.Kubernetes.NodePools[nodePool]
+		if !ok {
+			var nodePools []string
+			for name := range s.Config.Kubernetes.NodePools {
+				nodePools = append(nodePools, name)
+			}
+			sort.Strings(nodePools)
+
+			return nil, fmt.Errorf("node pool %q is not present on list of node pools: %s",
+				nodePool, strings.Join(nodePools, ", "))
+		}
+
+		for key, value := range labels {
+			nodeSelector[key] = value
+		}
+	}
+
+	labels, err := parseNodeSelector(s.Build.GetAllVariables().Get("KUBERNETES_NODE_SELECTOR"))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	for key, value := range labels {
+		if !s.isAllowedNodeSelector(key, value) {
+			return nil, fmt.Errorf("node selector %q is not present on list of allowed node selectors: %s",
+				key+"="+value, strings.Join(s.Config.Kubernetes.AllowedNodeSelectors, ", "))
+		}
+		nodeSelector[key] = value
 	}
 
-	s.pod = pod
+	if len(nodeSelector) == 0 {
+		return nil, nil
+	}
+	return nodeSelector, nil
+}
 
-	return nil
+// getHostNetwork returns whether the build pod uses the network namespace of
+// its node, as configured or requested with the KUBERNETES_HOST_NETWORK
+// variable. It needs to be allowed, and the DNS policy needs to resolve the
+// names of the cluster from the host network
+func (s *executor) getHostNetwork() (bool, error) {
+	hostNetwork := s.Config.Kubernetes.HostNetwork
+	if requested := s.Build.GetAllVariables().Get("KUBERNETES_HOST_NETWORK"); requested != "" {
+		var err error
+		if hostNetwork, err = strconv.ParseBool(requested); err != nil {
+			return false, fmt.Errorf("invalid KUBERNETES_HOST_NETWORK %q, expected true or false", requested)
+		}
+	}
+	if !hostNetwork {
+		return false, nil
+	}
+
+	if !s.Config.Kubernetes.AllowHostNetwork {
+		return false, fmt.Errorf("the host network is not allowed, it needs to be enabled with allow_host_network")
+	}
+
+	if standard := s.Config.Kubernetes.PodSecurityStandard; standard != "" {
+		return false, fmt.Errorf("the host network is not allowed by the %s pod security standard", standard)
+	}
+
+	switch api.DNSPolicy(s.Config.Kubernetes.DNSPolicy) {
+	case dnsPolicyClusterFirstWithHostNet, api.DNSDefault, dnsPolicyNone:
+	default:
+		return false, fmt.Errorf("the host network requires the %q DNS policy to resolve the cluster services",
+			dnsPolicyClusterFirstWithHostNet)
+	}
+	return true, nil
 }
 
-func (s *executor) runInContainer(ctx context.Context, name, command string) <-chan error {
-	errc := make(chan error, 1)
-	go func() {
-		defer close(errc)
+func (s *executor) isAllowedNodeSelector(key, value string) bool {
+	for _, allowed := range s.Config.Kubernetes.AllowedNodeSelectors {
+		if ok, _ := filepath.Match(allowed, key+"="+value); ok {
+			return true
+		}
+	}
+	return false
+}
 
-		status, err := waitForPodRunning(ctx, s.kubeClient, s.pod, s.BuildTrace)
+// checkShell verifies that the build scripts can be run with shell in the
+// containers
+func checkShell(shell string) error {
+	switch shell {
+	case "bash", "sh", "powershell":
+		return nil
+	default:
+		return fmt.Errorf("unsupported shell %q, it needs to be bash, sh or powershell", shell)
+	}
+}
 
-		if err != nil {
-			errc <- err
-			return
+// checkShellFlags verifies that the shell flags are only options of the
+// set builtin, since they are added to the build scripts
+func (s *executor) checkShellFlags() error {
+	for _, flag := range s.Config.Kubernetes.ShellFlags {
+		if !shellFlagRegexp.MatchString(flag) {
+			return fmt.Errorf("invalid shell flag %q", flag)
 		}
+	}
+	return nil
+}
 
-		if status != api.PodRunning {
-			errc <- fmt.Errorf("pod failed to enter running state: %s", status)
-			return
+// serviceHostnames returns the hostnames of the services, which are resolved
+// to localhost since all containers of the pod share its network. Hostnames
+// which are invalid or already used by a previous service are skipped
+func (s *executor) serviceHostnames() []string {
+	variables := s.Build.GetAllVariables()
+	used := make(map[string]bool)
+
+	var hostnames []string
+	for _, service := range s.options.Services {
+		for _, alias := range service.aliases(variables) {
+			if used[alias] || len(validation.IsDNS1123Subdomain(alias)) > 0 {
+				continue
+			}
+			used[alias] = true
+			hostnames = append(hostnames, alias)
 		}
+	}
+	return hostnames
+}
 
-		config, err := getKubeClientConfig(s.Config.Kubernetes)
+// buildHostAliases returns the entries of /etc/hosts of the pod: the
+// hostnames of the services resolving to localhost, followed by the
+// configured ones
+func (s *executor) buildHostAliases() []interface{} {
+	var hostAliases []interface{}
+	if hostnames := s.serviceHostnames(); len(hostnames) > 0 {
+		hostAliases = append(hostAliases, map[string]interface{}{
+			"ip":        "127.0.0.1",
+			"hostnames": hostnames,
+		})
+	}
 
-		if err != nil {
-			errc <- err
-			return
+	for _, hostAlias := range s.Config.Kubernetes.HostAliases {
+		hostAliases = append(hostAliases, map[string]interface{}{
+			"ip":        hostAlias.IP,
+			"hostnames": hostAlias.Hostnames,
+		})
+	}
+	return hostAliases
+}
+
+// checkHostAliases verifies the IP addresses and hostnames of the configured
+// host aliases
+func (s *executor) checkHostAliases() error {
+	for _, hostAlias := range s.Config.Kubernetes.HostAliases {
+		if net.ParseIP(hostAlias.IP) == nil {
+			return fmt.Errorf("invalid IP address %q of the host aliases", hostAlias.IP)
+		}
+		if len(hostAlias.Hostnames) == 0 {
+			return fmt.Errorf("no hostnames specified for the host alias %s", hostAlias.IP)
+		}
+		for _, hostname := range hostAlias.Hostnames {
+			if msgs := validation.IsDNS1123Subdomain(hostname); len(msgs) > 0 {
+				return fmt.Errorf("invalid hostname %q of the host alias %s: %s", hostname, hostAlias.IP, strings.Join(msgs, ", "))
+			}
 		}
+	}
+	return nil
+}
 
-		exec := ExecOptions{
-			PodName:       s.pod.Name,
-			Namespace:     s.pod.Namespace,
-			ContainerName: name,
-			Command:       s.BuildShell.DockerCommand,
-			In:            strings.NewReader(command),
-			Out:           s.BuildTrace,
-			Err:           s.BuildTrace,
-			Stdin:         true,
-			Config:        config,
-			Client:        s.kubeClient,
-			Executor:      &DefaultRemoteExecutor{},
+// checkServiceAliases verifies that the aliases of the services are valid
+// hostnames and that no two services use the same alias
+func (s *executor) checkServiceAliases() error {
+	variables := s.Build.GetAllVariables()
+	declared := make(map[string]int)
+	for i, service := range s.options.Services {
+		if service.Alias == "" {
+			continue
 		}
 
-		errc <- exec.Run()
-	}()
+		alias := service.aliases(variables)[0]
+		if msgs := validation.IsDNS1123Subdomain(alias); len(msgs) > 0 {
+			return fmt.Errorf("invalid alias %q of service svc-%d (%s): %s", alias, i, service.Name, strings.Join(msgs, ", "))
+		}
+		if other, ok := declared[alias]; ok {
+			return fmt.Errorf("services svc-%d (%s) and svc-%d (%s) both use the alias %s",
+				other, s.options.Services[other].Name, i, service.Name, alias)
+		}
+		declared[alias] = i
+	}
+	return nil
+}
 
-	return errc
+// checkServicePorts verifies that no two services declare the same port,
+// since all containers of the pod share its network namespace
+func (s *executor) checkServicePorts() error {
+	declared := make(map[int32]int)
+	for i, service := range s.options.Services {
+		for _, port := range service.Ports {
+			if other, ok := declared[port]; ok && other != i {
+				return fmt.Errorf("services svc-%d (%s) and svc-%d (%s) both declare port %d, but share the pod network",
+					other, s.options.Services[other].Name, i, service.Name, port)
+			}
+			declared[port] = i
+		}
+	}
+	return nil
 }
 
 func (s *executor) checkDefaults() error {
@@ -237,10 +2947,100 @@ func (s *executor) checkDefaults() error {
 		s.options.Image = s.Config.Kubernetes.Image
 	}
 
+	if s.Config.Kubernetes.NamespacePerBuild {
+		// the namespace of the build is set on a copy of the configuration,
+		// which is shared by the builds of the runner
+		config := *s.Config.Kubernetes
+		config.Namespace = s.buildNamespace()
+		s.Config.Kubernetes = &config
+	}
+
 	if s.Config.Kubernetes.Namespace == "" {
 		s.Config.Kubernetes.Namespace = "default"
 	}
 
+	switch api.PullPolicy(s.Config.Kubernetes.PullPolicy) {
+	case "", api.PullAlways, api.PullIfNotPresent, api.PullNever:
+	default:
+		return fmt.Errorf("unsupported pull policy %q, expected %q, %q or %q",
+			s.Config.Kubernetes.PullPolicy, api.PullAlways, api.PullIfNotPresent, api.PullNever)
+	}
+
+	if s.Config.Kubernetes.ActiveDeadlineSeconds < 0 {
+		return fmt.Errorf("invalid active deadline %d, expected a non-negative number of seconds", s.Config.Kubernetes.ActiveDeadlineSeconds)
+	}
+
+	if s.Config.Kubernetes.PollInterval < 0 {
+		return fmt.Errorf("invalid poll interval %d, expected a non-negative number of seconds", s.Config.Kubernetes.PollInterval)
+	}
+
+	if s.Config.Kubernetes.ExecTimeout < 0 {
+		return fmt.Errorf("invalid exec timeout %d, expected a non-negative number of seconds", s.Config.Kubernetes.ExecTimeout)
+	}
+
+	if mountPath := s.Config.Kubernetes.WorkspaceMountPath; mountPath != "" {
+		buildDir := path.Clean(s.Build.BuildDir)
+		if !path.IsAbs(mountPath) || path.Clean(mountPath) == "/" {
+			return fmt.Errorf("invalid workspace mount path %q, expected an absolute path other than /", mountPath)
+		}
+		if mountPath = path.Clean(mountPath); buildDir != mountPath && !strings.HasPrefix(buildDir, mountPath+"/") {
+			return fmt.Errorf("the workspace mount path %q doesn't contain the build directory %q", mountPath, buildDir)
+		}
+	}
+
+	if s.Config.Kubernetes.ExecKeepalive < 0 {
+		return fmt.Errorf("invalid exec keepalive %d, expected a non-negative number of seconds", s.Config.Kubernetes.ExecKeepalive)
+	}
+
+	if s.Config.Kubernetes.ExecReconnects < 0 {
+		return fmt.Errorf("invalid exec reconnects %d, expected a non-negative number", s.Config.Kubernetes.ExecReconnects)
+	}
+
+	if s.Config.Kubernetes.PollTimeout < 0 {
+		return fmt.Errorf("invalid poll timeout %d, expected a non-negative number of seconds", s.Config.Kubernetes.PollTimeout)
+	}
+
+	if gracePeriod := s.Config.Kubernetes.TerminationGracePeriodSeconds; gracePeriod != nil && *gracePeriod < 0 {
+		return fmt.Errorf("invalid termination grace period %d, expected a non-negative number of seconds", *gracePeriod)
+	}
+
+	switch api.RestartPolicy(s.Config.Kubernetes.RestartPolicy) {
+	case "", api.RestartPolicyNever, api.RestartPolicyOnFailure, api.RestartPolicyAlways:
+	default:
+		return fmt.Errorf("unsupported restart policy %q, expected %q, %q or %q", s.Config.Kubernetes.RestartPolicy,
+			api.RestartPolicyNever, api.RestartPolicyOnFailure, api.RestartPolicyAlways)
+	}
+
+	if s.Config.Kubernetes.RunAsJob && s.restartPolicy() == api.RestartPolicyAlways {
+		return fmt.Errorf("the restart policy %q isn't supported by jobs", api.RestartPolicyAlways)
+	}
+
+	if owner := s.Config.Kubernetes.PodOwner; owner != nil && (owner.Kind == "" || owner.Name == "" || owner.UID == "") {
+		return fmt.Errorf("the pod owner needs a kind, a name and a uid")
+	}
+
+	if prefix := s.Config.Kubernetes.PodNamePrefix; prefix != "" {
+		if len(prefix) > podNamePrefixMaxLength || len(validation.IsDNS1123Label(prefix)) > 0 {
+			return fmt.Errorf("invalid pod name prefix %q, expected at most %d lowercase alphanumeric characters or '-'", prefix, podNamePrefixMaxLength)
+		}
+	}
+
+	switch api.DNSPolicy(s.Config.Kubernetes.DNSPolicy) {
+	case "", api.DNSClusterFirst, dnsPolicyClusterFirstWithHostNet, api.DNSDefault, dnsPolicyNone:
+	default:
+		return fmt.Errorf("unsupported DNS policy %q, expected %q, %q, %q or %q", s.Config.Kubernetes.DNSPolicy,
+			api.DNSClusterFirst, dnsPolicyClusterFirstWithHostNet, api.DNSDefault, dnsPolicyNone)
+	}
+
+	// the configuration is shared by the builds of the runner, an empty
+	// policy adopts the existing pods
+	switch s.Config.Kubernetes.ExistingPodPolicy {
+	case "", existingPodPolicyAdopt, existingPodPolicyFail:
+	default:
+		return fmt.Errorf("unsupported existing pod policy %q, expected %q or %q",
+			s.Config.Kubernetes.ExistingPodPolicy, existingPodPolicyAdopt, existingPodPolicyFail)
+	}
+
 	return nil
 }
 
@@ -260,9 +3060,38 @@ func featuresFn(features *common.FeaturesInfo) {
 	features.Cache = true
 }
 
+// CollectGarbage deletes the orphaned pods of the runner in its namespace,
+// see collectOrphanedPods. The namespaces of the builds aren't looked into
+func (p executorProvider) CollectGarbage(config *common.RunnerConfig) error {
+	if config.Kubernetes == nil || config.Kubernetes.OrphanedPodsTimeout <= 0 || config.Kubernetes.NamespacePerBuild {
+		return nil
+	}
+
+	// the namespace defaults like in checkDefaults, without modifying the
+	// shared configuration
+	kubernetes := *config.Kubernetes
+	if kubernetes.Namespace == "" {
+		kubernetes.Namespace = "default"
+	}
+
+	kubeClient, err := getKubeClient(config.Token, &kubernetes)
+	if err != nil {
+		return fmt.Errorf("error connecting to Kubernetes: %s", err.Error())
+	}
+
+	deleted, err := collectOrphanedPods(kubeClient, &kubernetes, config.ShortDescription())
+	if deleted > 0 {
+		logrus.WithField("runner", config.ShortDescription()).
+			Println(fmt.Sprintf("Deleted %d orphaned pods of the runner in namespace %s", deleted, kubernetes.Namespace))
+	}
+	return err
+}
+
 func init() {
-	common.RegisterExecutor("kubernetes", executors.DefaultExecutorProvider{
-		Creator:         createFn,
-		FeaturesUpdater: featuresFn,
+	common.RegisterExecutor("kubernetes", executorProvider{
+		DefaultExecutorProvider: executors.DefaultExecutorProvider{
+			Creator:         createFn,
+			FeaturesUpdater: featuresFn,
+		},
 	})
 }
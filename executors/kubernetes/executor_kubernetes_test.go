@@ -1,17 +1,26 @@
 package kubernetes
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 
 	"k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/api/resource"
@@ -20,10 +29,13 @@ import (
 	"k8s.io/kubernetes/pkg/client/restclient"
 	client "k8s.io/kubernetes/pkg/client/unversioned"
 	"k8s.io/kubernetes/pkg/client/unversioned/fake"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/validation"
 
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/executors"
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/helpers"
+	_ "gitlab.com/gitlab-org/gitlab-ci-multi-runner/shells"
 )
 
 var (
@@ -32,36 +44,52 @@ var (
 
 func TestLimits(t *testing.T) {
 	tests := []struct {
-		CPU, Memory string
-		Expected    api.ResourceList
+		CPU, Memory, EphemeralStorage string
+		Expected                      api.ResourceList
+		Error                         bool
 	}{
 		{
 			CPU:    "100m",
 			Memory: "100Mi",
 			Expected: api.ResourceList{
-				api.ResourceLimitsCPU:    resource.MustParse("100m"),
-				api.ResourceLimitsMemory: resource.MustParse("100Mi"),
+				api.ResourceCPU:    resource.MustParse("100m"),
+				api.ResourceMemory: resource.MustParse("100Mi"),
 			},
 		},
 		{
 			CPU: "100m",
 			Expected: api.ResourceList{
-				api.ResourceLimitsCPU: resource.MustParse("100m"),
+				api.ResourceCPU: resource.MustParse("100m"),
 			},
 		},
 		{
 			Memory: "100Mi",
 			Expected: api.ResourceList{
-				api.ResourceLimitsMemory: resource.MustParse("100Mi"),
+				api.ResourceMemory: resource.MustParse("100Mi"),
+			},
+		},
+		{
+			Memory:           "1Gi",
+			EphemeralStorage: "10Gi",
+			Expected: api.ResourceList{
+				api.ResourceMemory:       resource.MustParse("1Gi"),
+				resourceEphemeralStorage: resource.MustParse("10Gi"),
 			},
 		},
 		{
 			CPU:      "100j",
 			Expected: api.ResourceList{},
+			Error:    true,
 		},
 		{
 			Memory:   "100j",
 			Expected: api.ResourceList{},
+			Error:    true,
+		},
+		{
+			EphemeralStorage: "100j",
+			Expected:         api.ResourceList{},
+			Error:            true,
 		},
 		{
 			Expected: api.ResourceList{},
@@ -69,11 +97,187 @@ func TestLimits(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		res, _ := limits(test.CPU, test.Memory)
+		res, err := limits(test.CPU, test.Memory, test.EphemeralStorage)
+		if test.Error {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
 		assert.Equal(t, test.Expected, res)
 	}
 }
 
+func TestRequests(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{})
+	limits := api.ResourceList{
+		api.ResourceCPU:    resource.MustParse("1"),
+		api.ResourceMemory: resource.MustParse("1Gi"),
+	}
+
+	requests, err := ex.requests("", "", "", limits)
+	require.NoError(t, err)
+	assert.Equal(t, limits, requests)
+
+	requests, err = ex.requests("500m", "", "", limits)
+	require.NoError(t, err)
+	assert.Equal(t, api.ResourceList{
+		api.ResourceCPU:    resource.MustParse("500m"),
+		api.ResourceMemory: resource.MustParse("1Gi"),
+	}, requests)
+
+	requests, err = ex.requests("", "256Mi", "", api.ResourceList{})
+	require.NoError(t, err)
+	assert.Equal(t, api.ResourceList{
+		api.ResourceMemory: resource.MustParse("256Mi"),
+	}, requests)
+
+	_, err = ex.requests("2", "", "", limits)
+	assert.Error(t, err)
+
+	limits[resourceEphemeralStorage] = resource.MustParse("10Gi")
+	requests, err = ex.requests("", "", "2Gi", limits)
+	require.NoError(t, err)
+	assert.Equal(t, api.ResourceList{
+		api.ResourceCPU:          resource.MustParse("1"),
+		api.ResourceMemory:       resource.MustParse("1Gi"),
+		resourceEphemeralStorage: resource.MustParse("2Gi"),
+	}, requests)
+
+	_, err = ex.requests("", "", "20Gi", limits)
+	assert.Error(t, err)
+}
+
+func TestBuildPodRequests(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{
+		Image:    "test-image",
+		Services: []kubernetesService{{Name: "test-service"}},
+	})
+	ex.buildLimits = api.ResourceList{api.ResourceCPU: resource.MustParse("2")}
+	ex.buildRequests = api.ResourceList{api.ResourceCPU: resource.MustParse("1")}
+	ex.serviceLimits = api.ResourceList{api.ResourceMemory: resource.MustParse("1Gi")}
+	ex.serviceRequests = api.ResourceList{api.ResourceMemory: resource.MustParse("512Mi")}
+	ex.helperLimits = api.ResourceList{api.ResourceCPU: resource.MustParse("500m")}
+	ex.helperRequests = api.ResourceList{api.ResourceCPU: resource.MustParse("500m")}
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(pod.Spec.Containers))
+	assert.Equal(t, ex.buildLimits, pod.Spec.Containers[0].Resources.Limits)
+	assert.Equal(t, ex.buildRequests, pod.Spec.Containers[0].Resources.Requests)
+	assert.Equal(t, "pre", pod.Spec.Containers[1].Name)
+	assert.Equal(t, ex.helperLimits, pod.Spec.Containers[1].Resources.Limits)
+	assert.Equal(t, ex.helperRequests, pod.Spec.Containers[1].Resources.Requests)
+	for _, container := range pod.Spec.Containers[2:] {
+		assert.Equal(t, ex.serviceLimits, container.Resources.Limits, container.Name)
+		assert.Equal(t, ex.serviceRequests, container.Resources.Requests, container.Name)
+	}
+}
+
+func TestServiceContainerRequests(t *testing.T) {
+	tests := []struct {
+		ServiceCPURequest    string
+		ServiceMemoryRequest string
+		Expected             api.ResourceList
+	}{
+		{
+			Expected: api.ResourceList{
+				api.ResourceCPU:    resource.MustParse("0.5"),
+				api.ResourceMemory: resource.MustParse("200Mi"),
+			},
+		},
+		{
+			ServiceCPURequest: "0.25",
+			Expected: api.ResourceList{
+				api.ResourceCPU:    resource.MustParse("0.25"),
+				api.ResourceMemory: resource.MustParse("200Mi"),
+			},
+		},
+		{
+			ServiceCPURequest:    "0.1",
+			ServiceMemoryRequest: "64Mi",
+			Expected: api.ResourceList{
+				api.ResourceCPU:    resource.MustParse("0.1"),
+				api.ResourceMemory: resource.MustParse("64Mi"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		e := &executor{
+			AbstractExecutor: executors.AbstractExecutor{
+				ExecutorOptions: executorOptions,
+			},
+		}
+
+		err := e.Prepare(&common.Config{}, &common.RunnerConfig{
+			RunnerSettings: common.RunnerSettings{
+				Kubernetes: &common.KubernetesConfig{
+					Host:                 "test-server",
+					CPUs:                 "1.5",
+					Memory:               "4Gi",
+					ServiceCPUs:          "0.5",
+					ServiceMemory:        "200Mi",
+					ServiceCPURequest:    test.ServiceCPURequest,
+					ServiceMemoryRequest: test.ServiceMemoryRequest,
+				},
+			},
+		}, &common.Build{
+			GetBuildResponse: common.GetBuildResponse{
+				Sha: "1234567890",
+				Options: common.BuildOptions{
+					"image":    "test-image",
+					"services": []interface{}{"postgres:9.6"},
+				},
+			},
+			Runner: &common.RunnerConfig{},
+		})
+		require.NoError(t, err)
+
+		pod, err := e.buildPod()
+		require.NoError(t, err)
+		var services int
+		for _, container := range pod.Spec.Containers {
+			if !strings.HasPrefix(container.Name, "svc-") {
+				continue
+			}
+			services++
+			assert.Equal(t, e.serviceLimits, container.Resources.Limits, container.Name)
+			assert.Equal(t, test.Expected, container.Resources.Requests, container.Name)
+		}
+		assert.Equal(t, 1, services)
+	}
+}
+
+func TestBuildPodOwnerReferences(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Nil(t, pod.OwnerReferences)
+
+	ex.Config.Kubernetes.PodOwner = &common.KubernetesOwnerReference{
+		Kind: "ConfigMap",
+		Name: "gitlab-runner",
+		UID:  "f2c5b7a4-6b1e-11e6-8b77-86f30ca893d3",
+	}
+	pod, err = ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, []api.OwnerReference{{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       "gitlab-runner",
+		UID:        "f2c5b7a4-6b1e-11e6-8b77-86f30ca893d3",
+	}}, pod.OwnerReferences)
+
+	ex.Config.Kubernetes.PodOwner.APIVersion = "apps/v1"
+	pod, err = ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, "apps/v1", pod.OwnerReferences[0].APIVersion)
+	assert.NoError(t, ex.checkDefaults())
+
+	ex.Config.Kubernetes.PodOwner.UID = ""
+	assert.Error(t, ex.checkDefaults())
+}
+
 func TestCleanup(t *testing.T) {
 	version := testapi.Default.GroupVersion().Version
 	codec := testapi.Default.Codec()
@@ -151,126 +355,4108 @@ func TestCleanup(t *testing.T) {
 	}
 }
 
-func TestPrepare(t *testing.T) {
-	tests := []struct {
-		GlobalConfig *common.Config
-		RunnerConfig *common.RunnerConfig
-		Build        *common.Build
+func TestCleanupGracePeriod(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	immediately := int64(0)
 
-		Expected *executor
-		Error    bool
-	}{
-		{
-			GlobalConfig: &common.Config{},
-			RunnerConfig: &common.RunnerConfig{
-				RunnerSettings: common.RunnerSettings{
-					Kubernetes: &common.KubernetesConfig{
-						Host:          "test-server",
-						ServiceCPUs:   "0.5",
-						ServiceMemory: "200Mi",
-						CPUs:          "1.5",
-						Memory:        "4Gi",
-						Privileged:    true,
-					},
-				},
-			},
-			Build: &common.Build{
-				GetBuildResponse: common.GetBuildResponse{
-					Sha: "1234567890",
-					Options: common.BuildOptions{
-						"image": "test-image",
-					},
-					Variables: []common.BuildVariable{
-						common.BuildVariable{Key: "privileged", Value: "true"},
-					},
-				},
-				Runner: &common.RunnerConfig{},
-			},
-			Expected: &executor{
-				options: &kubernetesOptions{
-					Image: "test-image",
-				},
-				serviceLimits: api.ResourceList{
-					api.ResourceLimitsCPU:    resource.MustParse("0.5"),
-					api.ResourceLimitsMemory: resource.MustParse("200Mi"),
-				},
-				buildLimits: api.ResourceList{
-					api.ResourceLimitsCPU:    resource.MustParse("1.5"),
-					api.ResourceLimitsMemory: resource.MustParse("4Gi"),
-				},
-			},
-		},
-		{
-			GlobalConfig: &common.Config{},
-			RunnerConfig: &common.RunnerConfig{
-				RunnerSettings: common.RunnerSettings{
-					Kubernetes: &common.KubernetesConfig{
-						Host:          "test-server",
-						ServiceCPUs:   "0.5",
-						ServiceMemory: "200Mi",
-						CPUs:          "1.5",
-						Memory:        "4Gi",
-						Privileged:    false,
-					},
-				},
-			},
-			Build: &common.Build{
-				GetBuildResponse: common.GetBuildResponse{
-					Sha: "1234567890",
-					Options: common.BuildOptions{
-						"image": "test-image",
-					},
-				},
-				Runner: &common.RunnerConfig{},
-			},
-			Expected: &executor{
-				options: &kubernetesOptions{
-					Image: "test-image",
-				},
-				serviceLimits: api.ResourceList{
-					api.ResourceLimitsCPU:    resource.MustParse("0.5"),
-					api.ResourceLimitsMemory: resource.MustParse("200Mi"),
-				},
-				buildLimits: api.ResourceList{
-					api.ResourceLimitsCPU:    resource.MustParse("1.5"),
-					api.ResourceLimitsMemory: resource.MustParse("4Gi"),
-				},
+	for _, gracePeriod := range []*int64{nil, &immediately} {
+		var deleteOptions *api.DeleteOptions
+		ex := newPodTestExecutor(&common.KubernetesConfig{TerminationGracePeriodSeconds: gracePeriod}, &kubernetesOptions{})
+		ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+			switch p, m := req.URL.Path, req.Method; {
+			case m == "DELETE" && p == "/api/"+version+"/namespaces/test-ns/pods/test-pod":
+				if req.Body != nil {
+					body, err := ioutil.ReadAll(req.Body)
+					require.NoError(t, err)
+					deleteOptions = &api.DeleteOptions{}
+					require.NoError(t, json.Unmarshal(body, deleteOptions))
+				}
+				return &http.Response{StatusCode: 200, Body: FakeReadCloser{Reader: strings.NewReader("")}}, nil
+			default:
+				return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+			}
+		})
+		ex.pod = &api.Pod{ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"}}
+		ex.Cleanup()
+
+		if gracePeriod == nil {
+			assert.Nil(t, deleteOptions)
+		} else {
+			require.NotNil(t, deleteOptions)
+			assert.Equal(t, gracePeriod, deleteOptions.GracePeriodSeconds)
+		}
+	}
+}
+
+func TestRunAbort(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	pod := &api.Pod{
+		ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"},
+		Status:     api.PodStatus{Phase: api.PodPending},
+	}
+
+	var lock sync.Mutex
+	var deleteOptions *api.DeleteOptions
+	deleted := false
+	ex := newPodTestExecutor(&common.KubernetesConfig{Namespace: "test-ns"}, &kubernetesOptions{Image: "test-image"})
+	ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		switch p, m := req.URL.Path, req.Method; {
+		case m == "GET" && p == "/api/"+version+"/namespaces/test-ns/pods/test-pod" && !deleted:
+			return &http.Response{StatusCode: 200, Body: objBody(codec, pod), Header: map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}}, nil
+		case m == "DELETE" && p == "/api/"+version+"/namespaces/test-ns/pods/test-pod" && !deleted:
+			deleted = true
+			if req.Body != nil {
+				body, err := ioutil.ReadAll(req.Body)
+				require.NoError(t, err)
+				deleteOptions = &api.DeleteOptions{}
+				require.NoError(t, json.Unmarshal(body, deleteOptions))
+			}
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &unversioned.Status{Status: unversioned.StatusSuccess}), Header: map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}}, nil
+		default:
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader("")), Header: map[string][]string{}}, nil
+		}
+	})
+	ex.pod = pod
+
+	trace := ""
+	buildTrace := FakeBuildTrace{
+		testWriter{
+			call: func(b []byte) (int, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				trace += string(b)
+				return len(b), nil
 			},
-			Error: true,
 		},
 	}
+	ex.AbstractExecutor.BuildTrace = buildTrace
+	ex.AbstractExecutor.BuildLogger = common.NewBuildLogger(buildTrace, logrus.WithFields(logrus.Fields{}))
+
+	abort := make(chan interface{})
+	close(abort)
+	err := ex.Run(common.ExecutorCommand{Script: "true", Abort: abort})
+	assert.EqualError(t, err, "build aborted")
+
+	lock.Lock()
+	assert.True(t, deleted)
+	require.NotNil(t, deleteOptions)
+	require.NotNil(t, deleteOptions.GracePeriodSeconds)
+	assert.Equal(t, int64(0), *deleteOptions.GracePeriodSeconds)
+	assert.NotContains(t, trace, "Error deleting the aborted pod")
+	assert.NotContains(t, trace, "didn't end in time")
+	lock.Unlock()
+
+	// the already deleted pod isn't reported during the cleanup
+	ex.Cleanup()
+	assert.NotContains(t, trace, "Error cleaning up pod")
+}
+
+func TestKeepFailedPod(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+	header := map[string][]string{
+		"Content-Type": []string{"application/json"},
+	}
+
+	defer func(interval time.Duration) { keptPodsReapInterval = interval }(keptPodsReapInterval)
+	keptPodsReapInterval = time.Hour
+	defer func(last map[string]time.Time) { keptPodsReaped.last = last }(keptPodsReaped.last)
+	keptPodsReaped.last = make(map[string]time.Time)
+
+	tests := []struct {
+		Name         string
+		KeepFor      int
+		BuildError   error
+		PerBuild     bool
+		ExpectedKept bool
+		Reaped       bool
+		// the kept namespaces are reaped at most once per host
+		NamespacesReaped bool
+	}{
+		{Name: "failed build", KeepFor: 600, BuildError: fmt.Errorf("build failed"), ExpectedKept: true, Reaped: true},
+		{Name: "reaped recently", KeepFor: 600, BuildError: fmt.Errorf("build failed"), ExpectedKept: true},
+		{Name: "succeeded build", KeepFor: 600},
+		{Name: "not kept", BuildError: fmt.Errorf("build failed")},
+		{Name: "namespace per build", KeepFor: 600, BuildError: fmt.Errorf("build failed"), PerBuild: true, ExpectedKept: true, NamespacesReaped: true},
+		{Name: "succeeded build with namespace per build", KeepFor: 600, PerBuild: true},
+	}
 
 	for _, test := range tests {
-		e := &executor{
-			AbstractExecutor: executors.AbstractExecutor{
-				ExecutorOptions: executorOptions,
-			},
+		patches := make(map[string]map[string]interface{})
+		var deleted []string
+		listed, namespacesListed := false, false
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Host:              "keep-failed-pod",
+			Namespace:         "test-ns",
+			KeepFailedPods:    test.KeepFor,
+			NamespacePerBuild: test.PerBuild,
+		}, &kubernetesOptions{Image: "test-image"})
+		ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+			switch p, m := req.URL.Path, req.Method; {
+			case m == "PATCH":
+				body, err := ioutil.ReadAll(req.Body)
+				require.NoError(t, err)
+				var patch map[string]interface{}
+				require.NoError(t, json.Unmarshal(body, &patch))
+				patches[p] = patch
+				return &http.Response{StatusCode: 200, Body: objBody(codec, ex.pod), Header: header}, nil
+			case m == "DELETE":
+				deleted = append(deleted, p)
+				return &http.Response{StatusCode: 200, Body: objBody(codec, &unversioned.Status{Status: unversioned.StatusSuccess}), Header: header}, nil
+			case m == "GET" && p == "/api/"+version+"/namespaces/test-ns/pods":
+				listed = true
+				return &http.Response{StatusCode: 200, Body: objBody(codec, &api.PodList{}), Header: header}, nil
+			case m == "GET" && p == "/api/"+version+"/namespaces":
+				namespacesListed = true
+				return &http.Response{StatusCode: 200, Body: objBody(codec, &api.NamespaceList{}), Header: header}, nil
+			default:
+				return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+			}
+		})
+		ex.pod = &api.Pod{ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns", UID: "1234"}}
+		ex.scriptsConfigMap = &api.ConfigMap{ObjectMeta: api.ObjectMeta{Name: "test-scripts", Namespace: "test-ns"}}
+		ex.jobTokenSecret = &api.Secret{ObjectMeta: api.ObjectMeta{Name: "test-token", Namespace: "test-ns"}}
+		ex.namespaceCreated = test.PerBuild
+
+		ex.Finish(test.BuildError)
+		ex.Cleanup()
+
+		assert.Equal(t, test.Reaped, listed, test.Name)
+		assert.Equal(t, test.NamespacesReaped, namespacesListed, test.Name)
+		if !test.ExpectedKept {
+			assert.Empty(t, patches, test.Name)
+			assert.Contains(t, deleted, "/api/"+version+"/namespaces/test-ns/pods/test-pod", test.Name)
+			assert.Contains(t, deleted, "/api/"+version+"/namespaces/test-ns/configmaps/test-scripts", test.Name)
+			assert.Contains(t, deleted, "/api/"+version+"/namespaces/test-ns/secrets/test-token", test.Name)
+			if test.PerBuild {
+				assert.Contains(t, deleted, "/api/"+version+"/namespaces/test-ns", test.Name)
+			}
+			continue
 		}
+		assert.Empty(t, deleted, test.Name)
 
-		err := e.Prepare(test.GlobalConfig, test.RunnerConfig, test.Build)
+		patch := patches["/api/"+version+"/namespaces/test-ns/pods/test-pod"]
+		require.NotNil(t, patch, test.Name)
+		annotations := patch["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+		until, err := time.Parse(time.RFC3339, annotations[keepUntilAnnotation].(string))
+		require.NoError(t, err, test.Name)
+		assert.True(t, until.After(time.Now().Add(9*time.Minute)), test.Name)
 
-		if err != nil {
-			if test.Error {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
+		for _, p := range []string{"configmaps/test-scripts", "secrets/test-token"} {
+			patch := patches["/api/"+version+"/namespaces/test-ns/"+p]
+			require.NotNil(t, patch, test.Name)
+			owners := patch["metadata"].(map[string]interface{})["ownerReferences"].([]interface{})
+			require.Equal(t, 1, len(owners), test.Name)
+			owner := owners[0].(map[string]interface{})
+			assert.Equal(t, "Pod", owner["kind"], test.Name)
+			assert.Equal(t, "test-pod", owner["name"], test.Name)
+			assert.Equal(t, "1234", owner["uid"], test.Name)
+		}
+
+		patch = patches["/api/"+version+"/namespaces/test-ns"]
+		if !test.PerBuild {
+			assert.Nil(t, patch, test.Name)
+			continue
+		}
+		require.NotNil(t, patch, test.Name)
+		metadata := patch["metadata"].(map[string]interface{})
+		assert.Equal(t, "true", metadata["labels"].(map[string]interface{})[keptNamespaceLabel], test.Name)
+		assert.NotEmpty(t, metadata["annotations"].(map[string]interface{})[keepUntilAnnotation], test.Name)
+	}
+}
+
+func TestReapKeptNamespaces(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+	header := map[string][]string{
+		"Content-Type": []string{"application/json"},
+	}
+
+	now := time.Now()
+	namespace := func(name string, until time.Time) api.Namespace {
+		return api.Namespace{ObjectMeta: api.ObjectMeta{
+			Name:        name,
+			Labels:      map[string]string{keptNamespaceLabel: "true"},
+			Annotations: map[string]string{keepUntilAnnotation: until.UTC().Format(time.RFC3339)},
+		}}
+	}
+
+	var selector string
+	var deleted []string
+	c := testKubeClient(func(req *http.Request) (*http.Response, error) {
+		switch p, m := req.URL.Path, req.Method; {
+		case m == "GET" && p == "/api/"+version+"/namespaces":
+			selector = req.URL.Query().Get("labelSelector")
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &api.NamespaceList{Items: []api.Namespace{
+				namespace("expired", now.Add(-time.Minute)),
+				namespace("kept", now.Add(time.Minute)),
+			}}), Header: header}, nil
+		case m == "DELETE":
+			deleted = append(deleted, p)
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &unversioned.Status{Status: unversioned.StatusSuccess}), Header: header}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+		}
+	})
+
+	require.NoError(t, reapKeptNamespaces(c, now))
+	assert.Equal(t, keptNamespaceLabel+"=true", selector)
+	assert.Equal(t, []string{"/api/" + version + "/namespaces/expired"}, deleted)
+}
+
+func TestCollectOrphanedPods(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	defer func(done map[string]bool) { orphanedPodsCollected.done = done }(orphanedPodsCollected.done)
+	orphanedPodsCollected.done = make(map[string]bool)
+
+	lists, failures := 0, 1
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Host:                "collect-orphaned-pods",
+		Namespace:           "test-ns",
+		OrphanedPodsTimeout: 3600,
+	}, &kubernetesOptions{Image: "test-image"})
+	ex.Build.Runner.Token = "abcdefgh12345"
+	ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+		switch p, m := req.URL.Path, req.Method; {
+		case m == "GET" && p == "/api/"+version+"/namespaces/test-ns/pods":
+			lists++
+			if failures > 0 {
+				failures--
+				return &http.Response{StatusCode: 403, Body: objBody(codec, &unversioned.Status{
+					Status: unversioned.StatusFailure,
+					Reason: unversioned.StatusReasonForbidden,
+				}), Header: map[string][]string{"Content-Type": []string{"application/json"}}}, nil
 			}
-			if !test.Error {
-				t.Errorf("Got error. Expected: %v", test.Expected)
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &api.PodList{}), Header: map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+		}
+	})
+
+	// the orphaned pods are looked for again once it failed, and then never
+	ex.collectOrphanedPods()
+	ex.collectOrphanedPods()
+	ex.collectOrphanedPods()
+	assert.Equal(t, 2, lists)
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefgh", pod.Labels[runnerLabel])
+
+	ex.Config.Kubernetes.OrphanedPodsTimeout = 0
+	ex.Config.Kubernetes.Namespace = "other-ns"
+	ex.collectOrphanedPods()
+	assert.Equal(t, 2, lists)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	collector, ok := common.GetExecutor("kubernetes").(common.ExecutorGarbageCollector)
+	require.True(t, ok, "expected the provider to collect the garbage")
+
+	assert.NoError(t, collector.CollectGarbage(&common.RunnerConfig{}))
+	assert.NoError(t, collector.CollectGarbage(&common.RunnerConfig{
+		RunnerSettings: common.RunnerSettings{Kubernetes: &common.KubernetesConfig{}},
+	}))
+	assert.NoError(t, collector.CollectGarbage(&common.RunnerConfig{
+		RunnerSettings: common.RunnerSettings{Kubernetes: &common.KubernetesConfig{
+			OrphanedPodsTimeout: 3600,
+			NamespacePerBuild:   true,
+		}},
+	}))
+
+	defer func(done map[string]bool) { orphanedPodsCollected.done = done }(orphanedPodsCollected.done)
+	orphanedPodsCollected.done = make(map[string]bool)
+
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+	var deleted []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch p, m := req.URL.Path, req.Method; {
+		case m == "GET" && p == "/api/"+version+"/namespaces/default/pods":
+			w.Write([]byte(runtime.EncodeOrDie(codec, &api.PodList{Items: []api.Pod{{
+				ObjectMeta: api.ObjectMeta{
+					Name:              "orphaned",
+					Namespace:         "default",
+					CreationTimestamp: unversioned.NewTime(time.Now().Add(-2 * time.Hour)),
+				},
+			}}})))
+		case m == "DELETE":
+			mu.Lock()
+			deleted = append(deleted, p)
+			mu.Unlock()
+			w.Write([]byte(runtime.EncodeOrDie(codec, &unversioned.Status{Status: unversioned.StatusSuccess})))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	runner := &common.RunnerConfig{
+		RunnerCredentials: common.RunnerCredentials{Token: "abcdefgh12345"},
+		RunnerSettings: common.RunnerSettings{Kubernetes: &common.KubernetesConfig{
+			Host:                server.URL,
+			OrphanedPodsTimeout: 3600,
+		}},
+	}
+	require.NoError(t, collector.CollectGarbage(runner))
+	assert.Equal(t, []string{"/api/" + version + "/namespaces/default/pods/orphaned"}, deleted)
+	assert.Equal(t, "", runner.Kubernetes.Namespace, "the shared configuration shouldn't be modified")
+}
+
+func TestDumpLogs(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+
+	var requested []string
+	ex := newPodTestExecutor(&common.KubernetesConfig{Namespace: "test-ns"}, &kubernetesOptions{Image: "test-image"})
+	ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+		switch p, m := req.URL.Path, req.Method; {
+		case m == "GET" && p == "/api/"+version+"/namespaces/test-ns/pods/test-pod/log":
+			container := req.URL.Query().Get("container")
+			requested = append(requested, container)
+			assert.Equal(t, "100", req.URL.Query().Get("tailLines"))
+			if container == "svc-1" {
+				return &http.Response{StatusCode: 400, Body: ioutil.NopCloser(strings.NewReader("")), Header: map[string][]string{}}, nil
 			}
-			continue
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("output of " + container)), Header: map[string][]string{
+				"Content-Type": []string{"text/plain"},
+			}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
 		}
+	})
+	ex.pod = &api.Pod{
+		ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"},
+		Spec: api.PodSpec{
+			Containers: []api.Container{
+				{Name: "build", Image: "test-image"},
+				{Name: "pre", Image: "helper-image"},
+				{Name: "svc-0", Image: "postgres:9.6"},
+				{Name: "svc-1", Image: "redis"},
+				{Name: "sidecar-0", Image: "proxy"},
+			},
+		},
+	}
 
-		// Set this to nil so we aren't testing the functionality of the
-		// base AbstractExecutor's Prepare method
-		e.AbstractExecutor = executors.AbstractExecutor{}
+	trace := ""
+	buildTrace := FakeBuildTrace{
+		testWriter{
+			call: func(b []byte) (int, error) {
+				trace += string(b)
+				return len(b), nil
+			},
+		},
+	}
+	ex.AbstractExecutor.BuildTrace = buildTrace
+	ex.AbstractExecutor.BuildLogger = common.NewBuildLogger(buildTrace, logrus.WithFields(logrus.Fields{}))
 
-		// TODO: Improve this so we don't have to nil-ify the kubeClient.
-		// It currently contains some moving parts that are failing, meaning
-		// we'll need to mock _something_
-		e.kubeClient = nil
-		assert.Equal(t, test.Expected, e)
+	ex.dumpLogs()
+	assert.Equal(t, []string{"build", "svc-0", "svc-1"}, requested)
+	assert.Contains(t, trace, "Logs of container build (test-image):")
+	assert.Contains(t, trace, "output of build\n")
+	assert.Contains(t, trace, "Logs of container svc-0 (postgres:9.6):")
+	assert.Contains(t, trace, "output of svc-0\n")
+	assert.Contains(t, trace, "Error getting the logs of container svc-1")
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	codec := testapi.Default.Codec()
+	c := testKubeClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: objBody(codec, execPod()), Header: map[string][]string{
+			"Content-Type": []string{"application/json"},
+		}}, nil
+	})
+
+	// run runs the exec of remote, returned is closed once it returned
+	run := func(remote *fakeRemoteExecutor, returned chan struct{}) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			defer close(returned)
+			remote.cancel = ctx.Done()
+			exec := &ExecOptions{
+				PodName:       "foo",
+				ContainerName: "bar",
+				Namespace:     "test",
+				Command:       []string{"command"},
+				In:            strings.NewReader(""),
+				Out:           ioutil.Discard,
+				Err:           ioutil.Discard,
+				Executor:      remote,
+				Client:        c,
+			}
+			return exec.Run()
+		}
+	}
+	assertReturned := func(returned chan struct{}) {
+		select {
+		case <-returned:
+		default:
+			t.Error("expected the command to have returned")
+		}
 	}
+
+	blocked := make(chan struct{})
+	defer close(blocked)
+
+	returned := make(chan struct{})
+	err := runWithTimeout(context.Background(), "bar", run(&fakeRemoteExecutor{block: blocked}, returned), 10*time.Millisecond)
+	assert.EqualError(t, err, "command in container bar timed out after 10ms")
+	assertReturned(returned)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	returned = make(chan struct{})
+	err = runWithTimeout(ctx, "bar", run(&fakeRemoteExecutor{block: blocked}, returned), 0)
+	assert.Equal(t, context.Canceled, err)
+	assertReturned(returned)
+
+	returned = make(chan struct{})
+	err = runWithTimeout(context.Background(), "bar", run(&fakeRemoteExecutor{execErr: fmt.Errorf("exec error")}, returned), time.Minute)
+	assert.EqualError(t, err, "exec error")
+	assertReturned(returned)
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{ExecTimeout: -1}, &kubernetesOptions{Image: "test-image"})
+	assert.Error(t, ex.checkDefaults())
+}
+
+func TestBuildPodServiceReadinessProbe(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{
+		Image: "test-image",
+		Services: []kubernetesService{
+			{Name: "postgres:9.6", Ports: []int32{5432}},
+			{Name: "selenium/standalone-chrome"},
+		},
+	})
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Nil(t, pod.Spec.Containers[2].ReadinessProbe)
+
+	ex.Config.Kubernetes.WaitForServicesTimeout = 30
+	pod, err = ex.buildPod()
+	require.NoError(t, err)
+	require.Equal(t, "svc-0", pod.Spec.Containers[2].Name)
+	require.NotNil(t, pod.Spec.Containers[2].ReadinessProbe)
+	require.NotNil(t, pod.Spec.Containers[2].ReadinessProbe.TCPSocket)
+	assert.Equal(t, 5432, pod.Spec.Containers[2].ReadinessProbe.TCPSocket.Port.IntValue())
+	assert.Nil(t, pod.Spec.Containers[3].ReadinessProbe)
+}
+
+func TestWaitForServices(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	tests := []struct {
+		Name     string
+		ReadyAt  int
+		Expected []string
+	}{
+		{Name: "ready", ReadyAt: 1},
+		{Name: "ready after a while", ReadyAt: 3},
+		{Name: "not ready", ReadyAt: -1, Expected: []string{"Service svc-0 (postgres:9.6) probably didn't start properly"}},
+	}
+
+	defer func(interval time.Duration) { servicesCheckInterval = interval }(servicesCheckInterval)
+	servicesCheckInterval = 10 * time.Millisecond
+
+	for _, test := range tests {
+		requests := 0
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Namespace:              "test-ns",
+			WaitForServicesTimeout: 1,
+		}, &kubernetesOptions{
+			Image:    "test-image",
+			Services: []kubernetesService{{Name: "postgres:9.6", Ports: []int32{5432}}},
+		})
+		ex.pod = &api.Pod{ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"}}
+		ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+			switch p, m := req.URL.Path, req.Method; {
+			case m == "GET" && p == "/api/"+version+"/namespaces/test-ns/pods/test-pod":
+				requests++
+				return &http.Response{StatusCode: 200, Body: objBody(codec, &api.Pod{
+					ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"},
+					Spec: api.PodSpec{
+						Containers: []api.Container{
+							{Name: "build", Image: "test-image"},
+							{Name: "svc-0", Image: "postgres:9.6"},
+						},
+					},
+					Status: api.PodStatus{
+						Phase: api.PodRunning,
+						ContainerStatuses: []api.ContainerStatus{
+							{Name: "build", Ready: true},
+							{Name: "svc-0", Ready: test.ReadyAt > 0 && requests >= test.ReadyAt},
+						},
+					},
+				}), Header: map[string][]string{
+					"Content-Type": []string{"application/json"},
+				}}, nil
+			default:
+				return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+			}
+		})
+		trace := ""
+		buildTrace := FakeBuildTrace{
+			testWriter{
+				call: func(b []byte) (int, error) {
+					trace += string(b)
+					return len(b), nil
+				},
+			},
+		}
+		ex.AbstractExecutor.BuildTrace = buildTrace
+		ex.AbstractExecutor.BuildLogger = common.NewBuildLogger(buildTrace, logrus.WithFields(logrus.Fields{}))
+
+		ex.waitForServices(context.Background())
+		assert.Contains(t, trace, "Waiting for services to be up and running", test.Name)
+		if test.ReadyAt > 0 {
+			assert.Equal(t, test.ReadyAt, requests, test.Name)
+			assert.NotContains(t, trace, "probably didn't start properly", test.Name)
+		}
+		for _, expected := range test.Expected {
+			assert.Contains(t, trace, expected, test.Name)
+		}
+	}
+
+	// the services are not waited for by default
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{
+		Services: []kubernetesService{{Name: "postgres:9.6"}},
+	})
+	ex.waitForServices(context.Background())
+}
+
+func TestWaitForSidecars(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	tests := []struct {
+		Name    string
+		ReadyAt int
+		Error   bool
+	}{
+		{Name: "ready", ReadyAt: 1},
+		{Name: "ready after a while", ReadyAt: 3},
+		{Name: "not ready", ReadyAt: -1, Error: true},
+	}
+
+	defer func(interval time.Duration) { servicesCheckInterval = interval }(servicesCheckInterval)
+	servicesCheckInterval = 10 * time.Millisecond
+
+	for _, test := range tests {
+		requests := 0
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Namespace:   "test-ns",
+			PollTimeout: 1,
+			Sidecars: []common.KubernetesSidecar{
+				{Name: "vault-agent", Image: "vault:1.4", WaitForReady: true},
+				{Image: "fluentd"},
+			},
+		}, &kubernetesOptions{Image: "test-image"})
+		ex.pod = &api.Pod{ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"}}
+		ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+			switch p, m := req.URL.Path, req.Method; {
+			case m == "GET" && p == "/api/"+version+"/namespaces/test-ns/pods/test-pod":
+				requests++
+				return &http.Response{StatusCode: 200, Body: objBody(codec, &api.Pod{
+					ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"},
+					Spec: api.PodSpec{
+						Containers: []api.Container{
+							{Name: "build", Image: "test-image"},
+							{Name: "vault-agent", Image: "vault:1.4"},
+							{Name: "sidecar-1", Image: "fluentd"},
+						},
+					},
+					Status: api.PodStatus{
+						Phase: api.PodRunning,
+						ContainerStatuses: []api.ContainerStatus{
+							{Name: "build", Ready: true},
+							{Name: "vault-agent", Ready: test.ReadyAt > 0 && requests >= test.ReadyAt},
+							{Name: "sidecar-1", Ready: false},
+						},
+					},
+				}), Header: map[string][]string{
+					"Content-Type": []string{"application/json"},
+				}}, nil
+			default:
+				return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+			}
+		})
+
+		err := ex.waitForSidecars(context.Background())
+		if test.Error {
+			require.Error(t, err, test.Name)
+			assert.Contains(t, err.Error(), "vault-agent (vault:1.4)", test.Name)
+			assert.NotContains(t, err.Error(), "sidecar-1", test.Name)
+			continue
+		}
+		assert.NoError(t, err, test.Name)
+		assert.Equal(t, test.ReadyAt, requests, test.Name)
+	}
+
+	// the sidecars are not waited for by default
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Sidecars: []common.KubernetesSidecar{{Image: "fluentd"}},
+	}, &kubernetesOptions{Image: "test-image"})
+	assert.NoError(t, ex.waitForSidecars(context.Background()))
+}
+
+func TestBuildPodTerminationGracePeriod(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Nil(t, pod.Spec.TerminationGracePeriodSeconds)
+
+	gracePeriod := int64(5)
+	ex.Config.Kubernetes.TerminationGracePeriodSeconds = &gracePeriod
+	require.NoError(t, ex.checkDefaults())
+	pod, err = ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, &gracePeriod, pod.Spec.TerminationGracePeriodSeconds)
+
+	gracePeriod = -1
+	assert.Error(t, ex.checkDefaults())
+}
+
+func TestPollOptions(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	require.NoError(t, ex.checkDefaults())
+	assert.Equal(t, 3*time.Second, ex.Config.Kubernetes.GetPollInterval())
+	assert.Equal(t, 3*time.Minute, ex.Config.Kubernetes.GetPollTimeout())
+
+	ex.Config.Kubernetes.PollInterval = 10
+	ex.Config.Kubernetes.PollTimeout = 900
+	require.NoError(t, ex.checkDefaults())
+	assert.Equal(t, 10*time.Second, ex.Config.Kubernetes.GetPollInterval())
+	assert.Equal(t, 15*time.Minute, ex.Config.Kubernetes.GetPollTimeout())
+
+	ex.Config.Kubernetes.PollInterval = -1
+	assert.Error(t, ex.checkDefaults())
+
+	ex.Config.Kubernetes.PollInterval = 0
+	ex.Config.Kubernetes.PollTimeout = -1
+	assert.Error(t, ex.checkDefaults())
+}
+
+func TestBuildPodActiveDeadline(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	require.NotNil(t, pod.Spec.ActiveDeadlineSeconds)
+	assert.Equal(t, int64(common.DefaultTimeout), *pod.Spec.ActiveDeadlineSeconds)
+
+	ex.Build.Timeout = 600
+	pod, err = ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, int64(600), *pod.Spec.ActiveDeadlineSeconds)
+
+	ex.Config.Kubernetes.ActiveDeadlineSeconds = 1800
+	require.NoError(t, ex.checkDefaults())
+	pod, err = ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1800), *pod.Spec.ActiveDeadlineSeconds)
+
+	ex.Config.Kubernetes.ActiveDeadlineSeconds = -1
+	assert.Error(t, ex.checkDefaults())
+}
+
+func TestCheckPodFailure(t *testing.T) {
+	codec := testapi.Default.Codec()
+	deadline := int64(600)
+
+	tests := []struct {
+		Reason     string
+		Message    string
+		Terminated *api.ContainerStateTerminated
+		Restarted  bool
+		Expected   string
+	}{
+		{},
+		{Reason: "Evicted", Message: "The node was low on resource: memory."},
+		{Terminated: &api.ContainerStateTerminated{ExitCode: 1, Reason: "Error"}},
+		{
+			Terminated: &api.ContainerStateTerminated{ExitCode: 137, Reason: "OOMKilled"},
+			Expected:   "container build ran out of memory and was killed, the memory limit of 1Gi needs to be raised",
+		},
+		{
+			Terminated: &api.ContainerStateTerminated{ExitCode: 137, Reason: "OOMKilled"},
+			Restarted:  true,
+			Expected:   "container build ran out of memory and was killed",
+		},
+		{Reason: "DeadlineExceeded", Expected: "active deadline of 600 seconds"},
+		{
+			Reason:   "Evicted",
+			Message:  "Pod ephemeral local storage usage exceeds the total limit of containers 1Gi.",
+			Expected: "pod was evicted: Pod ephemeral local storage usage exceeds the total limit of containers 1Gi.",
+		},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{})
+		ex.pod = &api.Pod{ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"}}
+		ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+			status := api.ContainerStatus{Name: "build"}
+			if test.Restarted {
+				status.LastTerminationState.Terminated = test.Terminated
+			} else {
+				status.State.Terminated = test.Terminated
+			}
+
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &api.Pod{
+				ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"},
+				Spec: api.PodSpec{
+					ActiveDeadlineSeconds: &deadline,
+					Containers: []api.Container{{
+						Name: "build",
+						Resources: api.ResourceRequirements{
+							Limits: api.ResourceList{api.ResourceMemory: resource.MustParse("1Gi")},
+						},
+					}},
+				},
+				Status: api.PodStatus{
+					Phase:             api.PodFailed,
+					Reason:            test.Reason,
+					Message:           test.Message,
+					ContainerStatuses: []api.ContainerStatus{status},
+				},
+			}), Header: map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}}, nil
+		})
+
+		assert.NoError(t, ex.checkPodFailure("build", nil))
+
+		execErr := fmt.Errorf("command terminated with non-zero exit code")
+		err := ex.checkPodFailure("build", execErr)
+		if test.Expected == "" {
+			assert.Equal(t, execErr, err, "reason: %s", test.Reason)
+			continue
+		}
+
+		buildErr, ok := err.(*common.BuildError)
+		require.True(t, ok, "expected a build error, got: %v", err)
+		assert.Contains(t, buildErr.Error(), test.Expected)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	tests := []struct {
+		GlobalConfig *common.Config
+		RunnerConfig *common.RunnerConfig
+		Build        *common.Build
+
+		Expected *executor
+		Error    bool
+	}{
+		{
+			GlobalConfig: &common.Config{},
+			RunnerConfig: &common.RunnerConfig{
+				RunnerSettings: common.RunnerSettings{
+					Kubernetes: &common.KubernetesConfig{
+						Host:          "test-server",
+						ServiceCPUs:   "0.5",
+						ServiceMemory: "200Mi",
+						HelperCPUs:    "0.25",
+						HelperMemory:  "100Mi",
+						CPUs:          "1.5",
+						Memory:        "4Gi",
+						Privileged:    true,
+					},
+				},
+			},
+			Build: &common.Build{
+				GetBuildResponse: common.GetBuildResponse{
+					Sha: "1234567890",
+					Options: common.BuildOptions{
+						"image": "test-image",
+					},
+					Variables: []common.BuildVariable{
+						common.BuildVariable{Key: "privileged", Value: "true"},
+					},
+				},
+				Runner: &common.RunnerConfig{},
+			},
+			Expected: &executor{
+				options: &kubernetesOptions{
+					Image: "test-image",
+				},
+				helperImage: "munnerz/gitlab-runner-helper",
+				serviceLimits: api.ResourceList{
+					api.ResourceCPU:    resource.MustParse("0.5"),
+					api.ResourceMemory: resource.MustParse("200Mi"),
+				},
+				buildLimits: api.ResourceList{
+					api.ResourceCPU:    resource.MustParse("1.5"),
+					api.ResourceMemory: resource.MustParse("4Gi"),
+				},
+				serviceRequests: api.ResourceList{
+					api.ResourceCPU:    resource.MustParse("0.5"),
+					api.ResourceMemory: resource.MustParse("200Mi"),
+				},
+				buildRequests: api.ResourceList{
+					api.ResourceCPU:    resource.MustParse("1.5"),
+					api.ResourceMemory: resource.MustParse("4Gi"),
+				},
+				helperLimits: api.ResourceList{
+					api.ResourceCPU:    resource.MustParse("0.25"),
+					api.ResourceMemory: resource.MustParse("100Mi"),
+				},
+				helperRequests: api.ResourceList{
+					api.ResourceCPU:    resource.MustParse("0.25"),
+					api.ResourceMemory: resource.MustParse("100Mi"),
+				},
+			},
+		},
+		{
+			GlobalConfig: &common.Config{},
+			RunnerConfig: &common.RunnerConfig{
+				RunnerSettings: common.RunnerSettings{
+					Kubernetes: &common.KubernetesConfig{
+						Host:              "test-server",
+						CPUs:              "1.5",
+						Privileged:        true,
+						ExtendedResources: map[string]string{"nvidia.com/gpu": "2"},
+					},
+				},
+			},
+			Build: &common.Build{
+				GetBuildResponse: common.GetBuildResponse{
+					Sha: "1234567890",
+					Options: common.BuildOptions{
+						"image": "test-image",
+					},
+				},
+				Runner: &common.RunnerConfig{},
+			},
+			Expected: &executor{
+				options: &kubernetesOptions{
+					Image: "test-image",
+				},
+				helperImage:     "munnerz/gitlab-runner-helper",
+				serviceLimits:   api.ResourceList{},
+				serviceRequests: api.ResourceList{},
+				helperLimits:    api.ResourceList{},
+				helperRequests:  api.ResourceList{},
+				buildLimits: api.ResourceList{
+					api.ResourceCPU:                    resource.MustParse("1.5"),
+					api.ResourceName("nvidia.com/gpu"): resource.MustParse("2"),
+				},
+				buildRequests: api.ResourceList{
+					api.ResourceCPU:                    resource.MustParse("1.5"),
+					api.ResourceName("nvidia.com/gpu"): resource.MustParse("2"),
+				},
+			},
+		},
+		{
+			GlobalConfig: &common.Config{},
+			RunnerConfig: &common.RunnerConfig{
+				RunnerSettings: common.RunnerSettings{
+					Kubernetes: &common.KubernetesConfig{
+						Host:          "test-server",
+						ServiceCPUs:   "0.5",
+						ServiceMemory: "200Mi",
+						CPUs:          "1.5",
+						Memory:        "4Gi",
+						Privileged:    false,
+					},
+				},
+			},
+			Build: &common.Build{
+				GetBuildResponse: common.GetBuildResponse{
+					Sha: "1234567890",
+					Options: common.BuildOptions{
+						"image": "test-image",
+					},
+				},
+				Runner: &common.RunnerConfig{},
+			},
+			Expected: &executor{
+				options: &kubernetesOptions{
+					Image: "test-image",
+				},
+				helperImage: "munnerz/gitlab-runner-helper",
+				serviceLimits: api.ResourceList{
+					api.ResourceCPU:    resource.MustParse("0.5"),
+					api.ResourceMemory: resource.MustParse("200Mi"),
+				},
+				buildLimits: api.ResourceList{
+					api.ResourceCPU:    resource.MustParse("1.5"),
+					api.ResourceMemory: resource.MustParse("4Gi"),
+				},
+				serviceRequests: api.ResourceList{
+					api.ResourceCPU:    resource.MustParse("0.5"),
+					api.ResourceMemory: resource.MustParse("200Mi"),
+				},
+				buildRequests: api.ResourceList{
+					api.ResourceCPU:    resource.MustParse("1.5"),
+					api.ResourceMemory: resource.MustParse("4Gi"),
+				},
+				helperLimits:   api.ResourceList{},
+				helperRequests: api.ResourceList{},
+			},
+			Error: true,
+		},
+	}
+
+	for _, test := range tests {
+		e := &executor{
+			AbstractExecutor: executors.AbstractExecutor{
+				ExecutorOptions: executorOptions,
+			},
+		}
+
+		err := e.Prepare(test.GlobalConfig, test.RunnerConfig, test.Build)
+
+		if err != nil {
+			if test.Error {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if !test.Error {
+				t.Errorf("Got error. Expected: %v", test.Expected)
+			}
+			continue
+		}
+
+		// Set this to nil so we aren't testing the functionality of the
+		// base AbstractExecutor's Prepare method
+		e.AbstractExecutor = executors.AbstractExecutor{}
+
+		// TODO: Improve this so we don't have to nil-ify the kubeClient.
+		// It currently contains some moving parts that are failing, meaning
+		// we'll need to mock _something_
+		e.kubeClient = nil
+		assert.Equal(t, test.Expected, e)
+	}
+}
+
+func TestPrepareCreatePod(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	created := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch p, m := r.URL.Path, r.Method; {
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "GET":
+			data, err := runtime.Encode(codec, &api.PodList{})
+			require.NoError(t, err)
+			w.Write(data)
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "POST":
+			created++
+			w.WriteHeader(http.StatusCreated)
+			data, err := runtime.Encode(codec, &api.Pod{ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"}})
+			require.NoError(t, err)
+			w.Write(data)
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer server.Close()
+
+	e := &executor{
+		AbstractExecutor: executors.AbstractExecutor{
+			ExecutorOptions: executorOptions,
+		},
+	}
+	err := e.Prepare(&common.Config{}, &common.RunnerConfig{
+		RunnerSettings: common.RunnerSettings{
+			Kubernetes: &common.KubernetesConfig{
+				Host:               server.URL,
+				Namespace:          "test-ns",
+				CreatePodOnPrepare: true,
+			},
+		},
+	}, &common.Build{
+		GetBuildResponse: common.GetBuildResponse{
+			Options: common.BuildOptions{
+				"image": "test-image",
+			},
+		},
+		Runner: &common.RunnerConfig{},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, e.pod)
+	assert.Equal(t, "test-pod", e.pod.Name)
+	assert.Equal(t, 1, created)
+}
+
+func TestPrepareShell(t *testing.T) {
+	tests := []struct {
+		RunnerShell     string
+		Shell           string
+		ExpectedShell   string
+		ExpectedCommand []string
+		Error           bool
+	}{
+		{ExpectedShell: "bash"},
+		{Shell: "sh", ExpectedShell: "sh", ExpectedCommand: []string{"sh"}},
+		{RunnerShell: "sh", ExpectedShell: "sh", ExpectedCommand: []string{"sh"}},
+		{RunnerShell: "sh", Shell: "bash", ExpectedShell: "bash"},
+		{Shell: "powershell", ExpectedShell: "powershell", ExpectedCommand: []string{"powershell"}},
+		{Shell: "cmd", Error: true},
+	}
+
+	for _, test := range tests {
+		e := &executor{
+			AbstractExecutor: executors.AbstractExecutor{
+				ExecutorOptions: executorOptions,
+			},
+		}
+
+		err := e.Prepare(&common.Config{}, &common.RunnerConfig{
+			RunnerSettings: common.RunnerSettings{
+				Shell: test.RunnerShell,
+				Kubernetes: &common.KubernetesConfig{
+					Host:  "test-server",
+					Shell: test.Shell,
+				},
+			},
+		}, &common.Build{
+			GetBuildResponse: common.GetBuildResponse{
+				Options: common.BuildOptions{"image": "test-image"},
+			},
+			Runner: &common.RunnerConfig{},
+		})
+		if test.Error {
+			assert.Error(t, err, "shell: %s", test.Shell)
+			continue
+		}
+		require.NoError(t, err, "shell: %s", test.Shell)
+
+		assert.Equal(t, test.ExpectedShell, e.Shell().Shell, "shell: %s", test.Shell)
+		if test.ExpectedCommand != nil {
+			assert.Equal(t, test.ExpectedCommand, e.shellCommand(), "shell: %s", test.Shell)
+		} else {
+			// bash is detected, falling back to sh
+			assert.Equal(t, []string{"sh", "-c"}, e.BuildShell.DockerCommand[:2], "shell: %s", test.Shell)
+		}
+	}
+}
+
+func newPodTestExecutor(config *common.KubernetesConfig, options *kubernetesOptions) *executor {
+	return &executor{
+		AbstractExecutor: executors.AbstractExecutor{
+			Config: common.RunnerConfig{
+				RunnerSettings: common.RunnerSettings{
+					Kubernetes: config,
+				},
+			},
+			Build: &common.Build{
+				Runner: &common.RunnerConfig{},
+			},
+			BuildShell: &common.ShellConfiguration{},
+		},
+		options: options,
+	}
+}
+
+func TestBuildPodSidecars(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Namespace: "test-ns",
+		Sidecars: []common.KubernetesSidecar{
+			{
+				Name:        "log-shipper",
+				Image:       "fluentd:latest",
+				Command:     []string{"fluentd", "-c", "/etc/fluentd.conf"},
+				Environment: []string{"LEVEL=debug"},
+				VolumeMounts: []common.KubernetesVolumeMount{
+					{Name: "repo", MountPath: "/logs", ReadOnly: true},
+				},
+				CPUs:   "100m",
+				Memory: "64Mi",
+			},
+			{
+				Image: "proxy:latest",
+			},
+		},
+	}, &kubernetesOptions{
+		Image:    "test-image",
+		Services: []kubernetesService{{Name: "test-service"}},
+	})
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	require.Equal(t, 5, len(pod.Spec.Containers))
+	assert.Equal(t, "build", pod.Spec.Containers[0].Name)
+	assert.Equal(t, "pre", pod.Spec.Containers[1].Name)
+	assert.Equal(t, "svc-0", pod.Spec.Containers[2].Name)
+
+	sidecar := pod.Spec.Containers[3]
+	assert.Equal(t, "log-shipper", sidecar.Name)
+	assert.Equal(t, "fluentd:latest", sidecar.Image)
+	assert.Equal(t, []string{"fluentd", "-c", "/etc/fluentd.conf"}, sidecar.Command)
+	assert.Equal(t, []api.EnvVar{{Name: "LEVEL", Value: "debug"}}, sidecar.Env)
+	assert.Equal(t, []api.VolumeMount{{Name: "repo", MountPath: "/logs", ReadOnly: true}}, sidecar.VolumeMounts)
+	assert.Equal(t, api.ResourceList{
+		api.ResourceCPU:    resource.MustParse("100m"),
+		api.ResourceMemory: resource.MustParse("64Mi"),
+	}, sidecar.Resources.Limits)
+	assert.Equal(t, sidecar.Resources.Limits, sidecar.Resources.Requests)
+	assert.False(t, sidecar.Stdin)
+
+	assert.Equal(t, "sidecar-1", pod.Spec.Containers[4].Name)
+	assert.Equal(t, "proxy:latest", pod.Spec.Containers[4].Image)
+}
+
+func TestBuildPodSidecarsInvalid(t *testing.T) {
+	tests := []common.KubernetesSidecar{
+		{Name: "no-image"},
+		{Image: "test", Environment: []string{"INVALID"}},
+	}
+
+	for _, sidecar := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Sidecars: []common.KubernetesSidecar{sidecar},
+		}, &kubernetesOptions{Image: "test-image"})
+
+		_, err := ex.buildPod()
+		assert.Error(t, err, "sidecar: %v", sidecar)
+	}
+}
+
+func TestBuildInitContainers(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Namespace: "test-ns",
+		InitContainers: []common.KubernetesInitContainer{
+			{
+				Name:    "cache-warmup",
+				Image:   "busybox:latest",
+				Command: []string{"cp", "-r", "/seed/.", "/cache"},
+				VolumeMounts: []common.KubernetesVolumeMount{
+					{Name: "cache", MountPath: "/cache"},
+				},
+				CPUs:   "100m",
+				Memory: "64Mi",
+			},
+			{
+				Image: "alpine:latest",
+			},
+		},
+	}, &kubernetesOptions{Image: "test-image"})
+
+	initContainers, err := ex.buildInitContainers()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(initContainers))
+
+	container := initContainers[0].(map[string]interface{})
+	assert.Equal(t, "cache-warmup", container["name"])
+	assert.Equal(t, "busybox:latest", container["image"])
+	assert.Equal(t, []interface{}{"cp", "-r", "/seed/.", "/cache"}, container["command"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"name": "cache", "mountPath": "/cache"}}, container["volumeMounts"])
+	resources := container["resources"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"cpu": "100m", "memory": "64Mi"}, resources["limits"])
+	assert.Equal(t, resources["limits"], resources["requests"])
+	assert.Nil(t, container["securityContext"])
+	assert.Equal(t, "init-1", initContainers[1].(map[string]interface{})["name"])
+
+	// the init containers are passed as spec.initContainers
+	ex.initContainers = initContainers
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, initContainers, ex.buildPodSpecExtra(pod)["initContainers"])
+
+	ex.Config.Kubernetes.PodSecurityStandard = podSecurityStandardRestricted
+	initContainers, err = ex.buildInitContainers()
+	require.NoError(t, err)
+	for _, container := range initContainers {
+		securityContext := container.(map[string]interface{})["securityContext"].(map[string]interface{})
+		assert.Equal(t, false, securityContext["allowPrivilegeEscalation"])
+		assert.Equal(t, []interface{}{"ALL"}, securityContext["capabilities"].(map[string]interface{})["drop"])
+	}
+
+	ex.Config.Kubernetes.InitContainers = []common.KubernetesInitContainer{{Name: "no-image"}}
+	_, err = ex.buildInitContainers()
+	assert.Error(t, err)
+
+	ex.Config.Kubernetes.InitContainers = []common.KubernetesInitContainer{{Image: "alpine", Memory: "1j"}}
+	_, err = ex.buildInitContainers()
+	assert.Error(t, err)
+}
+
+func TestBuildPodImagePullSecrets(t *testing.T) {
+	tests := []struct {
+		ServiceAccount   string
+		ImagePullSecrets []string
+		Expected         []api.LocalObjectReference
+	}{
+		{
+			ServiceAccount: "ci",
+		},
+		{
+			ServiceAccount:   "ci",
+			ImagePullSecrets: []string{"registry-a", "registry-b"},
+			Expected: []api.LocalObjectReference{
+				{Name: "registry-a"},
+				{Name: "registry-b"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			ServiceAccount:   test.ServiceAccount,
+			ImagePullSecrets: test.ImagePullSecrets,
+		}, &kubernetesOptions{Image: "test-image"})
+
+		pod, err := ex.buildPod()
+		require.NoError(t, err)
+		assert.Equal(t, test.ServiceAccount, pod.Spec.ServiceAccountName)
+		assert.Equal(t, test.Expected, pod.Spec.ImagePullSecrets)
+	}
+}
+
+func TestBuildPodServiceImagePullSecrets(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		ImagePullSecrets: []string{"registry-a"},
+	}, &kubernetesOptions{
+		Image: "test-image",
+		Services: []kubernetesService{
+			{Name: "registry-b.example.com/mysql", PullSecrets: []string{"registry-b", "registry-a"}},
+			{Name: "registry-c.example.com/redis", PullSecrets: []string{"registry-c"}},
+		},
+	})
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, []api.LocalObjectReference{
+		{Name: "registry-a"},
+		{Name: "registry-b"},
+		{Name: "registry-c"},
+	}, pod.Spec.ImagePullSecrets)
+}
+
+func TestCheckImagePullSecrets(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	existing := map[string]bool{"registry-a": true, "registry-b": true}
+	kubeClient := testKubeClient(func(req *http.Request) (*http.Response, error) {
+		prefix := "/api/" + version + "/namespaces/test-ns/secrets/"
+		if req.Method != "GET" || !strings.HasPrefix(req.URL.Path, prefix) {
+			return nil, fmt.Errorf("unexpected request: %s %s", req.Method, req.URL.Path)
+		}
+
+		name := strings.TrimPrefix(req.URL.Path, prefix)
+		if !existing[name] {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader("")), Header: map[string][]string{}}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: objBody(codec, &api.Secret{
+			ObjectMeta: api.ObjectMeta{Name: name, Namespace: "test-ns"},
+		}), Header: map[string][]string{
+			"Content-Type": []string{"application/json"},
+		}}, nil
+	})
+
+	tests := []struct {
+		ImagePullSecrets []string
+		Allowed          []string
+		ServiceSecrets   []string
+		Error            bool
+	}{
+		{},
+		{
+			ImagePullSecrets: []string{"registry-a"},
+			Allowed:          []string{"registry-*"},
+			ServiceSecrets:   []string{"registry-b"},
+		},
+		{
+			ImagePullSecrets: []string{"missing"},
+			Error:            true,
+		},
+		{
+			ServiceSecrets: []string{"registry-b"},
+			Error:          true,
+		},
+		{
+			Allowed:        []string{"registry-*"},
+			ServiceSecrets: []string{"registry-c"},
+			Error:          true,
+		},
+	}
+
+	for i, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Namespace:               "test-ns",
+			ImagePullSecrets:        test.ImagePullSecrets,
+			AllowedImagePullSecrets: test.Allowed,
+		}, &kubernetesOptions{
+			Image:    "test-image",
+			Services: []kubernetesService{{Name: "test-service", PullSecrets: test.ServiceSecrets}},
+		})
+		ex.kubeClient = kubeClient
+
+		err := ex.checkImagePullSecrets()
+		if test.Error {
+			assert.Error(t, err, "test %d", i)
+		} else {
+			assert.NoError(t, err, "test %d", i)
+		}
+	}
+}
+
+func TestGetEnvFrom(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	existing := map[string]bool{"secrets/db-credentials": true, "configmaps/build-settings": true}
+	kubeClient := testKubeClient(func(req *http.Request) (*http.Response, error) {
+		prefix := "/api/" + version + "/namespaces/test-ns/"
+		if req.Method != "GET" || !strings.HasPrefix(req.URL.Path, prefix) {
+			return nil, fmt.Errorf("unexpected request: %s %s", req.Method, req.URL.Path)
+		}
+
+		if !existing[strings.TrimPrefix(req.URL.Path, prefix)] {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader("")), Header: map[string][]string{}}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: objBody(codec, &api.Secret{}), Header: map[string][]string{
+			"Content-Type": []string{"application/json"},
+		}}, nil
+	})
+
+	tests := []struct {
+		EnvFrom  []common.KubernetesEnvFrom
+		Allowed  []string
+		Variable string
+		Expected []interface{}
+		Error    bool
+	}{
+		{},
+		{
+			EnvFrom: []common.KubernetesEnvFrom{
+				{Secret: "db-credentials", Prefix: "DB_"},
+				{ConfigMap: "missing", Optional: true},
+			},
+			Expected: []interface{}{
+				map[string]interface{}{
+					"prefix":    "DB_",
+					"secretRef": map[string]interface{}{"name": "db-credentials", "optional": false},
+				},
+				map[string]interface{}{
+					"configMapRef": map[string]interface{}{"name": "missing", "optional": true},
+				},
+			},
+		},
+		{
+			Allowed:  []string{"config_map/build-*"},
+			Variable: "config_map/build-settings",
+			Expected: []interface{}{
+				map[string]interface{}{
+					"configMapRef": map[string]interface{}{"name": "build-settings", "optional": false},
+				},
+			},
+		},
+		{
+			EnvFrom: []common.KubernetesEnvFrom{{Secret: "missing"}},
+			Error:   true,
+		},
+		{
+			Variable: "secret/db-credentials",
+			Error:    true,
+		},
+		{
+			Allowed:  []string{"*"},
+			Variable: "pod/test",
+			Error:    true,
+		},
+		{
+			EnvFrom: []common.KubernetesEnvFrom{{Secret: "db-credentials", ConfigMap: "build-settings"}},
+			Error:   true,
+		},
+		{
+			EnvFrom: []common.KubernetesEnvFrom{{Secret: "db-credentials", Prefix: "1-DB"}},
+			Error:   true,
+		},
+	}
+
+	for i, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Namespace:      "test-ns",
+			EnvFrom:        test.EnvFrom,
+			AllowedEnvFrom: test.Allowed,
+		}, &kubernetesOptions{Image: "test-image"})
+		ex.kubeClient = kubeClient
+		if test.Variable != "" {
+			ex.Build.Variables = common.BuildVariables{
+				{Key: "KUBERNETES_ENV_FROM", Value: test.Variable},
+			}
+		}
+
+		envFrom, err := ex.getEnvFrom()
+		if test.Error {
+			assert.Error(t, err, "test %d", i)
+			continue
+		}
+		assert.NoError(t, err, "test %d", i)
+		assert.Equal(t, test.Expected, envFrom, "test %d", i)
+	}
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	ex.envFrom = tests[2].Expected
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	containers := ex.buildPodSpecExtra(pod)["containers"].([]interface{})
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "build", "envFrom": tests[2].Expected},
+	}, containers)
+}
+
+func TestCheckResourceQuota(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	tests := []struct {
+		Hard, Used api.ResourceList
+		Scopes     []api.ResourceQuotaScope
+		Disabled   bool
+		Status     int
+		Error      bool
+	}{
+		{Status: 200},
+		{
+			Hard:     api.ResourceList{api.ResourcePods: resource.MustParse("1")},
+			Used:     api.ResourceList{api.ResourcePods: resource.MustParse("1")},
+			Disabled: true,
+		},
+		{
+			Hard:   api.ResourceList{api.ResourceRequestsCPU: resource.MustParse("4"), api.ResourcePods: resource.MustParse("10")},
+			Used:   api.ResourceList{api.ResourceRequestsCPU: resource.MustParse("1"), api.ResourcePods: resource.MustParse("3")},
+			Status: 200,
+		},
+		{
+			Hard:   api.ResourceList{api.ResourceRequestsCPU: resource.MustParse("4")},
+			Used:   api.ResourceList{api.ResourceRequestsCPU: resource.MustParse("3")},
+			Status: 200,
+			Error:  true,
+		},
+		{
+			Hard:   api.ResourceList{api.ResourceRequestsCPU: resource.MustParse("4")},
+			Used:   api.ResourceList{api.ResourceRequestsCPU: resource.MustParse("3")},
+			Scopes: []api.ResourceQuotaScope{api.ResourceQuotaScopeTerminating, api.ResourceQuotaScopeNotBestEffort},
+			Status: 200,
+			Error:  true,
+		},
+		// the quotas of other pods are ignored
+		{
+			Hard:   api.ResourceList{api.ResourcePods: resource.MustParse("1")},
+			Used:   api.ResourceList{api.ResourcePods: resource.MustParse("1")},
+			Scopes: []api.ResourceQuotaScope{api.ResourceQuotaScopeBestEffort},
+			Status: 200,
+		},
+		{
+			Hard:   api.ResourceList{api.ResourceRequestsCPU: resource.MustParse("4")},
+			Used:   api.ResourceList{api.ResourceRequestsCPU: resource.MustParse("3")},
+			Scopes: []api.ResourceQuotaScope{api.ResourceQuotaScopeNotTerminating},
+			Status: 200,
+		},
+		// the usage isn't known yet
+		{
+			Hard:   api.ResourceList{api.ResourceLimitsMemory: resource.MustParse("1Gi")},
+			Status: 200,
+		},
+		{
+			Hard:   api.ResourceList{api.ResourceLimitsMemory: resource.MustParse("1Gi")},
+			Used:   api.ResourceList{api.ResourceLimitsMemory: resource.MustParse("0")},
+			Status: 200,
+			Error:  true,
+		},
+		{
+			Hard:   api.ResourceList{api.ResourcePods: resource.MustParse("2")},
+			Used:   api.ResourceList{api.ResourcePods: resource.MustParse("2")},
+			Status: 200,
+			Error:  true,
+		},
+		{
+			Hard:   api.ResourceList{api.ResourceRequestsCPU: resource.MustParse("1")},
+			Status: 403,
+		},
+	}
+
+	for i, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{Namespace: "test-ns", CheckResourceQuota: !test.Disabled}, &kubernetesOptions{
+			Image:    "test-image",
+			Services: []kubernetesService{{Name: "mysql"}, {Name: "redis"}},
+		})
+		ex.buildRequests = api.ResourceList{api.ResourceCPU: resource.MustParse("1"), api.ResourceMemory: resource.MustParse("1Gi")}
+		ex.buildLimits = api.ResourceList{api.ResourceMemory: resource.MustParse("1Gi")}
+		ex.serviceRequests = api.ResourceList{api.ResourceCPU: resource.MustParse("500m")}
+		ex.serviceLimits = api.ResourceList{api.ResourceMemory: resource.MustParse("256Mi")}
+
+		status := test.Status
+		quota := api.ResourceQuota{
+			ObjectMeta: api.ObjectMeta{Name: "compute", Namespace: "test-ns"},
+			Spec:       api.ResourceQuotaSpec{Hard: test.Hard, Scopes: test.Scopes},
+			Status:     api.ResourceQuotaStatus{Hard: test.Hard, Used: test.Used},
+		}
+		ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+			if test.Disabled {
+				return nil, fmt.Errorf("the quotas shouldn't be listed")
+			}
+			if p, m := req.URL.Path, req.Method; p != "/api/"+version+"/namespaces/test-ns/resourcequotas" || m != "GET" {
+				return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+			}
+			list := &api.ResourceQuotaList{}
+			if test.Hard != nil {
+				list.Items = []api.ResourceQuota{quota}
+			}
+			return &http.Response{StatusCode: status, Body: objBody(codec, list), Header: map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}}, nil
+		})
+
+		err := ex.checkResourceQuota()
+		if test.Error {
+			if assert.Error(t, err, "test %d", i) {
+				assert.Contains(t, err.Error(), "may not fit", "test %d", i)
+			}
+		} else {
+			assert.NoError(t, err, "test %d", i)
+		}
+	}
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{
+		Services: []kubernetesService{{Name: "mysql"}, {Name: "redis"}},
+	})
+	ex.buildRequests = api.ResourceList{api.ResourceCPU: resource.MustParse("1")}
+	ex.serviceRequests = api.ResourceList{api.ResourceCPU: resource.MustParse("500m")}
+	requests, _ := ex.podResources()
+	cpu := requests[api.ResourceCPU]
+	assert.Equal(t, "2", cpu.String())
+	assert.Equal(t, "500m", ex.serviceRequests.Cpu().String(), "the resources of the containers shouldn't be modified")
+
+	for _, test := range []struct {
+		Requests, Limits api.ResourceList
+		Expected         bool
+	}{
+		{Expected: true},
+		{Requests: api.ResourceList{resourceEphemeralStorage: resource.MustParse("1Gi")}, Expected: true},
+		{Requests: api.ResourceList{api.ResourceCPU: resource.MustParse("1")}},
+		{Limits: api.ResourceList{api.ResourceMemory: resource.MustParse("1Gi")}},
+	} {
+		assert.Equal(t, test.Expected, isBestEffort(test.Requests, test.Limits), "requests: %v, limits: %v", test.Requests, test.Limits)
+	}
+}
+
+func TestSetupNamespace(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+	header := map[string][]string{
+		"Content-Type": []string{"application/json"},
+	}
+
+	var created *api.Namespace
+	var deleted []string
+	serviceAccountChecks := 0
+	kubeClient := testKubeClient(func(req *http.Request) (*http.Response, error) {
+		switch p, m := req.URL.Path, req.Method; {
+		case m == "GET" && p == "/api/"+version+"/namespaces/existing":
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &api.Namespace{
+				ObjectMeta: api.ObjectMeta{Name: "existing"},
+			}), Header: header}, nil
+		case m == "GET" && p == "/api/"+version+"/namespaces/forbidden":
+			return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(strings.NewReader("")), Header: map[string][]string{}}, nil
+		case m == "GET" && strings.HasSuffix(p, "/serviceaccounts/default"):
+			serviceAccountChecks++
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &api.ServiceAccount{
+				ObjectMeta: api.ObjectMeta{Name: "default"},
+			}), Header: header}, nil
+		case m == "GET":
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader("")), Header: map[string][]string{}}, nil
+		case m == "POST" && p == "/api/"+version+"/namespaces":
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			namespace := &api.Namespace{}
+			if err = runtime.DecodeInto(codec, body, namespace); err != nil {
+				return nil, err
+			}
+			if namespace.Name == "concurrent" {
+				return &http.Response{StatusCode: 409, Body: objBody(codec, &unversioned.Status{
+					Status: unversioned.StatusFailure,
+					Reason: unversioned.StatusReasonAlreadyExists,
+					Code:   409,
+				}), Header: header}, nil
+			}
+			created = namespace
+			return &http.Response{StatusCode: 201, Body: objBody(codec, namespace), Header: header}, nil
+		case m == "DELETE":
+			deleted = append(deleted, p)
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &unversioned.Status{Status: unversioned.StatusSuccess}), Header: header}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+		}
+	})
+
+	tests := []struct {
+		Namespace       string
+		Disabled        bool
+		PerBuild        bool
+		Labels          map[string]string
+		ExpectedCreated bool
+		ExpectedDeleted bool
+		Error           bool
+	}{
+		{Namespace: "missing", Disabled: true},
+		{Namespace: "existing"},
+		{Namespace: "missing", Labels: map[string]string{"env": "review"}, ExpectedCreated: true, ExpectedDeleted: true},
+		{Namespace: "concurrent"},
+		{Namespace: "forbidden", Error: true},
+		{Namespace: "missing", Labels: map[string]string{"env": "review app"}, Error: true},
+		// the namespace of the build is deleted, even if it already existed
+		{Namespace: "missing", Disabled: true, PerBuild: true, ExpectedCreated: true, ExpectedDeleted: true},
+		{Namespace: "existing", Disabled: true, PerBuild: true, ExpectedDeleted: true},
+		{Namespace: "concurrent", Disabled: true, PerBuild: true, ExpectedDeleted: true},
+	}
+
+	for _, test := range tests {
+		created, deleted, serviceAccountChecks = nil, nil, 0
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Namespace:              test.Namespace,
+			CreateNamespace:        !test.Disabled,
+			NamespaceLabels:        test.Labels,
+			DeleteCreatedNamespace: !test.PerBuild,
+			NamespacePerBuild:      test.PerBuild,
+		}, &kubernetesOptions{Image: "test-image"})
+		ex.kubeClient = kubeClient
+
+		err := ex.setupNamespace()
+		if test.Error {
+			assert.Error(t, err, "namespace: %s", test.Namespace)
+			continue
+		}
+		require.NoError(t, err, "namespace: %s", test.Namespace)
+
+		ex.Cleanup()
+		if test.ExpectedCreated {
+			require.NotNil(t, created)
+			assert.Equal(t, test.Labels, created.Labels)
+			assert.Equal(t, 1, serviceAccountChecks, "namespace: %s", test.Namespace)
+		} else {
+			assert.Nil(t, created, "namespace: %s", test.Namespace)
+		}
+		if test.ExpectedDeleted {
+			assert.Equal(t, []string{"/api/" + version + "/namespaces/" + test.Namespace}, deleted)
+		} else {
+			assert.Empty(t, deleted, "namespace: %s", test.Namespace)
+		}
+	}
+}
+
+func TestBuildNamespace(t *testing.T) {
+	config := &common.KubernetesConfig{Namespace: "ci", NamespacePerBuild: true}
+	ex := newPodTestExecutor(config, &kubernetesOptions{Image: "test-image"})
+	ex.Build.ID = 1234
+	ex.Build.ProjectID = 56
+	ex.Build.Runner.Token = "AbC_dEf9xyz"
+
+	require.NoError(t, ex.checkDefaults())
+	assert.Equal(t, "runner-abc-def9-project-56-concurrent-0-1234", ex.Config.Kubernetes.Namespace)
+	assert.Equal(t, "ci", config.Namespace, "the shared configuration shouldn't be modified")
+
+	ex.Build.ProjectID = 1234567890
+	ex.Build.ProjectRunnerID = 1234567890
+	ex.Build.ID = 1234567890
+	namespace := ex.buildNamespace()
+	assert.Equal(t, validation.DNS1123LabelMaxLength, len(namespace), namespace)
+	assert.Empty(t, validation.IsDNS1123Label(namespace), namespace)
+	assert.True(t, strings.HasSuffix(namespace, "-1234567890"), namespace)
+}
+
+func TestObjectNamePrefix(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	ex.Build.ProjectID = 56
+	ex.Build.Runner.Token = "AbC_dEf9xyz"
+	assert.Equal(t, "runner-abc-def9-project-56-concurrent-0", ex.objectNamePrefix(""))
+	assert.Equal(t, "runner-abc-def9-project-56-concurrent-0-scripts-", ex.objectNamePrefix("scripts"))
+
+	ex.Build.ProjectID = 1234567890
+	ex.Build.ProjectRunnerID = 1234567890
+	for _, kind := range []string{"", "scripts", "registry"} {
+		prefix := ex.objectNamePrefix(kind)
+		assert.True(t, len(prefix) <= generatedNameMaxLength, prefix)
+		assert.Empty(t, validation.IsDNS1123Label(strings.TrimSuffix(prefix, "-")+"abcde"), prefix)
+	}
+	assert.NotEqual(t, ex.objectNamePrefix("scripts"), ex.objectNamePrefix("registry"))
+
+	ex.Config.Kubernetes.PodNamePrefix = "gitlab-ci"
+	for _, kind := range []string{"", "scripts", "registry"} {
+		prefix := ex.objectNamePrefix(kind)
+		assert.True(t, strings.HasPrefix(prefix, "gitlab-ci-runner-abc-def9-"), prefix)
+		assert.True(t, len(prefix) <= generatedNameMaxLength, prefix)
+		assert.Empty(t, validation.IsDNS1123Label(strings.TrimSuffix(prefix, "-")+"abcde"), prefix)
+	}
+	assert.NoError(t, ex.checkDefaults())
+
+	for _, prefix := range []string{"GitLab", "gitlab-", "gitlab_ci", strings.Repeat("a", podNamePrefixMaxLength+1)} {
+		ex.Config.Kubernetes.PodNamePrefix = prefix
+		assert.Error(t, ex.checkDefaults(), prefix)
+	}
+}
+
+func TestWorkspaceMountPath(t *testing.T) {
+	tests := []struct {
+		BuildDir   string
+		MountPath  string
+		Expected   string
+		InvalidErr string
+	}{
+		{BuildDir: "/builds/group/project", Expected: "/builds/group"},
+		{BuildDir: "/builds/group/nested/project/", Expected: "/builds/group/nested"},
+		{BuildDir: "/builds", Expected: "/builds"},
+		{BuildDir: "/builds/group/project", MountPath: "/builds/", Expected: "/builds"},
+		{BuildDir: "/builds/group/project", MountPath: "/builds/group/project", Expected: "/builds/group/project"},
+		{BuildDir: "/builds/group/project", MountPath: "/build", InvalidErr: "doesn't contain the build directory"},
+		{BuildDir: "/builds/group/project", MountPath: "builds", InvalidErr: "expected an absolute path"},
+		{BuildDir: "/builds/group/project", MountPath: "/", InvalidErr: "expected an absolute path"},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{WorkspaceMountPath: test.MountPath}, &kubernetesOptions{Image: "test-image"})
+		ex.Build.BuildDir = test.BuildDir
+
+		err := ex.checkDefaults()
+		if test.InvalidErr != "" {
+			if assert.Error(t, err, test.MountPath) {
+				assert.Contains(t, err.Error(), test.InvalidErr)
+			}
+			continue
+		}
+		assert.NoError(t, err, test.MountPath)
+
+		container := ex.buildContainer("build", "test-image", nil, nil, nil, nil)
+		assert.Equal(t, api.VolumeMount{Name: "repo", MountPath: test.Expected}, container.VolumeMounts[0], test.BuildDir)
+	}
+}
+
+func TestCheckServiceAccount(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	kubeClient := testKubeClient(func(req *http.Request) (*http.Response, error) {
+		switch p, m := req.URL.Path, req.Method; {
+		case m == "GET" && p == "/api/"+version+"/namespaces/test-ns/serviceaccounts/ci":
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &api.ServiceAccount{
+				ObjectMeta: api.ObjectMeta{Name: "ci", Namespace: "test-ns"},
+			}), Header: map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}}, nil
+		case m == "GET" && p == "/api/"+version+"/namespaces/test-ns/serviceaccounts/forbidden":
+			return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(strings.NewReader("")), Header: map[string][]string{}}, nil
+		case m == "GET":
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader("")), Header: map[string][]string{}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+		}
+	})
+
+	tests := []struct {
+		ServiceAccount string
+		Error          bool
+	}{
+		{ServiceAccount: ""},
+		{ServiceAccount: "ci"},
+		{ServiceAccount: "forbidden"},
+		{ServiceAccount: "cl", Error: true},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Namespace:      "test-ns",
+			ServiceAccount: test.ServiceAccount,
+		}, &kubernetesOptions{Image: "test-image"})
+		ex.kubeClient = kubeClient
+
+		err := ex.checkServiceAccount()
+		if test.Error {
+			assert.Error(t, err, "service account: %s", test.ServiceAccount)
+		} else {
+			assert.NoError(t, err, "service account: %s", test.ServiceAccount)
+		}
+	}
+}
+
+func TestServiceOptions(t *testing.T) {
+	build := common.Build{
+		GetBuildResponse: common.GetBuildResponse{
+			Options: common.BuildOptions{
+				"services": []interface{}{
+					"mysql:5.7",
+					map[string]interface{}{
+						"name":         "postgres:9.5",
+						"alias":        "db",
+						"entrypoint":   []interface{}{"docker-entrypoint.sh"},
+						"command":      []interface{}{"postgres", "-c", "fsync=off"},
+						"ports":        []interface{}{5432},
+						"pull_secrets": []interface{}{"registry"},
+					},
+				},
+			},
+		},
+	}
+
+	var options kubernetesOptions
+	require.NoError(t, build.Options.Decode(&options))
+	assert.Equal(t, []kubernetesService{
+		{Name: "mysql:5.7"},
+		{
+			Name:        "postgres:9.5",
+			Alias:       "db",
+			Entrypoint:  []string{"docker-entrypoint.sh"},
+			Command:     []string{"postgres", "-c", "fsync=off"},
+			Ports:       []int32{5432},
+			PullSecrets: []string{"registry"},
+		},
+	}, options.Services)
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &options)
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Empty(t, pod.Spec.Containers[2].Ports)
+	assert.Equal(t, []api.ContainerPort{{ContainerPort: 5432}}, pod.Spec.Containers[3].Ports)
+
+	// the image name keeps the entrypoint and command of the image
+	assert.Empty(t, pod.Spec.Containers[2].Command)
+	assert.Empty(t, pod.Spec.Containers[2].Args)
+	assert.Equal(t, []string{"docker-entrypoint.sh"}, pod.Spec.Containers[3].Command)
+	assert.Equal(t, []string{"postgres", "-c", "fsync=off"}, pod.Spec.Containers[3].Args)
+}
+
+func TestImageOptions(t *testing.T) {
+	tests := []struct {
+		Image              interface{}
+		ExpectedImage      string
+		ExpectedEntrypoint []string
+	}{
+		{Image: nil},
+		{Image: "ruby:2.3", ExpectedImage: "ruby:2.3"},
+		{
+			Image:              map[string]interface{}{"name": "ruby:2.3", "entrypoint": []interface{}{"/usr/bin/tini", "--"}},
+			ExpectedImage:      "ruby:2.3",
+			ExpectedEntrypoint: []string{"/usr/bin/tini", "--"},
+		},
+	}
+
+	for _, test := range tests {
+		build := common.Build{
+			GetBuildResponse: common.GetBuildResponse{
+				Options: common.BuildOptions{
+					"image":    test.Image,
+					"services": []interface{}{"mysql:5.7"},
+				},
+			},
+		}
+
+		var options kubernetesOptions
+		require.NoError(t, build.Options.Decode(&options), "image: %v", test.Image)
+		assert.Equal(t, test.ExpectedImage, options.Image, "image: %v", test.Image)
+		assert.Equal(t, test.ExpectedEntrypoint, options.Entrypoint, "image: %v", test.Image)
+		assert.Equal(t, []kubernetesService{{Name: "mysql:5.7"}}, options.Services, "image: %v", test.Image)
+	}
+}
+
+func TestBuildPodEntrypoint(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	ex.BuildShell = &common.ShellConfiguration{DockerCommand: []string{"sh", "-c", "exec bash"}}
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sh", "-c", "exec bash"}, pod.Spec.Containers[0].Command)
+	assert.Empty(t, pod.Spec.Containers[0].Args)
+
+	ex.options.Entrypoint = []string{"/usr/bin/tini", "--"}
+	pod, err = ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/usr/bin/tini", "--"}, pod.Spec.Containers[0].Command)
+	assert.Equal(t, []string{"sh", "-c", "exec bash"}, pod.Spec.Containers[0].Args)
+
+	// the helper image is not affected
+	assert.Equal(t, []string{"sh", "-c", "exec bash"}, pod.Spec.Containers[1].Command)
+	assert.Empty(t, pod.Spec.Containers[1].Args)
+}
+
+func TestCheckServicePorts(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{
+		Services: []kubernetesService{
+			{Name: "postgres:9.5", Ports: []int32{5432}},
+			{Name: "redis", Ports: []int32{6379}},
+		},
+	})
+	assert.NoError(t, ex.checkServicePorts())
+
+	ex.options.Services = append(ex.options.Services, kubernetesService{
+		Name:  "postgres:9.6",
+		Ports: []int32{8080, 5432},
+	})
+	err := ex.checkServicePorts()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "svc-0 (postgres:9.5) and svc-2 (postgres:9.6) both declare port 5432")
+}
+
+func TestServiceAliases(t *testing.T) {
+	tests := []struct {
+		Service  kubernetesService
+		Expected []string
+	}{
+		{Service: kubernetesService{Name: "mysql"}, Expected: []string{"mysql"}},
+		{Service: kubernetesService{Name: "mysql:5.7"}, Expected: []string{"mysql"}},
+		{Service: kubernetesService{Name: "tutum/wordpress:latest"}, Expected: []string{"tutum-wordpress"}},
+		{Service: kubernetesService{Name: "registry.example.com:5000/ci/mysql:5.7"}, Expected: []string{"registry.example.com:5000-ci-mysql"}},
+		{Service: kubernetesService{Name: "postgres@sha256:0123456789abcdef"}, Expected: []string{"postgres"}},
+		{Service: kubernetesService{Name: "$SERVICE_IMAGE"}, Expected: []string{"redis"}},
+		{Service: kubernetesService{Name: "postgres:9.5", Alias: "db"}, Expected: []string{"db"}},
+		{Service: kubernetesService{Name: "postgres:9.5", Alias: "$SERVICE_ALIAS"}, Expected: []string{"cache"}},
+	}
+
+	variables := common.BuildVariables{
+		{Key: "SERVICE_IMAGE", Value: "redis:3"},
+		{Key: "SERVICE_ALIAS", Value: "cache"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.Expected, test.Service.aliases(variables), "service: %v", test.Service)
+	}
+}
+
+func TestBuildPodServiceHostAliases(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{
+		Image: "test-image",
+		Services: []kubernetesService{
+			{Name: "mysql:5.7"},
+			{Name: "postgres:9.5", Alias: "db"},
+			{Name: "mysql:5.6"},
+			{Name: "registry.example.com:5000/ci/redis"},
+		},
+	})
+	require.NoError(t, ex.checkServiceAliases())
+	assert.Equal(t, []string{"mysql", "db"}, ex.serviceHostnames())
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	c := client.NewOrDie(&restclient.Config{ContentConfig: restclient.ContentConfig{GroupVersion: &unversioned.GroupVersion{Version: testapi.Default.GroupVersion().Version}}})
+	data, err := encodePod(c, pod, ex.buildPodSpecExtra(pod))
+	require.NoError(t, err)
+
+	var encoded struct {
+		Spec struct {
+			HostAliases []struct {
+				IP        string   `json:"ip"`
+				Hostnames []string `json:"hostnames"`
+			} `json:"hostAliases"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	require.Equal(t, 1, len(encoded.Spec.HostAliases))
+	assert.Equal(t, "127.0.0.1", encoded.Spec.HostAliases[0].IP)
+	assert.Equal(t, []string{"mysql", "db"}, encoded.Spec.HostAliases[0].Hostnames)
+
+	ex.options.Services = nil
+	_, found := ex.buildPodSpecExtra(pod)["hostAliases"]
+	assert.False(t, found)
+}
+
+func TestCheckServiceAliases(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{
+		Services: []kubernetesService{
+			{Name: "postgres:9.5", Alias: "db"},
+			{Name: "mysql:5.7"},
+			{Name: "mysql:5.6", Alias: "mysql-old"},
+		},
+	})
+	assert.NoError(t, ex.checkServiceAliases())
+
+	ex.options.Services = append(ex.options.Services, kubernetesService{Name: "postgres:9.6", Alias: "db"})
+	err := ex.checkServiceAliases()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "svc-0 (postgres:9.5) and svc-3 (postgres:9.6) both use the alias db")
+
+	ex.options.Services = []kubernetesService{{Name: "postgres:9.5", Alias: "my_db"}}
+	assert.Error(t, ex.checkServiceAliases())
+}
+
+func TestBuildPodHostAliases(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		HostAliases: []common.KubernetesHostAlias{
+			{IP: "10.1.2.3", Hostnames: []string{"legacy.example.com", "legacy"}},
+		},
+	}, &kubernetesOptions{
+		Image:    "test-image",
+		Services: []kubernetesService{{Name: "postgres:9.5", Alias: "db"}},
+	})
+	require.NoError(t, ex.checkHostAliases())
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	c := client.NewOrDie(&restclient.Config{ContentConfig: restclient.ContentConfig{GroupVersion: &unversioned.GroupVersion{Version: testapi.Default.GroupVersion().Version}}})
+	data, err := encodePod(c, pod, ex.buildPodSpecExtra(pod))
+	require.NoError(t, err)
+
+	var encoded struct {
+		Spec struct {
+			HostAliases []struct {
+				IP        string   `json:"ip"`
+				Hostnames []string `json:"hostnames"`
+			} `json:"hostAliases"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	require.Equal(t, 2, len(encoded.Spec.HostAliases))
+	assert.Equal(t, "127.0.0.1", encoded.Spec.HostAliases[0].IP)
+	assert.Equal(t, []string{"db"}, encoded.Spec.HostAliases[0].Hostnames)
+	assert.Equal(t, "10.1.2.3", encoded.Spec.HostAliases[1].IP)
+	assert.Equal(t, []string{"legacy.example.com", "legacy"}, encoded.Spec.HostAliases[1].Hostnames)
+
+	// the configured host aliases are set without services
+	ex.options.Services = nil
+	assert.Equal(t, 1, len(ex.buildHostAliases()))
+}
+
+func TestCheckHostAliases(t *testing.T) {
+	tests := []struct {
+		HostAliases []common.KubernetesHostAlias
+		Error       bool
+	}{
+		{},
+		{HostAliases: []common.KubernetesHostAlias{{IP: "10.1.2.3", Hostnames: []string{"legacy.example.com"}}}},
+		{HostAliases: []common.KubernetesHostAlias{{IP: "fd00::1", Hostnames: []string{"legacy"}}}},
+		{HostAliases: []common.KubernetesHostAlias{{IP: "legacy", Hostnames: []string{"legacy"}}}, Error: true},
+		{HostAliases: []common.KubernetesHostAlias{{IP: "10.1.2.3"}}, Error: true},
+		{HostAliases: []common.KubernetesHostAlias{{IP: "10.1.2.3", Hostnames: []string{"legacy_host"}}}, Error: true},
+	}
+
+	for i, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{HostAliases: test.HostAliases}, &kubernetesOptions{Image: "test-image"})
+
+		err := ex.checkHostAliases()
+		if test.Error {
+			assert.Error(t, err, "test %d", i)
+		} else {
+			assert.NoError(t, err, "test %d", i)
+		}
+	}
+}
+
+func TestGetHelperImage(t *testing.T) {
+	tests := []struct {
+		HelperImage string
+		Allowed     []string
+		Variable    string
+		Expected    string
+		Error       bool
+	}{
+		{
+			Expected: "munnerz/gitlab-runner-helper",
+		},
+		{
+			HelperImage: "registry.example.com/ci/gitlab-runner-helper:1.5.0",
+			Expected:    "registry.example.com/ci/gitlab-runner-helper:1.5.0",
+		},
+		{
+			HelperImage: "registry.example.com:5000/ci/gitlab-runner-helper:1.5.0",
+			Expected:    "registry.example.com:5000/ci/gitlab-runner-helper:1.5.0",
+		},
+		{
+			HelperImage: "registry.example.com/ci/gitlab-runner-helper@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			Expected:    "registry.example.com/ci/gitlab-runner-helper@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		},
+		{
+			HelperImage: "registry.example.com/ci/gitlab-runner-helper:1.5.0",
+			Variable:    "registry.example.com/ci/gitlab-runner-helper:1.5.0",
+			Expected:    "registry.example.com/ci/gitlab-runner-helper:1.5.0",
+		},
+		{
+			Allowed:  []string{"registry.example.com/ci/*"},
+			Variable: "registry.example.com/ci/gitlab-runner-helper:dev",
+			Expected: "registry.example.com/ci/gitlab-runner-helper:dev",
+		},
+		{
+			Allowed:  []string{"registry.example.com/ci/*"},
+			Variable: "evil/gitlab-runner-helper",
+			Error:    true,
+		},
+		{
+			Variable: "registry.example.com/ci/gitlab-runner-helper:dev",
+			Error:    true,
+		},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			HelperImage:         test.HelperImage,
+			AllowedHelperImages: test.Allowed,
+		}, &kubernetesOptions{Image: "test-image"})
+		if test.Variable != "" {
+			ex.Build.Variables = common.BuildVariables{
+				{Key: "KUBERNETES_HELPER_IMAGE", Value: test.Variable},
+			}
+		}
+
+		helperImage, err := ex.getHelperImage()
+		if test.Error {
+			assert.Error(t, err, "variable: %s", test.Variable)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.Expected, helperImage)
+
+		ex.helperImage = helperImage
+		pod, err := ex.buildPod()
+		require.NoError(t, err)
+		assert.Equal(t, "pre", pod.Spec.Containers[1].Name)
+		assert.Equal(t, test.Expected, pod.Spec.Containers[1].Image)
+	}
+}
+
+func TestPullPolicy(t *testing.T) {
+	for _, pullPolicy := range []string{"", "Always", "IfNotPresent", "Never"} {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			PullPolicy: pullPolicy,
+			Sidecars:   []common.KubernetesSidecar{{Image: "proxy:latest"}},
+		}, &kubernetesOptions{
+			Image:    "test-image",
+			Services: []kubernetesService{{Name: "test-service"}},
+		})
+		require.NoError(t, ex.checkDefaults(), pullPolicy)
+
+		pod, err := ex.buildPod()
+		require.NoError(t, err)
+		require.Equal(t, 4, len(pod.Spec.Containers))
+		for _, container := range pod.Spec.Containers {
+			assert.Equal(t, api.PullPolicy(pullPolicy), container.ImagePullPolicy, container.Name)
+		}
+	}
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{PullPolicy: "always"}, &kubernetesOptions{Image: "test-image"})
+	assert.Error(t, ex.checkDefaults())
+}
+
+func TestRestartPolicy(t *testing.T) {
+	tests := map[string]api.RestartPolicy{
+		"":          api.RestartPolicyNever,
+		"Never":     api.RestartPolicyNever,
+		"OnFailure": api.RestartPolicyOnFailure,
+		"Always":    api.RestartPolicyAlways,
+	}
+
+	for restartPolicy, expected := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{RestartPolicy: restartPolicy}, &kubernetesOptions{Image: "test-image"})
+		require.NoError(t, ex.checkDefaults(), restartPolicy)
+
+		pod, err := ex.buildPod()
+		require.NoError(t, err)
+		assert.Equal(t, expected, pod.Spec.RestartPolicy, restartPolicy)
+	}
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{RestartPolicy: "never"}, &kubernetesOptions{Image: "test-image"})
+	assert.Error(t, ex.checkDefaults())
+}
+
+func TestDNSPolicy(t *testing.T) {
+	for _, dnsPolicy := range []string{"", "ClusterFirst", "ClusterFirstWithHostNet", "Default", "None"} {
+		ex := newPodTestExecutor(&common.KubernetesConfig{DNSPolicy: dnsPolicy}, &kubernetesOptions{Image: "test-image"})
+		require.NoError(t, ex.checkDefaults(), dnsPolicy)
+
+		pod, err := ex.buildPod()
+		require.NoError(t, err)
+		assert.Equal(t, api.DNSPolicy(dnsPolicy), pod.Spec.DNSPolicy)
+	}
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{DNSPolicy: "clusterfirst"}, &kubernetesOptions{Image: "test-image"})
+	assert.Error(t, ex.checkDefaults())
+}
+
+func TestBuildPodDNSConfig(t *testing.T) {
+	ndots := "2"
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		DNSPolicy: "None",
+		DNSConfig: common.KubernetesDNSConfig{
+			Nameservers: []string{"10.0.0.10", "fd00::10"},
+			Searches:    []string{"ci.example.com"},
+			Options: []common.KubernetesDNSConfigOption{
+				{Name: "ndots", Value: &ndots},
+				{Name: "edns0"},
+			},
+		},
+	}, &kubernetesOptions{Image: "test-image"})
+	require.NoError(t, ex.checkDNSConfig())
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	c := client.NewOrDie(&restclient.Config{ContentConfig: restclient.ContentConfig{GroupVersion: &unversioned.GroupVersion{Version: testapi.Default.GroupVersion().Version}}})
+	data, err := encodePod(c, pod, ex.buildPodSpecExtra(pod))
+	require.NoError(t, err)
+
+	var encoded struct {
+		Spec struct {
+			DNSPolicy string `json:"dnsPolicy"`
+			DNSConfig struct {
+				Nameservers []string `json:"nameservers"`
+				Searches    []string `json:"searches"`
+				Options     []struct {
+					Name  string  `json:"name"`
+					Value *string `json:"value"`
+				} `json:"options"`
+			} `json:"dnsConfig"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	assert.Equal(t, "None", encoded.Spec.DNSPolicy)
+	assert.Equal(t, []string{"10.0.0.10", "fd00::10"}, encoded.Spec.DNSConfig.Nameservers)
+	assert.Equal(t, []string{"ci.example.com"}, encoded.Spec.DNSConfig.Searches)
+	require.Equal(t, 2, len(encoded.Spec.DNSConfig.Options))
+	assert.Equal(t, "ndots", encoded.Spec.DNSConfig.Options[0].Name)
+	assert.Equal(t, &ndots, encoded.Spec.DNSConfig.Options[0].Value)
+	assert.Equal(t, "edns0", encoded.Spec.DNSConfig.Options[1].Name)
+	assert.Nil(t, encoded.Spec.DNSConfig.Options[1].Value)
+
+	ex.Config.Kubernetes.DNSConfig = common.KubernetesDNSConfig{}
+	_, found := ex.buildPodSpecExtra(pod)["dnsConfig"]
+	assert.False(t, found)
+}
+
+func TestBuildPodAutomountServiceAccountToken(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{ServiceAccount: "ci"}, &kubernetesOptions{Image: "test-image"})
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	_, found := ex.buildPodSpecExtra(pod)["automountServiceAccountToken"]
+	assert.False(t, found)
+
+	automount := false
+	ex.Config.Kubernetes.AutomountServiceAccountToken = &automount
+
+	c := client.NewOrDie(&restclient.Config{ContentConfig: restclient.ContentConfig{GroupVersion: &unversioned.GroupVersion{Version: testapi.Default.GroupVersion().Version}}})
+	data, err := encodePod(c, pod, ex.buildPodSpecExtra(pod))
+	require.NoError(t, err)
+
+	var encoded struct {
+		Spec struct {
+			ServiceAccountName           string `json:"serviceAccountName"`
+			AutomountServiceAccountToken *bool  `json:"automountServiceAccountToken"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	assert.Equal(t, "ci", encoded.Spec.ServiceAccountName)
+	assert.Equal(t, &automount, encoded.Spec.AutomountServiceAccountToken)
+}
+
+func TestBuildPodShareProcessNamespace(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	_, found := ex.buildPodSpecExtra(pod)["shareProcessNamespace"]
+	assert.False(t, found)
+
+	share := true
+	ex.Config.Kubernetes.ShareProcessNamespace = &share
+
+	c := client.NewOrDie(&restclient.Config{ContentConfig: restclient.ContentConfig{GroupVersion: &unversioned.GroupVersion{Version: testapi.Default.GroupVersion().Version}}})
+	data, err := encodePod(c, pod, ex.buildPodSpecExtra(pod))
+	require.NoError(t, err)
+
+	var encoded struct {
+		Spec struct {
+			ShareProcessNamespace *bool `json:"shareProcessNamespace"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	assert.Equal(t, &share, encoded.Spec.ShareProcessNamespace)
+}
+
+func TestBuildPodSpecTemplate(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	template, err := parsePodSpec(`
+runtimeClassName: gvisor
+restartPolicy: Always
+containers:
+- name: build
+  image: template-image
+  stdin: true
+topologySpreadConstraints:
+- maxSkew: 1
+  topologyKey: kubernetes.io/hostname
+  whenUnsatisfiable: ScheduleAnyway
+`)
+	require.NoError(t, err)
+
+	c := client.NewOrDie(&restclient.Config{ContentConfig: restclient.ContentConfig{GroupVersion: &unversioned.GroupVersion{Version: testapi.Default.GroupVersion().Version}}})
+	extra, err := podSpecWithTemplate(c, pod, template, ex.buildPodSpecExtra(pod))
+	require.NoError(t, err)
+	data, err := encodePod(c, pod, extra)
+	require.NoError(t, err)
+
+	var encoded struct {
+		Spec struct {
+			RuntimeClassName          string        `json:"runtimeClassName"`
+			RestartPolicy             string        `json:"restartPolicy"`
+			TopologySpreadConstraints []interface{} `json:"topologySpreadConstraints"`
+			Containers                []struct {
+				Name  string `json:"name"`
+				Image string `json:"image"`
+				Stdin bool   `json:"stdin"`
+			} `json:"containers"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	assert.Equal(t, "gvisor", encoded.Spec.RuntimeClassName)
+	assert.Len(t, encoded.Spec.TopologySpreadConstraints, 1)
+	// the fields managed by the executor replace the ones of the template
+	assert.Equal(t, "Never", encoded.Spec.RestartPolicy)
+	require.Equal(t, 2, len(encoded.Spec.Containers))
+	assert.Equal(t, "build", encoded.Spec.Containers[0].Name)
+	assert.Equal(t, "test-image", encoded.Spec.Containers[0].Image)
+	assert.True(t, encoded.Spec.Containers[0].Stdin)
+
+	// the template isn't modified by the pods
+	assert.Equal(t, "Always", template["restartPolicy"])
+
+	_, err = parsePodSpec("containers: [")
+	assert.Error(t, err)
+}
+
+func TestCheckDNSConfig(t *testing.T) {
+	tests := []struct {
+		Policy string
+		Config common.KubernetesDNSConfig
+		Error  bool
+	}{
+		{},
+		{Policy: "ClusterFirst", Config: common.KubernetesDNSConfig{Searches: []string{"ci.example.com."}}},
+		{Policy: "None", Config: common.KubernetesDNSConfig{Nameservers: []string{"10.0.0.10"}}},
+		{Policy: "None", Config: common.KubernetesDNSConfig{Searches: []string{"ci.example.com"}}, Error: true},
+		{Config: common.KubernetesDNSConfig{Nameservers: []string{"dns.example.com"}}, Error: true},
+		{Config: common.KubernetesDNSConfig{Nameservers: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}}, Error: true},
+		{Config: common.KubernetesDNSConfig{Searches: []string{"a", "b", "c", "d", "e", "f", "g"}}, Error: true},
+		{Config: common.KubernetesDNSConfig{Searches: []string{"CI_example"}}, Error: true},
+		{Config: common.KubernetesDNSConfig{Options: []common.KubernetesDNSConfigOption{{}}}, Error: true},
+	}
+
+	for i, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			DNSPolicy: test.Policy,
+			DNSConfig: test.Config,
+		}, &kubernetesOptions{Image: "test-image"})
+
+		err := ex.checkDNSConfig()
+		if test.Error {
+			assert.Error(t, err, "test %d", i)
+		} else {
+			assert.NoError(t, err, "test %d", i)
+		}
+	}
+}
+
+func TestGetNodeSelector(t *testing.T) {
+	nodePools := map[string]map[string]string{
+		"gpu": {
+			"pool":        "gpu",
+			"accelerator": "nvidia-tesla-k80",
+		},
+		"highmem": {
+			"pool": "highmem",
+		},
+	}
+
+	tests := []struct {
+		Variable string
+		Expected map[string]string
+		Error    bool
+	}{
+		{},
+		{
+			Variable: "gpu",
+			Expected: map[string]string{
+				"pool":        "gpu",
+				"accelerator": "nvidia-tesla-k80",
+			},
+		},
+		{
+			Variable: "highmem",
+			Expected: map[string]string{"pool": "highmem"},
+		},
+		{
+			Variable: "unknown",
+			Error:    true,
+		},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			NodePools: nodePools,
+		}, &kubernetesOptions{Image: "test-image"})
+		if test.Variable != "" {
+			ex.Build.Variables = common.BuildVariables{
+				{Key: "KUBERNETES_NODE_POOL", Value: test.Variable},
+			}
+		}
+
+		nodeSelector, err := ex.getNodeSelector()
+		if test.Error {
+			assert.Error(t, err, "variable: %s", test.Variable)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.Expected, nodeSelector)
+
+		ex.nodeSelector = nodeSelector
+		pod, err := ex.buildPod()
+		require.NoError(t, err)
+		assert.Equal(t, test.Expected, pod.Spec.NodeSelector)
+	}
+}
+
+func TestGetNodeSelectorVariable(t *testing.T) {
+	tests := []struct {
+		Pool     string
+		Variable string
+		Expected map[string]string
+		Error    bool
+	}{
+		{
+			Expected: map[string]string{"role": "ci", "arch": "amd64"},
+		},
+		{
+			Pool:     "arm",
+			Expected: map[string]string{"role": "ci", "arch": "arm64"},
+		},
+		{
+			Variable: "disk=ssd, zone = eu-1a",
+			Expected: map[string]string{"role": "ci", "arch": "amd64", "disk": "ssd", "zone": "eu-1a"},
+		},
+		{
+			Pool:     "arm",
+			Variable: "zone=eu-1b",
+			Expected: map[string]string{"role": "ci", "arch": "arm64", "zone": "eu-1b"},
+		},
+		{
+			Variable: "role=prod",
+			Error:    true,
+		},
+		{
+			Variable: "disk",
+			Error:    true,
+		},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			NodeSelector:         map[string]string{"role": "ci", "arch": "amd64"},
+			NodePools:            map[string]map[string]string{"arm": {"arch": "arm64"}},
+			AllowedNodeSelectors: []string{"disk=*", "zone=eu-*"},
+		}, &kubernetesOptions{Image: "test-image"})
+		ex.Build.Variables = common.BuildVariables{
+			{Key: "KUBERNETES_NODE_POOL", Value: test.Pool},
+			{Key: "KUBERNETES_NODE_SELECTOR", Value: test.Variable},
+		}
+
+		nodeSelector, err := ex.getNodeSelector()
+		if test.Error {
+			assert.Error(t, err, "variable: %s", test.Variable)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.Expected, nodeSelector)
+	}
+}
+
+func TestGetPriorityClass(t *testing.T) {
+	tests := []struct {
+		Configured string
+		Allowed    []string
+		Variable   string
+		Expected   string
+		Error      bool
+	}{
+		{
+			Allowed: []string{"high"},
+		},
+		{
+			Allowed:  []string{"high", "debug-*"},
+			Variable: "high",
+			Expected: "high",
+		},
+		{
+			Allowed:  []string{"high", "debug-*"},
+			Variable: "debug-interactive",
+			Expected: "debug-interactive",
+		},
+		{
+			Allowed:  []string{"high"},
+			Variable: "system-cluster-critical",
+			Error:    true,
+		},
+		{
+			Variable: "high",
+			Error:    true,
+		},
+		{
+			Configured: "low",
+			Expected:   "low",
+		},
+		{
+			Configured: "low",
+			Variable:   "low",
+			Expected:   "low",
+		},
+		{
+			Configured: "low",
+			Allowed:    []string{"high"},
+			Variable:   "high",
+			Expected:   "high",
+		},
+		{
+			Configured: "low",
+			Variable:   "high",
+			Error:      true,
+		},
+		{
+			Configured: "Low_Priority",
+			Error:      true,
+		},
+		{
+			Allowed:  []string{"*"},
+			Variable: "high priority",
+			Error:    true,
+		},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			PriorityClassName:      test.Configured,
+			AllowedPriorityClasses: test.Allowed,
+		}, &kubernetesOptions{})
+		if test.Variable != "" {
+			ex.Build.Variables = common.BuildVariables{
+				{Key: "KUBERNETES_PRIORITY_CLASS", Value: test.Variable},
+			}
+		}
+
+		priorityClass, err := ex.getPriorityClass()
+		if test.Error {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.Expected, priorityClass)
+
+		ex.priorityClass = priorityClass
+		extra := ex.buildPodSpecExtra(&api.Pod{})
+		if test.Expected == "" {
+			_, found := extra["priorityClassName"]
+			assert.False(t, found)
+		} else {
+			assert.Equal(t, test.Expected, extra["priorityClassName"])
+		}
+	}
+}
+
+func TestBuildTolerations(t *testing.T) {
+	seconds := int64(300)
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Tolerations: []common.KubernetesToleration{
+			{Key: "dedicated", Value: "ci", Effect: "NoSchedule"},
+			{Key: "node.kubernetes.io/unreachable", Operator: "Exists", Effect: "NoExecute", TolerationSeconds: &seconds},
+		},
+	}, &kubernetesOptions{Image: "test-image"})
+	require.NoError(t, ex.checkTolerations())
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	c := client.NewOrDie(&restclient.Config{ContentConfig: restclient.ContentConfig{GroupVersion: &unversioned.GroupVersion{Version: testapi.Default.GroupVersion().Version}}})
+	data, err := encodePod(c, pod, ex.buildPodSpecExtra(pod))
+	require.NoError(t, err)
+
+	var encoded struct {
+		Spec struct {
+			Tolerations []map[string]interface{} `json:"tolerations"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	assert.Equal(t, []map[string]interface{}{
+		{"key": "dedicated", "value": "ci", "effect": "NoSchedule"},
+		{"key": "node.kubernetes.io/unreachable", "operator": "Exists", "effect": "NoExecute", "tolerationSeconds": float64(300)},
+	}, encoded.Spec.Tolerations)
+
+	ex.Config.Kubernetes.Tolerations = nil
+	_, found := ex.buildPodSpecExtra(pod)["tolerations"]
+	assert.False(t, found)
+}
+
+func TestCheckTolerations(t *testing.T) {
+	seconds := int64(60)
+	tests := []struct {
+		Toleration common.KubernetesToleration
+		Error      bool
+	}{
+		{Toleration: common.KubernetesToleration{Key: "dedicated", Value: "ci"}},
+		{Toleration: common.KubernetesToleration{Operator: "Exists"}},
+		{Toleration: common.KubernetesToleration{Key: "dedicated", Operator: "Exists", Effect: "PreferNoSchedule"}},
+		{Toleration: common.KubernetesToleration{Key: "dedicated", Effect: "NoExecute", TolerationSeconds: &seconds}},
+		{Toleration: common.KubernetesToleration{Value: "ci"}, Error: true},
+		{Toleration: common.KubernetesToleration{Key: "dedicated", Operator: "Exists", Value: "ci"}, Error: true},
+		{Toleration: common.KubernetesToleration{Key: "dedicated", Operator: "In"}, Error: true},
+		{Toleration: common.KubernetesToleration{Key: "dedicated", Effect: "NoStart"}, Error: true},
+		{Toleration: common.KubernetesToleration{Key: "dedicated", Effect: "NoSchedule", TolerationSeconds: &seconds}, Error: true},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Tolerations: []common.KubernetesToleration{test.Toleration},
+		}, &kubernetesOptions{Image: "test-image"})
+
+		err := ex.checkTolerations()
+		if test.Error {
+			assert.Error(t, err, "toleration: %v", test.Toleration)
+		} else {
+			assert.NoError(t, err, "toleration: %v", test.Toleration)
+		}
+	}
+}
+
+func TestBuildPodDownwardAPI(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		DownwardAPIPath: "/etc/podinfo",
+	}, &kubernetesOptions{Image: "test-image"})
+	ex.Build.ID = 42
+	ex.Build.ProjectID = 7
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"gitlab-runner/build":      "true",
+		"gitlab-runner/build-id":   "42",
+		"gitlab-runner/project-id": "7",
+	}, pod.Labels)
+
+	require.Equal(t, 2, len(pod.Spec.Volumes))
+	volume := pod.Spec.Volumes[1]
+	assert.Equal(t, "podinfo", volume.Name)
+	require.NotNil(t, volume.DownwardAPI)
+	assert.Equal(t, []api.DownwardAPIVolumeFile{
+		{
+			Path:     "labels",
+			FieldRef: &api.ObjectFieldSelector{APIVersion: "v1", FieldPath: "metadata.labels"},
+		},
+		{
+			Path:     "annotations",
+			FieldRef: &api.ObjectFieldSelector{APIVersion: "v1", FieldPath: "metadata.annotations"},
+		},
+	}, volume.DownwardAPI.Items)
+
+	build := pod.Spec.Containers[0]
+	assert.Equal(t, "build", build.Name)
+	assert.Contains(t, build.VolumeMounts, api.VolumeMount{
+		Name:      "podinfo",
+		MountPath: "/etc/podinfo",
+		ReadOnly:  true,
+	})
+	for _, container := range pod.Spec.Containers[1:] {
+		for _, mount := range container.VolumeMounts {
+			assert.NotEqual(t, "podinfo", mount.Name, container.Name)
+		}
+	}
+
+	ex.Config.Kubernetes.DownwardAPIPath = ""
+	pod, err = ex.buildPod()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pod.Spec.Volumes))
+	assert.Equal(t, "repo", pod.Spec.Volumes[0].Name)
+}
+
+func TestBuildPodInfoVariables(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	for _, container := range pod.Spec.Containers {
+		assert.Contains(t, container.Env, api.EnvVar{
+			Name: "KUBERNETES_POD_NAME",
+			ValueFrom: &api.EnvVarSource{
+				FieldRef: &api.ObjectFieldSelector{APIVersion: "v1", FieldPath: "metadata.name"},
+			},
+		}, container.Name)
+		assert.Contains(t, container.Env, api.EnvVar{
+			Name: "KUBERNETES_NODE_NAME",
+			ValueFrom: &api.EnvVarSource{
+				FieldRef: &api.ObjectFieldSelector{APIVersion: "v1", FieldPath: "spec.nodeName"},
+			},
+		}, container.Name)
+	}
+}
+
+func TestProxyVariables(t *testing.T) {
+	defer os.Setenv("HTTPS_PROXY", os.Getenv("HTTPS_PROXY"))
+	defer os.Setenv("https_proxy", os.Getenv("https_proxy"))
+	os.Setenv("HTTPS_PROXY", "")
+	os.Setenv("https_proxy", "http://runner-proxy.example.com:3128")
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		HTTPProxy: "http://proxy.example.com:3128",
+		NoProxy:   "localhost,.svc",
+	}, &kubernetesOptions{Image: "test-image"})
+	ex.Build.Variables = common.BuildVariables{
+		{Key: "no_proxy", Value: "localhost", Public: true},
+	}
+
+	variables := ex.containerVariables()
+	assert.Equal(t, common.BuildVariables{
+		{Key: "HTTP_PROXY", Value: "http://proxy.example.com:3128"},
+		{Key: "http_proxy", Value: "http://proxy.example.com:3128"},
+		{Key: "NO_PROXY", Value: "localhost,.svc"},
+	}, variables[:3])
+	assert.Equal(t, "localhost", variables.Get("no_proxy"))
+	assert.Equal(t, "", variables.Get("HTTPS_PROXY"))
+
+	ex.Config.Kubernetes.InheritProxy = true
+	variables = ex.containerVariables()
+	assert.Equal(t, "http://runner-proxy.example.com:3128", variables.Get("HTTPS_PROXY"))
+	assert.Equal(t, "http://runner-proxy.example.com:3128", variables.Get("https_proxy"))
+	assert.Equal(t, "http://proxy.example.com:3128", variables.Get("HTTP_PROXY"))
+}
+
+func TestBuildPodResourceVariables(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	for _, env := range pod.Spec.Containers[0].Env {
+		assert.NotEqual(t, "KUBERNETES_CPU_LIMIT", env.Name)
+	}
+
+	ex.Config.Kubernetes.ResourceVariables = true
+	pod, err = ex.buildPod()
+	require.NoError(t, err)
+
+	build := pod.Spec.Containers[0]
+	assert.Contains(t, build.Env, api.EnvVar{
+		Name: "KUBERNETES_CPU_LIMIT",
+		ValueFrom: &api.EnvVarSource{
+			ResourceFieldRef: &api.ResourceFieldSelector{
+				Resource: "limits.cpu",
+				Divisor:  resource.MustParse("1"),
+			},
+		},
+	})
+	assert.Contains(t, build.Env, api.EnvVar{
+		Name: "KUBERNETES_MEMORY_REQUEST",
+		ValueFrom: &api.EnvVarSource{
+			ResourceFieldRef: &api.ResourceFieldSelector{
+				Resource: "requests.memory",
+				Divisor:  resource.MustParse("1"),
+			},
+		},
+	})
+	for _, container := range pod.Spec.Containers[1:] {
+		for _, env := range container.Env {
+			assert.NotEqual(t, "KUBERNETES_CPU_LIMIT", env.Name, container.Name)
+		}
+	}
+}
+
+func TestBuildPodAutoscalerEviction(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Nil(t, pod.Annotations)
+
+	ex.Config.Kubernetes.PreventAutoscalerEviction = true
+	pod, err = ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, "false", pod.Annotations["cluster-autoscaler.kubernetes.io/safe-to-evict"])
+	assert.Equal(t, "true", pod.Annotations["karpenter.sh/do-not-disrupt"])
+}
+
+func TestBuildPodLabels(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		PodLabels: map[string]string{
+			"team":                 "backend",
+			"example.com/branch":   "$CI_BUILD_REF_NAME",
+			"gitlab-runner/build":  "false",
+			"gitlab-runner/custom": "value",
+		},
+	}, &kubernetesOptions{Image: "test-image"})
+	ex.Build.Variables = common.BuildVariables{
+		{Key: "CI_BUILD_REF_NAME", Value: "feature-1"},
+	}
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Equal(t, "backend", pod.Labels["team"])
+	assert.Equal(t, "feature-1", pod.Labels["example.com/branch"])
+	// the labels of the runner can't be replaced
+	assert.Equal(t, "true", pod.Labels[buildPodLabel])
+	for key, value := range ex.buildLabels() {
+		assert.Equal(t, value, pod.Labels[key], key)
+	}
+}
+
+func TestCheckPodLabels(t *testing.T) {
+	tests := []struct {
+		Labels map[string]string
+		Error  bool
+	}{
+		{Labels: nil},
+		{Labels: map[string]string{"team": "backend", "example.com/branch": "$CI_BUILD_REF_NAME"}},
+		{Labels: map[string]string{"team": ""}},
+		{Labels: map[string]string{"gitlab-runner/custom": "value"}, Error: true},
+		{Labels: map[string]string{"-team": "backend"}, Error: true},
+		{Labels: map[string]string{"example.com/team/name": "backend"}, Error: true},
+		{Labels: map[string]string{"team": "back end"}, Error: true},
+		{Labels: map[string]string{"branch": "$CI_BUILD_REF"}, Error: true},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{PodLabels: test.Labels}, &kubernetesOptions{Image: "test-image"})
+		ex.Build.Variables = common.BuildVariables{
+			{Key: "CI_BUILD_REF_NAME", Value: "feature-1"},
+			{Key: "CI_BUILD_REF", Value: "refs/heads/feature-1"},
+		}
+
+		err := ex.checkPodLabels()
+		if test.Error {
+			assert.Error(t, err, "labels: %v", test.Labels)
+		} else {
+			assert.NoError(t, err, "labels: %v", test.Labels)
+		}
+	}
+}
+
+func TestPodSecurityStandard(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		PodSecurityStandard: "restricted",
+		Sidecars: []common.KubernetesSidecar{
+			{Name: "proxy", Image: "proxy:latest"},
+		},
+	}, &kubernetesOptions{
+		Image:    "test-image",
+		Services: []kubernetesService{{Name: "postgres"}},
+	})
+	ex.helperImage = defaultHelperImage
+	require.NoError(t, ex.checkPodSecurityStandard())
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	require.NotNil(t, pod.Spec.SecurityContext)
+	require.NotNil(t, pod.Spec.SecurityContext.RunAsNonRoot)
+	assert.True(t, *pod.Spec.SecurityContext.RunAsNonRoot)
+
+	require.Equal(t, 4, len(pod.Spec.Containers))
+	for _, container := range pod.Spec.Containers {
+		require.NotNil(t, container.SecurityContext, container.Name)
+		require.NotNil(t, container.SecurityContext.Capabilities, container.Name)
+		assert.Equal(t, []api.Capability{"ALL"}, container.SecurityContext.Capabilities.Drop, container.Name)
+		if container.SecurityContext.Privileged != nil {
+			assert.False(t, *container.SecurityContext.Privileged, container.Name)
+		}
+	}
+
+	c := client.NewOrDie(&restclient.Config{ContentConfig: restclient.ContentConfig{GroupVersion: &unversioned.GroupVersion{Version: testapi.Default.GroupVersion().Version}}})
+	data, err := encodePod(c, pod, ex.buildPodSpecExtra(pod))
+	require.NoError(t, err)
+
+	var encoded struct {
+		Spec struct {
+			SecurityContext struct {
+				RunAsNonRoot   bool `json:"runAsNonRoot"`
+				SeccompProfile struct {
+					Type string `json:"type"`
+				} `json:"seccompProfile"`
+			} `json:"securityContext"`
+			Containers []struct {
+				Name            string `json:"name"`
+				Image           string `json:"image"`
+				SecurityContext struct {
+					AllowPrivilegeEscalation *bool `json:"allowPrivilegeEscalation"`
+					Capabilities             struct {
+						Drop []string `json:"drop"`
+					} `json:"capabilities"`
+				} `json:"securityContext"`
+			} `json:"containers"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+
+	assert.True(t, encoded.Spec.SecurityContext.RunAsNonRoot)
+	assert.Equal(t, "RuntimeDefault", encoded.Spec.SecurityContext.SeccompProfile.Type)
+	require.Equal(t, 4, len(encoded.Spec.Containers))
+	for _, container := range encoded.Spec.Containers {
+		assert.NotEmpty(t, container.Image, container.Name)
+		require.NotNil(t, container.SecurityContext.AllowPrivilegeEscalation, container.Name)
+		assert.False(t, *container.SecurityContext.AllowPrivilegeEscalation, container.Name)
+		assert.Equal(t, []string{"ALL"}, container.SecurityContext.Capabilities.Drop, container.Name)
+	}
+}
+
+func TestPodSecurityStandardBaseline(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		PodSecurityStandard: "baseline",
+	}, &kubernetesOptions{Image: "test-image"})
+	require.NoError(t, ex.checkPodSecurityStandard())
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Nil(t, pod.Spec.SecurityContext)
+	assert.Nil(t, pod.Spec.Containers[0].SecurityContext.Capabilities)
+
+	_, found := ex.buildPodSpecExtra(pod)["securityContext"]
+	assert.False(t, found)
+}
+
+func TestCheckPodSecurityStandard(t *testing.T) {
+	tests := []struct {
+		Standard   string
+		Privileged bool
+		Error      bool
+	}{
+		{Standard: "", Privileged: true},
+		{Standard: "baseline"},
+		{Standard: "restricted"},
+		{Standard: "baseline", Privileged: true, Error: true},
+		{Standard: "restricted", Privileged: true, Error: true},
+		{Standard: "unknown", Error: true},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			PodSecurityStandard: test.Standard,
+			Privileged:          test.Privileged,
+		}, &kubernetesOptions{Image: "test-image"})
+
+		err := ex.checkPodSecurityStandard()
+		if test.Error {
+			assert.Error(t, err, "standard: %s, privileged: %v", test.Standard, test.Privileged)
+		} else {
+			assert.NoError(t, err, "standard: %s, privileged: %v", test.Standard, test.Privileged)
+		}
+	}
+}
+
+func TestGetHostNetwork(t *testing.T) {
+	tests := []struct {
+		HostNetwork bool
+		Allow       bool
+		Variable    string
+		DNSPolicy   string
+		Standard    string
+		Expected    bool
+		Error       bool
+	}{
+		{},
+		{HostNetwork: true, Allow: true, DNSPolicy: "ClusterFirstWithHostNet", Expected: true},
+		{Variable: "true", Allow: true, DNSPolicy: "ClusterFirstWithHostNet", Expected: true},
+		{HostNetwork: true, Variable: "false", Allow: true, DNSPolicy: "ClusterFirstWithHostNet"},
+		{HostNetwork: true, Allow: true, DNSPolicy: "Default", Expected: true},
+		{HostNetwork: true, DNSPolicy: "ClusterFirstWithHostNet", Error: true},
+		{Variable: "true", DNSPolicy: "ClusterFirstWithHostNet", Error: true},
+		{HostNetwork: true, Allow: true, Error: true},
+		{HostNetwork: true, Allow: true, DNSPolicy: "ClusterFirst", Error: true},
+		{HostNetwork: true, Allow: true, DNSPolicy: "ClusterFirstWithHostNet", Standard: "baseline", Error: true},
+		{Variable: "yes please", Allow: true, Error: true},
+	}
+
+	for i, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			HostNetwork:         test.HostNetwork,
+			AllowHostNetwork:    test.Allow,
+			DNSPolicy:           test.DNSPolicy,
+			PodSecurityStandard: test.Standard,
+		}, &kubernetesOptions{Image: "test-image"})
+		ex.Build.Variables = common.BuildVariables{
+			{Key: "KUBERNETES_HOST_NETWORK", Value: test.Variable},
+		}
+
+		hostNetwork, err := ex.getHostNetwork()
+		if test.Error {
+			assert.Error(t, err, "test %d", i)
+			continue
+		}
+		require.NoError(t, err, "test %d", i)
+		assert.Equal(t, test.Expected, hostNetwork, "test %d", i)
+	}
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	ex.hostNetwork = true
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	c := client.NewOrDie(&restclient.Config{ContentConfig: restclient.ContentConfig{GroupVersion: &unversioned.GroupVersion{Version: testapi.Default.GroupVersion().Version}}})
+	data, err := encodePod(c, pod, nil)
+	require.NoError(t, err)
+
+	var encoded struct {
+		Spec struct {
+			HostNetwork bool `json:"hostNetwork"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	assert.True(t, encoded.Spec.HostNetwork)
+}
+
+func TestBuildPodSecurityContext(t *testing.T) {
+	user, group, fsGroup := int64(1000), int64(2000), int64(3000)
+	runAsNonRoot := true
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		PodSecurityContext: common.KubernetesPodSecurityContext{
+			RunAsUser:    &user,
+			RunAsGroup:   &group,
+			RunAsNonRoot: &runAsNonRoot,
+			FSGroup:      &fsGroup,
+		},
+	}, &kubernetesOptions{Image: "test-image"})
+	require.NoError(t, ex.checkPodSecurityContext())
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	require.NotNil(t, pod.Spec.SecurityContext)
+	assert.Equal(t, &user, pod.Spec.SecurityContext.RunAsUser)
+	assert.Equal(t, &runAsNonRoot, pod.Spec.SecurityContext.RunAsNonRoot)
+	assert.Equal(t, &fsGroup, pod.Spec.SecurityContext.FSGroup)
+
+	c := client.NewOrDie(&restclient.Config{ContentConfig: restclient.ContentConfig{GroupVersion: &unversioned.GroupVersion{Version: testapi.Default.GroupVersion().Version}}})
+	data, err := encodePod(c, pod, ex.buildPodSpecExtra(pod))
+	require.NoError(t, err)
+
+	var encoded struct {
+		Spec struct {
+			SecurityContext struct {
+				RunAsUser    int64 `json:"runAsUser"`
+				RunAsGroup   int64 `json:"runAsGroup"`
+				RunAsNonRoot bool  `json:"runAsNonRoot"`
+				FSGroup      int64 `json:"fsGroup"`
+			} `json:"securityContext"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	assert.Equal(t, user, encoded.Spec.SecurityContext.RunAsUser)
+	assert.Equal(t, group, encoded.Spec.SecurityContext.RunAsGroup)
+	assert.True(t, encoded.Spec.SecurityContext.RunAsNonRoot)
+	assert.Equal(t, fsGroup, encoded.Spec.SecurityContext.FSGroup)
+
+	// the restricted standard doesn't replace the configured values
+	ex.Config.Kubernetes.PodSecurityStandard = "restricted"
+	runAsNonRoot = false
+	ex.Config.Kubernetes.PodSecurityContext = common.KubernetesPodSecurityContext{RunAsNonRoot: &runAsNonRoot}
+	pod, err = ex.buildPod()
+	require.NoError(t, err)
+	assert.False(t, *pod.Spec.SecurityContext.RunAsNonRoot)
+}
+
+func TestBuildPodWithoutSecurityContext(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+	assert.Nil(t, pod.Spec.SecurityContext)
+
+	_, found := ex.buildPodSpecExtra(pod)["securityContext"]
+	assert.False(t, found)
+}
+
+func TestCheckPodSecurityContext(t *testing.T) {
+	root, user, negative := int64(0), int64(1000), int64(-1)
+	yes, no := true, false
+
+	tests := []struct {
+		Standard string
+		Context  common.KubernetesPodSecurityContext
+		Error    bool
+	}{
+		{},
+		{Context: common.KubernetesPodSecurityContext{RunAsUser: &root, RunAsNonRoot: &no}},
+		{Context: common.KubernetesPodSecurityContext{RunAsUser: &user, RunAsGroup: &root, RunAsNonRoot: &yes, FSGroup: &root}},
+		{Context: common.KubernetesPodSecurityContext{RunAsUser: &negative}, Error: true},
+		{Context: common.KubernetesPodSecurityContext{RunAsGroup: &negative}, Error: true},
+		{Context: common.KubernetesPodSecurityContext{FSGroup: &negative}, Error: true},
+		{Context: common.KubernetesPodSecurityContext{RunAsUser: &root, RunAsNonRoot: &yes}, Error: true},
+		{Standard: "baseline", Context: common.KubernetesPodSecurityContext{RunAsUser: &root}},
+		{Standard: "restricted", Context: common.KubernetesPodSecurityContext{RunAsUser: &user, RunAsNonRoot: &yes}},
+		{Standard: "restricted", Context: common.KubernetesPodSecurityContext{RunAsUser: &root}, Error: true},
+		{Standard: "restricted", Context: common.KubernetesPodSecurityContext{RunAsNonRoot: &no}, Error: true},
+	}
+
+	for i, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			PodSecurityStandard: test.Standard,
+			PodSecurityContext:  test.Context,
+		}, &kubernetesOptions{Image: "test-image"})
+
+		err := ex.checkPodSecurityStandard()
+		if err == nil {
+			err = ex.checkPodSecurityContext()
+		}
+		if test.Error {
+			assert.Error(t, err, "test %d", i)
+		} else {
+			assert.NoError(t, err, "test %d", i)
+		}
+	}
+}
+
+func TestExecCommand(t *testing.T) {
+	pipefail := "if (set -o pipefail) 2>/dev/null; then set -o pipefail; " +
+		"else echo 'WARNING: The shell doesn'\\''t support `set -o pipefail`, skipping it' >&2; fi\n"
+
+	tests := []struct {
+		WorkingDir      string
+		ShellFlags      []string
+		Predefined      bool
+		ExpectedCommand []string
+		ExpectedScript  string
+	}{
+		{
+			ExpectedCommand: []string{"sh", "-c", `cd '/builds/group/project' 2>/dev/null; exec "$0" "$@"`, "bash", "-s"},
+			ExpectedScript:  "echo test\n",
+		},
+		{
+			WorkingDir: "$CI_PROJECT_DIR/src",
+			ShellFlags: []string{"-o pipefail"},
+			ExpectedCommand: []string{"sh", "-c", `cd '/builds/group/project/src' || ` +
+				`{ printf 'ERROR: Failed to change to the exec working directory %s\n' '/builds/group/project/src' >&2; exit 1; }; ` +
+				`exec "$0" "$@"`, "bash", "-s"},
+			ExpectedScript: pipefail + "echo test\n",
+		},
+		{
+			WorkingDir:      "$CI_PROJECT_DIR/src",
+			ShellFlags:      []string{"-o pipefail"},
+			Predefined:      true,
+			ExpectedCommand: []string{"sh", "-c", `cd '/builds/group/project' 2>/dev/null; exec "$0" "$@"`, "bash", "-s"},
+			ExpectedScript:  pipefail + "echo test\n",
+		},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			ExecWorkingDir: test.WorkingDir,
+			ShellFlags:     test.ShellFlags,
+		}, &kubernetesOptions{Image: "test-image"})
+		ex.Build.BuildDir = "/builds/group/project"
+		ex.Build.Variables = common.BuildVariables{
+			{Key: "CI_PROJECT_DIR", Value: "/builds/group/project"},
+		}
+		ex.BuildShell.DockerCommand = []string{"bash", "-s"}
+		require.NoError(t, ex.checkShellFlags())
+
+		command, script := ex.execCommand("echo test\n", test.Predefined)
+		assert.Equal(t, test.ExpectedCommand, command)
+		assert.Equal(t, test.ExpectedScript, script)
+	}
+}
+
+func TestExecCommandInShell(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is required")
+	}
+
+	dir, err := ioutil.TempDir("", "exec-command")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		WorkingDir string
+		Predefined bool
+		Output     string
+		Error      string
+	}{
+		{WorkingDir: dir, Output: dir + "\n"},
+		{WorkingDir: "$CI_PROJECT_DIR/missing", Error: "Failed to change to the exec working directory " + dir + "/missing"},
+		{WorkingDir: "$CI_PROJECT_DIR/missing", Predefined: true, Output: dir + "\n"},
+	}
+
+	for _, test := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			ExecWorkingDir: test.WorkingDir,
+			ShellFlags:     []string{"-e", "-o pipefail"},
+		}, &kubernetesOptions{Image: "test-image"})
+		ex.Build.BuildDir = dir
+		ex.Build.Variables = common.BuildVariables{
+			{Key: "CI_PROJECT_DIR", Value: dir},
+		}
+		ex.BuildShell.DockerCommand = []string{"sh", "-s"}
+		require.NoError(t, ex.checkShellFlags())
+
+		command, script := ex.execCommand("pwd\n", test.Predefined)
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdin = strings.NewReader(script)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		err := cmd.Run()
+		if test.Error == "" {
+			assert.NoError(t, err, stderr.String())
+		} else {
+			assert.Error(t, err)
+			assert.Contains(t, stderr.String(), test.Error)
+		}
+		assert.Equal(t, test.Output, stdout.String(), test.WorkingDir)
+	}
+}
+
+func TestCheckShellFlags(t *testing.T) {
+	for _, flag := range []string{"-e", "+x", "-eu", "-o pipefail", "+o noclobber"} {
+		ex := newPodTestExecutor(&common.KubernetesConfig{ShellFlags: []string{flag}}, &kubernetesOptions{})
+		assert.NoError(t, ex.checkShellFlags(), flag)
+	}
+
+	for _, flag := range []string{"", "x", "-e; rm -rf /", "$(id)"} {
+		ex := newPodTestExecutor(&common.KubernetesConfig{ShellFlags: []string{flag}}, &kubernetesOptions{})
+		assert.Error(t, ex.checkShellFlags(), flag)
+	}
+}
+
+func TestBuildEvents(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	for _, emitEvents := range []bool{true, false} {
+		var events []*api.Event
+
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Namespace:  "test-ns",
+			EmitEvents: emitEvents,
+		}, &kubernetesOptions{
+			Image: "test-image",
+		})
+		ex.Build.ID = 42
+		ex.Build.ProjectID = 7
+		ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+			switch p, m := req.URL.Path, req.Method; {
+			case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "GET":
+				return &http.Response{StatusCode: 200, Body: objBody(codec, &api.PodList{}), Header: map[string][]string{
+					"Content-Type": []string{"application/json"},
+				}}, nil
+			case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "POST":
+				return &http.Response{StatusCode: 201, Body: objBody(codec, &api.Pod{
+					ObjectMeta: api.ObjectMeta{
+						Name:      "test-pod",
+						Namespace: "test-ns",
+						UID:       "test-uid",
+					},
+				}), Header: map[string][]string{
+					"Content-Type": []string{"application/json"},
+				}}, nil
+			case p == "/api/"+version+"/namespaces/test-ns/events" && m == "POST":
+				body, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					return nil, err
+				}
+				event := &api.Event{}
+				if err = runtime.DecodeInto(codec, body, event); err != nil {
+					return nil, err
+				}
+				events = append(events, event)
+
+				return &http.Response{StatusCode: 201, Body: objBody(codec, event), Header: map[string][]string{
+					"Content-Type": []string{"application/json"},
+				}}, nil
+			default:
+				return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+			}
+		})
+
+		require.NoError(t, ex.setupBuildPod())
+		ex.Finish(errors.New("exit code 1"))
+
+		if !emitEvents {
+			assert.Empty(t, events)
+			continue
+		}
+
+		require.Equal(t, 2, len(events))
+		assert.Equal(t, api.EventTypeNormal, events[0].Type)
+		assert.Equal(t, "BuildStarted", events[0].Reason)
+		assert.Equal(t, "Build 42 of project 7 started", events[0].Message)
+		assert.Equal(t, api.EventTypeWarning, events[1].Type)
+		assert.Equal(t, "BuildFailed", events[1].Reason)
+		assert.Equal(t, "Build 42 of project 7 failed: exit code 1", events[1].Message)
+
+		for _, event := range events {
+			assert.Equal(t, "test-ns", event.Namespace)
+			assert.Equal(t, "Pod", event.InvolvedObject.Kind)
+			assert.Equal(t, "test-pod", event.InvolvedObject.Name)
+			assert.Equal(t, "gitlab-runner", event.Source.Component)
+			require.Equal(t, 1, len(event.OwnerReferences))
+			assert.Equal(t, "test-pod", event.OwnerReferences[0].Name)
+			assert.Equal(t, "test-uid", string(event.OwnerReferences[0].UID))
+		}
+	}
+}
+
+func TestScriptsConfigMap(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	var configMap *api.ConfigMap
+	var pod *api.Pod
+	deleted := false
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Namespace:        "test-ns",
+		ScriptsConfigMap: true,
+	}, &kubernetesOptions{
+		Image: "test-image",
+	})
+	ex.Build.BuildDir = "/builds/group/project"
+	ex.Build.Sha = "1234567890abcdef"
+	ex.Build.RefName = "master"
+	ex.ExecutorOptions.Shell = common.ShellScriptInfo{
+		Shell: "bash",
+		Type:  common.NormalShell,
+		Build: ex.Build,
+	}
+	ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+		header := map[string][]string{
+			"Content-Type": []string{"application/json"},
+		}
+
+		switch p, m := req.URL.Path, req.Method; {
+		case p == "/api/"+version+"/namespaces/test-ns/configmaps" && m == "POST":
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			configMap = &api.ConfigMap{}
+			if err = runtime.DecodeInto(codec, body, configMap); err != nil {
+				return nil, err
+			}
+			configMap.Name = "test-scripts"
+			return &http.Response{StatusCode: 201, Body: objBody(codec, configMap), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "GET":
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &api.PodList{}), Header: map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "POST":
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			pod = &api.Pod{}
+			if err = runtime.DecodeInto(codec, body, pod); err != nil {
+				return nil, err
+			}
+			pod.Name = "test-pod"
+			return &http.Response{StatusCode: 201, Body: objBody(codec, pod), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/configmaps/test-scripts" && m == "DELETE":
+			deleted = true
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &unversioned.Status{Status: unversioned.StatusSuccess}), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/pods/test-pod" && m == "DELETE":
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &unversioned.Status{Status: unversioned.StatusSuccess}), Header: header}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+		}
+	})
+
+	require.NoError(t, ex.setupBuildPod())
+
+	require.NotNil(t, configMap)
+	buildScript, err := common.GenerateShellScript(common.ShellBuildScript, *ex.Shell())
+	require.NoError(t, err)
+	assert.Equal(t, buildScript, configMap.Data["build_script"])
+	assert.NotEmpty(t, configMap.Data["prepare_script"])
+
+	require.NotNil(t, pod)
+	require.Equal(t, 2, len(pod.Spec.Volumes))
+	assert.Equal(t, "scripts", pod.Spec.Volumes[1].Name)
+	require.NotNil(t, pod.Spec.Volumes[1].ConfigMap)
+	assert.Equal(t, "test-scripts", pod.Spec.Volumes[1].ConfigMap.Name)
+	for _, container := range pod.Spec.Containers[:2] {
+		assert.Contains(t, container.VolumeMounts, api.VolumeMount{
+			Name:      "scripts",
+			MountPath: "/gitlab-runner/scripts",
+			ReadOnly:  true,
+		}, container.Name)
+	}
+
+	assert.Equal(t, ". '/gitlab-runner/scripts/build_script'\n", ex.containerScript(common.ExecutorCommand{
+		Script: buildScript,
+	}))
+	assert.Equal(t, "echo unknown\n", ex.containerScript(common.ExecutorCommand{
+		Script: "echo unknown\n",
+	}))
+
+	ex.Cleanup()
+	assert.True(t, deleted, "the scripts config map should be deleted")
+}
+
+func TestScriptsConfigMapPassFile(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	var configMap *api.ConfigMap
+	var pod *api.Pod
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Namespace: "test-ns",
+	}, &kubernetesOptions{
+		Image: "test-image",
+	})
+	ex.Build.BuildDir = "/builds/group/project"
+	ex.Build.Sha = "1234567890abcdef"
+	ex.Build.RefName = "master"
+	ex.ExecutorOptions.Shell = common.ShellScriptInfo{
+		Shell: "powershell",
+		Type:  common.NormalShell,
+		Build: ex.Build,
+	}
+
+	var err error
+	ex.BuildShell, err = common.GetShellConfiguration(*ex.Shell())
+	require.NoError(t, err)
+	require.True(t, ex.BuildShell.PassFile)
+
+	ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+		header := map[string][]string{
+			"Content-Type": []string{"application/json"},
+		}
+
+		switch p, m := req.URL.Path, req.Method; {
+		case p == "/api/"+version+"/namespaces/test-ns/configmaps" && m == "POST":
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			configMap = &api.ConfigMap{}
+			if err = runtime.DecodeInto(codec, body, configMap); err != nil {
+				return nil, err
+			}
+			configMap.Name = "test-scripts"
+			return &http.Response{StatusCode: 201, Body: objBody(codec, configMap), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "GET":
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &api.PodList{}), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "POST":
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			pod = &api.Pod{}
+			if err = runtime.DecodeInto(codec, body, pod); err != nil {
+				return nil, err
+			}
+			pod.Name = "test-pod"
+			return &http.Response{StatusCode: 201, Body: objBody(codec, pod), Header: header}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+		}
+	})
+
+	require.NoError(t, ex.setupBuildPod())
+
+	// the config map is created for the shells which require a script file
+	require.NotNil(t, configMap)
+	buildScript, err := common.GenerateShellScript(common.ShellBuildScript, *ex.Shell())
+	require.NoError(t, err)
+	assert.Equal(t, buildScript, configMap.Data["build_script.ps1"])
+
+	require.NotNil(t, pod)
+	assert.Equal(t, []string{"powershell"}, pod.Spec.Containers[0].Command)
+	assert.Equal(t, []string{"powershell"}, pod.Spec.Containers[1].Command)
+
+	command, err := ex.passFileCommand(buildScript)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"powershell", "-noprofile", "-noninteractive", "-executionpolicy", "Bypass",
+		"-command", "/gitlab-runner/scripts/build_script.ps1"}, command)
+
+	_, err = ex.passFileCommand("echo unknown")
+	assert.Error(t, err)
+}
+
+func TestJobTokenSecret(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	var secret *api.Secret
+	var podSpec struct {
+		Volumes []struct {
+			Name   string `json:"name"`
+			Secret *struct {
+				SecretName  string `json:"secretName"`
+				DefaultMode int    `json:"defaultMode"`
+			} `json:"secret"`
+		} `json:"volumes"`
+		Containers []api.Container `json:"containers"`
+	}
+	deleted := false
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Namespace:    "test-ns",
+		JobTokenPath: "/var/run/gitlab",
+	}, &kubernetesOptions{
+		Image: "test-image",
+	})
+	ex.Build.Token = "job-token"
+	ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+		header := map[string][]string{
+			"Content-Type": []string{"application/json"},
+		}
+
+		switch p, m := req.URL.Path, req.Method; {
+		case p == "/api/"+version+"/namespaces/test-ns/secrets" && m == "POST":
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			secret = &api.Secret{}
+			if err = runtime.DecodeInto(codec, body, secret); err != nil {
+				return nil, err
+			}
+			secret.Name = "test-token"
+			return &http.Response{StatusCode: 201, Body: objBody(codec, secret), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "GET":
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &api.PodList{}), Header: map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "POST":
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			var pod struct {
+				Spec interface{} `json:"spec"`
+			}
+			pod.Spec = &podSpec
+			if err = json.Unmarshal(body, &pod); err != nil {
+				return nil, err
+			}
+			return &http.Response{StatusCode: 201, Body: objBody(codec, &api.Pod{
+				ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"},
+			}), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/secrets/test-token" && m == "DELETE":
+			deleted = true
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &unversioned.Status{Status: unversioned.StatusSuccess}), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/pods/test-pod" && m == "DELETE":
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &unversioned.Status{Status: unversioned.StatusSuccess}), Header: header}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+		}
+	})
+
+	require.NoError(t, ex.setupBuildPod())
+
+	require.NotNil(t, secret)
+	assert.Equal(t, map[string][]byte{"CI_BUILD_TOKEN": []byte("job-token")}, secret.Data)
+	assert.Equal(t, "test-ns", secret.Namespace)
+
+	require.Equal(t, 2, len(podSpec.Volumes))
+	volume := podSpec.Volumes[1]
+	assert.Equal(t, "job-token", volume.Name)
+	require.NotNil(t, volume.Secret)
+	assert.Equal(t, "test-token", volume.Secret.SecretName)
+	assert.Equal(t, 0400, volume.Secret.DefaultMode)
+
+	build := podSpec.Containers[0]
+	assert.Contains(t, build.VolumeMounts, api.VolumeMount{
+		Name:      "job-token",
+		MountPath: "/var/run/gitlab",
+		ReadOnly:  true,
+	})
+	assert.Contains(t, build.Env, api.EnvVar{Name: "CI_BUILD_TOKEN_FILE", Value: "/var/run/gitlab/CI_BUILD_TOKEN"})
+	for _, env := range build.Env {
+		assert.NotEqual(t, "CI_BUILD_TOKEN", env.Name)
+		assert.NotEqual(t, "job-token", env.Value, env.Name)
+	}
+
+	ex.Cleanup()
+	assert.True(t, deleted, "the job token secret should be deleted")
+}
+
+func TestDockerAuthSecret(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	var secret *api.Secret
+	var podSpec struct {
+		ImagePullSecrets []api.LocalObjectReference `json:"imagePullSecrets"`
+	}
+	deleted := false
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Namespace: "test-ns",
+	}, &kubernetesOptions{
+		Image: "registry.example.com/ci/image",
+	})
+	ex.Build.Variables = common.BuildVariables{
+		{Key: "DOCKER_AUTH_CONFIG", Value: `{"auths": {"registry.example.com": {"auth": "dXNlcjpwYXNz"}}}`},
+		{Key: "CI_REGISTRY", Value: "gitlab.example.com:5005"},
+		{Key: "CI_REGISTRY_USER", Value: "gitlab-ci-token"},
+		{Key: "CI_REGISTRY_PASSWORD", Value: "job-token"},
+	}
+	ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+		header := map[string][]string{
+			"Content-Type": []string{"application/json"},
+		}
+
+		switch p, m := req.URL.Path, req.Method; {
+		case p == "/api/"+version+"/namespaces/test-ns/serviceaccounts/default" && m == "GET":
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &api.ServiceAccount{
+				ObjectMeta:       api.ObjectMeta{Name: "default", Namespace: "test-ns"},
+				ImagePullSecrets: []api.LocalObjectReference{{Name: "account-registry"}},
+			}), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/secrets" && m == "POST":
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			secret = &api.Secret{}
+			if err = runtime.DecodeInto(codec, body, secret); err != nil {
+				return nil, err
+			}
+			secret.Name = "test-registry"
+			return &http.Response{StatusCode: 201, Body: objBody(codec, secret), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "GET":
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &api.PodList{}), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "POST":
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			var pod struct {
+				Spec interface{} `json:"spec"`
+			}
+			pod.Spec = &podSpec
+			if err = json.Unmarshal(body, &pod); err != nil {
+				return nil, err
+			}
+			return &http.Response{StatusCode: 201, Body: objBody(codec, &api.Pod{
+				ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"},
+			}), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/secrets/test-registry" && m == "DELETE":
+			deleted = true
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &unversioned.Status{Status: unversioned.StatusSuccess}), Header: header}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/pods/test-pod" && m == "DELETE":
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &unversioned.Status{Status: unversioned.StatusSuccess}), Header: header}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+		}
+	})
+
+	require.NoError(t, ex.setupBuildPod())
+
+	require.NotNil(t, secret)
+	assert.Equal(t, api.SecretTypeDockerConfigJson, secret.Type)
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	require.NoError(t, json.Unmarshal(secret.Data[api.DockerConfigJsonKey], &config))
+	assert.Equal(t, "dXNlcjpwYXNz", config.Auths["registry.example.com"].Auth)
+	assert.Equal(t, "Z2l0bGFiLWNpLXRva2VuOmpvYi10b2tlbg==", config.Auths["gitlab.example.com:5005"].Auth)
+	assert.Equal(t, []api.LocalObjectReference{{Name: "account-registry"}, {Name: "test-registry"}}, podSpec.ImagePullSecrets)
+
+	ex.Cleanup()
+	assert.True(t, deleted, "the registry secret should be deleted")
+
+	ex.Build.Variables = common.BuildVariables{{Key: "DOCKER_AUTH_CONFIG", Value: "invalid"}}
+	assert.Error(t, ex.setupDockerAuthSecret())
+}
+
+func TestSetupBuildPodExistingPod(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	tests := []struct {
+		Policy  string
+		Pods    []api.Pod
+		Adopted string
+		Created bool
+		Error   bool
+	}{
+		{
+			Pods: []api.Pod{
+				{
+					ObjectMeta: api.ObjectMeta{Name: "finished-pod", Namespace: "test-ns"},
+					Status:     api.PodStatus{Phase: api.PodFailed},
+				},
+				{
+					ObjectMeta: api.ObjectMeta{Name: "running-pod", Namespace: "test-ns"},
+					Status:     api.PodStatus{Phase: api.PodRunning},
+				},
+			},
+			Adopted: "running-pod",
+		},
+		{
+			Policy: "adopt",
+			Pods: []api.Pod{
+				{
+					ObjectMeta: api.ObjectMeta{Name: "pending-pod", Namespace: "test-ns"},
+					Status:     api.PodStatus{Phase: api.PodPending},
+				},
+			},
+			Adopted: "pending-pod",
+		},
+		{
+			Policy: "fail",
+			Pods: []api.Pod{
+				{
+					ObjectMeta: api.ObjectMeta{Name: "running-pod", Namespace: "test-ns"},
+					Status:     api.PodStatus{Phase: api.PodRunning},
+				},
+			},
+			Error: true,
+		},
+		{
+			Policy: "fail",
+			Pods: []api.Pod{
+				{
+					ObjectMeta: api.ObjectMeta{Name: "finished-pod", Namespace: "test-ns"},
+					Status:     api.PodStatus{Phase: api.PodSucceeded},
+				},
+			},
+			Created: true,
+		},
+	}
+
+	for _, test := range tests {
+		labelSelector := ""
+		created := false
+
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Namespace:         "test-ns",
+			ExistingPodPolicy: test.Policy,
+		}, &kubernetesOptions{
+			Image: "test-image",
+		})
+		ex.Build.ID = 42
+		ex.Build.ProjectID = 7
+		ex.Build.Runner.Token = "abcdefgh1234"
+		ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+			header := map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}
+
+			switch p, m := req.URL.Path, req.Method; {
+			case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "GET":
+				labelSelector = req.URL.Query().Get("labelSelector")
+				return &http.Response{StatusCode: 200, Body: objBody(codec, &api.PodList{Items: test.Pods}), Header: header}, nil
+			case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "POST":
+				created = true
+				return &http.Response{StatusCode: 201, Body: objBody(codec, &api.Pod{
+					ObjectMeta: api.ObjectMeta{Name: "new-pod", Namespace: "test-ns"},
+				}), Header: header}, nil
+			default:
+				return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+			}
+		})
+
+		err := ex.setupBuildPod()
+		assert.Equal(t, "gitlab-runner/build-id=42,gitlab-runner/project-id=7,gitlab-runner/runner=abcdefgh", labelSelector)
+		assert.Equal(t, test.Created, created, "policy: %s", test.Policy)
+
+		if test.Error {
+			assert.Error(t, err, "policy: %s", test.Policy)
+			assert.Nil(t, ex.pod)
+			continue
+		}
+		require.NoError(t, err, "policy: %s", test.Policy)
+		require.NotNil(t, ex.pod)
+		if test.Created {
+			assert.Equal(t, "new-pod", ex.pod.Name)
+		} else {
+			assert.Equal(t, test.Adopted, ex.pod.Name)
+		}
+	}
+
+	// the default policy isn't written to the shared configuration
+	config := &common.KubernetesConfig{Namespace: "test-ns"}
+	ex := newPodTestExecutor(config, &kubernetesOptions{Image: "test-image"})
+	require.NoError(t, ex.checkDefaults())
+	assert.Empty(t, config.ExistingPodPolicy)
+
+	config.ExistingPodPolicy = "replace"
+	assert.Error(t, ex.checkDefaults())
+}
+
+func TestSetupBuildPodRetry(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	defer func(interval time.Duration) {
+		podCreationRetryInterval = interval
+	}(podCreationRetryInterval)
+	podCreationRetryInterval = time.Millisecond
+
+	tests := []struct {
+		Name      string
+		Failures  []int
+		Created   bool
+		Existing  bool
+		Requests  int
+		Error     bool
+		Retrying  bool
+		Reconnect bool
+	}{
+		{Name: "no failure", Requests: 1, Created: true},
+		{Name: "API server restarted", Failures: []int{503, 502}, Requests: 3, Created: true, Retrying: true},
+		{Name: "API server overloaded", Failures: []int{429}, Requests: 2, Created: true, Retrying: true},
+		{Name: "API server down", Failures: []int{503, 503, 503, 503}, Requests: 4, Error: true, Retrying: true},
+		{Name: "invalid pod", Failures: []int{422}, Requests: 1, Error: true},
+		{Name: "quota exceeded", Failures: []int{403}, Requests: 1, Error: true},
+		{Name: "connection reset", Failures: []int{0}, Requests: 1, Existing: true, Retrying: true},
+	}
+
+	for _, test := range tests {
+		requests := 0
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Namespace: "test-ns",
+		}, &kubernetesOptions{
+			Image: "test-image",
+		})
+		ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+			header := map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}
+
+			switch p, m := req.URL.Path, req.Method; {
+			case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "GET":
+				pods := &api.PodList{}
+				if test.Existing && requests > 0 {
+					// the pod was created by the request which failed
+					pods.Items = []api.Pod{{
+						ObjectMeta: api.ObjectMeta{Name: "existing-pod", Namespace: "test-ns"},
+						Status:     api.PodStatus{Phase: api.PodPending},
+					}}
+				}
+				return &http.Response{StatusCode: 200, Body: objBody(codec, pods), Header: header}, nil
+			case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "POST":
+				requests++
+				if requests <= len(test.Failures) {
+					if code := test.Failures[requests-1]; code != 0 {
+						return &http.Response{StatusCode: code, Body: ioutil.NopCloser(strings.NewReader("")), Header: map[string][]string{}}, nil
+					}
+					return nil, fmt.Errorf("connection reset by peer")
+				}
+				return &http.Response{StatusCode: 201, Body: objBody(codec, &api.Pod{
+					ObjectMeta: api.ObjectMeta{Name: "new-pod", Namespace: "test-ns"},
+				}), Header: header}, nil
+			default:
+				return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+			}
+		})
+
+		trace := ""
+		buildTrace := FakeBuildTrace{
+			testWriter{
+				call: func(b []byte) (int, error) {
+					trace += string(b)
+					return len(b), nil
+				},
+			},
+		}
+		ex.AbstractExecutor.BuildTrace = buildTrace
+		ex.AbstractExecutor.BuildLogger = common.NewBuildLogger(buildTrace, logrus.WithFields(logrus.Fields{}))
+
+		err := ex.setupBuildPod()
+		assert.Equal(t, test.Requests, requests, test.Name)
+		assert.Equal(t, test.Retrying, strings.Contains(trace, "retrying"), test.Name)
+		if test.Error {
+			assert.Error(t, err, test.Name)
+			continue
+		}
+		require.NoError(t, err, test.Name)
+		if test.Existing {
+			assert.Equal(t, "existing-pod", ex.pod.Name, test.Name)
+		} else {
+			assert.Equal(t, "new-pod", ex.pod.Name, test.Name)
+		}
+	}
+}
+
+func TestSetupBuildPodYAML(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Namespace:    "test-ns",
+		PrintPodYAML: true,
+		PodYAMLFile:  "pod.yml",
+	}, &kubernetesOptions{
+		Image: "test-image",
+	})
+	ex.Build.BuildDir = "/builds/group/project"
+	ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+		switch p, m := req.URL.Path, req.Method; {
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "GET":
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &api.PodList{}), Header: map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}}, nil
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "POST":
+			return &http.Response{StatusCode: 201, Body: objBody(codec, &api.Pod{
+				ObjectMeta: api.ObjectMeta{
+					Name:      "test-pod",
+					Namespace: "test-ns",
+				},
+			}), Header: map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+		}
+	})
+
+	trace := ""
+	buildTrace := FakeBuildTrace{
+		testWriter{
+			call: func(b []byte) (int, error) {
+				trace += string(b)
+				return len(b), nil
+			},
+		},
+	}
+	ex.AbstractExecutor.BuildTrace = buildTrace
+	ex.AbstractExecutor.BuildLogger = common.NewBuildLogger(buildTrace, logrus.WithFields(logrus.Fields{}))
+
+	require.NoError(t, ex.setupBuildPod())
+	assert.Contains(t, trace, "Created pod test-ns/test-pod")
+	assert.Contains(t, trace, "name: test-pod")
+	assert.Contains(t, trace, "image: test-image")
+
+	script := ex.podYAMLScript()
+	assert.Contains(t, script, "cat > '/builds/group/project/pod.yml' <<'GITLAB_RUNNER_POD_YAML' || ")
+	assert.Contains(t, script, "image: test-image")
+	assert.True(t, strings.HasSuffix(script, "\nGITLAB_RUNNER_POD_YAML\n"))
+
+	// the file is written by the build scripts until one of them succeeded
+	cmd := common.ExecutorCommand{Script: "echo build\n"}
+	assert.False(t, strings.HasPrefix(ex.containerScript(common.ExecutorCommand{Script: "echo clone\n", Predefined: true}), "cat >"))
+	assert.True(t, strings.HasPrefix(ex.containerScript(cmd), "cat >"))
+	assert.True(t, strings.HasPrefix(ex.containerScript(cmd), "cat >"))
+	ex.podYAMLWritten = true
+	assert.Equal(t, "echo build\n", ex.containerScript(cmd))
+}
+
+func TestPodYAMLScriptInShell(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is required")
+	}
+
+	dir, err := ioutil.TempDir("", "pod-yaml")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		BuildDir string
+		Error    bool
+	}{
+		{BuildDir: dir},
+		{BuildDir: filepath.Join(dir, "missing"), Error: true},
+	} {
+		ex := newPodTestExecutor(&common.KubernetesConfig{PodYAMLFile: "pod.yml"}, &kubernetesOptions{Image: "test-image"})
+		ex.Build.BuildDir = test.BuildDir
+		ex.podYAML = "kind: Pod\n"
+
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-s")
+		cmd.Stdin = strings.NewReader(ex.podYAMLScript() + "echo build\n")
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if test.Error {
+			assert.Error(t, err, test.BuildDir)
+			assert.Contains(t, stderr.String(), "Failed to write the pod YAML", test.BuildDir)
+			assert.Empty(t, out, test.BuildDir)
+			continue
+		}
+
+		require.NoError(t, err, stderr.String())
+		assert.Equal(t, "build\n", string(out))
+		written, err := ioutil.ReadFile(filepath.Join(test.BuildDir, "pod.yml"))
+		require.NoError(t, err)
+		assert.Equal(t, "kind: Pod\n", string(written))
+	}
+}
+
+func TestSetupBuildPodJob(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+	header := map[string][]string{
+		"Content-Type": []string{"application/json"},
+	}
+
+	defer func(interval time.Duration) { jobPodCheckInterval = interval }(jobPodCheckInterval)
+	jobPodCheckInterval = 10 * time.Millisecond
+
+	var job, deleteOptions map[string]interface{}
+	jobPodLists := 0
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Namespace: "test-ns",
+		RunAsJob:  true,
+	}, &kubernetesOptions{
+		Image: "test-image",
+	})
+	ex.kubeClient = testKubeClient(func(req *http.Request) (*http.Response, error) {
+		switch p, m := req.URL.Path, req.Method; {
+		case p == "/api/"+version+"/namespaces/test-ns/pods" && m == "GET":
+			list := &api.PodList{}
+			if req.URL.Query().Get("labelSelector") == jobNameLabel+"=test-job" {
+				// the pod is created by the job controller after the first check
+				if jobPodLists++; jobPodLists > 1 {
+					list.Items = []api.Pod{{ObjectMeta: api.ObjectMeta{Name: "test-job-abcde", Namespace: "test-ns"}}}
+				}
+			}
+			return &http.Response{StatusCode: 200, Body: objBody(codec, list), Header: header}, nil
+		case p == "/apis/batch/v1/namespaces/test-ns/jobs" && m == "POST":
+			body, err := ioutil.ReadAll(req.Body)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(body, &job))
+			return &http.Response{StatusCode: 201, Body: ioutil.NopCloser(strings.NewReader(
+				`{"kind":"Job","metadata":{"name":"test-job","namespace":"test-ns"}}`)), Header: header}, nil
+		case p == "/apis/batch/v1/namespaces/test-ns/jobs/test-job" && m == "DELETE":
+			body, err := ioutil.ReadAll(req.Body)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(body, &deleteOptions))
+			return &http.Response{StatusCode: 200, Body: objBody(codec, &unversioned.Status{Status: unversioned.StatusSuccess}), Header: header}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+		}
+	})
+
+	require.NoError(t, ex.setupBuildPod())
+	assert.Equal(t, "test-job", ex.job)
+	require.NotNil(t, ex.pod)
+	assert.Equal(t, "test-job-abcde", ex.pod.Name)
+	assert.Equal(t, 2, jobPodLists)
+
+	require.NotNil(t, job)
+	assert.Equal(t, "batch/v1", job["apiVersion"])
+	assert.Equal(t, "Job", job["kind"])
+	spec := job["spec"].(map[string]interface{})
+	assert.Equal(t, float64(0), spec["backoffLimit"])
+	template := spec["template"].(map[string]interface{})
+	labels := template["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	assert.Equal(t, "true", labels[buildPodLabel])
+	podSpec := template["spec"].(map[string]interface{})
+	assert.Equal(t, "Never", podSpec["restartPolicy"])
+	assert.Equal(t, 2, len(podSpec["containers"].([]interface{})))
+
+	// the failed builds aren't kept, the pod is deleted with the job
+	ex.Config.Kubernetes.KeepFailedPods = 600
+	ex.Finish(errors.New("exit code 1"))
+	ex.Cleanup()
+	assert.False(t, ex.keepFailedPod)
+	require.NotNil(t, deleteOptions)
+	assert.Equal(t, "Foreground", deleteOptions["propagationPolicy"])
+
+	ex.Config.Kubernetes.RestartPolicy = "Always"
+	assert.Error(t, ex.checkDefaults())
 }
 
 func TestKubernetesSuccessRun(t *testing.T) {
@@ -0,0 +1,186 @@
+package kubernetes
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unhealthyEndpointInterval is how long an API server endpoint is skipped
+// after a request to it failed
+var unhealthyEndpointInterval = 30 * time.Second
+
+// endpointHealth tracks the API server endpoints which recently failed. It's
+// shared by all clients, so that all builds skip an endpoint which is down
+type endpointHealth struct {
+	lock           sync.Mutex
+	unhealthyUntil map[string]time.Time
+}
+
+var apiEndpoints = &endpointHealth{}
+
+func (h *endpointHealth) isHealthy(endpoint string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return time.Now().After(h.unhealthyUntil[endpoint])
+}
+
+func (h *endpointHealth) markUnhealthy(endpoint string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.unhealthyUntil == nil {
+		h.unhealthyUntil = make(map[string]time.Time)
+	}
+	h.unhealthyUntil[endpoint] = time.Now().Add(unhealthyEndpointInterval)
+}
+
+func (h *endpointHealth) markHealthy(endpoint string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.unhealthyUntil, endpoint)
+}
+
+type requestCanceler interface {
+	CancelRequest(*http.Request)
+}
+
+// failoverTransport spreads the requests across the API server endpoints in
+// a round-robin fashion. If a request to an endpoint fails, the endpoint is
+// skipped for unhealthyEndpointInterval and the request is retried with the
+// next endpoint
+type failoverTransport struct {
+	rt        http.RoundTripper
+	endpoints []*url.URL
+	health    *endpointHealth
+
+	lock     sync.Mutex
+	next     int
+	requests map[*http.Request]*http.Request
+}
+
+func newFailoverTransport(rt http.RoundTripper, hosts []string, health *endpointHealth) (*failoverTransport, error) {
+	t := &failoverTransport{
+		rt:       rt,
+		health:   health,
+		requests: make(map[*http.Request]*http.Request),
+	}
+
+	for _, host := range hosts {
+		if !strings.Contains(host, "://") {
+			host = "https://" + host
+		}
+		endpoint, err := url.Parse(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %q: %s", host, err.Error())
+		}
+		t.endpoints = append(t.endpoints, endpoint)
+	}
+
+	if len(t.endpoints) == 0 {
+		return nil, fmt.Errorf("no hosts specified")
+	}
+	return t, nil
+}
+
+// order returns the endpoints to try for the next request, the healthy ones
+// first, starting with the next one in the round-robin order
+func (t *failoverTransport) order() []*url.URL {
+	t.lock.Lock()
+	start := t.next
+	t.next = (t.next + 1) % len(t.endpoints)
+	t.lock.Unlock()
+
+	var healthy, unhealthy []*url.URL
+	for i := range t.endpoints {
+		endpoint := t.endpoints[(start+i)%len(t.endpoints)]
+		if t.health.isHealthy(endpoint.Host) {
+			healthy = append(healthy, endpoint)
+		} else {
+			unhealthy = append(unhealthy, endpoint)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	defer t.setRequest(req, nil)
+
+	var lastErr error
+	for _, endpoint := range t.order() {
+		r := new(http.Request)
+		*r = *req
+		r.URL = new(url.URL)
+		*r.URL = *req.URL
+		r.URL.Scheme = endpoint.Scheme
+		r.URL.Host = endpoint.Host
+		r.Host = ""
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		t.setRequest(req, r)
+		resp, err := t.rt.RoundTrip(r)
+		if err == nil {
+			t.health.markHealthy(endpoint.Host)
+			return resp, nil
+		}
+
+		if t.isCanceled(req) {
+			return nil, err
+		}
+
+		t.health.markUnhealthy(endpoint.Host)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (t *failoverTransport) setRequest(req, current *http.Request) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if current == nil {
+		delete(t.requests, req)
+	} else {
+		t.requests[req] = current
+	}
+}
+
+func (t *failoverTransport) isCanceled(req *http.Request) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	_, found := t.requests[req]
+	return !found
+}
+
+// CancelRequest cancels the request to the current endpoint and prevents
+// retrying it with the other endpoints
+func (t *failoverTransport) CancelRequest(req *http.Request) {
+	t.lock.Lock()
+	current := t.requests[req]
+	delete(t.requests, req)
+	t.lock.Unlock()
+
+	if canceler, ok := t.rt.(requestCanceler); ok && current != nil {
+		canceler.CancelRequest(current)
+	}
+}
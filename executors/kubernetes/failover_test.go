@@ -0,0 +1,134 @@
+package kubernetes
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+type countingTransport struct {
+	rt    http.RoundTripper
+	hosts []string
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.hosts = append(t.hosts, req.URL.Host)
+	return t.rt.RoundTrip(req)
+}
+
+func closedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func TestFailoverTransport(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	down := closedAddress(t)
+	up := strings.TrimPrefix(server.URL, "http://")
+
+	rt := &countingTransport{rt: &http.Transport{}}
+	transport, err := newFailoverTransport(rt, []string{"http://" + down, server.URL}, &endpointHealth{})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("POST", "http://"+down+"/api/v1/namespaces/test-ns/pods", strings.NewReader("pod"))
+		require.NoError(t, err)
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "ok", string(body))
+	}
+
+	// the first endpoint is skipped after it failed
+	assert.Equal(t, []string{down, up, up, up}, rt.hosts)
+	assert.Equal(t, []string{"pod", "pod", "pod"}, bodies)
+	assert.False(t, transport.health.isHealthy(down))
+	assert.True(t, transport.health.isHealthy(up))
+}
+
+func TestFailoverTransportRoundRobin(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	rt := &countingTransport{rt: &http.Transport{}}
+	transport, err := newFailoverTransport(rt, []string{first.URL, second.URL}, &endpointHealth{})
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		req, err := http.NewRequest("GET", first.URL+"/api", nil)
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	firstHost := strings.TrimPrefix(first.URL, "http://")
+	secondHost := strings.TrimPrefix(second.URL, "http://")
+	assert.Equal(t, []string{firstHost, secondHost, firstHost, secondHost}, rt.hosts)
+}
+
+func TestFailoverTransportAllDown(t *testing.T) {
+	transport, err := newFailoverTransport(&http.Transport{}, []string{
+		"http://" + closedAddress(t),
+		"http://" + closedAddress(t),
+	}, &endpointHealth{})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", "http://kubernetes/api", nil)
+	require.NoError(t, err)
+	_, err = transport.RoundTrip(req)
+	assert.Error(t, err)
+}
+
+func TestGetKubeClientConfigHosts(t *testing.T) {
+	config, err := getKubeClientConfig(&common.KubernetesConfig{
+		Host:  "https://master-1.example.com",
+		Hosts: []string{"https://master-2.example.com", "master-3.example.com:6443"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "https://master-1.example.com", config.Host)
+	require.NotNil(t, config.WrapTransport)
+
+	transport, ok := config.WrapTransport(&http.Transport{}).(*failoverTransport)
+	require.True(t, ok)
+	require.Equal(t, 3, len(transport.endpoints))
+	assert.Equal(t, "master-3.example.com:6443", transport.endpoints[2].Host)
+	assert.Equal(t, "https", transport.endpoints[2].Scheme)
+
+	config, err = getKubeClientConfig(&common.KubernetesConfig{
+		Host: "https://master-1.example.com",
+	})
+	require.NoError(t, err)
+	require.NotNil(t, config.WrapTransport)
+	_, ok = config.WrapTransport(&http.Transport{}).(*timeoutTransport)
+	assert.True(t, ok)
+
+	_, err = getKubeClientConfig(&common.KubernetesConfig{
+		Host:  "https://master-1.example.com",
+		Hosts: []string{"https://master 2"},
+	})
+	assert.Error(t, err)
+}
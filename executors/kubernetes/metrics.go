@@ -0,0 +1,70 @@
+package kubernetes
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/executors"
+)
+
+const metricsNamespace = "ci_runner"
+const metricsSubsystem = "kubernetes"
+
+// the reasons of the build pod failures counted by podFailures
+const (
+	podFailureCreate    = "create"
+	podFailureOOMKilled = "oom_killed"
+	podFailureImagePull = "image_pull"
+)
+
+var (
+	podCreationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "pod_creation_duration_seconds",
+		Help:      "How long the build pods took to be created, including the retries.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+
+	podRunningDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "pod_running_duration_seconds",
+		Help:      "How long the build pods took to be running once created, including their scheduling and the image pulls.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	})
+
+	execDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "exec_duration_seconds",
+		Help:      "How long the commands took to run in the containers of the build pods.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"container"})
+
+	podFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "pod_failures_total",
+		Help:      "Number of the build pods which couldn't be created, were killed for running out of memory or whose images couldn't be pulled.",
+	}, []string{"reason"})
+)
+
+// executorProvider creates the Kubernetes executors. It collects the metrics
+// of their build pods, they're registered by the runner if it serves metrics
+type executorProvider struct {
+	executors.DefaultExecutorProvider
+}
+
+func (p executorProvider) Describe(ch chan<- *prometheus.Desc) {
+	podCreationDuration.Describe(ch)
+	podRunningDuration.Describe(ch)
+	execDuration.Describe(ch)
+	podFailures.Describe(ch)
+}
+
+func (p executorProvider) Collect(ch chan<- prometheus.Metric) {
+	podCreationDuration.Collect(ch)
+	podRunningDuration.Collect(ch)
+	execDuration.Collect(ch)
+	podFailures.Collect(ch)
+}
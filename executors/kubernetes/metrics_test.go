@@ -0,0 +1,98 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/testapi"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	var m dto.Metric
+	require.NoError(t, counter.Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestPodFailureMetrics(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	pod := &api.Pod{
+		ObjectMeta: api.ObjectMeta{Name: "test-pod", Namespace: "test-ns"},
+		Spec: api.PodSpec{
+			Containers: []api.Container{{Name: "build", Image: "registry.example.com/ci:missing"}},
+		},
+		Status: api.PodStatus{
+			Phase: api.PodPending,
+			ContainerStatuses: []api.ContainerStatus{{
+				Name:  "build",
+				State: api.ContainerState{Waiting: &api.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+			}},
+		},
+	}
+
+	c := testKubeClient(func(req *http.Request) (*http.Response, error) {
+		switch p, m := req.URL.Path, req.Method; {
+		case p == "/api/"+version+"/namespaces/test-ns/pods/test-pod" && m == "GET":
+			return &http.Response{StatusCode: 200, Body: objBody(codec, pod), Header: map[string][]string{
+				"Content-Type": []string{"application/json"},
+			}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request. method: %s, path: %s", m, p)
+		}
+	})
+	out := testWriter{
+		call: func(b []byte) (int, error) {
+			return len(b), nil
+		},
+	}
+
+	imagePulls := counterValue(t, podFailures.WithLabelValues(podFailureImagePull))
+	_, err := waitForPodRunning(context.Background(), c, pod, out, testPodWaitOptions)
+	assert.Error(t, err)
+	assert.Equal(t, imagePulls+1, counterValue(t, podFailures.WithLabelValues(podFailureImagePull)))
+
+	pod.Status = api.PodStatus{
+		Phase: api.PodFailed,
+		ContainerStatuses: []api.ContainerStatus{{
+			Name:  "build",
+			State: api.ContainerState{Terminated: &api.ContainerStateTerminated{ExitCode: 137, Reason: "OOMKilled"}},
+		}},
+	}
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{})
+	ex.pod = pod
+	ex.kubeClient = c
+
+	oomKills := counterValue(t, podFailures.WithLabelValues(podFailureOOMKilled))
+	assert.Error(t, ex.checkPodFailure("build", fmt.Errorf("command terminated with non-zero exit code")))
+	assert.Equal(t, oomKills+1, counterValue(t, podFailures.WithLabelValues(podFailureOOMKilled)))
+	assert.Equal(t, imagePulls+1, counterValue(t, podFailures.WithLabelValues(podFailureImagePull)))
+}
+
+func TestExecutorProviderMetrics(t *testing.T) {
+	provider, ok := common.GetExecutor("kubernetes").(prometheus.Collector)
+	require.True(t, ok, "expected the provider to collect the metrics")
+
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(provider))
+	execDuration.WithLabelValues("build").Observe(1)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	assert.Contains(t, names, "ci_runner_kubernetes_pod_creation_duration_seconds")
+	assert.Contains(t, names, "ci_runner_kubernetes_exec_duration_seconds")
+}
@@ -0,0 +1,122 @@
+package kubernetes
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/intstr"
+)
+
+// kubernetesProbe is a readiness or liveness probe of a service, defined with
+// the extended syntax: {"tcp_socket": {"port": 5432}}, {"http_get": {"path":
+// "/health", "port": 8080}} or {"exec": {"command": ["pg_isready"]}}, and the
+// optional timing of the checks
+type kubernetesProbe struct {
+	Exec      *kubernetesExecCheck      `json:"exec"`
+	HTTPGet   *kubernetesHTTPGetCheck   `json:"http_get"`
+	TCPSocket *kubernetesTCPSocketCheck `json:"tcp_socket"`
+
+	InitialDelaySeconds int32 `json:"initial_delay_seconds"`
+	TimeoutSeconds      int32 `json:"timeout_seconds"`
+	PeriodSeconds       int32 `json:"period_seconds"`
+	SuccessThreshold    int32 `json:"success_threshold"`
+	FailureThreshold    int32 `json:"failure_threshold"`
+}
+
+type kubernetesExecCheck struct {
+	Command []string `json:"command"`
+}
+
+type kubernetesHTTPGetCheck struct {
+	Path   string             `json:"path"`
+	Port   intstr.IntOrString `json:"port"`
+	Scheme string             `json:"scheme"`
+}
+
+type kubernetesTCPSocketCheck struct {
+	Port intstr.IntOrString `json:"port"`
+}
+
+// convertProbe converts the probe of a service to the probe of its container.
+// Exactly one check has to be defined, and liveness probes only support a
+// success threshold of 1, like in Kubernetes
+func convertProbe(config *kubernetesProbe, liveness bool) (*api.Probe, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	probe := &api.Probe{
+		InitialDelaySeconds: config.InitialDelaySeconds,
+		TimeoutSeconds:      config.TimeoutSeconds,
+		PeriodSeconds:       config.PeriodSeconds,
+		SuccessThreshold:    config.SuccessThreshold,
+		FailureThreshold:    config.FailureThreshold,
+	}
+
+	checks := 0
+	if config.Exec != nil {
+		checks++
+		if len(config.Exec.Command) == 0 {
+			return nil, fmt.Errorf("no exec command specified")
+		}
+		probe.Exec = &api.ExecAction{Command: config.Exec.Command}
+	}
+
+	if config.HTTPGet != nil {
+		checks++
+		if err := checkProbePort(config.HTTPGet.Port); err != nil {
+			return nil, err
+		}
+		scheme := api.URIScheme(strings.ToUpper(config.HTTPGet.Scheme))
+		switch scheme {
+		case "":
+			scheme = api.URISchemeHTTP
+		case api.URISchemeHTTP, api.URISchemeHTTPS:
+		default:
+			return nil, fmt.Errorf("unsupported scheme %q", config.HTTPGet.Scheme)
+		}
+		probe.HTTPGet = &api.HTTPGetAction{
+			Path:   config.HTTPGet.Path,
+			Port:   config.HTTPGet.Port,
+			Scheme: scheme,
+		}
+	}
+
+	if config.TCPSocket != nil {
+		checks++
+		if err := checkProbePort(config.TCPSocket.Port); err != nil {
+			return nil, err
+		}
+		probe.TCPSocket = &api.TCPSocketAction{Port: config.TCPSocket.Port}
+	}
+
+	if checks != 1 {
+		return nil, fmt.Errorf("exactly one of exec, http_get and tcp_socket needs to be specified")
+	}
+
+	names := []string{"initial_delay_seconds", "timeout_seconds", "period_seconds", "success_threshold", "failure_threshold"}
+	for i, value := range []int32{probe.InitialDelaySeconds, probe.TimeoutSeconds, probe.PeriodSeconds,
+		probe.SuccessThreshold, probe.FailureThreshold} {
+		if value < 0 {
+			return nil, fmt.Errorf("invalid %s %d, it can't be negative", names[i], value)
+		}
+	}
+	if liveness && probe.SuccessThreshold > 1 {
+		return nil, fmt.Errorf("invalid success_threshold %d, it needs to be 1 for liveness probes", probe.SuccessThreshold)
+	}
+	return probe, nil
+}
+
+func checkProbePort(port intstr.IntOrString) error {
+	if port.Type == intstr.String {
+		if port.StrVal == "" {
+			return fmt.Errorf("no port specified")
+		}
+		return nil
+	}
+	if port.IntVal < 1 || port.IntVal > 65535 {
+		return fmt.Errorf("invalid port %d", port.IntVal)
+	}
+	return nil
+}
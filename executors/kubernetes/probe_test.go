@@ -0,0 +1,120 @@
+package kubernetes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/intstr"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+func TestServiceProbeOptions(t *testing.T) {
+	build := common.Build{
+		GetBuildResponse: common.GetBuildResponse{
+			Options: common.BuildOptions{
+				"services": []interface{}{
+					map[string]interface{}{
+						"name": "postgres:9.5",
+						"readiness_probe": map[string]interface{}{
+							"exec":           map[string]interface{}{"command": []interface{}{"pg_isready"}},
+							"period_seconds": 2,
+						},
+						"liveness_probe": map[string]interface{}{
+							"tcp_socket":        map[string]interface{}{"port": 5432},
+							"failure_threshold": 5,
+						},
+					},
+					map[string]interface{}{
+						"name": "nginx",
+						"readiness_probe": map[string]interface{}{
+							"http_get": map[string]interface{}{"path": "/health", "port": "http", "scheme": "https"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	var options kubernetesOptions
+	require.NoError(t, build.Options.Decode(&options))
+	require.Equal(t, 2, len(options.Services))
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{}, &options)
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	assert.Equal(t, &api.Probe{
+		Handler:       api.Handler{Exec: &api.ExecAction{Command: []string{"pg_isready"}}},
+		PeriodSeconds: 2,
+	}, pod.Spec.Containers[2].ReadinessProbe)
+	assert.Equal(t, &api.Probe{
+		Handler:          api.Handler{TCPSocket: &api.TCPSocketAction{Port: intstr.FromInt(5432)}},
+		FailureThreshold: 5,
+	}, pod.Spec.Containers[2].LivenessProbe)
+	assert.Equal(t, &api.Probe{
+		Handler: api.Handler{HTTPGet: &api.HTTPGetAction{
+			Path:   "/health",
+			Port:   intstr.FromString("http"),
+			Scheme: api.URISchemeHTTPS,
+		}},
+	}, pod.Spec.Containers[3].ReadinessProbe)
+	assert.Nil(t, pod.Spec.Containers[3].LivenessProbe)
+
+	// the services with a readiness probe are awaited as long as the pod
+	assert.Equal(t, common.DefaultKubernetesPollTimeout*time.Second, ex.servicesWaitTimeout())
+	ex.Config.Kubernetes.WaitForServicesTimeout = 30
+	assert.Equal(t, 30*time.Second, ex.servicesWaitTimeout())
+
+	ex.options.Services[1].ReadinessProbe.HTTPGet.Scheme = "ftp"
+	_, err = ex.buildPod()
+	assert.Error(t, err)
+}
+
+func TestConvertProbe(t *testing.T) {
+	tcp := func(port intstr.IntOrString) *kubernetesTCPSocketCheck {
+		return &kubernetesTCPSocketCheck{Port: port}
+	}
+
+	tests := []struct {
+		Probe    *kubernetesProbe
+		Liveness bool
+		Error    bool
+	}{
+		{Probe: nil},
+		{Probe: &kubernetesProbe{TCPSocket: tcp(intstr.FromInt(80))}},
+		{Probe: &kubernetesProbe{TCPSocket: tcp(intstr.FromString("http"))}},
+		{Probe: &kubernetesProbe{TCPSocket: tcp(intstr.FromInt(0))}, Error: true},
+		{Probe: &kubernetesProbe{TCPSocket: tcp(intstr.FromInt(70000))}, Error: true},
+		{Probe: &kubernetesProbe{TCPSocket: tcp(intstr.FromString(""))}, Error: true},
+		{Probe: &kubernetesProbe{HTTPGet: &kubernetesHTTPGetCheck{Port: intstr.FromInt(80), Scheme: "http"}}},
+		{Probe: &kubernetesProbe{HTTPGet: &kubernetesHTTPGetCheck{Path: "/health"}}, Error: true},
+		{Probe: &kubernetesProbe{Exec: &kubernetesExecCheck{Command: []string{"true"}}}},
+		{Probe: &kubernetesProbe{Exec: &kubernetesExecCheck{}}, Error: true},
+		{Probe: &kubernetesProbe{}, Error: true},
+		{Probe: &kubernetesProbe{
+			TCPSocket: tcp(intstr.FromInt(80)),
+			Exec:      &kubernetesExecCheck{Command: []string{"true"}},
+		}, Error: true},
+		{Probe: &kubernetesProbe{TCPSocket: tcp(intstr.FromInt(80)), PeriodSeconds: -1}, Error: true},
+		{Probe: &kubernetesProbe{TCPSocket: tcp(intstr.FromInt(80)), SuccessThreshold: 2}},
+		{Probe: &kubernetesProbe{TCPSocket: tcp(intstr.FromInt(80)), SuccessThreshold: 2}, Liveness: true, Error: true},
+	}
+
+	for i, test := range tests {
+		probe, err := convertProbe(test.Probe, test.Liveness)
+		if test.Error {
+			assert.Error(t, err, "test %d", i)
+			continue
+		}
+		require.NoError(t, err, "test %d", i)
+		if test.Probe == nil {
+			assert.Nil(t, probe, "test %d", i)
+		} else {
+			assert.NotNil(t, probe, "test %d", i)
+		}
+	}
+}
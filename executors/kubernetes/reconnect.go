@@ -0,0 +1,137 @@
+package kubernetes
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execReconnectInterval is how long to wait before the stream of a command
+// is re-attached
+var execReconnectInterval = time.Second
+
+// detachedStartScript starts the command in its arguments in the background,
+// with the standard input of the exec as its input. The output and then the
+// exit code of the command are written next to the file of the first argument
+const detachedStartScript = `f=$1
+shift
+mkdir -p "$(dirname "$f")" && rm -f "$f.status" && cat > "$f.sh" && : > "$f.log" || exit 1
+("$@" < "$f.sh" >> "$f.log" 2>&1; echo $? > "$f.tmp"; mv "$f.tmp" "$f.status") > /dev/null 2>&1 &
+`
+
+// detachedFollowScript writes the output of the command started by
+// detachedStartScript, from the offset of the second argument, until the
+// command exits. It then exits with the exit code of the command
+const detachedFollowScript = `f=$1
+offset=$2
+while :; do
+  done=
+  [ -f "$f.status" ] && done=1
+  size=$(wc -c < "$f.log") || exit 1
+  if [ "$size" -gt "$offset" ]; then
+    tail -c +$((offset + 1)) "$f.log" | head -c $((size - offset))
+    offset=$size
+  fi
+  if [ -n "$done" ]; then
+    exit "$(cat "$f.status")"
+  fi
+  sleep 1
+done
+`
+
+// reconnectingExec runs the command of exec in the background of the
+// container, so it isn't killed if the stream of the exec drops, eg. once a
+// proxy closed the idle connection. The output of the command is streamed from
+// file, the stream is re-attached up to reconnects times and resumes after the
+// output which was already written. The standard error of the command is
+// written to its output
+type reconnectingExec struct {
+	exec       ExecOptions
+	file       string
+	reconnects int
+	stop       <-chan struct{}
+	warn       func(args ...interface{})
+}
+
+func (e *reconnectingExec) Run() error {
+	start := e.exec
+	start.Command = append([]string{"sh", "-c", detachedStartScript, "sh", e.file}, e.exec.Command...)
+	if err := start.Run(); err != nil {
+		return err
+	}
+
+	out := &countingWriter{w: e.exec.Out}
+	for attempt := 1; ; attempt++ {
+		follow := e.exec
+		follow.Command = []string{"sh", "-c", detachedFollowScript, "sh", e.file, strconv.FormatInt(out.n, 10)}
+		follow.In = nil
+		follow.Stdin = false
+		follow.Out = out
+
+		err := follow.Run()
+		if !isExecStreamError(err) || attempt > e.reconnects {
+			return err
+		}
+
+		e.warn(fmt.Sprintf("The stream of the command in container %s dropped, reconnecting in %s (%d/%d): %s",
+			e.exec.ContainerName, execReconnectInterval, attempt, e.reconnects, err.Error()))
+		select {
+		case <-time.After(execReconnectInterval):
+		case <-e.stop:
+			return err
+		}
+	}
+}
+
+// execStreamErrors are the messages of the errors of the connections, eg.
+// they're wrapped by the SPDY executor into "error sending request: ..."
+var execStreamErrors = []string{
+	"connection reset",
+	"broken pipe",
+	"unexpected eof",
+	"use of closed network connection",
+	"i/o timeout",
+}
+
+// isExecStreamError returns true if err was caused by the transport of the
+// stream of an exec, eg. the connection was reset. The other errors, eg. the
+// command exited with an error or the pod isn't running anymore, are false
+func isExecStreamError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	if strings.HasSuffix(message, ": eof") {
+		return true
+	}
+	for _, streamError := range execStreamErrors {
+		if strings.Contains(message, streamError) {
+			return true
+		}
+	}
+	return false
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,155 @@
+package kubernetes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/kubernetes/pkg/api/testapi"
+	"k8s.io/kubernetes/pkg/client/restclient"
+)
+
+// localRemoteExecutor runs the commands of the execs locally. The streams of
+// the first drops commands following the output are dropped once they wrote
+// some of it
+type localRemoteExecutor struct {
+	mu       sync.Mutex
+	commands [][]string
+	drops    int
+}
+
+func (e *localRemoteExecutor) Execute(method string, url *url.URL, config *restclient.Config, stdin io.Reader, stdout, stderr io.Writer, tty bool) error {
+	command := url.Query()["command"]
+	e.mu.Lock()
+	e.commands = append(e.commands, command)
+	drop := e.drops > 0 && command[2] == detachedFollowScript
+	if drop {
+		e.drops--
+	}
+	e.mu.Unlock()
+
+	cmd := exec.Command(command[0], command[1:]...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	cmd.Stderr = stderr
+
+	if !drop {
+		cmd.Stdout = stdout
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("error executing remote command: %s", err.Error())
+		}
+		return nil
+	}
+
+	// the stream drops once the first output was written
+	pipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	n, _ := pipe.Read(buf)
+	stdout.Write(buf[:n])
+	cmd.Process.Kill()
+	cmd.Wait()
+	return fmt.Errorf("read tcp 10.0.0.1:43210->10.0.0.2:443: read: connection reset by peer")
+}
+
+func TestReconnectingExec(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is required")
+	}
+
+	dir, err := ioutil.TempDir("", "reconnect")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	interval := execReconnectInterval
+	execReconnectInterval = 10 * time.Millisecond
+	defer func() { execReconnectInterval = interval }()
+
+	codec := testapi.Default.Codec()
+	c := testKubeClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: objBody(codec, execPod()), Header: map[string][]string{
+			"Content-Type": []string{"application/json"},
+		}}, nil
+	})
+
+	tests := []struct {
+		Script     string
+		Drops      int
+		Reconnects int
+		Output     string
+		Error      string
+	}{
+		{Script: "echo one; sleep 1; echo two >&2\n", Drops: 1, Reconnects: 1, Output: "one\ntwo\n"},
+		{Script: "echo one; exit 3\n", Output: "one\n", Error: "error executing remote command: exit status 3"},
+		{Script: "echo one; sleep 1; echo two\n", Drops: 2, Reconnects: 1, Output: "one\ntwo\n", Error: "connection reset by peer"},
+	}
+
+	for i, test := range tests {
+		remote := &localRemoteExecutor{drops: test.Drops}
+		var out bytes.Buffer
+		var warnings []string
+		e := &reconnectingExec{
+			exec: ExecOptions{
+				PodName:       "foo",
+				ContainerName: "bar",
+				Namespace:     "test",
+				Command:       []string{"sh"},
+				In:            strings.NewReader(test.Script),
+				Out:           &out,
+				Err:           ioutil.Discard,
+				Stdin:         true,
+				Executor:      remote,
+				Client:        c,
+			},
+			file:       filepath.Join(dir, "exec", fmt.Sprintf("exec-%d", i)),
+			reconnects: test.Reconnects,
+			warn: func(args ...interface{}) {
+				warnings = append(warnings, fmt.Sprint(args...))
+			},
+		}
+
+		err := e.Run()
+		if test.Error == "" {
+			assert.NoError(t, err, test.Script)
+		} else if assert.Error(t, err, test.Script) {
+			assert.Contains(t, err.Error(), test.Error, test.Script)
+		}
+		assert.Equal(t, test.Output, out.String(), test.Script)
+		assert.Len(t, warnings, test.Reconnects)
+		assert.Len(t, remote.commands, 2+test.Reconnects, test.Script)
+	}
+}
+
+func TestIsExecStreamError(t *testing.T) {
+	assert.False(t, isExecStreamError(nil))
+	assert.False(t, isExecStreamError(fmt.Errorf("error executing remote command: Error executing in Docker Container: 1")))
+	assert.False(t, isExecStreamError(fmt.Errorf("pod foo is not running and cannot execute commands; current phase is Failed")))
+	assert.False(t, isExecStreamError(fmt.Errorf("pods \"foo\" not found")))
+	assert.False(t, isExecStreamError(fmt.Errorf("container bar was killed for running out of memory")))
+	assert.True(t, isExecStreamError(fmt.Errorf("error sending request: connection reset by peer")))
+	assert.True(t, isExecStreamError(fmt.Errorf("error reading from error stream: EOF")))
+	assert.True(t, isExecStreamError(&net.OpError{Op: "read", Net: "tcp", Err: errors.New("i/o timeout")}))
+	assert.True(t, isExecStreamError(io.EOF))
+	assert.True(t, isExecStreamError(io.ErrUnexpectedEOF))
+}
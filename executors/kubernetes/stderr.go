@@ -0,0 +1,50 @@
+package kubernetes
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// linePrefixWriter writes prefix at the start of each line written to w, eg.
+// to tell the stderr of the build apart from its stdout in the build trace.
+// Each line is written with a single call, so the lines aren't mixed with the
+// ones written to w concurrently
+type linePrefixWriter struct {
+	w      io.Writer
+	prefix []byte
+
+	lock    sync.Mutex
+	midLine bool
+}
+
+func newLinePrefixWriter(w io.Writer, prefix string) *linePrefixWriter {
+	return &linePrefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (p *linePrefixWriter) Write(data []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	written := 0
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+
+		var buf []byte
+		if !p.midLine {
+			buf = append(buf, p.prefix...)
+		}
+		buf = append(buf, line...)
+		if _, err := p.w.Write(buf); err != nil {
+			return written, err
+		}
+
+		p.midLine = line[len(line)-1] != '\n'
+		written += len(line)
+		data = data[len(line):]
+	}
+	return written, nil
+}
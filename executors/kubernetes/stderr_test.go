@@ -0,0 +1,33 @@
+package kubernetes
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinePrefixWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := newLinePrefixWriter(buf, "[stderr] ")
+
+	for _, data := range []string{"first\nsec", "ond\n", "", "third\n\nfourth"} {
+		n, err := w.Write([]byte(data))
+		assert.NoError(t, err)
+		assert.Equal(t, len(data), n)
+	}
+	assert.Equal(t, "[stderr] first\n[stderr] second\n[stderr] third\n[stderr] \n[stderr] fourth", buf.String())
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(data []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestLinePrefixWriterError(t *testing.T) {
+	n, err := newLinePrefixWriter(failingWriter{}, "[stderr] ").Write([]byte("first\nsecond\n"))
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+}
@@ -0,0 +1,108 @@
+package kubernetes
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRequestTimeout is the timeout of the API requests when none is
+// configured
+const defaultRequestTimeout = 30 * time.Second
+
+type requestTimeoutError struct {
+	method  string
+	path    string
+	timeout time.Duration
+}
+
+func (e *requestTimeoutError) Error() string {
+	return fmt.Sprintf("%s %s timed out after %s", e.method, e.path, e.timeout)
+}
+
+// isRequestTimeout returns true if err was caused by an API request which
+// timed out
+func isRequestTimeout(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	_, ok := err.(*requestTimeoutError)
+	return ok
+}
+
+// isStreamingRequest returns true if the response of req is streamed for an
+// unbounded time, eg. the output of the build
+func isStreamingRequest(req *http.Request) bool {
+	if req.URL.Query().Get("watch") == "true" || req.URL.Query().Get("follow") == "true" {
+		return true
+	}
+
+	for _, suffix := range []string{"/exec", "/attach", "/portforward"} {
+		if strings.HasSuffix(req.URL.Path, suffix) {
+			return true
+		}
+	}
+	return strings.Contains(req.URL.Path, "/watch/")
+}
+
+// timeoutTransport cancels the API requests, including reading their
+// response, which take longer than timeout. Streaming requests are not
+// limited
+type timeoutTransport struct {
+	rt      http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	canceler, ok := t.rt.(requestCanceler)
+	if !ok || t.timeout <= 0 || isStreamingRequest(req) {
+		return t.rt.RoundTrip(req)
+	}
+
+	var timedOut int32
+	timer := time.AfterFunc(t.timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		canceler.CancelRequest(req)
+	})
+
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		timer.Stop()
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return nil, &requestTimeoutError{method: req.Method, path: req.URL.Path, timeout: t.timeout}
+		}
+		return nil, err
+	}
+
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, timer: timer}
+	return resp, nil
+}
+
+func (t *timeoutTransport) CancelRequest(req *http.Request) {
+	if canceler, ok := t.rt.(requestCanceler); ok {
+		canceler.CancelRequest(req)
+	}
+}
+
+// timeoutBody stops the timer of the request once its response was read
+type timeoutBody struct {
+	io.ReadCloser
+	timer *time.Timer
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.timer.Stop()
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,68 @@
+package kubernetes
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+func TestTimeoutTransport(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/namespaces/test-ns/pods/hung" {
+			<-unblock
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	transport := &timeoutTransport{rt: &http.Transport{}, timeout: 50 * time.Millisecond}
+
+	req, err := http.NewRequest("GET", server.URL+"/api/v1/namespaces/test-ns/pods/hung", nil)
+	require.NoError(t, err)
+	started := time.Now()
+	_, err = transport.RoundTrip(req)
+	assert.True(t, isRequestTimeout(err), "unexpected error: %v", err)
+	assert.True(t, time.Since(started) < 5*time.Second)
+
+	req, err = http.NewRequest("GET", server.URL+"/api/v1/namespaces/test-ns/pods/pod", nil)
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ok", string(body))
+}
+
+func TestIsStreamingRequest(t *testing.T) {
+	tests := map[string]bool{
+		"/api/v1/namespaces/test-ns/pods/pod":                   false,
+		"/api/v1/namespaces/test-ns/pods?watch=true":            true,
+		"/api/v1/namespaces/test-ns/pods/pod/log?follow=true":   true,
+		"/api/v1/namespaces/test-ns/pods/pod/exec?command=sh":   true,
+		"/api/v1/namespaces/test-ns/pods/pod/attach?stdin=true": true,
+		"/api/v1/watch/namespaces/test-ns/pods":                 true,
+	}
+
+	for path, streaming := range tests {
+		req, err := http.NewRequest("GET", "http://kubernetes"+path, nil)
+		require.NoError(t, err)
+		assert.Equal(t, streaming, isStreamingRequest(req), path)
+	}
+}
+
+func TestGetTransportOptions(t *testing.T) {
+	options := getTransportOptions(&common.KubernetesConfig{})
+	assert.Equal(t, defaultRequestTimeout, options.RequestTimeout)
+
+	options = getTransportOptions(&common.KubernetesConfig{RequestTimeout: 5})
+	assert.Equal(t, 5*time.Second, options.RequestTimeout)
+}
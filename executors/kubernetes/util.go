@@ -1,103 +1,1023 @@
 package kubernetes
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/ghodss/yaml"
 	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/api"
+	kubeerrors "k8s.io/kubernetes/pkg/api/errors"
 	"k8s.io/kubernetes/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/api/v1"
 	"k8s.io/kubernetes/pkg/client/restclient"
 	client "k8s.io/kubernetes/pkg/client/unversioned"
 	clientcmd "k8s.io/kubernetes/pkg/client/unversioned/clientcmd"
 	clientcmdapi "k8s.io/kubernetes/pkg/client/unversioned/clientcmd/api"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/validation"
+	"k8s.io/kubernetes/pkg/watch"
 
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/helpers"
 )
 
+var podDeletionCheckInterval = time.Second
+
+// podCreationRetries is how many times the creation of the build pod is
+// retried if the API server fails temporarily
+const podCreationRetries = 3
+
+var podCreationRetryInterval = time.Second
+
+// podAbortTimeout is how long to wait for the command running in the pod of an
+// aborted build to end once the pod is deleted
+var podAbortTimeout = 10 * time.Second
+
+// serviceAccountTimeout is how long to wait for the default service account
+// of a created namespace, the build pod is rejected until it exists
+var serviceAccountTimeout = 30 * time.Second
+
+var serviceAccountCheckInterval = time.Second
+
+// dumpLogsTailLines is how many lines of the logs of each container are added
+// to the build trace when a command fails
+const dumpLogsTailLines = 100
+
+// jobPodCheckInterval is how often the pod of a created build job is looked
+// up until the job controller created it
+var jobPodCheckInterval = time.Second
+
+// jobNameLabel is set by the job controller on the pods of a job
+const jobNameLabel = "job-name"
+
+// servicesCheckInterval is how often the readiness of the services is checked
+// before the build starts
+var servicesCheckInterval = time.Second
+
 func init() {
 	clientcmd.DefaultCluster = clientcmdapi.Cluster{}
 }
 
+// apiHosts returns the API server endpoints of config, the host followed by
+// the additional hosts
+func apiHosts(config *common.KubernetesConfig) []string {
+	var hosts []string
+	for _, host := range append([]string{config.Host}, config.Hosts...) {
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// transportOptions are the options of the transport of the clients, which
+// aren't part of restclient.Config
+type transportOptions struct {
+	Hosts          []string
+	RequestTimeout time.Duration
+}
+
+func getTransportOptions(config *common.KubernetesConfig) transportOptions {
+	options := transportOptions{
+		Hosts:          apiHosts(config),
+		RequestTimeout: defaultRequestTimeout,
+	}
+	if config.RequestTimeout > 0 {
+		options.RequestTimeout = time.Duration(config.RequestTimeout) * time.Second
+	}
+	return options
+}
+
 func getKubeClientConfig(config *common.KubernetesConfig) (*restclient.Config, error) {
+	restConfig, err := getBaseKubeClientConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the client applies its default rate limit when these are zero
+	if config.QPS < 0 || config.Burst < 0 {
+		return nil, fmt.Errorf("qps and burst can't be negative")
+	}
+	restConfig.QPS = config.QPS
+	restConfig.Burst = config.Burst
+
+	options := getTransportOptions(config)
+	if len(options.Hosts) > 1 {
+		// the transport can't return an error, so the hosts are verified here
+		if _, err = newFailoverTransport(nil, options.Hosts, apiEndpoints); err != nil {
+			return nil, err
+		}
+	}
+
+	restConfig.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		rt = &timeoutTransport{rt: rt, timeout: options.RequestTimeout}
+		if len(options.Hosts) > 1 {
+			rt, _ = newFailoverTransport(rt, options.Hosts, apiEndpoints)
+		}
+		return rt
+	}
+	return restConfig, nil
+}
+
+func getBaseKubeClientConfig(config *common.KubernetesConfig) (*restclient.Config, error) {
+	hosts := apiHosts(config)
+	host := ""
+	if len(hosts) > 0 {
+		host = hosts[0]
+	}
+
+	var restConfig *restclient.Config
 	switch {
-	case len(config.CertFile) > 0:
-		if len(config.KeyFile) == 0 || len(config.CAFile) == 0 {
-			return nil, fmt.Errorf("ca file, cert file and key file must be specified when using file based auth")
-		}
-		return &restclient.Config{
-			Host: config.Host,
-			TLSClientConfig: restclient.TLSClientConfig{
-				CertFile: config.CertFile,
-				KeyFile:  config.KeyFile,
-				CAFile:   config.CAFile,
-			},
-		}, nil
+	case len(config.KubeConfig) > 0 || len(config.Context) > 0:
+		return loadKubeConfig(config.KubeConfig, config.Context, host, config.Insecure)
 
-	case len(config.Host) > 0:
-		return &restclient.Config{
-			Host: config.Host,
-		}, nil
+	case len(config.CertFile) > 0 || len(config.KeyFile) > 0:
+		if len(config.CertFile) == 0 || len(config.KeyFile) == 0 {
+			return nil, fmt.Errorf("cert file and key file must be specified together when using file based auth")
+		}
+		restConfig = &restclient.Config{Host: host}
+		restConfig.CertFile, restConfig.CertData = pemFileOrData(config.CertFile)
+		restConfig.KeyFile, restConfig.KeyData = pemFileOrData(config.KeyFile)
+
+	case len(host) > 0:
+		restConfig = &restclient.Config{Host: host}
 
 	default:
-		config, err := clientcmd.NewDefaultClientConfigLoadingRules().Load()
-		if err != nil {
-			return nil, err
+		return loadKubeConfig("", "", "", config.Insecure)
+	}
+
+	restConfig.CAFile, restConfig.CAData = pemFileOrData(config.CAFile)
+	if config.Insecure {
+		if len(config.CAFile) > 0 {
+			return nil, fmt.Errorf("ca file can't be specified together with insecure")
 		}
+		restConfig.Insecure = true
+	}
+	return restConfig, nil
+}
 
-		clientConfig := clientcmd.NewDefaultClientConfig(*config, &clientcmd.ConfigOverrides{})
-		return clientConfig.ClientConfig()
+// pemFileOrData returns value as the data of a certificate or key if it's
+// PEM encoded, otherwise as the path of the file containing it
+func pemFileOrData(value string) (string, []byte) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN ") {
+		return "", []byte(strings.TrimSpace(value) + "\n")
 	}
+	return value, nil
 }
 
-func getKubeClient(config *common.KubernetesConfig) (*client.Client, error) {
+// loadKubeConfig loads the client config with the standard loading rules,
+// from path if it's set, using contextName instead of the current context and
+// host instead of the server of the cluster if they're set. With insecure, the
+// CA of the cluster is ignored and its certificate isn't verified
+func loadKubeConfig(path, contextName, host string, insecure bool) (*restclient.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = path
+
+	config, err := rules.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: contextName}
+	overrides.ClusterInfo.InsecureSkipTLSVerify = insecure
+	restConfig, err := clientcmd.NewDefaultClientConfig(*config, overrides).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// the overrides don't replace the server of the kubeconfig
+	if host != "" {
+		restConfig.Host = host
+	}
+	return restConfig, nil
+}
+
+type cachedKubeClient struct {
+	client *client.Client
+	mtimes map[string]time.Time
+}
+
+// kubeClientCache holds a client for each distinct cluster connection, so that
+// the builds reuse the connections to the same cluster. The connection last
+// used by each runner is tracked, so that the client of a connection is
+// dropped once no runner is configured with it anymore
+type kubeClientCache struct {
+	lock    sync.Mutex
+	clients map[string]*cachedKubeClient
+	owners  map[string]string
+}
+
+var kubeClients = &kubeClientCache{}
+
+// kubeClientKey returns a hash of the connection fields of config and of the
+// options of its transport
+func kubeClientKey(config *restclient.Config, options transportOptions) (string, error) {
+	data, err := json.Marshal(struct {
+		Host        string
+		Transport   transportOptions
+		APIPath     string
+		Username    string
+		Password    string
+		BearerToken string
+		Impersonate string
+		Insecure    bool
+		TLS         restclient.TLSClientConfig
+		QPS         float32
+		Burst       int
+	}{
+		Host:        config.Host,
+		Transport:   options,
+		APIPath:     config.APIPath,
+		Username:    config.Username,
+		Password:    config.Password,
+		BearerToken: config.BearerToken,
+		Impersonate: config.Impersonate,
+		Insecure:    config.Insecure,
+		TLS:         config.TLSClientConfig,
+		QPS:         config.QPS,
+		Burst:       config.Burst,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// authFileMTimes returns the modification times of the auth files of config
+func authFileMTimes(config *restclient.Config) map[string]time.Time {
+	mtimes := make(map[string]time.Time)
+	for _, file := range []string{config.CertFile, config.KeyFile, config.CAFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			mtimes[file] = info.ModTime()
+		} else {
+			mtimes[file] = time.Time{}
+		}
+	}
+	return mtimes
+}
+
+// release records that owner now uses the connection of key, the client of
+// the connection it used before is closed if no other owner uses it
+func (c *kubeClientCache) release(owner, key string) {
+	if owner == "" {
+		return
+	}
+
+	previous, ok := c.owners[owner]
+	if c.owners == nil {
+		c.owners = make(map[string]string)
+	}
+	c.owners[owner] = key
+	if !ok || previous == key {
+		return
+	}
+
+	for _, used := range c.owners {
+		if used == previous {
+			return
+		}
+	}
+	if cached := c.clients[previous]; cached != nil {
+		closeKubeClient(cached.client)
+		delete(c.clients, previous)
+	}
+}
+
+// get returns the cached client for config, a new client is created if there
+// is none or if any of the auth files was modified since it was cached. owner
+// identifies the runner of the build, when its configuration changes the
+// client of its previous connection is released
+func (c *kubeClientCache) get(owner string, config *restclient.Config, options transportOptions) (*client.Client, error) {
+	key, err := kubeClientKey(config, options)
+	if err != nil {
+		return nil, err
+	}
+	mtimes := authFileMTimes(config)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.release(owner, key)
+
+	if cached := c.clients[key]; cached != nil {
+		if reflect.DeepEqual(cached.mtimes, mtimes) {
+			return cached.client, nil
+		}
+		closeKubeClient(cached.client)
+		delete(c.clients, key)
+	}
+
+	kubeClient, err := client.New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Insecure {
+		logrus.WithField("host", config.Host).
+			Warningln("The TLS certificate of the Kubernetes API server is not verified, the connection is insecure")
+	}
+
+	if c.clients == nil {
+		c.clients = make(map[string]*cachedKubeClient)
+	}
+	c.clients[key] = &cachedKubeClient{
+		client: kubeClient,
+		mtimes: mtimes,
+	}
+	return kubeClient, nil
+}
+
+func getKubeClient(owner string, config *common.KubernetesConfig) (*client.Client, error) {
 	restConfig, err := getKubeClientConfig(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return client.New(restConfig)
+	return kubeClients.get(owner, restConfig, getTransportOptions(config))
+}
+
+func closeKubeClient(client *client.Client) bool {
+	if client == nil || client.Client == nil || client.Client.Transport == nil {
+		return false
+	}
+	if transport, _ := client.Client.Transport.(*http.Transport); transport != nil {
+		transport.CloseIdleConnections()
+		return true
+	}
+	return false
+}
+
+// encodePod serializes pod with the client's codec and merges extraSpec into
+// its spec. This allows setting PodSpec fields that newer API servers support,
+// but which aren't modeled by the vendored API types
+func encodePod(c *client.Client, pod *api.Pod, extraSpec map[string]interface{}) ([]byte, error) {
+	data, err := runtime.Encode(c.RESTClient.Codec(), pod)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(extraSpec) == 0 {
+		return data, nil
+	}
+
+	var object map[string]interface{}
+	if err = json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	spec, _ := object["spec"].(map[string]interface{})
+	if spec == nil {
+		spec = make(map[string]interface{})
+	}
+	mergeObject(spec, extraSpec)
+	object["spec"] = spec
+
+	return json.Marshal(object)
+}
+
+// mergeObject merges src into the decoded JSON object dst. Nested objects are
+// merged recursively, lists of named objects (eg. containers) are merged by
+// name, all other values of src replace the ones of dst. Like a strategic
+// merge patch, a null value removes the field of dst, an object with
+// "$patch: replace" replaces the one of dst and a named object with
+// "$patch: delete" is removed from its list
+func mergeObject(dst, src map[string]interface{}) {
+	for key, value := range src {
+		switch value := value.(type) {
+		case nil:
+			delete(dst, key)
+			continue
+		case map[string]interface{}:
+			if value[patchDirective] == "replace" {
+				delete(value, patchDirective)
+			} else if object, ok := dst[key].(map[string]interface{}); ok {
+				mergeObject(object, value)
+				continue
+			}
+		case []interface{}:
+			if list, ok := dst[key].([]interface{}); ok && isNamedList(value) {
+				dst[key] = mergeNamedList(list, value)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+const patchDirective = "$patch"
+
+// parsePodSpec parses the YAML or JSON object of a pod spec
+func parsePodSpec(data string) (map[string]interface{}, error) {
+	var spec map[string]interface{}
+	if err := yaml.Unmarshal([]byte(data), &spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// podSpecWithTemplate returns the spec of pod merged with extraSpec, like
+// encodePod, and merged into template. The fields of template which aren't
+// set by the executor are used as is
+func podSpecWithTemplate(c *client.Client, pod *api.Pod, template, extraSpec map[string]interface{}) (map[string]interface{}, error) {
+	if len(template) == 0 {
+		return extraSpec, nil
+	}
+
+	data, err := encodePod(c, pod, extraSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	var object struct {
+		Spec map[string]interface{} `json:"spec"`
+	}
+	if err = json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	// template is shared by the pods of the build, it's copied before merging
+	data, err = json.Marshal(template)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec map[string]interface{}
+	if err = json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	mergeObject(spec, object.Spec)
+	return spec, nil
+}
+
+func isNamedList(list []interface{}) bool {
+	for _, item := range list {
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if _, ok = object["name"].(string); !ok {
+			return false
+		}
+	}
+	return len(list) > 0
+}
+
+func mergeNamedList(dst, src []interface{}) []interface{} {
+	for _, item := range src {
+		object := item.(map[string]interface{})
+		remove := object[patchDirective] == "delete"
+
+		merged := false
+		for i, existing := range dst {
+			if existing, ok := existing.(map[string]interface{}); ok && existing["name"] == object["name"] {
+				if remove {
+					dst = append(dst[:i], dst[i+1:]...)
+				} else {
+					mergeObject(existing, object)
+				}
+				merged = true
+				break
+			}
+		}
+		if !merged && !remove {
+			dst = append(dst, object)
+		}
+	}
+	return dst
+}
+
+// parsePodPatch parses the YAML or JSON patch of the build pods. The patch
+// can only change the metadata and the spec of the pods, and not their name
+// or namespace, which identify the pods of the build
+func parsePodPatch(data string) (map[string]interface{}, error) {
+	var patch map[string]interface{}
+	if err := yaml.Unmarshal([]byte(data), &patch); err != nil {
+		return nil, err
+	}
+
+	for key := range patch {
+		if key != "metadata" && key != "spec" {
+			return nil, fmt.Errorf("only the metadata and the spec can be patched, got %s", key)
+		}
+	}
+
+	metadata, ok := patch["metadata"].(map[string]interface{})
+	if !ok && patch["metadata"] != nil {
+		return nil, fmt.Errorf("metadata must be an object")
+	}
+	for _, key := range []string{"name", "generateName", "namespace"} {
+		if _, found := metadata[key]; found {
+			return nil, fmt.Errorf("the %s of the pod can't be patched", key)
+		}
+	}
+
+	if _, ok = patch["spec"].(map[string]interface{}); !ok && patch["spec"] != nil {
+		return nil, fmt.Errorf("spec must be an object")
+	}
+	return patch, nil
+}
+
+// encodePatchedPod serializes pod like encodePod, and applies patch to it
+// with the semantics of mergeObject
+func encodePatchedPod(c *client.Client, pod *api.Pod, extraSpec, patch map[string]interface{}) ([]byte, error) {
+	data, err := encodePod(c, pod, extraSpec)
+	if err != nil || len(patch) == 0 {
+		return data, err
+	}
+
+	var object map[string]interface{}
+	if err = json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	// the patch is shared by the pods of the build, it's copied before merging
+	data, err = json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	var copied map[string]interface{}
+	if err = json.Unmarshal(data, &copied); err != nil {
+		return nil, err
+	}
+	mergeObject(object, copied)
+	return json.Marshal(object)
+}
+
+// createPod creates pod in its namespace, see encodePatchedPod for extraSpec
+// and patch
+func createPod(c *client.Client, pod *api.Pod, extraSpec, patch map[string]interface{}) (*api.Pod, error) {
+	data, err := encodePatchedPod(c, pod, extraSpec, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &api.Pod{}
+	err = c.RESTClient.Post().
+		Namespace(pod.Namespace).
+		Resource("pods").
+		SetHeader("Content-Type", "application/json").
+		Body(data).
+		Do().
+		Into(result)
+	return result, err
+}
+
+// encodeJob serializes a batch/v1 Job running pod once, see encodePatchedPod
+// for extraSpec and patch. The Job isn't modeled by the vendored API types, so
+// it's built as unstructured data
+func encodeJob(c *client.Client, pod *api.Pod, extraSpec, patch map[string]interface{}) ([]byte, error) {
+	data, err := encodePatchedPod(c, pod, extraSpec, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	var object map[string]interface{}
+	if err = json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	metadata, _ := object["metadata"].(map[string]interface{})
+	template := map[string]interface{}{
+		"labels":      metadata["labels"],
+		"annotations": metadata["annotations"],
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata":   metadata,
+		"spec": map[string]interface{}{
+			"backoffLimit": 0,
+			"template": map[string]interface{}{
+				"metadata": template,
+				"spec":     object["spec"],
+			},
+		},
+	})
+}
+
+// createJob creates a Job running pod in its namespace and returns the name
+// of the Job
+func createJob(c *client.Client, pod *api.Pod, extraSpec, patch map[string]interface{}) (string, error) {
+	data, err := encodeJob(c, pod, extraSpec, patch)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := c.RESTClient.Post().
+		AbsPath("/apis/batch/v1").
+		Namespace(pod.Namespace).
+		Resource("jobs").
+		SetHeader("Content-Type", "application/json").
+		Body(data).
+		Do().
+		Raw()
+	if err != nil {
+		return "", err
+	}
+
+	var job struct {
+		Metadata api.ObjectMeta `json:"metadata"`
+	}
+	if err = json.Unmarshal(result, &job); err != nil {
+		return "", err
+	}
+	return job.Metadata.Name, nil
+}
+
+// waitForJobPod returns the pod the job controller created for the Job
+func waitForJobPod(c *client.Client, namespace, job string, timeout time.Duration) (*api.Pod, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		pods, err := c.Pods(namespace).List(api.ListOptions{
+			LabelSelector: labels.SelectorFromSet(labels.Set{jobNameLabel: job}),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range pods.Items {
+			if pods.Items[i].DeletionTimestamp == nil {
+				return &pods.Items[i], nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("the pod of job %s/%s wasn't created after %s", namespace, job, timeout)
+		}
+		time.Sleep(jobPodCheckInterval)
+	}
+}
+
+// deleteJob deletes the Job together with its pod, which is deleted before
+// the Job by the foreground propagation
+func deleteJob(c *client.Client, namespace, job string) error {
+	return c.RESTClient.Delete().
+		AbsPath("/apis/batch/v1").
+		Namespace(namespace).
+		Resource("jobs").
+		Name(job).
+		SetHeader("Content-Type", "application/json").
+		Body([]byte(`{"kind":"DeleteOptions","apiVersion":"v1","propagationPolicy":"Foreground"}`)).
+		Do().
+		Error()
+}
+
+// isRetryableError returns true if err is caused by a temporary failure of
+// the API server, eg. it's restarted or overloaded, so the request can be
+// retried. The requests rejected by the API server, eg. because they're
+// invalid or exceed the quota, are not retried
+func isRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if status, ok := err.(kubeerrors.APIStatus); ok {
+		code := status.Status().Code
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+
+	if isRequestTimeout(err) {
+		return true
+	}
+
+	// the request failed before getting a response, eg. the connection
+	// was refused or reset
+	_, ok := err.(*url.Error)
+	return ok
+}
+
+// podYAML converts a pod serialized with encodePod to YAML. The values of
+// environment variables are masked, so the result is safe to archive
+func podYAML(data []byte) (string, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return "", err
+	}
+
+	spec, _ := object["spec"].(map[string]interface{})
+	for _, key := range []string{"initContainers", "containers"} {
+		containers, _ := spec[key].([]interface{})
+		for _, container := range containers {
+			container, _ := container.(map[string]interface{})
+			env, _ := container["env"].([]interface{})
+			for _, variable := range env {
+				variable, _ := variable.(map[string]interface{})
+				if _, ok := variable["value"]; ok {
+					variable["value"] = "[MASKED]"
+				}
+			}
+		}
+	}
+
+	return helpers.ToYAML(object), nil
+}
+
+func isRunning(pod *api.Pod) (bool, error) {
+	switch pod.Status.Phase {
+	case api.PodRunning:
+		return true, nil
+	case api.PodSucceeded:
+		return false, fmt.Errorf("pod already succeeded before it begins running")
+	case api.PodFailed:
+		if err := deadlineExceeded(pod); err != nil {
+			return false, err
+		}
+		if err := ephemeralStorageExceeded(pod); err != nil {
+			return false, err
+		}
+		return false, fmt.Errorf("pod status is failed")
+	default:
+		return false, nil
+	}
+}
+
+// podReasonDeadlineExceeded is the reason of the pods killed by Kubernetes
+// since they were running longer than their active deadline
+const podReasonDeadlineExceeded = "DeadlineExceeded"
+
+// deadlineExceeded returns an error if pod was killed since it exceeded its
+// active deadline
+func deadlineExceeded(pod *api.Pod) error {
+	if pod.Status.Reason != podReasonDeadlineExceeded {
+		return nil
+	}
+
+	if pod.Spec.ActiveDeadlineSeconds != nil {
+		return fmt.Errorf("pod was running longer than its active deadline of %d seconds", *pod.Spec.ActiveDeadlineSeconds)
+	}
+	return fmt.Errorf("pod was running longer than its active deadline")
+}
+
+// podReasonEvicted is the reason of the pods evicted by the kubelet, eg.
+// since they exceeded their ephemeral storage limit
+const podReasonEvicted = "Evicted"
+
+// ephemeralStorageExceeded returns an error if pod was evicted since it
+// exceeded its ephemeral storage limit
+func ephemeralStorageExceeded(pod *api.Pod) error {
+	if pod.Status.Reason != podReasonEvicted || !strings.Contains(pod.Status.Message, "ephemeral") {
+		return nil
+	}
+	return fmt.Errorf("pod was evicted: %s", pod.Status.Message)
+}
+
+// containerReasonOOMKilled is the reason of the containers killed since they
+// ran out of memory
+const containerReasonOOMKilled = "OOMKilled"
+
+// oomKilled returns an error if the container of pod was killed since it
+// exceeded its memory limit. The container may have been restarted since
+func oomKilled(pod *api.Pod, container string) error {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != container {
+			continue
+		}
+
+		terminated := status.State.Terminated
+		if terminated == nil {
+			terminated = status.LastTerminationState.Terminated
+		}
+		if terminated == nil || terminated.Reason != containerReasonOOMKilled {
+			return nil
+		}
+
+		for _, spec := range pod.Spec.Containers {
+			if limit, ok := spec.Resources.Limits[api.ResourceMemory]; spec.Name == container && ok {
+				return fmt.Errorf("container %s ran out of memory and was killed, "+
+					"the memory limit of %s needs to be raised", container, limit.String())
+			}
+		}
+		return fmt.Errorf("container %s ran out of memory and was killed, the memory limit needs to be raised", container)
+	}
+	return nil
+}
+
+type podPhaseResponse struct {
+	done  bool
+	phase api.PodPhase
+	err   error
+}
+
+var versionSkewWarning sync.Once
+
+// getPod retrieves a pod. If the pod can't be decoded, eg. because the API
+// server is newer and changed the type of a field, it's retrieved again and
+// decoded ignoring the fields which can't be decoded
+func getPod(c *client.Client, namespace, name string) (*api.Pod, error) {
+	pod, err := c.Pods(namespace).Get(name)
+	if err == nil {
+		return pod, nil
+	}
+	if _, ok := err.(kubeerrors.APIStatus); ok {
+		return nil, err
+	}
+
+	data, rawErr := c.Get().Namespace(namespace).Resource("pods").Name(name).DoRaw()
+	if rawErr != nil {
+		return nil, err
+	}
+
+	pod, decodeErr := decodePodLeniently(data)
+	if decodeErr != nil {
+		return nil, err
+	}
+
+	versionSkewWarning.Do(func() {
+		logrus.Warningln("The Kubernetes API server returned a pod which can't be fully decoded, "+
+			"probably because it's newer than the client. Ignoring the fields which can't be decoded:", err)
+	})
+	return pod, nil
+}
+
+// getContainerLogs returns the last lines of the logs of container of pod
+func getContainerLogs(c *client.Client, pod *api.Pod, container string, lines int64) ([]byte, error) {
+	return c.Pods(pod.Namespace).GetLogs(pod.Name, &api.PodLogOptions{
+		Container: container,
+		TailLines: &lines,
+	}).Do().Raw()
+}
+
+// decodePodLeniently decodes a v1 pod, skipping unknown fields as well as the
+// fields which have an unexpected type
+func decodePodLeniently(data []byte) (*api.Pod, error) {
+	var versioned v1.Pod
+	if err := json.Unmarshal(data, &versioned); err != nil {
+		if _, ok := err.(*json.UnmarshalTypeError); !ok {
+			return nil, err
+		}
+	}
+
+	pod := &api.Pod{}
+	if err := api.Scheme.Convert(&versioned, pod); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+// serviceStartFailure returns an error naming the first service container of
+// pod which terminated with a failure or is restarted in a crash loop
+func serviceStartFailure(pod *api.Pod) error {
+	images := make(map[string]string)
+	for _, container := range pod.Spec.Containers {
+		images[container.Name] = container.Image
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if !strings.HasPrefix(status.Name, "svc-") {
+			continue
+		}
+
+		service := fmt.Sprintf("service %s (%s)", status.Name, images[status.Name])
+		switch {
+		case status.State.Terminated != nil && status.State.Terminated.ExitCode != 0:
+			return fmt.Errorf("%s failed to start: %s", service, terminationMessage(status.State.Terminated))
+		case status.State.Waiting != nil && status.State.Waiting.Reason == "CrashLoopBackOff":
+			if last := status.LastTerminationState.Terminated; last != nil {
+				return fmt.Errorf("%s failed to start, it's restarted in a crash loop: %s", service, terminationMessage(last))
+			}
+			return fmt.Errorf("%s failed to start, it's restarted in a crash loop", service)
+		}
+	}
+	return nil
+}
+
+// imagePullError is returned when the image of a container of the build pod
+// can't be pulled
+type imagePullError struct {
+	message string
+}
+
+func (e *imagePullError) Error() string {
+	return e.message
+}
+
+// containerStartFailure returns an error naming the first container of pod
+// which can't be started on its own, because its image can't be pulled or its
+// configuration is invalid, eg. it references a missing secret
+func containerStartFailure(pod *api.Pod) error {
+	images := make(map[string]string)
+	for _, container := range pod.Spec.Containers {
+		images[container.Name] = container.Image
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		waiting := status.State.Waiting
+		if status.Ready || waiting == nil {
+			continue
+		}
+
+		image := images[status.Name]
+		if image == "" {
+			image = status.Image
+		}
+
+		switch waiting.Reason {
+		case "ErrImagePull", "ImagePullBackOff", "InvalidImageName":
+			return &imagePullError{fmt.Sprintf("image %s of container %s can't be pulled: %s", image, status.Name, waitingMessage(waiting))}
+		case "CreateContainerConfigError":
+			return fmt.Errorf("container %s can't be created: %s", status.Name, waitingMessage(waiting))
+		}
+	}
+	return nil
+}
+
+func waitingMessage(state *api.ContainerStateWaiting) string {
+	if state.Message == "" {
+		return state.Reason
+	}
+	return state.Message
+}
+
+func terminationMessage(state *api.ContainerStateTerminated) string {
+	message := fmt.Sprintf("exit code %d", state.ExitCode)
+	if state.Reason != "" {
+		message += ", reason " + state.Reason
+	}
+	if state.Message != "" {
+		message += ": " + state.Message
+	}
+	return message
+}
+
+// notReadyServices returns the names and images of the service containers of
+// pod which are not ready
+func notReadyServices(pod *api.Pod) []string {
+	return notReadyContainers(pod, func(name string) bool {
+		return strings.HasPrefix(name, "svc-")
+	})
 }
 
-func closeKubeClient(client *client.Client) bool {
-	if client == nil || client.Client == nil || client.Client.Transport == nil {
-		return false
-	}
-	if transport, _ := client.Client.Transport.(*http.Transport); transport != nil {
-		transport.CloseIdleConnections()
-		return true
+// notReadyContainers returns the names and images of the containers of pod
+// matching match which are not ready
+func notReadyContainers(pod *api.Pod, match func(name string) bool) []string {
+	ready := make(map[string]bool)
+	for _, status := range pod.Status.ContainerStatuses {
+		ready[status.Name] = status.Ready
 	}
-	return false
-}
 
-func isRunning(pod *api.Pod) (bool, error) {
-	switch pod.Status.Phase {
-	case api.PodRunning:
-		return true, nil
-	case api.PodSucceeded:
-		return false, fmt.Errorf("pod already succeeded before it begins running")
-	case api.PodFailed:
-		return false, fmt.Errorf("pod status is failed")
-	default:
-		return false, nil
+	var notReady []string
+	for _, container := range pod.Spec.Containers {
+		if match(container.Name) && !ready[container.Name] {
+			notReady = append(notReady, fmt.Sprintf("%s (%s)", container.Name, container.Image))
+		}
 	}
+	return notReady
 }
 
-type podPhaseResponse struct {
-	done  bool
-	phase api.PodPhase
-	err   error
+// unschedulableMessage returns why the scheduler can't place pod on a node, or
+// an empty string if pod isn't unschedulable
+func unschedulableMessage(pod *api.Pod) string {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == api.PodScheduled && condition.Status == api.ConditionFalse &&
+			condition.Reason == "Unschedulable" {
+			return condition.Message
+		}
+	}
+	return ""
 }
 
-func getPodPhase(c *client.Client, pod *api.Pod, out io.Writer) podPhaseResponse {
-	pod, err := c.Pods(pod.Namespace).Get(pod.Name)
+func getPodPhase(c *client.Client, pod *api.Pod, out io.Writer, failOnServices bool) podPhaseResponse {
+	namespace, name := pod.Namespace, pod.Name
+	pod, err := getPod(c, namespace, name)
+	if isRequestTimeout(err) {
+		fmt.Fprintf(out, "Waiting for pod %s/%s to be running, %s\n", namespace, name, err.Error())
+		return podPhaseResponse{false, api.PodUnknown, nil}
+	}
 	if err != nil {
 		return podPhaseResponse{true, api.PodUnknown, err}
 	}
 
+	if failOnServices {
+		if err = serviceStartFailure(pod); err != nil {
+			return podPhaseResponse{true, pod.Status.Phase, err}
+		}
+	}
+
 	ready, err := isRunning(pod)
 
 	if err != nil {
@@ -108,6 +1028,10 @@ func getPodPhase(c *client.Client, pod *api.Pod, out io.Writer) podPhaseResponse
 		return podPhaseResponse{true, pod.Status.Phase, nil}
 	}
 
+	if err = containerStartFailure(pod); err != nil {
+		return podPhaseResponse{true, api.PodUnknown, err}
+	}
+
 	// check status of containers
 	for _, container := range pod.Status.ContainerStatuses {
 		if container.Ready {
@@ -118,53 +1042,544 @@ func getPodPhase(c *client.Client, pod *api.Pod, out io.Writer) podPhaseResponse
 		}
 
 		switch container.State.Waiting.Reason {
-		case "ErrImagePull", "ImagePullBackOff":
-			return podPhaseResponse{true, api.PodUnknown, errors.New(container.State.Waiting.Message)}
+		case "CrashLoopBackOff":
+			// a restarted container is only waiting in CrashLoopBackOff
+			// once it failed repeatedly, so it won't start on its own
+			if container.Name != "build" {
+				continue
+			}
+			err = errors.New("build container is restarted in a crash loop")
+			if last := container.LastTerminationState.Terminated; last != nil {
+				err = fmt.Errorf("build container is restarted in a crash loop: %s", terminationMessage(last))
+			}
+			return podPhaseResponse{true, api.PodUnknown, err}
 		}
 	}
 
+	// the pod is retried to be scheduled, eg. once the cluster was scaled up,
+	// so it's awaited, the reason is reported if the pod doesn't start in time
+	if message := unschedulableMessage(pod); message != "" {
+		fmt.Fprintf(out, "Waiting for pod %s/%s to be scheduled: %s\n", pod.Namespace, pod.Name, message)
+		return podPhaseResponse{false, pod.Status.Phase, fmt.Errorf("pod can't be scheduled: %s", message)}
+	}
+
 	fmt.Fprintf(out, "Waiting for pod %s/%s to be running, status is %s\n", pod.Namespace, pod.Name, pod.Status.Phase)
 	return podPhaseResponse{false, pod.Status.Phase, nil}
 
 }
 
-func triggerPodPhaseCheck(c *client.Client, pod *api.Pod, out io.Writer) <-chan podPhaseResponse {
+func triggerPodPhaseCheck(c *client.Client, pod *api.Pod, out io.Writer, failOnServices bool) <-chan podPhaseResponse {
 	errc := make(chan podPhaseResponse)
 	go func() {
 		defer close(errc)
-		errc <- getPodPhase(c, pod, out)
+		errc <- getPodPhase(c, pod, out, failOnServices)
 	}()
 	return errc
 }
 
+// watchPod watches the changes of pod, nil is returned if it can't be
+// watched, eg. if it's not allowed by RBAC. The field selector is passed as is,
+// the client doesn't know how to convert metadata.name of the pods
+func watchPod(c *client.Client, pod *api.Pod) watch.Interface {
+	watcher, err := c.Get().Prefix("watch").Namespace(pod.Namespace).Resource("pods").
+		Param("fieldSelector", fields.OneTermEqualSelector("metadata.name", pod.Name).String()).
+		Watch()
+	if err != nil {
+		return nil
+	}
+	return watcher
+}
+
+// schedulingFailureMessage returns the message of the last event reporting
+// why pod can't be scheduled, eg. "Insufficient cpu", or an empty string if
+// pod is scheduled or the events can't be listed
+func schedulingFailureMessage(c *client.Client, pod *api.Pod) string {
+	pod, err := getPod(c, pod.Namespace, pod.Name)
+	if err != nil || pod.Spec.NodeName != "" {
+		return ""
+	}
+
+	events, err := c.Events(pod.Namespace).List(api.ListOptions{
+		FieldSelector: fields.Set{
+			"involvedObject.kind": "Pod",
+			"involvedObject.name": pod.Name,
+			"reason":              "FailedScheduling",
+		}.AsSelector(),
+	})
+	if err != nil {
+		return ""
+	}
+
+	var last *api.Event
+	for i := range events.Items {
+		if last == nil || last.LastTimestamp.Before(events.Items[i].LastTimestamp) {
+			last = &events.Items[i]
+		}
+	}
+	if last == nil {
+		return ""
+	}
+	return last.Message
+}
+
+// streamPodEvents writes the events of pod to out, eg. why it can't be
+// scheduled or which images are pulled, until the returned function is called.
+// Nothing is written if the events can't be watched
+func streamPodEvents(c *client.Client, pod *api.Pod, out io.Writer) func() {
+	watcher, err := c.Get().Prefix("watch").Namespace(pod.Namespace).Resource("events").
+		Param("fieldSelector", fields.Set{
+			"involvedObject.kind": "Pod",
+			"involvedObject.name": pod.Name,
+		}.String()).
+		Watch()
+	if err != nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// the repeated events are updated, they're only written once
+		// they occurred again
+		counts := make(map[string]int32)
+		for change := range watcher.ResultChan() {
+			event, ok := change.Object.(*api.Event)
+			if !ok || change.Type == watch.Deleted {
+				continue
+			}
+			if count, found := counts[event.Name]; found && event.Count <= count {
+				continue
+			}
+			counts[event.Name] = event.Count
+
+			fmt.Fprintf(out, "Pod event: %s %s: %s\n", event.Type, event.Reason, event.Message)
+		}
+	}()
+
+	return func() {
+		watcher.Stop()
+		<-done
+	}
+}
+
+// podWaitOptions configures how waitForPodRunning waits for the pod
+type podWaitOptions struct {
+	// failOnServices fails the wait if a service container fails to start
+	failOnServices bool
+	// pollInterval is how often the pod is checked if it can't be watched
+	pollInterval time.Duration
+	// timeout is how long the pod is waited for
+	timeout time.Duration
+}
+
 // waitForPodRunning will use client c to detect when pod reaches the PodRunning
-// state. It will check every second, and will return the final PodPhase once
-// either PodRunning, PodSucceeded or PodFailed has been reached. In the case of
-// PodRunning, it will also wait until all containers within the pod are also Ready
-// Returns error if the call to retrieve pod details fails
-func waitForPodRunning(ctx context.Context, c *client.Client, pod *api.Pod, out io.Writer) (api.PodPhase, error) {
-	for i := 0; i < 60; i++ {
+// state. It's checked every time the pod changes, or every poll interval if it
+// can't be watched, and will return the final PodPhase once either
+// PodRunning, PodSucceeded or PodFailed has been reached. In the case of
+// PodRunning, it will also wait until all containers within the pod are also
+// Ready. Returns error if the call to retrieve pod details fails, or if the pod
+// doesn't start within the timeout. If failOnServices is set, returns error
+// if a service container fails to start. The events of the pod are written to
+// out while it's waited for
+func waitForPodRunning(ctx context.Context, c *client.Client, pod *api.Pod, out io.Writer, options podWaitOptions) (api.PodPhase, error) {
+	timeout := time.NewTimer(options.timeout)
+	defer timeout.Stop()
+
+	// the watch is started before the pod is checked, not to miss its changes
+	watcher := watchPod(c, pod)
+	watchable := watcher != nil
+	defer func() {
+		if watcher != nil {
+			watcher.Stop()
+		}
+	}()
+
+	var stopEvents func()
+	defer func() {
+		if stopEvents != nil {
+			stopEvents()
+		}
+	}()
+
+	last := podPhaseResponse{false, api.PodUnknown, nil}
+	for {
 		select {
-		case r := <-triggerPodPhaseCheck(c, pod, out):
-			if !r.done {
-				time.Sleep(3 * time.Second)
-				continue
+		case r := <-triggerPodPhaseCheck(c, pod, out, options.failOnServices):
+			if r.done {
+				if _, ok := r.err.(*imagePullError); ok {
+					podFailures.WithLabelValues(podFailureImagePull).Inc()
+				}
+				return r.phase, r.err
+			}
+			last = r
+
+			// the events are only streamed if the pod isn't running yet, not
+			// to repeat them every time the running pod is checked
+			if stopEvents == nil {
+				stopEvents = streamPodEvents(c, pod, out)
 			}
+		case <-ctx.Done():
+			return api.PodUnknown, ctx.Err()
+		case <-timeout.C:
+			return api.PodUnknown, podStartTimeoutError(c, pod, last)
+		}
 
-			return r.phase, r.err
+		var changes <-chan watch.Event
+		var poll <-chan time.Time
+		if watcher != nil {
+			changes = watcher.ResultChan()
+		} else {
+			poll = time.After(options.pollInterval)
+		}
+
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				// the watch was closed by the API server, the pod is polled
+				// until it's watched again
+				watcher = nil
+			}
+		case <-poll:
+			if watchable {
+				watcher = watchPod(c, pod)
+			}
 		case <-ctx.Done():
 			return api.PodUnknown, ctx.Err()
+		case <-timeout.C:
+			return api.PodUnknown, podStartTimeoutError(c, pod, last)
+		}
+	}
+}
+
+// podStartTimeoutError returns the error of pod which didn't start in time.
+// If the last check of the pod didn't report why, and the pod isn't scheduled
+// yet, the reason is looked up in the events of the scheduler
+func podStartTimeoutError(c *client.Client, pod *api.Pod, last podPhaseResponse) error {
+	if last.err == nil && last.phase == api.PodPending {
+		if message := schedulingFailureMessage(c, pod); message != "" {
+			last.err = fmt.Errorf("pod can't be scheduled: %s", message)
+		}
+	}
+
+	if last.err != nil {
+		return fmt.Errorf("timedout waiting for pod to start, status is %s: %s", last.phase, last.err.Error())
+	}
+	return fmt.Errorf("timedout waiting for pod to start, status is %s", last.phase)
+}
+
+// keepUntilAnnotation is the time, in RFC 3339 format, until which the pod of
+// a failed build is kept for debugging
+const keepUntilAnnotation = "gitlab-runner/keep-until"
+
+// keptPodsReapInterval is how often the expired pods of failed builds are
+// looked for in a namespace
+var keptPodsReapInterval = time.Minute
+
+// keptPodsReaped is when the kept pods of each namespace were last reaped
+var keptPodsReaped = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+// reapDue returns true if the kept pods of key weren't reaped for
+// keptPodsReapInterval, and records that they're reaped at now
+func reapDue(key string, now time.Time) bool {
+	keptPodsReaped.Lock()
+	defer keptPodsReaped.Unlock()
+
+	if now.Sub(keptPodsReaped.last[key]) < keptPodsReapInterval {
+		return false
+	}
+	keptPodsReaped.last[key] = now
+	return true
+}
+
+// keepPod annotates pod to be kept until the given time, see reapKeptPods
+func keepPod(c *client.Client, pod *api.Pod, until time.Time) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{keepUntilAnnotation: until.UTC().Format(time.RFC3339)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.Patch(api.MergePatchType).Namespace(pod.Namespace).Resource("pods").Name(pod.Name).
+		Body(patch).Do().Error()
+}
+
+// reapKeptPods deletes the kept pods of failed builds in namespace, whose
+// time to be kept expired before now
+func reapKeptPods(c *client.Client, namespace string, now time.Time) error {
+	pods, err := c.Pods(namespace).List(api.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{buildPodLabel: "true"}),
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		until, err := time.Parse(time.RFC3339, pod.Annotations[keepUntilAnnotation])
+		if err != nil || pod.DeletionTimestamp != nil || until.After(now) {
+			continue
+		}
+
+		if err = deletePod(c, pod, nil); err != nil && !kubeerrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// keptNamespaceLabel marks the namespaces created for a build which are kept
+// with its failed pod, see reapKeptNamespaces
+const keptNamespaceLabel = "gitlab-runner/kept"
+
+// keepNamespace labels and annotates the namespace to be kept until the given
+// time, see reapKeptNamespaces
+func keepNamespace(c *client.Client, namespace string, until time.Time) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]string{keptNamespaceLabel: "true"},
+			"annotations": map[string]string{keepUntilAnnotation: until.UTC().Format(time.RFC3339)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.Patch(api.MergePatchType).Resource("namespaces").Name(namespace).Body(patch).Do().Error()
+}
+
+// reapKeptNamespaces deletes the kept namespaces, with the pods of the failed
+// builds in them, whose time to be kept expired before now
+func reapKeptNamespaces(c *client.Client, now time.Time) error {
+	namespaces, err := c.Namespaces().List(api.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{keptNamespaceLabel: "true"}),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, namespace := range namespaces.Items {
+		until, err := time.Parse(time.RFC3339, namespace.Annotations[keepUntilAnnotation])
+		if err != nil || namespace.DeletionTimestamp != nil || until.After(now) {
+			continue
+		}
+
+		if err = c.Namespaces().Delete(namespace.Name); err != nil && !kubeerrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownByPod makes pod the owner of the object of resource in its namespace, so
+// the object is deleted by the garbage collector with the pod
+func ownByPod(c *client.Client, resource, name string, pod *api.Pod) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": []api.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Name:       pod.Name,
+				UID:        pod.UID,
+			}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.Patch(api.MergePatchType).Namespace(pod.Namespace).Resource(resource).Name(name).
+		Body(patch).Do().Error()
+}
+
+// runnerLabel marks the build pods with the short token of their runner, so
+// the pods it leaked, eg. because it crashed, can be found
+const runnerLabel = "gitlab-runner/runner"
+
+// orphanedPodsCollected records the runners and namespaces whose orphaned
+// pods were already deleted by the process
+var orphanedPodsCollected = struct {
+	sync.Mutex
+	done map[string]bool
+}{done: make(map[string]bool)}
+
+// collectOrphanedPods deletes the pods of runner older than the configured
+// timeout, which leaked, eg. because the runner crashed before the cleanup,
+// and returns how many were deleted. It's done once per namespace by the
+// process, unless it failed, therefore the timeout needs to be longer than
+// the builds
+func collectOrphanedPods(c *client.Client, config *common.KubernetesConfig, runner string) (int, error) {
+	if config.OrphanedPodsTimeout <= 0 || runner == "" {
+		return 0, nil
+	}
+
+	key := config.Host + "/" + config.Namespace + "/" + runner
+	orphanedPodsCollected.Lock()
+	done := orphanedPodsCollected.done[key]
+	orphanedPodsCollected.Unlock()
+	if done {
+		return 0, nil
+	}
+
+	timeout := time.Duration(config.OrphanedPodsTimeout) * time.Second
+	deleted, err := deleteOrphanedPods(c, config.Namespace, runner, time.Now().Add(-timeout))
+	if err != nil {
+		return deleted, err
+	}
+
+	orphanedPodsCollected.Lock()
+	orphanedPodsCollected.done[key] = true
+	orphanedPodsCollected.Unlock()
+	return deleted, nil
+}
+
+// deleteOrphanedPods deletes the build pods of runner in namespace which were
+// created before the given time, except the kept pods of failed builds, and
+// returns how many were deleted
+func deleteOrphanedPods(c *client.Client, namespace, runner string, before time.Time) (int, error) {
+	pods, err := c.Pods(namespace).List(api.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{buildPodLabel: "true", runnerLabel: runner}),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || !pod.CreationTimestamp.Time.Before(before) {
+			continue
+		}
+		if _, kept := pod.Annotations[keepUntilAnnotation]; kept {
+			continue
 		}
+
+		if err = deletePod(c, pod, nil); err != nil && !kubeerrors.IsNotFound(err) {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// deletePod deletes pod, retrying the requests which timed out. The grace
+// period of the pod is used unless gracePeriod is set, 0 deletes it immediately
+func deletePod(c *client.Client, pod *api.Pod, gracePeriod *int64) (err error) {
+	var options *api.DeleteOptions
+	if gracePeriod != nil {
+		options = api.NewDeleteOptions(*gracePeriod)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = c.Pods(pod.Namespace).Delete(pod.Name, options)
+		if !isRequestTimeout(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// createPodEvent creates an event about pod. The event is owned by the pod,
+// so it's garbage collected once the pod is deleted
+func createPodEvent(c *client.Client, pod *api.Pod, eventType, reason, message string) error {
+	now := unversioned.Now()
+	_, err := c.Events(pod.Namespace).Create(&api.Event{
+		ObjectMeta: api.ObjectMeta{
+			GenerateName: pod.Name + "-",
+			Namespace:    pod.Namespace,
+			OwnerReferences: []api.OwnerReference{
+				{
+					APIVersion: "v1",
+					Kind:       "Pod",
+					Name:       pod.Name,
+					UID:        pod.UID,
+				},
+			},
+		},
+		InvolvedObject: api.ObjectReference{
+			APIVersion:      "v1",
+			Kind:            "Pod",
+			Namespace:       pod.Namespace,
+			Name:            pod.Name,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Source:         api.EventSource{Component: "gitlab-runner"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	})
+	return err
+}
+
+// waitForPodDeletion will use client c to check the pod until it is no
+// longer found, or the timeout is reached
+func waitForPodDeletion(c *client.Client, pod *api.Pod, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := getPod(c, pod.Namespace, pod.Name)
+		if kubeerrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil && !isRequestTimeout(err) {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timedout waiting for pod %s/%s to be deleted", pod.Namespace, pod.Name)
+		}
+		time.Sleep(podDeletionCheckInterval)
+	}
+}
+
+// resolvePercentage translates a limit expressed as a percentage, eg. 50%,
+// to the respective quantity of reference, which is the allocatable amount
+// of the resource on the reference node. Other limits are returned unchanged
+func resolvePercentage(limit, reference string, format resource.Format) (string, error) {
+	if !strings.HasSuffix(limit, "%") {
+		return limit, nil
+	}
+
+	percentage, err := strconv.ParseFloat(strings.TrimSuffix(limit, "%"), 64)
+	if err != nil || percentage <= 0 || percentage > 100 {
+		return "", fmt.Errorf("invalid resource limit percentage %q", limit)
+	}
+
+	if reference == "" {
+		return "", fmt.Errorf("resource limit %q requires the size of the reference node", limit)
+	}
+
+	q, err := resource.ParseQuantity(reference)
+	if err != nil {
+		return "", fmt.Errorf("error parsing reference node size: %s", err.Error())
 	}
-	return api.PodUnknown, errors.New("timedout waiting for pod to start")
+
+	if format == resource.BinarySI {
+		return resource.NewQuantity(int64(float64(q.Value())*percentage/100), format).String(), nil
+	}
+	return resource.NewMilliQuantity(int64(float64(q.MilliValue())*percentage/100), format).String(), nil
 }
 
-// limits takes a string representing CPU & memory limits,
+// resourceEphemeralStorage is the local ephemeral storage of a container,
+// its writable layer, logs and emptyDir volumes. It's not modeled by
+// api.ResourceName
+const resourceEphemeralStorage = api.ResourceName("ephemeral-storage")
+
+// limits takes a string representing CPU, memory & ephemeral storage limits,
 // and returns a ResourceList with appropriately scaled Quantity
 // values for Kubernetes. This allows users to write "500m" for CPU,
 // and "50Mi" for memory (etc.)
-func limits(cpu, memory string) (api.ResourceList, error) {
-	var rCPU, rMem resource.Quantity
+func limits(cpu, memory, ephemeralStorage string) (api.ResourceList, error) {
+	var rCPU, rMem, rStorage resource.Quantity
 	var err error
 
 	parse := func(s string) (resource.Quantity, error) {
@@ -179,26 +1594,208 @@ func limits(cpu, memory string) (api.ResourceList, error) {
 	}
 
 	if rCPU, err = parse(cpu); err != nil {
-		return api.ResourceList{}, nil
+		return api.ResourceList{}, err
 	}
 
 	if rMem, err = parse(memory); err != nil {
-		return api.ResourceList{}, nil
+		return api.ResourceList{}, err
+	}
+
+	if rStorage, err = parse(ephemeralStorage); err != nil {
+		return api.ResourceList{}, err
 	}
 
 	l := make(api.ResourceList)
 
 	q := resource.Quantity{}
 	if rCPU != q {
-		l[api.ResourceLimitsCPU] = rCPU
+		l[api.ResourceCPU] = rCPU
 	}
 	if rMem != q {
-		l[api.ResourceLimitsMemory] = rMem
+		l[api.ResourceMemory] = rMem
+	}
+	if rStorage != q {
+		l[resourceEphemeralStorage] = rStorage
 	}
 
 	return l, nil
 }
 
+// extendedResources returns the extended resources, eg. nvidia.com/gpu, with
+// their integer quantities. Kubernetes doesn't overcommit them, so they can't
+// be requested, only limited
+func extendedResources(resources map[string]string) (api.ResourceList, error) {
+	l := make(api.ResourceList)
+	for name, value := range resources {
+		if !strings.Contains(name, "/") || strings.HasSuffix(strings.SplitN(name, "/", 2)[0], "kubernetes.io") {
+			return nil, fmt.Errorf("invalid extended resource %s, expected a name prefixed with a domain, eg. nvidia.com/gpu", name)
+		}
+		if msgs := validation.IsQualifiedName(name); len(msgs) > 0 {
+			return nil, fmt.Errorf("invalid extended resource %s: %s", name, strings.Join(msgs, ", "))
+		}
+
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing extended resource %s: %s", name, err.Error())
+		}
+		if q.MilliValue()%1000 != 0 || q.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid quantity %s of extended resource %s, expected a positive integer", value, name)
+		}
+		l[api.ResourceName(name)] = q
+	}
+	return l, nil
+}
+
+// parseNodeSelector parses a comma separated list of key=value node labels
+func parseNodeSelector(text string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(text, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("invalid node selector %q, expected key=value", pair)
+		}
+		labels[key] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+// dockerConfigJSON returns the registry credentials of auth, the value of the
+// DOCKER_AUTH_CONFIG variable, in the format of ~/.docker/config.json. The
+// credentials can also be given in the older format of ~/.dockercfg, without
+// the auths object. If they're all set, the credentials of user and password
+// are added for registry, unless auth already has credentials for it
+func dockerConfigJSON(auth, registry, user, password string) ([]byte, error) {
+	config := make(map[string]interface{})
+	if auth != "" {
+		if err := json.Unmarshal([]byte(auth), &config); err != nil {
+			return nil, err
+		}
+		if _, ok := config["auths"]; !ok {
+			config = map[string]interface{}{"auths": config}
+		}
+	}
+
+	auths, ok := config["auths"].(map[string]interface{})
+	if !ok {
+		if config["auths"] != nil {
+			return nil, fmt.Errorf("auths must be an object")
+		}
+		auths = make(map[string]interface{})
+		config["auths"] = auths
+	}
+
+	if _, found := auths[registry]; !found && registry != "" && user != "" && password != "" {
+		auths[registry] = map[string]interface{}{
+			"username": user,
+			"password": password,
+			"auth":     base64.StdEncoding.EncodeToString([]byte(user + ":" + password)),
+		}
+	}
+	return json.Marshal(config)
+}
+
+// generatedNameMaxLength is the maximum length of the GenerateName of the
+// objects of the build. The names then fit in a DNS label, eg. so the names of
+// the Jobs can be used as label values, with the random suffix of Kubernetes
+const generatedNameMaxLength = validation.DNS1123LabelMaxLength - 5
+
+// podNamePrefixMaxLength is the maximum length of the configured prefix of
+// the names, so enough of the project name is left to tell the builds apart
+const podNamePrefixMaxLength = 20
+
+// sanitizedNameStem is the start of the sanitized names which would be empty
+// or start with a digit
+const sanitizedNameStem = "runner"
+
+// sanitizeName returns name as a valid DNS label (RFC 1123) of at most
+// maxLength characters, starting with a letter: it's lowercased and the
+// invalid characters are replaced with dashes. A name left empty, or starting
+// with a digit, is prefixed with "runner". A longer name is truncated, and the
+// hash of the whole name appended to keep it unique
+func sanitizeName(name string, maxLength int) string {
+	hash := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(hash[:])[:8]
+
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(name))
+	name = strings.Trim(name, "-")
+
+	switch {
+	case name == "":
+		// the hash keeps the names of only invalid characters apart
+		return sanitizedNameStem + suffix
+	case name[0] >= '0' && name[0] <= '9':
+		name = sanitizedNameStem + "-" + name
+	}
+
+	if len(name) <= maxLength {
+		return name
+	}
+	return strings.TrimRight(name[:maxLength-len(suffix)], "-") + suffix
+}
+
+// podInfoVariables returns the variables set from the fields of the build pod
+// with the downward API, so the builds know where they run
+func podInfoVariables() []api.EnvVar {
+	fields := []struct {
+		name, path string
+	}{
+		{"KUBERNETES_POD_NAME", "metadata.name"},
+		{"KUBERNETES_POD_NAMESPACE", "metadata.namespace"},
+		{"KUBERNETES_NODE_NAME", "spec.nodeName"},
+		{"KUBERNETES_POD_IP", "status.podIP"},
+	}
+
+	e := make([]api.EnvVar, len(fields))
+	for i, field := range fields {
+		e[i] = api.EnvVar{
+			Name: field.name,
+			ValueFrom: &api.EnvVarSource{
+				FieldRef: &api.ObjectFieldSelector{APIVersion: "v1", FieldPath: field.path},
+			},
+		}
+	}
+	return e
+}
+
+// resourceVariables returns the variables set from the CPU and memory limits
+// and requests of the container with the downward API. The CPUs are rounded
+// up to whole cores and the memory is given in bytes
+func resourceVariables() []api.EnvVar {
+	resources := []struct {
+		name, resource string
+	}{
+		{"KUBERNETES_CPU_LIMIT", "limits.cpu"},
+		{"KUBERNETES_CPU_REQUEST", "requests.cpu"},
+		{"KUBERNETES_MEMORY_LIMIT", "limits.memory"},
+		{"KUBERNETES_MEMORY_REQUEST", "requests.memory"},
+	}
+
+	e := make([]api.EnvVar, len(resources))
+	for i, r := range resources {
+		e[i] = api.EnvVar{
+			Name: r.name,
+			ValueFrom: &api.EnvVarSource{
+				ResourceFieldRef: &api.ResourceFieldSelector{
+					Resource: r.resource,
+					Divisor:  resource.MustParse("1"),
+				},
+			},
+		}
+	}
+	return e
+}
+
 // buildVariables converts a common.BuildVariables into a list of
 // kubernetes EnvVar objects
 func buildVariables(bv common.BuildVariables) []api.EnvVar {
@@ -211,3 +1808,9 @@ func buildVariables(bv common.BuildVariables) []api.EnvVar {
 	}
 	return e
 }
+
+// shellQuote quotes str for a POSIX shell, unlike helpers.ShellEscape whose
+// $'...' quoting isn't understood by dash or busybox sh
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,218 @@
+package kubernetes
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+	kubeerrors "k8s.io/kubernetes/pkg/api/errors"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+// reservedVolumeNames are the names of the volumes added by the executor
+var reservedVolumeNames = []string{"repo", "job-token", "scripts", "podinfo"}
+
+// checkVolumes verifies the configured volumes, so the build fails early
+// instead of the API server rejecting the pod
+func (s *executor) checkVolumes() error {
+	names := make(map[string]bool)
+	for _, name := range reservedVolumeNames {
+		names[name] = true
+	}
+
+	check := func(name, mountPath string) error {
+		if name == "" {
+			return fmt.Errorf("no name specified for the volume mounted at %s", mountPath)
+		}
+		if names[name] {
+			return fmt.Errorf("volume name %q is reserved or used more than once", name)
+		}
+		names[name] = true
+
+		if !path.IsAbs(mountPath) {
+			return fmt.Errorf("mount path %q of volume %s is not absolute", mountPath, name)
+		}
+		return nil
+	}
+
+	for _, volume := range s.Config.Kubernetes.Volumes.HostPaths {
+		if err := check(volume.Name, volume.MountPath); err != nil {
+			return err
+		}
+		if !path.IsAbs(volume.HostPath) {
+			return fmt.Errorf("host path %q of volume %s is not absolute", volume.HostPath, volume.Name)
+		}
+	}
+
+	for _, volume := range s.Config.Kubernetes.Volumes.PVCs {
+		if err := check(volume.Name, volume.MountPath); err != nil {
+			return err
+		}
+	}
+
+	for _, volume := range s.Config.Kubernetes.Volumes.Secrets {
+		if err := check(volume.Name, volume.MountPath); err != nil {
+			return err
+		}
+		for key, itemPath := range volume.Items {
+			if itemPath == "" || path.IsAbs(itemPath) || strings.HasPrefix(path.Clean(itemPath), "..") {
+				return fmt.Errorf("path %q of key %s of volume %s is not a relative path in the volume", itemPath, key, volume.Name)
+			}
+		}
+		if _, err := parseFileMode(volume.FileMode); err != nil {
+			return fmt.Errorf("volume %s: %s", volume.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// parseFileMode parses an octal file mode, eg. 0400, 0 if empty
+func parseFileMode(mode string) (int64, error) {
+	if mode == "" {
+		return 0, nil
+	}
+
+	value, err := strconv.ParseInt(mode, 8, 32)
+	if err != nil || value < 0 || value > 0777 {
+		return 0, fmt.Errorf("invalid file mode %q, expected an octal mode, eg. 0400", mode)
+	}
+	return value, nil
+}
+
+// checkPersistentVolumeClaims verifies that the claims of the configured
+// volumes exist, as the pod would be pending forever otherwise
+func (s *executor) checkPersistentVolumeClaims() error {
+	for _, volume := range s.Config.Kubernetes.Volumes.PVCs {
+		claimName := pvcClaimName(volume)
+		_, err := s.kubeClient.PersistentVolumeClaims(s.Config.Kubernetes.Namespace).Get(claimName)
+		if kubeerrors.IsNotFound(err) {
+			return fmt.Errorf("persistent volume claim %q doesn't exist in namespace %s", claimName, s.Config.Kubernetes.Namespace)
+		}
+		// other errors, eg. if the runner isn't allowed to get the claims,
+		// don't prevent the build, Kubernetes reports the missing claims
+	}
+	return nil
+}
+
+func pvcClaimName(volume common.KubernetesPVC) string {
+	if volume.ClaimName != "" {
+		return volume.ClaimName
+	}
+	return volume.Name
+}
+
+func secretName(volume common.KubernetesSecret) string {
+	if volume.SecretName != "" {
+		return volume.SecretName
+	}
+	return volume.Name
+}
+
+// buildVolumes returns the configured volumes of the pod
+func (s *executor) buildVolumes() []api.Volume {
+	var volumes []api.Volume
+	for _, volume := range s.Config.Kubernetes.Volumes.HostPaths {
+		volumes = append(volumes, api.Volume{
+			Name: volume.Name,
+			VolumeSource: api.VolumeSource{
+				HostPath: &api.HostPathVolumeSource{Path: volume.HostPath},
+			},
+		})
+	}
+
+	for _, volume := range s.Config.Kubernetes.Volumes.PVCs {
+		volumes = append(volumes, api.Volume{
+			Name: volume.Name,
+			VolumeSource: api.VolumeSource{
+				PersistentVolumeClaim: &api.PersistentVolumeClaimVolumeSource{
+					ClaimName: pvcClaimName(volume),
+					ReadOnly:  volume.ReadOnly,
+				},
+			},
+		})
+	}
+
+	for _, volume := range s.Config.Kubernetes.Volumes.Secrets {
+		keys := make([]string, 0, len(volume.Items))
+		for key := range volume.Items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var items []api.KeyToPath
+		for _, key := range keys {
+			items = append(items, api.KeyToPath{Key: key, Path: volume.Items[key]})
+		}
+
+		volumes = append(volumes, api.Volume{
+			Name: volume.Name,
+			VolumeSource: api.VolumeSource{
+				Secret: &api.SecretVolumeSource{
+					SecretName: secretName(volume),
+					Items:      items,
+				},
+			},
+		})
+	}
+	return volumes
+}
+
+// buildVolumesExtra returns the fields of the configured volumes which are
+// not modeled by api.Volume, see buildPodSpecExtra
+func (s *executor) buildVolumesExtra() []interface{} {
+	var volumes []interface{}
+	for _, volume := range s.Config.Kubernetes.Volumes.Secrets {
+		// the mode is verified by checkVolumes
+		mode, _ := parseFileMode(volume.FileMode)
+		if mode == 0 {
+			continue
+		}
+		volumes = append(volumes, map[string]interface{}{
+			"name": volume.Name,
+			"secret": map[string]interface{}{
+				"defaultMode": mode,
+			},
+		})
+	}
+	return volumes
+}
+
+// buildSecretVolumeMounts returns the mounts of the configured secrets, which
+// are only mounted in the build container
+func (s *executor) buildSecretVolumeMounts() []api.VolumeMount {
+	var mounts []api.VolumeMount
+	for _, volume := range s.Config.Kubernetes.Volumes.Secrets {
+		mounts = append(mounts, api.VolumeMount{
+			Name:      volume.Name,
+			MountPath: volume.MountPath,
+			ReadOnly:  true,
+		})
+	}
+	return mounts
+}
+
+// buildVolumeMounts returns the mounts of the configured volumes in the build,
+// helper and service containers
+func (s *executor) buildVolumeMounts() []api.VolumeMount {
+	var mounts []api.VolumeMount
+	for _, volume := range s.Config.Kubernetes.Volumes.HostPaths {
+		mounts = append(mounts, api.VolumeMount{
+			Name:      volume.Name,
+			MountPath: volume.MountPath,
+			ReadOnly:  volume.ReadOnly,
+		})
+	}
+
+	for _, volume := range s.Config.Kubernetes.Volumes.PVCs {
+		mounts = append(mounts, api.VolumeMount{
+			Name:      volume.Name,
+			MountPath: volume.MountPath,
+			ReadOnly:  volume.ReadOnly,
+		})
+	}
+	return mounts
+}
@@ -0,0 +1,253 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/testapi"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+func TestBuildPodHostPathVolumes(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Volumes: common.KubernetesVolumes{
+			HostPaths: []common.KubernetesHostPath{
+				{Name: "cache", HostPath: "/mnt/ssd/cache", MountPath: "/cache"},
+				{Name: "certs", HostPath: "/etc/ssl/certs", MountPath: "/etc/ssl/certs", ReadOnly: true},
+			},
+		},
+	}, &kubernetesOptions{
+		Image:    "test-image",
+		Services: []kubernetesService{{Name: "test-service"}},
+	})
+	require.NoError(t, ex.checkVolumes())
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	require.Equal(t, 3, len(pod.Spec.Volumes))
+	assert.Equal(t, "repo", pod.Spec.Volumes[0].Name)
+	assert.Equal(t, api.Volume{
+		Name: "cache",
+		VolumeSource: api.VolumeSource{
+			HostPath: &api.HostPathVolumeSource{Path: "/mnt/ssd/cache"},
+		},
+	}, pod.Spec.Volumes[1])
+	assert.Equal(t, "certs", pod.Spec.Volumes[2].Name)
+
+	require.Equal(t, 3, len(pod.Spec.Containers))
+	for _, container := range pod.Spec.Containers {
+		assert.Contains(t, container.VolumeMounts, api.VolumeMount{Name: "cache", MountPath: "/cache"}, container.Name)
+		assert.Contains(t, container.VolumeMounts, api.VolumeMount{Name: "certs", MountPath: "/etc/ssl/certs", ReadOnly: true}, container.Name)
+	}
+}
+
+func TestBuildPodPVCVolumes(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Volumes: common.KubernetesVolumes{
+			PVCs: []common.KubernetesPVC{
+				{Name: "dependencies", MountPath: "/cache/dependencies"},
+				{Name: "datasets", ClaimName: "shared-datasets", MountPath: "/datasets", ReadOnly: true},
+			},
+		},
+	}, &kubernetesOptions{Image: "test-image"})
+	require.NoError(t, ex.checkVolumes())
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	require.Equal(t, 3, len(pod.Spec.Volumes))
+	assert.Equal(t, api.Volume{
+		Name: "dependencies",
+		VolumeSource: api.VolumeSource{
+			PersistentVolumeClaim: &api.PersistentVolumeClaimVolumeSource{ClaimName: "dependencies"},
+		},
+	}, pod.Spec.Volumes[1])
+	assert.Equal(t, api.Volume{
+		Name: "datasets",
+		VolumeSource: api.VolumeSource{
+			PersistentVolumeClaim: &api.PersistentVolumeClaimVolumeSource{ClaimName: "shared-datasets", ReadOnly: true},
+		},
+	}, pod.Spec.Volumes[2])
+
+	// the helper container handles the caches, so it mounts the claims too
+	require.Equal(t, 2, len(pod.Spec.Containers))
+	for _, container := range pod.Spec.Containers {
+		assert.Contains(t, container.VolumeMounts, api.VolumeMount{Name: "dependencies", MountPath: "/cache/dependencies"}, container.Name)
+		assert.Contains(t, container.VolumeMounts, api.VolumeMount{Name: "datasets", MountPath: "/datasets", ReadOnly: true}, container.Name)
+	}
+}
+
+func TestCheckPersistentVolumeClaims(t *testing.T) {
+	version := testapi.Default.GroupVersion().Version
+	codec := testapi.Default.Codec()
+
+	kubeClient := testKubeClient(func(req *http.Request) (*http.Response, error) {
+		prefix := "/api/" + version + "/namespaces/test-ns/persistentvolumeclaims/"
+		if req.Method != "GET" || !strings.HasPrefix(req.URL.Path, prefix) {
+			return nil, fmt.Errorf("unexpected request: %s %s", req.Method, req.URL.Path)
+		}
+
+		name := strings.TrimPrefix(req.URL.Path, prefix)
+		if name != "shared-datasets" {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader("")), Header: map[string][]string{}}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: objBody(codec, &api.PersistentVolumeClaim{
+			ObjectMeta: api.ObjectMeta{Name: name, Namespace: "test-ns"},
+		}), Header: map[string][]string{
+			"Content-Type": []string{"application/json"},
+		}}, nil
+	})
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Namespace: "test-ns",
+		Volumes: common.KubernetesVolumes{
+			PVCs: []common.KubernetesPVC{
+				{Name: "datasets", ClaimName: "shared-datasets", MountPath: "/datasets"},
+			},
+		},
+	}, &kubernetesOptions{Image: "test-image"})
+	ex.kubeClient = kubeClient
+	assert.NoError(t, ex.checkPersistentVolumeClaims())
+
+	ex.Config.Kubernetes.Volumes.PVCs = append(ex.Config.Kubernetes.Volumes.PVCs, common.KubernetesPVC{
+		Name: "dependencies", MountPath: "/cache",
+	})
+	err := ex.checkPersistentVolumeClaims()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"dependencies"`)
+}
+
+func TestBuildPodSecretVolumes(t *testing.T) {
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Volumes: common.KubernetesVolumes{
+			Secrets: []common.KubernetesSecret{
+				{Name: "tls", MountPath: "/etc/tls"},
+				{
+					Name:       "ssh",
+					SecretName: "deploy-key",
+					MountPath:  "/root/.ssh",
+					Items:      map[string]string{"known_hosts": "known_hosts", "id_rsa": "id_rsa"},
+					FileMode:   "0400",
+				},
+			},
+		},
+	}, &kubernetesOptions{
+		Image:    "test-image",
+		Services: []kubernetesService{{Name: "test-service"}},
+	})
+	require.NoError(t, ex.checkVolumes())
+
+	pod, err := ex.buildPod()
+	require.NoError(t, err)
+
+	require.Equal(t, 3, len(pod.Spec.Volumes))
+	assert.Equal(t, api.Volume{
+		Name: "tls",
+		VolumeSource: api.VolumeSource{
+			Secret: &api.SecretVolumeSource{SecretName: "tls"},
+		},
+	}, pod.Spec.Volumes[1])
+	assert.Equal(t, api.Volume{
+		Name: "ssh",
+		VolumeSource: api.VolumeSource{
+			Secret: &api.SecretVolumeSource{
+				SecretName: "deploy-key",
+				Items: []api.KeyToPath{
+					{Key: "id_rsa", Path: "id_rsa"},
+					{Key: "known_hosts", Path: "known_hosts"},
+				},
+			},
+		},
+	}, pod.Spec.Volumes[2])
+
+	build := pod.Spec.Containers[0]
+	assert.Contains(t, build.VolumeMounts, api.VolumeMount{Name: "tls", MountPath: "/etc/tls", ReadOnly: true})
+	assert.Contains(t, build.VolumeMounts, api.VolumeMount{Name: "ssh", MountPath: "/root/.ssh", ReadOnly: true})
+	for _, container := range pod.Spec.Containers[1:] {
+		for _, mount := range container.VolumeMounts {
+			assert.NotEqual(t, "tls", mount.Name, container.Name)
+			assert.NotEqual(t, "ssh", mount.Name, container.Name)
+		}
+	}
+
+	c := client.NewOrDie(&restclient.Config{ContentConfig: restclient.ContentConfig{GroupVersion: &unversioned.GroupVersion{Version: testapi.Default.GroupVersion().Version}}})
+	data, err := encodePod(c, pod, ex.buildPodSpecExtra(pod))
+	require.NoError(t, err)
+
+	var encoded struct {
+		Spec struct {
+			Volumes []struct {
+				Name   string `json:"name"`
+				Secret *struct {
+					DefaultMode *int `json:"defaultMode"`
+				} `json:"secret"`
+			} `json:"volumes"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	require.Equal(t, 3, len(encoded.Spec.Volumes))
+	assert.Nil(t, encoded.Spec.Volumes[1].Secret.DefaultMode)
+	require.NotNil(t, encoded.Spec.Volumes[2].Secret.DefaultMode)
+	assert.Equal(t, 0400, *encoded.Spec.Volumes[2].Secret.DefaultMode)
+}
+
+func TestCheckVolumes(t *testing.T) {
+	tests := map[string][]common.KubernetesHostPath{
+		"relative host path":  {{Name: "cache", HostPath: "cache", MountPath: "/cache"}},
+		"relative mount path": {{Name: "cache", HostPath: "/cache", MountPath: "cache"}},
+		"no name":             {{HostPath: "/cache", MountPath: "/cache"}},
+		"reserved name":       {{Name: "repo", HostPath: "/cache", MountPath: "/cache"}},
+		"duplicate name": {
+			{Name: "cache", HostPath: "/cache", MountPath: "/cache"},
+			{Name: "cache", HostPath: "/other", MountPath: "/other"},
+		},
+	}
+
+	for name, hostPaths := range tests {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Volumes: common.KubernetesVolumes{HostPaths: hostPaths},
+		}, &kubernetesOptions{Image: "test-image"})
+		assert.Error(t, ex.checkVolumes(), name)
+	}
+
+	ex := newPodTestExecutor(&common.KubernetesConfig{
+		Volumes: common.KubernetesVolumes{
+			HostPaths: []common.KubernetesHostPath{{Name: "cache", HostPath: "/cache", MountPath: "/cache"}},
+			PVCs:      []common.KubernetesPVC{{Name: "cache", MountPath: "/other"}},
+		},
+	}, &kubernetesOptions{Image: "test-image"})
+	assert.Error(t, ex.checkVolumes(), "name used by volumes of different types")
+
+	ex.Config.Kubernetes.Volumes.HostPaths = nil
+	ex.Config.Kubernetes.Volumes.PVCs[0].MountPath = "other"
+	assert.Error(t, ex.checkVolumes(), "relative mount path of claim")
+
+	secrets := map[string]common.KubernetesSecret{
+		"absolute item path": {Name: "ssh", MountPath: "/root/.ssh", Items: map[string]string{"id_rsa": "/id_rsa"}},
+		"item path outside":  {Name: "ssh", MountPath: "/root/.ssh", Items: map[string]string{"id_rsa": "../id_rsa"}},
+		"empty item path":    {Name: "ssh", MountPath: "/root/.ssh", Items: map[string]string{"id_rsa": ""}},
+		"invalid file mode":  {Name: "ssh", MountPath: "/root/.ssh", FileMode: "0800"},
+		"symbolic file mode": {Name: "ssh", MountPath: "/root/.ssh", FileMode: "r--"},
+	}
+	for name, secret := range secrets {
+		ex := newPodTestExecutor(&common.KubernetesConfig{
+			Volumes: common.KubernetesVolumes{Secrets: []common.KubernetesSecret{secret}},
+		}, &kubernetesOptions{Image: "test-image"})
+		assert.Error(t, ex.checkVolumes(), name)
+	}
+
+	ex = newPodTestExecutor(&common.KubernetesConfig{}, &kubernetesOptions{Image: "test-image"})
+	assert.NoError(t, ex.checkVolumes())
+}